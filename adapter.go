@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// ProviderAdapter translates between runprompt and one provider API dialect
+type ProviderAdapter interface {
+	// BuildRequest returns the JSON request body and auth headers for a chat
+	// request. schema is the output schema, or nil for plain text output,
+	// and tools are those the model may call.
+	BuildRequest(model string, messages []Message, schema map[string]interface{}, tools []Tool, gen GenerationConfig, apiKey string) (map[string]interface{}, map[string]string)
+	// ParseResponse normalizes a decoded response body
+	ParseResponse(response map[string]interface{}) Result
+	// ParseStream consumes a server-sent events body, writing text deltas
+	// to w, and returns the events assembled into a response body
+	ParseStream(body io.Reader, w io.Writer) (map[string]interface{}, error)
+	Capabilities() Capabilities
+}
+
+// Capabilities describes the optional features an adapter supports
+type Capabilities struct {
+	// Tools is tool calling, used for structured output
+	Tools bool
+	// Streaming is server-sent event responses
+	Streaming bool
+}
+
+// adapters maps Provider.API values to adapter constructors. An empty API
+// means the OpenAI chat completions dialect.
+var adapters = map[string]func(Provider) ProviderAdapter{
+	"openai":    func(p Provider) ProviderAdapter { return openAIAdapter{p} },
+	"anthropic": func(p Provider) ProviderAdapter { return anthropicAdapter{p} },
+}
+
+// adapterFor returns the adapter for a provider name. Unknown providers get
+// the OpenAI adapter, matching the many compatible APIs.
+func adapterFor(provider string) ProviderAdapter {
+	p := providers[provider]
+	api := p.API
+	if api == "" {
+		api = "openai"
+	}
+	newAdapter, ok := adapters[api]
+	if !ok {
+		newAdapter = adapters["openai"]
+	}
+	return newAdapter(p)
+}
+
+// validAPI reports whether an adapter is registered for api
+func validAPI(api string) error {
+	if _, ok := adapters[api]; !ok {
+		return fmt.Errorf("unknown api %q", api)
+	}
+	return nil
+}
+
+// setParam sets body[key] when the setting is present
+func setParam[T any](body map[string]interface{}, key string, value *T) {
+	if value != nil {
+		body[key] = *value
+	}
+}
+
+// openAIAdapter speaks the OpenAI chat completions API, which OpenRouter,
+// Google AI, Azure and most local servers also implement
+type openAIAdapter struct {
+	provider Provider
+}
+
+func (a openAIAdapter) BuildRequest(model string, messages []Message, schema map[string]interface{}, tools []Tool, gen GenerationConfig, apiKey string) (map[string]interface{}, map[string]string) {
+	headers := map[string]string{}
+	if a.provider.AuthHeader != "" {
+		headers[a.provider.AuthHeader] = apiKey
+	} else if apiKey != "" {
+		headers["Authorization"] = fmt.Sprintf("Bearer %s", apiKey)
+	}
+	body := map[string]interface{}{
+		"model":    model,
+		"messages": messages,
+	}
+	if hasToolMessages(messages) {
+		body["messages"] = openAIToolMessages(messages)
+	}
+	setParam(body, "temperature", gen.Temperature)
+	setParam(body, "top_p", gen.TopP)
+	setParam(body, "max_tokens", gen.MaxOutputTokens)
+	setParam(body, "presence_penalty", gen.PresencePenalty)
+	setParam(body, "frequency_penalty", gen.FrequencyPenalty)
+	setParam(body, "seed", gen.Seed)
+	if len(gen.StopSequences) > 0 {
+		body["stop"] = gen.StopSequences
+	}
+	if gen.TopK != nil {
+		log("topK is not supported by OpenAI-compatible APIs, ignoring")
+	}
+	if len(schema) > 0 {
+		body["tools"] = []interface{}{buildSchemaTool(schema)}
+		body["tool_choice"] = map[string]interface{}{
+			"type":     "function",
+			"function": map[string]interface{}{"name": "extract"},
+		}
+	} else if len(tools) > 0 {
+		defs := make([]interface{}, len(tools))
+		for i, t := range tools {
+			defs[i] = map[string]interface{}{
+				"type": "function",
+				"function": map[string]interface{}{
+					"name":        t.Name,
+					"description": t.Description,
+					"parameters":  t.parameters(),
+				},
+			}
+		}
+		body["tools"] = defs
+	}
+	return body, headers
+}
+
+func (a openAIAdapter) ParseResponse(response map[string]interface{}) Result {
+	return extractOpenAIResponse(response)
+}
+
+func (a openAIAdapter) ParseStream(body io.Reader, w io.Writer) (map[string]interface{}, error) {
+	return readOpenAIStream(body, w)
+}
+
+func (a openAIAdapter) Capabilities() Capabilities {
+	return Capabilities{Tools: !a.provider.NoTools, Streaming: true}
+}
+
+// anthropicAdapter speaks the Anthropic Messages API
+type anthropicAdapter struct {
+	provider Provider
+}
+
+func (a anthropicAdapter) BuildRequest(model string, messages []Message, schema map[string]interface{}, tools []Tool, gen GenerationConfig, apiKey string) (map[string]interface{}, map[string]string) {
+	headers := map[string]string{
+		"x-api-key":         apiKey,
+		"anthropic-version": "2023-06-01",
+	}
+	system, conversation := splitSystem(messages)
+	body := map[string]interface{}{
+		"model":      model,
+		"max_tokens": 4096,
+		"messages":   conversation,
+	}
+	if system != "" {
+		body["system"] = system
+	}
+	if hasToolMessages(conversation) {
+		body["messages"] = anthropicToolMessages(conversation)
+	}
+	setParam(body, "max_tokens", gen.MaxOutputTokens)
+	setParam(body, "temperature", gen.Temperature)
+	setParam(body, "top_p", gen.TopP)
+	setParam(body, "top_k", gen.TopK)
+	if len(gen.StopSequences) > 0 {
+		body["stop_sequences"] = gen.StopSequences
+	}
+	if gen.PresencePenalty != nil || gen.FrequencyPenalty != nil {
+		log("presencePenalty and frequencyPenalty are not supported by Anthropic, ignoring")
+	}
+	if gen.Seed != nil {
+		log("seed is not supported by Anthropic, ignoring")
+	}
+	if len(schema) > 0 {
+		funcDef := buildSchemaTool(schema)["function"].(map[string]interface{})
+		body["tools"] = []map[string]interface{}{{
+			"name":         funcDef["name"],
+			"description":  funcDef["description"],
+			"input_schema": funcDef["parameters"],
+		}}
+		body["tool_choice"] = map[string]interface{}{"type": "tool", "name": "extract"}
+	} else if len(tools) > 0 {
+		defs := make([]map[string]interface{}, len(tools))
+		for i, t := range tools {
+			defs[i] = map[string]interface{}{
+				"name":         t.Name,
+				"description":  t.Description,
+				"input_schema": t.parameters(),
+			}
+		}
+		body["tools"] = defs
+	}
+	return body, headers
+}
+
+func (a anthropicAdapter) ParseResponse(response map[string]interface{}) Result {
+	return extractAnthropicResponse(response)
+}
+
+func (a anthropicAdapter) ParseStream(body io.Reader, w io.Writer) (map[string]interface{}, error) {
+	return readAnthropicStream(body, w)
+}
+
+func (a anthropicAdapter) Capabilities() Capabilities {
+	return Capabilities{Tools: !a.provider.NoTools, Streaming: true}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAdapterFor(t *testing.T) {
+	tests := []struct {
+		provider string
+		expected string
+	}{
+		{"anthropic", "main.anthropicAdapter"},
+		{"openai", "main.openAIAdapter"},
+		{"googleai", "main.openAIAdapter"},
+		{"unknown", "main.openAIAdapter"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.provider, func(t *testing.T) {
+			if got := fmt.Sprintf("%T", adapterFor(tc.provider)); got != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAdapterBuildRequest(t *testing.T) {
+	messages := []Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "Hi"},
+	}
+	schema := map[string]interface{}{"name": "string"}
+
+	body, headers := adapterFor("anthropic").BuildRequest("claude-3", messages, schema, nil, GenerationConfig{}, "sk-ant")
+	if headers["x-api-key"] != "sk-ant" {
+		t.Errorf("Expected x-api-key header, got %v", headers)
+	}
+	if body["system"] != "Be brief." {
+		t.Errorf("Expected system field, got %v", body["system"])
+	}
+	if conversation := body["messages"].([]Message); len(conversation) != 1 {
+		t.Errorf("Expected 1 message, got %d", len(conversation))
+	}
+	if _, ok := body["tools"]; !ok {
+		t.Error("Expected tools for schema")
+	}
+
+	body, headers = adapterFor("openai").BuildRequest("gpt-4o", messages, nil, nil, GenerationConfig{}, "sk-oai")
+	if headers["Authorization"] != "Bearer sk-oai" {
+		t.Errorf("Expected bearer auth, got %v", headers)
+	}
+	if conversation := body["messages"].([]Message); len(conversation) != 2 {
+		t.Errorf("Expected 2 messages, got %d", len(conversation))
+	}
+	if _, ok := body["tools"]; ok {
+		t.Error("Expected no tools without schema")
+	}
+}
+
+func TestAdapterGenerationConfig(t *testing.T) {
+	temperature, maxTokens, topK, seed := 0.3, 256, 20, 42
+	gen := GenerationConfig{Temperature: &temperature, MaxOutputTokens: &maxTokens, TopK: &topK, StopSequences: []string{"END"}, Seed: &seed}
+	messages := []Message{{Role: "user", Content: "Hi"}}
+
+	body, _ := adapterFor("anthropic").BuildRequest("claude-3", messages, nil, nil, gen, "")
+	if body["max_tokens"] != 256 || body["temperature"] != 0.3 || body["top_k"] != 20 {
+		t.Errorf("Unexpected anthropic params: %v", body)
+	}
+	if stop, _ := body["stop_sequences"].([]string); len(stop) != 1 {
+		t.Errorf("Expected stop_sequences, got %v", body["stop_sequences"])
+	}
+	if _, ok := body["seed"]; ok {
+		t.Error("Expected seed to be omitted for anthropic")
+	}
+
+	body, _ = adapterFor("openai").BuildRequest("gpt-4o", messages, nil, nil, gen, "")
+	if body["max_tokens"] != 256 || body["temperature"] != 0.3 {
+		t.Errorf("Unexpected openai params: %v", body)
+	}
+	if _, ok := body["top_k"]; ok {
+		t.Error("Expected top_k to be omitted for openai")
+	}
+	if body["seed"] != 42 {
+		t.Errorf("Expected seed 42, got %v", body["seed"])
+	}
+	if stop, _ := body["stop"].([]string); len(stop) != 1 {
+		t.Errorf("Expected stop, got %v", body["stop"])
+	}
+
+	body, _ = adapterFor("anthropic").BuildRequest("claude-3", messages, nil, nil, GenerationConfig{}, "")
+	if body["max_tokens"] != 4096 {
+		t.Errorf("Expected default max_tokens 4096, got %v", body["max_tokens"])
+	}
+	if _, ok := body["temperature"]; ok {
+		t.Error("Expected temperature to be omitted when unset")
+	}
+}
+
+func TestAdapterCapabilities(t *testing.T) {
+	if !adapterFor("openai").Capabilities().Tools {
+		t.Error("Expected openai to support tools")
+	}
+	if adapterFor("custom").Capabilities().Tools {
+		t.Error("Expected custom to lack tools")
+	}
+}
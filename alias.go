@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+)
+
+// modelAliases reads modelAliases, short names for models that config
+// files or prompts define so prompts can say model: fast:
+//
+//	modelAliases:
+//	  fast: openrouter/google/gemini-2.5-flash
+//	  smart: anthropic/claude-sonnet-4-20250514
+func modelAliases(meta map[string]interface{}) (map[string]string, error) {
+	v, ok := meta["modelAliases"]
+	if !ok {
+		return nil, nil
+	}
+	block, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("modelAliases must map names to models")
+	}
+	aliases := make(map[string]string, len(block))
+	for name, target := range block {
+		s, ok := target.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("modelAliases.%s must be a model like openai/gpt-4o", name)
+		}
+		aliases[name] = s
+	}
+	return aliases, nil
+}
+
+// resolveAlias returns the model name stands for, following aliases of
+// aliases, or name itself if it isn't an alias
+func resolveAlias(aliases map[string]string, name string) (string, error) {
+	seen := map[string]bool{}
+	for {
+		target, ok := aliases[name]
+		if !ok {
+			return name, nil
+		}
+		if seen[name] {
+			return "", fmt.Errorf("model alias %s refers to itself", name)
+		}
+		seen[name] = true
+		name = target
+	}
+}
+
+// applyModelAliases replaces aliases in model and fallbackModels with the
+// models they stand for
+func applyModelAliases(meta map[string]interface{}) error {
+	aliases, err := modelAliases(meta)
+	if err != nil || len(aliases) == 0 {
+		return err
+	}
+	if name, ok := meta["model"].(string); ok {
+		model, err := resolveAlias(aliases, name)
+		if err != nil {
+			return err
+		}
+		if model != name {
+			log(fmt.Sprintf("Model alias %s is %s", name, model))
+			meta["model"] = model
+		}
+	}
+	if list, ok := meta["fallbackModels"].([]interface{}); ok {
+		resolved := make([]interface{}, len(list))
+		for i, item := range list {
+			resolved[i] = item
+			if name, ok := item.(string); ok {
+				if resolved[i], err = resolveAlias(aliases, name); err != nil {
+					return err
+				}
+			}
+		}
+		meta["fallbackModels"] = resolved
+	}
+	return nil
+}
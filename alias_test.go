@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyModelAliases(t *testing.T) {
+	meta := map[string]interface{}{
+		"model":          "fast",
+		"fallbackModels": []interface{}{"smart", "ollama/llama3"},
+		"modelAliases": map[string]interface{}{
+			"fast":    "openrouter/google/gemini-2.5-flash",
+			"smart":   "default",
+			"default": "anthropic/claude-sonnet-4-20250514",
+		},
+	}
+	if err := applyModelAliases(meta); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if meta["model"] != "openrouter/google/gemini-2.5-flash" {
+		t.Errorf("Expected the fast model, got %v", meta["model"])
+	}
+	expected := []interface{}{"anthropic/claude-sonnet-4-20250514", "ollama/llama3"}
+	if !reflect.DeepEqual(meta["fallbackModels"], expected) {
+		t.Errorf("Expected %v, got %v", expected, meta["fallbackModels"])
+	}
+
+	for _, tt := range []struct {
+		aliases  interface{}
+		expected string
+	}{
+		{map[string]interface{}{"fast": "slow", "slow": "fast"}, "model alias fast refers to itself"},
+		{map[string]interface{}{"fast": 3}, "modelAliases.fast must be a model like openai/gpt-4o"},
+		{"fast", "modelAliases must map names to models"},
+	} {
+		err := applyModelAliases(map[string]interface{}{"model": "fast", "modelAliases": tt.aliases})
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("Expected %q, got %v", tt.expected, err)
+		}
+	}
+}
+
+func TestResolvePromptAlias(t *testing.T) {
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+	writeFiles(t, config, "runprompt/config.yaml", "modelAliases:\n  fast: openai/gpt-4o-mini\n")
+	meta, _, _, err := resolvePrompt(map[string]interface{}{"model": []interface{}{"fast", "test"}}, "Hi", map[string]interface{}{}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if meta["model"] != "openai/gpt-4o-mini" {
+		t.Errorf("Expected the alias from config.yaml to apply, got %v", meta["model"])
+	}
+
+	// Lint knows the aliases config files define
+	if problems := lintSource(t, "---\nmodel: fast\n---\nHi\n"); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+	problems := lintSource(t, "---\nmodel: quick\n---\nHi\n")
+	if len(problems) != 1 || !strings.Contains(problems[0], `model "quick" must be written provider/model`) {
+		t.Errorf("Expected an unknown model, got %v", problems)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// allowedModels reads allowedModels, the models a prompt may be sent to,
+// as patterns in which * matches anything:
+//
+//	allowedModels: [anthropic/claude-*, openai/gpt-4o*]
+//
+// It returns nil when the prompt doesn't restrict its models.
+func allowedModels(meta map[string]interface{}) ([]string, error) {
+	v, ok := meta["allowedModels"]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("allowedModels must list at least one model")
+	}
+	patterns := make([]string, 0, len(list))
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("allowedModels must be a list of models like anthropic/claude-*, got %v", item)
+		}
+		patterns = append(patterns, s)
+	}
+	return patterns, nil
+}
+
+// matchModelPattern reports whether model matches pattern, in which *
+// matches any run of characters, slashes included
+func matchModelPattern(pattern, model string) bool {
+	re := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+	matched, _ := regexp.MatchString(re, model)
+	return matched
+}
+
+// checkAllowedModel fails if the prompt lists allowedModels and modelStr
+// isn't one of them
+func checkAllowedModel(meta map[string]interface{}, modelStr string) error {
+	patterns, err := allowedModels(meta)
+	if err != nil || patterns == nil {
+		return err
+	}
+	for _, p := range patterns {
+		if matchModelPattern(p, modelStr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not allowed for this prompt, whose allowedModels are %s", modelStr, strings.Join(patterns, ", "))
+}
+
+// keepAllowedModels restores the allowedModels a prompt file set, before
+// config files, RUNPROMPT_* variables and flags were applied, so that
+// whoever overrides a prompt's model can't widen what it may run on
+func keepAllowedModels(meta map[string]interface{}, fromPrompt interface{}, set bool) {
+	v, changed := meta["allowedModels"]
+	if set {
+		changed = !reflect.DeepEqual(v, fromPrompt)
+		meta["allowedModels"] = fromPrompt
+	} else {
+		delete(meta, "allowedModels")
+	}
+	if changed {
+		fmt.Fprintln(os.Stderr, "Warning: allowedModels can only be set in the prompt file, ignoring the override")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMatchModelPattern(t *testing.T) {
+	tests := []struct {
+		pattern, model string
+		want           bool
+	}{
+		{"anthropic/claude-*", "anthropic/claude-sonnet-4-20250514", true},
+		{"anthropic/claude-*", "openai/claude-x", false},
+		{"openai/gpt-4o*", "openai/gpt-4o", true},
+		{"openai/gpt-4o*", "openai/gpt-4o-mini", true},
+		{"openai/gpt-4o*", "openai/gpt-4.1", false},
+		{"openrouter/*", "openrouter/google/gemini-2.5-flash", true},
+		{"openai/gpt-4o", "openai/gpt-4o-mini", false},
+		{"openai/gpt-4.1", "openai/gpt-401", false},
+	}
+	for _, tc := range tests {
+		if got := matchModelPattern(tc.pattern, tc.model); got != tc.want {
+			t.Errorf("%s against %s: Expected %v, got %v", tc.pattern, tc.model, tc.want, got)
+		}
+	}
+}
+
+func TestAllowedModels(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeFiles(t, dir,
+		"safe.prompt", "---\nmodel: test\nallowedModels: [test, anthropic/claude-*]\n---\nHi",
+		"safe.prompt.test-response", `{"choices":[{"message":{"content":"Hello"}}]}`)
+	path := filepath.Join(dir, "safe.prompt")
+	if err := run(context.Background(), []string{path}); err != nil {
+		t.Fatalf("Expected the allowed model to run, got %v", err)
+	}
+
+	// Overrides of the model are refused, and can't widen the list
+	t.Setenv("RUNPROMPT_ALLOWEDMODELS", "[openai/*]")
+	err := run(context.Background(), []string{"--model", "openai/gpt-4o", path})
+	if err == nil || !strings.Contains(err.Error(), "openai/gpt-4o is not allowed for this prompt") {
+		t.Errorf("Expected the model to be refused, got %v", err)
+	}
+	err = run(context.Background(), []string{"--allowedModels=[openai/*]", "--model", "openai/gpt-4o", path})
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("Expected --allowedModels to be ignored, got %v", err)
+	}
+
+	if _, err := allowedModels(map[string]interface{}{"allowedModels": []interface{}{}}); err == nil {
+		t.Error("Expected an empty allowedModels to be an error")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// batchOptions configure a --batch run
+type batchOptions struct {
+	concurrency int               // lines run at once
+	rate        float64           // lines started per minute, or 0 for no limit
+	extract     string            // --extract path applied to each result
+	files       map[string]string // output.files written for each line
+	sinks       []*sink           // output.sink, delivered for each line
+	force       bool
+	progress    *batchProgress
+}
+
+// batchResult is one line of --batch output: the run's summary, or the
+// error that stopped it. Line numbers count input lines from 1, blank ones
+// included.
+type batchResult struct {
+	Line int `json:"line"`
+	*runSummary
+	Error string `json:"error,omitempty"`
+}
+
+// batchFlags reads --concurrency and --rate from argOverrides, removing
+// them so they aren't taken as frontmatter overrides
+func batchFlags(argOverrides map[string]interface{}) (concurrency int, rate float64, err error) {
+	concurrency = 1
+	if v, ok := argOverrides["concurrency"]; ok {
+		delete(argOverrides, "concurrency")
+		n, ok := v.(int)
+		if !ok || n < 1 {
+			return 0, 0, fmt.Errorf("--concurrency must be a positive integer, got %v", v)
+		}
+		concurrency = n
+	}
+	if v, ok := argOverrides["rate"]; ok {
+		delete(argOverrides, "rate")
+		if rate, ok = toFloat(v); !ok || rate <= 0 {
+			return 0, 0, fmt.Errorf("--rate must be a positive number of lines per minute, got %v", v)
+		}
+	}
+	return concurrency, rate, nil
+}
+
+// batchItem is the input of one run in a batch
+type batchItem struct {
+	line   int      // where it starts in the batch input, counting from 1
+	input  string   // the run's input, as stdin would be
+	record []string // the CSV record it came from, if any
+}
+
+// batchInput yields the items of a batch one at a time, returning io.EOF
+// after the last
+type batchInput interface {
+	next() (batchItem, error)
+}
+
+// lineInput reads batch input with one run's input on each line, usually a
+// JSON object of variables. Blank lines are skipped.
+type lineInput struct {
+	r    *bufio.Reader
+	line int
+}
+
+func newLineInput(r io.Reader) *lineInput {
+	return &lineInput{r: bufio.NewReader(r)}
+}
+
+func (in *lineInput) next() (batchItem, error) {
+	for {
+		text, err := in.r.ReadString('\n')
+		if err != nil && (err != io.EOF || text == "") {
+			return batchItem{}, err
+		}
+		in.line++
+		if input := strings.TrimSpace(text); input != "" {
+			return batchItem{line: in.line, input: input}, nil
+		}
+	}
+}
+
+// csvInput reads batch input as CSV, whose header row names the variables
+// each later row gives values for
+type csvInput struct {
+	r      *csv.Reader
+	header []string
+}
+
+func newCSVInput(r io.Reader) (*csvInput, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("the CSV input has no header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+		if header[i] == "" {
+			return nil, fmt.Errorf("column %d of the CSV header has no name", i+1)
+		}
+	}
+	return &csvInput{r: cr, header: header}, nil
+}
+
+func (in *csvInput) next() (batchItem, error) {
+	record, err := in.r.Read()
+	if err != nil {
+		return batchItem{}, err
+	}
+	line, _ := in.r.FieldPos(0)
+	variables := make(map[string]string, len(in.header))
+	for i, name := range in.header {
+		variables[name] = record[i]
+	}
+	data, _ := json.Marshal(variables)
+	return batchItem{line: line, input: string(data), record: record}, nil
+}
+
+// batchOutput writes the results of a batch, in input order
+type batchOutput interface {
+	write(item batchItem, r batchResult) error
+}
+
+// jsonlOutput writes each result as a line of JSON
+type jsonlOutput struct {
+	enc *json.Encoder
+}
+
+func newJSONLOutput(w io.Writer) *jsonlOutput {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &jsonlOutput{enc}
+}
+
+func (out *jsonlOutput) write(item batchItem, r batchResult) error {
+	return out.enc.Encode(r)
+}
+
+// csvOutput writes each input record back out with the run's output and
+// error appended as new columns
+type csvOutput struct {
+	w *csv.Writer
+}
+
+// csvResultColumns are the columns csvOutput appends
+var csvResultColumns = []string{"output", "error"}
+
+func newCSVOutput(w io.Writer, header []string) (*csvOutput, error) {
+	for _, name := range csvResultColumns {
+		if containsString(header, name) {
+			return nil, fmt.Errorf("the CSV input already has an %s column; use --output json for JSONL results", name)
+		}
+	}
+	out := &csvOutput{csv.NewWriter(w)}
+	return out, out.writeRecord(append(header[:len(header):len(header)], csvResultColumns...))
+}
+
+func (out *csvOutput) write(item batchItem, r batchResult) error {
+	output := ""
+	if r.runSummary != nil {
+		if s, ok := r.Output.(string); ok {
+			output = s
+		} else {
+			data, _ := json.Marshal(r.Output)
+			output = string(data)
+		}
+	}
+	return out.writeRecord(append(item.record[:len(item.record):len(item.record)], output, r.Error))
+}
+
+func (out *csvOutput) writeRecord(record []string) error {
+	out.w.Write(record)
+	// Flushed as it goes, so results can be followed as they arrive
+	out.w.Flush()
+	return out.w.Error()
+}
+
+// runBatch runs a prompt once for each item of in, writing a result to out
+// for each, in input order however many run at once. It fails if any run
+// did.
+func runBatch(ctx context.Context, in batchInput, out batchOutput, base promptRun, template string, opts batchOptions) error {
+	type pendingResult struct {
+		item   batchItem
+		result chan batchResult
+	}
+	// Results are written in the order their items were read, each as soon
+	// as it and the ones before it are done
+	pending := make(chan pendingResult, opts.concurrency)
+	written := make(chan error)
+	go func() {
+		runs, failed := 0, 0
+		var writeErr error
+		for p := range pending {
+			runs++
+			r := <-p.result
+			if r.Error != "" {
+				failed++
+			}
+			if err := out.write(p.item, r); err != nil && writeErr == nil {
+				writeErr = fmt.Errorf("writing batch results: %v", err)
+			}
+		}
+		if writeErr == nil && failed > 0 {
+			writeErr = fmt.Errorf("%d of %d batch runs failed", failed, runs)
+		}
+		written <- writeErr
+	}()
+
+	slots := make(chan struct{}, opts.concurrency)
+	var interval time.Duration
+	if opts.rate > 0 {
+		interval = time.Duration(float64(time.Minute) / opts.rate)
+	}
+	var next time.Time
+	var readErr error
+read:
+	for {
+		item, err := in.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = fmt.Errorf("reading batch input: %v", err)
+			break
+		}
+		if wait := time.Until(next); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				break read
+			case <-timer.C:
+			}
+		}
+		next = time.Now().Add(interval)
+		select {
+		case <-ctx.Done():
+			break read
+		case slots <- struct{}{}:
+		}
+		result := make(chan batchResult, 1)
+		pending <- pendingResult{item, result}
+		opts.progress.start(item.line)
+		go func() {
+			defer func() { <-slots }()
+			r, usage := runBatchLine(ctx, base, template, item.line, item.input, opts)
+			opts.progress.finish(item.line, usage, r.Error)
+			result <- r
+		}()
+	}
+	close(pending)
+	writeErr := <-written
+	opts.progress.end()
+	switch {
+	case readErr != nil:
+		return readErr
+	case ctx.Err() != nil:
+		return ctx.Err()
+	}
+	return writeErr
+}
+
+// runBatchLine renders and sends the prompt for one line of batch input,
+// returning its result and the tokens it used
+func runBatchLine(ctx context.Context, base promptRun, template string, line int, input string, opts batchOptions) (batchResult, Usage) {
+	var c completion
+	fail := func(err error) (batchResult, Usage) {
+		return batchResult{Line: line, Error: err.Error()}, c.Usage
+	}
+	variables, err := inputVariables(input, base.meta)
+	if err != nil {
+		return fail(err)
+	}
+	messages, err := renderPromptMessages(compileMessages(template), variables, base.meta)
+	if err != nil {
+		return fail(err)
+	}
+	pr := base
+	pr.messages = messages
+	c, err = complete(ctx, pr)
+	if err != nil {
+		return fail(err)
+	}
+	summary := summarize(pr, c)
+	if opts.extract != "" {
+		var data interface{}
+		if err := json.Unmarshal([]byte(c.Result), &data); err != nil {
+			return fail(fmt.Errorf("--extract needs a JSON response: %v", err))
+		}
+		value, err := extractPath(data, opts.extract)
+		if err != nil {
+			return fail(fmt.Errorf("--extract %s: %v", opts.extract, err))
+		}
+		summary.Output = value
+	}
+	if len(opts.files) > 0 {
+		paths, err := writeOutputFiles(opts.files, c.Result, variables, opts.force)
+		for _, path := range paths {
+			fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if err := deliverSinks(ctx, opts.sinks, pr, c, variables); err != nil {
+		return fail(err)
+	}
+	return batchResult{Line: line, runSummary: &summary}, c.Usage
+}
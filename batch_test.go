@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunBatch(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	var inFlight, maxInFlight int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		var body struct {
+			Messages []Message `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		content := body.Messages[len(body.Messages)-1].Content
+		// Later lines answer sooner, so results finish out of order
+		if strings.Contains(content, "Ada") {
+			time.Sleep(50 * time.Millisecond)
+		}
+		reply, _ := json.Marshal(strings.ToUpper(content))
+		fmt.Fprintf(w, `{"choices":[{"message":{"content":%s}}]}`, reply)
+	}))
+	defer server.Close()
+
+	base := promptRun{
+		path:     "greet.prompt",
+		meta:     map[string]interface{}{"model": "custom/x", "baseURL": server.URL},
+		provider: "custom",
+		model:    "x",
+	}
+	template := "{{#if name}}Hello {{name}}{{/if}}"
+	in := strings.NewReader("{\"name\": \"Ada\"}\n\n{\"name\": \"Bob\"}\n{\"name\": \"Cy\"}")
+	var out bytes.Buffer
+	if err := runBatch(context.Background(), newLineInput(in), newJSONLOutput(&out), base, template, batchOptions{concurrency: 2}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	type result struct {
+		Line   int    `json:"line"`
+		Output string `json:"output"`
+	}
+	var results []result
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var r result
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("Expected a JSON line, got %q: %v", line, err)
+		}
+		results = append(results, r)
+	}
+	expected := []result{{1, "HELLO ADA"}, {3, "HELLO BOB"}, {4, "HELLO CY"}}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %v, got %v", expected, results)
+	}
+	if maxInFlight != 2 {
+		t.Errorf("Expected 2 requests at once, got %d", maxInFlight)
+	}
+}
+
+func TestRunBatchFailures(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	base := promptRun{
+		path: "greet.prompt",
+		meta: map[string]interface{}{
+			"model": "custom/x",
+			"input": map[string]interface{}{"schema": map[string]interface{}{"name": "string"}},
+		},
+		provider: "custom",
+		model:    "x",
+		// No baseURL, so a line that gets as far as sending fails there
+	}
+	in := strings.NewReader("{\"name\": 5}\n{\"name\": \"Ada\"}\n")
+	var out bytes.Buffer
+	err := runBatch(context.Background(), newLineInput(in), newJSONLOutput(&out), base, "Hello {{name}}", batchOptions{concurrency: 1})
+	if err == nil || err.Error() != "2 of 2 batch runs failed" {
+		t.Errorf("Expected both runs to fail, got %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], `{"line":1,"error":"`) || !strings.Contains(lines[1], "requires baseURL") {
+		t.Errorf("Expected an error result per line, got %q", lines)
+	}
+}
+
+func TestRunBatchRate(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeFiles(t, dir, "greet.prompt.test-response", `{"choices":[{"message":{"content":"Hi"}}]}`)
+	base := promptRun{path: filepath.Join(dir, "greet.prompt"), meta: map[string]interface{}{"model": "test"}, provider: "test"}
+	start := time.Now()
+	var out bytes.Buffer
+	if err := runBatch(context.Background(), newLineInput(strings.NewReader("{}\n{}\n{}\n")), newJSONLOutput(&out), base, "Hi", batchOptions{concurrency: 3, rate: 1200}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// 1200 a minute is one every 50ms
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected the rate to space out the runs, took %v", elapsed)
+	}
+}
+
+func TestRunBatchCSV(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []Message `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		reply, _ := json.Marshal(strings.ToUpper(body.Messages[0].Content))
+		fmt.Fprintf(w, `{"choices":[{"message":{"content":%s}}]}`, reply)
+	}))
+	defer server.Close()
+	base := promptRun{
+		path:     "greet.prompt",
+		meta:     map[string]interface{}{"model": "custom/x", "baseURL": server.URL},
+		provider: "custom",
+		model:    "x",
+	}
+	csvText := "name,city\nAda,London\n\"Smith, Bob\",\"New\nYork\"\n"
+
+	in, err := newCSVInput(strings.NewReader(csvText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	results, err := newCSVOutput(&out, in.header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runBatch(context.Background(), in, results, base, "{{name}} of {{city}}", batchOptions{concurrency: 2}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "name,city,output,error\nAda,London,ADA OF LONDON,\n\"Smith, Bob\",\"New\nYork\",\"SMITH, BOB OF NEW\nYORK\",\n"
+	if out.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, out.String())
+	}
+
+	// JSONL results name the line each row starts on
+	in, _ = newCSVInput(strings.NewReader(csvText))
+	out.Reset()
+	if err := runBatch(context.Background(), in, newJSONLOutput(&out), base, "{{name}}", batchOptions{concurrency: 1}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], `{"line":2,"output":"ADA"`) || !strings.HasPrefix(lines[1], `{"line":3,"output":"SMITH, BOB"`) {
+		t.Errorf("Expected a JSON result per row, got %q", lines)
+	}
+
+	if _, err := newCSVOutput(&out, []string{"name", "output"}); err == nil || !strings.Contains(err.Error(), "already has an output column") {
+		t.Errorf("Expected an error for a clashing column, got %v", err)
+	}
+	if _, err := newCSVInput(strings.NewReader("")); err == nil {
+		t.Error("Expected an error for CSV input without a header")
+	}
+}
+
+func TestBatchFlags(t *testing.T) {
+	overrides := map[string]interface{}{"concurrency": 4, "rate": 30, "temperature": 0.5}
+	concurrency, rate, err := batchFlags(overrides)
+	if err != nil || concurrency != 4 || rate != 30 {
+		t.Errorf("Expected 4 at 30 a minute, got %d at %g (%v)", concurrency, rate, err)
+	}
+	if len(overrides) != 1 {
+		t.Errorf("Expected only the temperature override to remain, got %v", overrides)
+	}
+	if _, _, err := batchFlags(map[string]interface{}{"concurrency": 0}); err == nil {
+		t.Error("Expected an error for --concurrency 0")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bestOf asks for several completions of a prompt and keeps the best, set
+// by bestOf: N or a block:
+//
+//	bestOf:
+//	  n: 3
+//	  judge: openai/gpt-4o-mini        # a model that picks the best
+//	  criteria: the most complete extraction
+//
+// Without a judge the candidate with the most filled-in fields of its JSON
+// response wins, then the longest.
+type bestOf struct {
+	N        int
+	Judge    string
+	Criteria string
+}
+
+// parseBestOf reads bestOf, resolving a judge given as a model alias
+func parseBestOf(meta map[string]interface{}) (bestOf, error) {
+	b := bestOf{N: 1}
+	v, ok := meta["bestOf"]
+	if !ok {
+		return b, nil
+	}
+	fields, isBlock := v.(map[string]interface{})
+	if !isBlock {
+		fields = map[string]interface{}{"n": v}
+	}
+	for key, value := range fields {
+		switch key {
+		case "n":
+			n, ok := value.(int)
+			if !ok || n < 1 {
+				return b, fmt.Errorf("bestOf must be a positive number of completions, got %v", value)
+			}
+			b.N = n
+		case "judge":
+			judge, _ := value.(string)
+			aliases, _ := modelAliases(meta)
+			model, err := resolveAlias(aliases, judge)
+			if err != nil {
+				return b, err
+			}
+			if provider, _ := parseModelString(model); provider == "" {
+				return b, fmt.Errorf("bestOf.judge must be a model like openai/gpt-4o-mini, got %v", value)
+			}
+			b.Judge = model
+		case "criteria":
+			b.Criteria = fmt.Sprintf("%v", value)
+		default:
+			return b, fmt.Errorf("unknown field bestOf.%s", key)
+		}
+	}
+	return b, nil
+}
+
+// completeBestOf runs best.N completions of pr at once and returns the best
+// of those that succeeded, with the requests and tokens of them all. It
+// fails with the first error only if every one did.
+func completeBestOf(ctx context.Context, pr promptRun, best bestOf) (completion, error) {
+	start := time.Now()
+	// Candidates are compared once whole, so none is streamed
+	pr.stream, pr.out = false, nil
+	results := make([]completion, best.N)
+	errs := make([]error, best.N)
+	var wg sync.WaitGroup
+	for i := 0; i < best.N; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = completeFallbacks(ctx, pr)
+		}(i)
+	}
+	wg.Wait()
+
+	var candidates []completion
+	var firstErr error
+	var total completion
+	for i, c := range results {
+		total.Requests += c.Requests
+		total.Usage.InputTokens += c.Usage.InputTokens
+		total.Usage.OutputTokens += c.Usage.OutputTokens
+		if errs[i] != nil {
+			log(fmt.Sprintf("Best of %d: candidate %d failed: %v", best.N, i+1, errs[i]))
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			continue
+		}
+		candidates = append(candidates, c)
+	}
+	if len(candidates) == 0 {
+		return total, firstErr
+	}
+
+	pick := -1
+	if best.Judge != "" && len(candidates) > 1 {
+		var err error
+		if pick, err = judgeCandidates(ctx, pr, best, candidates); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: bestOf judge failed, picking by completeness instead: %v\n", err)
+			pick = -1
+		}
+	}
+	if pick == -1 {
+		pick = 0
+		for i, c := range candidates {
+			if candidateScore(c.Result) > candidateScore(candidates[pick].Result) {
+				pick = i
+			}
+		}
+	}
+	log(fmt.Sprintf("Best of %d: picked candidate %d of the %d that succeeded", best.N, pick+1, len(candidates)))
+	c := candidates[pick]
+	c.Requests, c.Usage, c.Latency = total.Requests, total.Usage, time.Since(start)
+	return c, nil
+}
+
+// candidateScore ranks a response for picking without a judge: the filled
+// in values of a JSON response, a million points each, then its length
+func candidateScore(result string) int {
+	var data interface{}
+	if err := json.Unmarshal([]byte(result), &data); err != nil {
+		return len(result)
+	}
+	return filledValues(data)*1000000 + len(result)
+}
+
+// filledValues counts the values in data that are not null or empty
+func filledValues(data interface{}) int {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		n := 0
+		for _, item := range v {
+			n += filledValues(item)
+		}
+		return n
+	case []interface{}:
+		n := 0
+		for _, item := range v {
+			n += filledValues(item)
+		}
+		return n
+	case nil:
+		return 0
+	case string:
+		if strings.TrimSpace(v) == "" {
+			return 0
+		}
+	}
+	return 1
+}
+
+// judgeNumberRe finds the candidate number in a judge's reply
+var judgeNumberRe = regexp.MustCompile(`\d+`)
+
+// judgeCandidates asks the judge model which candidate answers the prompt
+// best, returning its index
+func judgeCandidates(ctx context.Context, pr promptRun, best bestOf, candidates []completion) (int, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Here are %d candidate responses to the same request. Pick the best one", len(candidates))
+	if best.Criteria != "" {
+		fmt.Fprintf(&b, ": %s", best.Criteria)
+	}
+	b.WriteString(".\n\n<request>\n")
+	for _, m := range pr.messages {
+		fmt.Fprintf(&b, "%s: %s\n", m.Role, m.Content)
+	}
+	b.WriteString("</request>\n")
+	for i, c := range candidates {
+		fmt.Fprintf(&b, "\n<candidate %d>\n%s\n</candidate %d>\n", i+1, c.Result, i+1)
+	}
+	b.WriteString("\nReply with only the number of the best candidate.")
+
+	judge := promptRun{path: pr.path, meta: map[string]interface{}{}, job: pr.job}
+	judge.provider, judge.model = parseModelString(best.Judge)
+	for k, v := range pr.meta {
+		judge.meta[k] = v
+	}
+	// The judge answers with a number, not in the prompt's output format,
+	// and has no use for its tools
+	for _, key := range []string{"output", "bestOf", "fallbackModels", "config", "tools", "mcpServers"} {
+		delete(judge.meta, key)
+	}
+	if judge.provider != pr.provider {
+		delete(judge.meta, "baseURL")
+		delete(judge.meta, "base_url")
+	}
+	judge.meta["model"] = best.Judge
+	judge.messages = []Message{{Role: "user", Content: b.String()}}
+	c, err := completeModel(ctx, judge)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(judgeNumberRe.FindString(c.Result))
+	if err != nil || n < 1 || n > len(candidates) {
+		return 0, fmt.Errorf("no candidate number in %q", c.Result)
+	}
+	return n - 1, nil
+}
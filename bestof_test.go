@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseBestOf(t *testing.T) {
+	tests := []struct {
+		bestOf   interface{}
+		expected string
+	}{
+		{3, "{N:3 Judge: Criteria:}"},
+		{map[string]interface{}{"n": 2, "judge": "cheap", "criteria": "most complete"}, "{N:2 Judge:openai/gpt-4o-mini Criteria:most complete}"},
+		{0, "bestOf must be a positive number of completions, got 0"},
+		{map[string]interface{}{"n": 2, "judge": "nobody"}, "bestOf.judge must be a model like openai/gpt-4o-mini, got nobody"},
+		{map[string]interface{}{"n": 2, "pick": "longest"}, "unknown field bestOf.pick"},
+	}
+	for _, tt := range tests {
+		b, err := parseBestOf(map[string]interface{}{
+			"bestOf":       tt.bestOf,
+			"modelAliases": map[string]interface{}{"cheap": "openai/gpt-4o-mini"},
+		})
+		got := fmt.Sprintf("%+v", b)
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.expected {
+			t.Errorf("bestOf %v: expected %q, got %q", tt.bestOf, tt.expected, got)
+		}
+	}
+}
+
+func TestCandidateScore(t *testing.T) {
+	ranked := []string{
+		`not json at all, but long`,
+		`{"name": "Ada", "email": null, "tags": []}`,
+		`{"name": "Ada", "email": "", "tags": ["x"]}`,
+		`{"name": "Ada", "email": "ada@example.com", "tags": ["x"]}`,
+	}
+	for i := 1; i < len(ranked); i++ {
+		if candidateScore(ranked[i]) <= candidateScore(ranked[i-1]) {
+			t.Errorf("Expected %s to score above %s", ranked[i], ranked[i-1])
+		}
+	}
+}
+
+func TestCompleteBestOf(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	replies := []string{`{"name":"Ada"}`, `{"name":"Ada","age":36}`, `{"name":""}`}
+	var mu sync.Mutex
+	calls := 0
+	judgeBlank := true
+	var judged string
+	var judgeTools interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		reply := "They are all fine."
+		if body["model"] == "judge" {
+			messages := body["messages"].([]interface{})
+			judged = messages[0].(map[string]interface{})["content"].(string)
+			judgeTools = body["tools"]
+			// Candidates finish in any order, so the judge finds the blank one
+			for i := 1; i <= 3 && judgeBlank; i++ {
+				if strings.Contains(judged, fmt.Sprintf("<candidate %d>\n{\"name\":\"\"}", i)) {
+					reply = fmt.Sprintf("Candidate %d is best.", i)
+				}
+			}
+		} else {
+			reply = replies[calls%len(replies)]
+			calls++
+		}
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{
+				"message": map[string]interface{}{"role": "assistant", "content": reply},
+			}},
+			"usage": map[string]interface{}{"prompt_tokens": 10, "completion_tokens": 5},
+		})
+	}))
+	defer server.Close()
+	pr := promptRun{
+		path:     "bestof.prompt",
+		meta:     map[string]interface{}{"model": "custom/x", "baseURL": server.URL, "bestOf": 3},
+		provider: "custom",
+		model:    "x",
+		messages: []Message{{Role: "user", Content: "Extract the person."}},
+	}
+	c, err := complete(context.Background(), pr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.Result != replies[1] {
+		t.Errorf("Expected the most complete candidate, got %s", c.Result)
+	}
+	if c.Requests != 3 || c.Usage != (Usage{InputTokens: 30, OutputTokens: 15}) {
+		t.Errorf("Expected the usage of all 3 candidates, got %d requests and %+v", c.Requests, c.Usage)
+	}
+
+	// A judge picks instead, seeing the request and every candidate
+	pr.meta["bestOf"] = map[string]interface{}{"n": 3, "judge": "custom/judge", "criteria": "the most accurate"}
+	pr.meta["tools"] = []interface{}{map[string]interface{}{"name": "echo", "command": "cat"}}
+	c, err = complete(context.Background(), pr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.Result != `{"name":""}` {
+		t.Errorf("Expected the judge's pick, got %s", c.Result)
+	}
+	for _, want := range []string{"Pick the best one: the most accurate.", "user: Extract the person.", "{\"name\":\"Ada\",\"age\":36}\n</candidate"} {
+		if !strings.Contains(judged, want) {
+			t.Errorf("Expected %q in the judge's prompt:\n%s", want, judged)
+		}
+	}
+	if judgeTools != nil {
+		t.Errorf("Expected the judge not to be offered the prompt's tools, got %v", judgeTools)
+	}
+
+	// A judge that doesn't answer with a candidate is passed over
+	judgeBlank = false
+	c, err = complete(context.Background(), pr)
+	if err != nil || c.Result != replies[1] {
+		t.Errorf("Expected the most complete candidate, got %s (%v)", c.Result, err)
+	}
+}
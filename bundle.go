@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A bundle is a gzipped tar of a prompt directory, for distributing prompt
+// sets to machines that can't fetch them. Its first entry is a manifest
+// listing the SHA-256 of every other file, checked before the bundle is
+// used. Bundles are reproducible: entries are sorted and carry no
+// timestamps or owners, so packing the same files gives the same bytes.
+const (
+	bundleExt      = ".bundle"
+	bundleManifest = "MANIFEST.json"
+	bundleFormat   = 1
+)
+
+// bundleFile is one file listed in a bundle manifest
+type bundleFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type bundleManifestData struct {
+	Format int          `json:"format"`
+	Files  []bundleFile `json:"files"`
+}
+
+// packCommand implements runprompt pack
+func packCommand(ctx context.Context, args []string) error {
+	// -o is accepted as the usual short form of --output
+	for i, arg := range args {
+		if arg == "-o" {
+			args[i] = "--output"
+		}
+	}
+	flags, positional, err := parseFlags("pack", args, map[string]bool{"output": true})
+	if err != nil {
+		return err
+	}
+	if len(positional) > 1 {
+		return commandUsage("pack")
+	}
+	dir := "."
+	if len(positional) == 1 {
+		dir = positional[0]
+	}
+	out := flags["output"]
+	if out == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		out = filepath.Base(abs) + bundleExt
+	}
+
+	data, manifest, err := packBundle(dir, out)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(out, data, 0644); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	fmt.Printf("Packed %d files into %s (sha256 %s)\n", len(manifest.Files), out, hex.EncodeToString(sum[:]))
+	return nil
+}
+
+// packBundle builds a bundle of every file under dir. Hidden files and
+// directories, other bundles and the output file itself are left out.
+func packBundle(dir, out string) ([]byte, bundleManifestData, error) {
+	manifest := bundleManifestData{Format: bundleFormat}
+	outAbs, _ := filepath.Abs(out)
+	var contents [][]byte
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(p, bundleExt) {
+			return nil
+		}
+		if abs, _ := filepath.Abs(p); abs == outAbs {
+			return nil
+		}
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		manifest.Files = append(manifest.Files, bundleFile{
+			Path:   filepath.ToSlash(rel),
+			Size:   int64(len(content)),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+		contents = append(contents, content)
+		return nil
+	})
+	if err != nil {
+		return nil, manifest, err
+	}
+	if len(manifest.Files) == 0 {
+		return nil, manifest, fmt.Errorf("no files to pack in %s", dir)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	add := func(name string, content []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg, Format: tar.FormatPAX}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+	manifestData, _ := json.MarshalIndent(manifest, "", "  ")
+	if err := add(bundleManifest, manifestData); err != nil {
+		return nil, manifest, err
+	}
+	for i, f := range manifest.Files {
+		if err := add(f.Path, contents[i]); err != nil {
+			return nil, manifest, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, manifest, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, manifest, err
+	}
+	return buf.Bytes(), manifest, nil
+}
+
+// readBundle reads and verifies a bundle, returning its files keyed by
+// slash-separated path. Every file must match its manifest entry, and the
+// bundle may hold no files the manifest doesn't list.
+func readBundle(data []byte) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("not a bundle: %v", err)
+	}
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != bundleManifest {
+		return nil, fmt.Errorf("not a bundle: missing %s", bundleManifest)
+	}
+	var manifest bundleManifestData
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", bundleManifest, err)
+	}
+	if manifest.Format != bundleFormat {
+		return nil, fmt.Errorf("unsupported bundle format %d", manifest.Format)
+	}
+	expected := map[string]bundleFile{}
+	for _, f := range manifest.Files {
+		if !safeBundlePath(f.Path) {
+			return nil, fmt.Errorf("bundle lists unsafe path %q", f.Path)
+		}
+		expected[f.Path] = f
+	}
+
+	files := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading bundle: %v", err)
+		}
+		f, ok := expected[hdr.Name]
+		if !ok || hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("bundle contains %s, which is not in its manifest", hdr.Name)
+		}
+		if _, dup := files[hdr.Name]; dup {
+			return nil, fmt.Errorf("bundle contains %s twice", hdr.Name)
+		}
+		content, err := io.ReadAll(io.LimitReader(tr, f.Size+1))
+		if err != nil {
+			return nil, fmt.Errorf("reading bundle: %v", err)
+		}
+		sum := sha256.Sum256(content)
+		if int64(len(content)) != f.Size || hex.EncodeToString(sum[:]) != f.SHA256 {
+			return nil, fmt.Errorf("integrity check failed for %s", hdr.Name)
+		}
+		files[hdr.Name] = content
+	}
+	var missing []string
+	for _, f := range manifest.Files {
+		if _, ok := files[f.Path]; !ok {
+			missing = append(missing, f.Path)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("bundle is missing %s", strings.Join(missing, ", "))
+	}
+	return files, nil
+}
+
+// safeBundlePath reports whether a manifest path stays inside the bundle
+func safeBundlePath(p string) bool {
+	return p != "" && !strings.Contains(p, `\`) && !path.IsAbs(p) &&
+		path.Clean(p) == p && p != "." && p != ".." && !strings.HasPrefix(p, "../")
+}
+
+// resolveBundle maps a path into a bundle, such as prompts.bundle or
+// prompts.bundle/summarize.prompt, to the same path in the bundle's
+// extracted copy. Other paths are returned unchanged.
+func resolveBundle(p string) (string, error) {
+	if !strings.Contains(p, bundleExt) {
+		return p, nil
+	}
+	parts := strings.Split(filepath.ToSlash(p), "/")
+	for i, part := range parts {
+		if !strings.HasSuffix(part, bundleExt) {
+			continue
+		}
+		bundle := filepath.FromSlash(strings.Join(parts[:i+1], "/"))
+		if info, err := os.Stat(bundle); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		dir, err := extractBundle(bundle)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", bundle, err)
+		}
+		resolved := filepath.Join(append([]string{dir}, parts[i+1:]...)...)
+		if _, err := os.Stat(resolved); err != nil {
+			return "", fmt.Errorf("%s has no %s", bundle, strings.Join(parts[i+1:], "/"))
+		}
+		return resolved, nil
+	}
+	return p, nil
+}
+
+// extractBundle verifies a bundle and extracts it under the cache
+// directory, returning the extracted directory. Extracted copies are keyed
+// by the bundle's hash, so each version is extracted once and reused.
+func extractBundle(bundle string) (string, error) {
+	data, err := os.ReadFile(bundle)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	dir := filepath.Join(cacheDir(), "bundles", hex.EncodeToString(sum[:]))
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+
+	files, err := readBundle(data)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return "", err
+	}
+	// Extract next to the final directory and rename it into place, so a
+	// concurrent run never sees a partly extracted bundle
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".extract-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	for name, content := range files {
+		target := filepath.Join(tmp, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(target, content, 0644); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		if _, statErr := os.Stat(dir); statErr == nil {
+			// Another run extracted the same bundle first
+			return dir, nil
+		}
+		return "", err
+	}
+	log(fmt.Sprintf("Extracted bundle %s to %s", bundle, dir))
+	return dir, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writePromptDir creates a small prompt directory for packing
+func writePromptDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"hello.prompt":            "---\nmodel: test\n---\nHello {{name}}!",
+		"hello.prompt.test-input": `{"name": "Ann"}`,
+		"sub/bye.prompt":          "---\nmodel: test\n---\nBye",
+		".git/config":             "ignored",
+		"old.bundle":              "ignored",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPackBundle(t *testing.T) {
+	dir := writePromptDir(t)
+	data, manifest, err := packBundle(dir, filepath.Join(dir, "out.bundle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range manifest.Files {
+		paths = append(paths, f.Path)
+	}
+	expected := "hello.prompt hello.prompt.test-input sub/bye.prompt"
+	if got := strings.Join(paths, " "); got != expected {
+		t.Errorf("Expected files %q, got %q", expected, got)
+	}
+
+	files, err := readBundle(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(files["sub/bye.prompt"]); got != "---\nmodel: test\n---\nBye" {
+		t.Errorf("Expected packed content, got %q", got)
+	}
+
+	again, _, err := packBundle(dir, filepath.Join(dir, "out.bundle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, again) {
+		t.Error("Expected packing the same files to give the same bundle")
+	}
+}
+
+// rawBundle builds a bundle from entries without computing a manifest, so
+// tests can make inconsistent ones
+func rawBundle(t *testing.T, entries ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for i := 0; i < len(entries); i += 2 {
+		hdr := &tar.Header{Name: entries[i], Mode: 0644, Size: int64(len(entries[i+1])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(entries[i+1]))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestReadBundleErrors(t *testing.T) {
+	// sha256 of "hi"
+	const hiSum = "8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4"
+	manifest := func(path string) string {
+		return `{"format": 1, "files": [{"path": "` + path + `", "size": 2, "sha256": "` + hiSum + `"}]}`
+	}
+	tests := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"not gzip", []byte("hello"), "not a bundle"},
+		{"no manifest", rawBundle(t, "a.prompt", "hi"), "missing MANIFEST.json"},
+		{"valid", rawBundle(t, "MANIFEST.json", manifest("a.prompt"), "a.prompt", "hi"), ""},
+		{"tampered", rawBundle(t, "MANIFEST.json", manifest("a.prompt"), "a.prompt", "ho"), "integrity check failed for a.prompt"},
+		{"unlisted", rawBundle(t, "MANIFEST.json", manifest("a.prompt"), "a.prompt", "hi", "b.prompt", "x"), "b.prompt, which is not in its manifest"},
+		{"missing", rawBundle(t, "MANIFEST.json", manifest("a.prompt")), "bundle is missing a.prompt"},
+		{"unsafe", rawBundle(t, "MANIFEST.json", manifest("../a.prompt"), "../a.prompt", "hi"), "unsafe path"},
+		{"format", rawBundle(t, "MANIFEST.json", `{"format": 9}`), "unsupported bundle format 9"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := readBundle(tc.data)
+			if tc.expected == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("Expected error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestResolveBundle(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	dir := writePromptDir(t)
+	bundle := filepath.Join(t.TempDir(), "prompts.bundle")
+	data, _, err := packBundle(dir, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bundle, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, template, err := parsePromptFile(bundle + "/hello.prompt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta["model"] != "test" || template != "Hello {{name}}!" {
+		t.Errorf("Expected the bundled prompt, got %v %q", meta, template)
+	}
+
+	prompts, err := expandPromptArgs([]string{bundle})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prompts) != 2 {
+		t.Errorf("Expected 2 prompts in the bundle, got %v", prompts)
+	}
+
+	if got, err := resolveBundle("plain/file.prompt"); err != nil || got != "plain/file.prompt" {
+		t.Errorf("Expected other paths unchanged, got %q, %v", got, err)
+	}
+	if _, _, err := parsePromptFile(bundle + "/missing.prompt"); err == nil {
+		t.Error("Expected an error for a file not in the bundle")
+	}
+
+	corrupt := filepath.Join(t.TempDir(), "corrupt.bundle")
+	os.WriteFile(corrupt, data[:len(data)/2], 0644)
+	if _, err := resolveBundle(corrupt + "/hello.prompt"); err == nil {
+		t.Error("Expected an error for a corrupt bundle")
+	}
+}
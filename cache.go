@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// compiledPrompt is a parsed prompt file ready to render. Meta must be
+// copied with copyMeta before it is modified, as it is shared between users
+// of the cache.
+type compiledPrompt struct {
+	Meta     map[string]interface{}
+	Template string
+	Messages []messageTemplate
+}
+
+// promptCache holds parsed prompts for long-running modes such as serve, so
+// each request skips parsing and compiling. Entries are keyed by prompt path
+// (including any #name) and revalidated on every lookup, against the prompt
+// file and every file it includes, extends, imports or takes partials from:
+// an unchanged modification time and size is a hit, otherwise the file is
+// re-read and the prompt reparsed only if its content hash changed. Edits
+// are therefore picked up without a restart. A promptCache is safe for
+// concurrent use.
+type promptCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	files  []*sourceFile
+	prompt *compiledPrompt
+}
+
+// sourceFile is a file a prompt was parsed from, as it was when read
+type sourceFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte
+}
+
+// unchanged reports whether the file still has the content it was read
+// with, noting a new modification time when only that changed
+func (f *sourceFile) unchanged() bool {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false
+	}
+	if f.modTime.Equal(info.ModTime()) && f.size == info.Size() {
+		return true
+	}
+	content, err := os.ReadFile(f.path)
+	if err != nil || sha256.Sum256(content) != f.hash {
+		return false
+	}
+	f.modTime, f.size = info.ModTime(), info.Size()
+	return true
+}
+
+// sourceSet records the files read while parsing a prompt. Its methods
+// may be called on a nil *sourceSet, which only reads.
+type sourceSet struct {
+	files []*sourceFile
+}
+
+// read reads a file, recording it
+func (s *sourceSet) read(path string) ([]byte, error) {
+	if s == nil {
+		return os.ReadFile(path)
+	}
+	// Stat first, so an edit made while reading shows as a later change
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s.files = append(s.files, &sourceFile{path: path, modTime: info.ModTime(), size: info.Size(), hash: sha256.Sum256(content)})
+	return content, nil
+}
+
+func newPromptCache() *promptCache {
+	return &promptCache{entries: make(map[string]*cacheEntry)}
+}
+
+// Get returns the parsed prompt at path, reloading it if any of its files
+// changed
+func (c *promptCache) Get(path string) (*compiledPrompt, error) {
+	filePath, name := splitPromptName(path)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[path]
+	if entry != nil && entry.unchanged() {
+		return entry.prompt, nil
+	}
+
+	sources := &sourceSet{}
+	content, err := sources.read(filePath)
+	if err != nil {
+		return nil, err
+	}
+	meta, template, err := parsePromptStack(filePath, name, content, nil, sources)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		log(fmt.Sprintf("Reloaded changed prompt %s", path))
+	}
+	prompt := &compiledPrompt{Meta: meta, Template: template, Messages: compileMessages(template)}
+	c.entries[path] = &cacheEntry{files: sources.files, prompt: prompt}
+	return prompt, nil
+}
+
+// unchanged reports whether none of the entry's files changed
+func (e *cacheEntry) unchanged() bool {
+	for _, f := range e.files {
+		if !f.unchanged() {
+			return false
+		}
+	}
+	return true
+}
+
+// copyMeta deep-copies frontmatter maps and lists
+func copyMeta(meta map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(meta))
+	for k, v := range meta {
+		copied[k] = copyValue(v)
+	}
+	return copied
+}
+
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return copyMeta(t)
+	case []interface{}:
+		copied := make([]interface{}, len(t))
+		for i, item := range t {
+			copied[i] = copyValue(item)
+		}
+		return copied
+	}
+	return v
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPromptCacheReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hello.prompt")
+	write := func(content string, mtime time.Time) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write("---\nmodel: test\n---\nHello {{name}}", start)
+
+	cache := newPromptCache()
+	first, err := cache.Get(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if again, _ := cache.Get(path); again != first {
+		t.Error("Expected unchanged file to be served from cache")
+	}
+
+	// Touched but identical content keeps the parsed prompt
+	write("---\nmodel: test\n---\nHello {{name}}", start.Add(time.Minute))
+	if again, _ := cache.Get(path); again != first {
+		t.Error("Expected identical content to be served from cache")
+	}
+
+	write("---\nmodel: test\n---\nBye {{name}}", start.Add(2*time.Minute))
+	changed, err := cache.Get(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if changed == first {
+		t.Fatal("Expected changed file to be reloaded")
+	}
+	messages := renderCompiledMessages(changed.Messages, map[string]interface{}{"name": "Ann"})
+	if len(messages) != 1 || messages[0].Content != "Bye Ann" {
+		t.Errorf("Unexpected messages: %v", messages)
+	}
+}
+
+func TestPromptCacheReloadsIncludedFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, partialsDir), 0755)
+	start := time.Now().Add(-time.Hour)
+	write := func(name, content string, mtime time.Time) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("base.prompt", "---\nmodel: test\n---\nBase", start)
+	write("footer.prompt", "Thanks", start)
+	write(filepath.Join(partialsDir, "greeting.prompt"), "Hello {{name}}", start)
+	write("hello.prompt", "---\nextends: base.prompt\n---\n{{> greeting}}\n{{include \"footer.prompt\"}}", start)
+
+	cache := newPromptCache()
+	path := filepath.Join(dir, "hello.prompt")
+	render := func() string {
+		prompt, err := cache.Get(path)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		messages := renderCompiledMessages(prompt.Messages, map[string]interface{}{"name": "Ann"})
+		return fmt.Sprintf("%v %s", prompt.Meta["model"], messages[0].Content)
+	}
+	if got := render(); got != "test Hello Ann\nThanks" {
+		t.Fatalf("Unexpected prompt: %q", got)
+	}
+
+	write(filepath.Join(partialsDir, "greeting.prompt"), "Hi {{name}}", start.Add(time.Minute))
+	write("footer.prompt", "Bye", start.Add(time.Minute))
+	write("base.prompt", "---\nmodel: other\n---\nBase", start.Add(time.Minute))
+	if got := render(); got != "other Hi Ann\nBye" {
+		t.Errorf("Expected edits to the partial, include and parent to be picked up, got %q", got)
+	}
+}
+
+func TestPromptCacheErrors(t *testing.T) {
+	cache := newPromptCache()
+	if _, err := cache.Get(filepath.Join(t.TempDir(), "missing.prompt")); err == nil {
+		t.Error("Expected error for missing file")
+	}
+
+	path := filepath.Join(t.TempDir(), "bad.prompt")
+	if err := os.WriteFile(path, []byte("{{#a}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get(path); err == nil {
+		t.Error("Expected error for unclosed section")
+	}
+}
+
+func TestCopyMeta(t *testing.T) {
+	meta := map[string]interface{}{
+		"config": map[string]interface{}{"temperature": 0.5},
+		"tags":   []interface{}{"a"},
+	}
+	copied := copyMeta(meta)
+	copied["config"].(map[string]interface{})["temperature"] = 1.0
+	copied["tags"].([]interface{})[0] = "b"
+	if meta["config"].(map[string]interface{})["temperature"] != 0.5 || meta["tags"].([]interface{})[0] != "a" {
+		t.Errorf("Expected original to be unchanged, got %v", meta)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// runChat runs an interactive conversation seeded by a prompt file. The
+// rendered template opens the conversation; each stdin line is then sent as
+// a follow-up user message and the reply printed, until EOF or "exit".
+func runChat(ctx context.Context, path string, argOverrides map[string]interface{}) error {
+	meta, template, variant, err := preparePrompt(path, argOverrides)
+	if err != nil {
+		return err
+	}
+	if err := checkRequiredEnv(meta); err != nil {
+		return err
+	}
+	provider, model, err := resolveModel(meta)
+	if err != nil {
+		return err
+	}
+	if err := checkAllowedModel(meta, meta["model"].(string)); err != nil {
+		return err
+	}
+	stream, _ := meta["stream"].(bool)
+
+	gen, err := generationConfig(meta)
+	if err != nil {
+		return err
+	}
+	limits, err := runLimits(meta)
+	if err != nil {
+		return err
+	}
+	client, err := providerClient(meta)
+	if err != nil {
+		return err
+	}
+
+	var url, apiKey string
+	var signing *Signing
+	var headers map[string]string
+	if provider != "test" {
+		url, apiKey, err = getProviderConfig(provider, model, getBaseURL(meta))
+		if err != nil {
+			return err
+		}
+		if signing, err = signingFor(meta, provider); err != nil {
+			return err
+		}
+		if headers, err = requestHeaders(meta, provider); err != nil {
+			return err
+		}
+	}
+
+	// The cost limit covers the whole conversation
+	var spent Usage
+	send := func(history []Message) (string, error) {
+		if provider == "test" {
+			response, err := loadTestResponse(path)
+			if err != nil {
+				return "", err
+			}
+			testProvider, _ := response["_provider"].(string)
+			result := extractResponse(response, nil, testProvider)
+			return result.Text, result.refused()
+		}
+		if err := limits.checkBudget(ctx, provider, model, history, gen, spent); err != nil {
+			return "", err
+		}
+		var meter *streamMeter
+		exchange, err := limits.retryRateLimited(ctx, func() (*Exchange, error) {
+			var out io.Writer
+			meter = nil
+			if stream {
+				meter = newStreamMeter(os.Stdout)
+				out = meter
+			}
+			return makeRequest(ctx, client, url, apiKey, model, history, nil, nil, gen, signing, headers, provider, out, limits)
+		})
+		if err != nil {
+			return "", err
+		}
+		result := extractResponse(exchange.Response, nil, provider)
+		spent.InputTokens += result.Usage.InputTokens
+		spent.OutputTokens += result.Usage.OutputTokens
+		recordRun(meta, path, provider, model, variant, "", 1, result.Usage, result.version(), meter.stats(result.Usage.OutputTokens))
+		return result.Text, result.refused()
+	}
+
+	history := renderMessages(template, map[string]interface{}{"STDIN": ""})
+	stat, _ := os.Stdin.Stat()
+	interactive := (stat.Mode() & os.ModeCharDevice) != 0
+	prompt := ""
+	if interactive {
+		prompt = "> "
+	}
+	_, err = chatLoop(os.Stdin, os.Stdout, os.Stderr, prompt, history, send, stream)
+	if interactive {
+		fmt.Fprintln(os.Stderr)
+	}
+	return err
+}
+
+// chatLoop drives the conversation: if history ends with a user turn it is
+// answered first, then each non-empty line read from in becomes a user
+// message. Replies go to out unless streaming already wrote them. prompt is
+// written to promptOut before each line. It returns the final history, and
+// stops at the first failed request.
+func chatLoop(in io.Reader, out, promptOut io.Writer, prompt string, history []Message, send func([]Message) (string, error), streamed bool) ([]Message, error) {
+	reply := func() error {
+		text, err := send(history)
+		if err != nil {
+			return err
+		}
+		if streamed {
+			fmt.Fprintln(out)
+		} else {
+			fmt.Fprintln(out, text)
+		}
+		history = append(history, Message{Role: "assistant", Content: text})
+		return nil
+	}
+
+	if len(history) > 0 && history[len(history)-1].Role == "user" {
+		if err := reply(); err != nil {
+			return history, err
+		}
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for {
+		fmt.Fprint(promptOut, prompt)
+		if !scanner.Scan() {
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == "exit" || line == "quit" {
+			break
+		}
+		history = append(history, Message{Role: "user", Content: line})
+		if err := reply(); err != nil {
+			return history, err
+		}
+	}
+	return history, scanner.Err()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestChatLoop(t *testing.T) {
+	history := []Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "Hi"},
+	}
+	var sent [][]Message
+	send := func(h []Message) (string, error) {
+		sent = append(sent, append([]Message(nil), h...))
+		return "reply " + h[len(h)-1].Content, nil
+	}
+
+	var out strings.Builder
+	in := strings.NewReader("How are you?\n\n  \nexit\nignored\n")
+	history, err := chatLoop(in, &out, io.Discard, "", history, send, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(sent) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(sent))
+	}
+	if len(sent[1]) != 4 {
+		t.Errorf("Expected second request to carry 4 messages, got %d", len(sent[1]))
+	}
+	expected := "reply Hi\nreply How are you?\n"
+	if out.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, out.String())
+	}
+	last := history[len(history)-1]
+	if last.Role != "assistant" || last.Content != "reply How are you?" {
+		t.Errorf("Unexpected final message: %+v", last)
+	}
+}
+
+func TestChatLoopWaitsForUser(t *testing.T) {
+	history := []Message{{Role: "system", Content: "Be brief."}}
+	calls := 0
+	send := func(h []Message) (string, error) {
+		calls++
+		return "ok", nil
+	}
+
+	var out strings.Builder
+	history, _ = chatLoop(strings.NewReader(""), &out, io.Discard, "", history, send, false)
+	if calls != 0 {
+		t.Errorf("Expected no requests, got %d", calls)
+	}
+	if len(history) != 1 {
+		t.Errorf("Expected history unchanged, got %d messages", len(history))
+	}
+}
+
+func TestChatLoopStopsOnError(t *testing.T) {
+	send := func(h []Message) (string, error) {
+		return "", fmt.Errorf("rate limited")
+	}
+	var out strings.Builder
+	_, err := chatLoop(strings.NewReader("Hello\nAgain\n"), &out, io.Discard, "", nil, send, false)
+	if err == nil || err.Error() != "rate limited" {
+		t.Errorf("Expected rate limited error, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Expected no output, got %q", out.String())
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// command is a runprompt subcommand
+type command struct {
+	args    string // argument synopsis for usage
+	summary string
+	run     func(ctx context.Context, args []string) error
+}
+
+// commands maps subcommand names to their implementations. A first
+// argument that is not a command name is taken as a prompt file for run.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"run": {
+			args:    "[--save-response <file>] [--snapshot-vars <file> | --from-snapshot <file>] [--key=value ...] <prompt_file>",
+			summary: "render a prompt with stdin as input and send it (the default)",
+			run:     runCommand,
+		},
+		"render": {
+			args:    "[--snapshot-vars <file> | --from-snapshot <file>] [--key=value ...] <prompt_file>",
+			summary: "print the messages a prompt renders to, without sending them",
+			run:     renderCommand,
+		},
+		"validate": {
+			args:    "[<prompt_file or dir> ...]",
+			summary: "check prompt files for errors without calling a model",
+			run:     validateCommand,
+		},
+		"test": {
+			args:    "[<prompt_file or dir> ...]",
+			summary: "run prompts against their .test-response fixtures",
+			run:     testCommand,
+		},
+		"chat": {
+			args:    "[--key=value ...] <prompt_file>",
+			summary: "hold an interactive conversation seeded by a prompt",
+			run:     chatCommand,
+		},
+		"import": {
+			args:    "--from chatgpt|openai-playground [--session <name> | --prompt <file>] [--conversation <title>] [--force] <export.json>",
+			summary: "convert a conversation exported from another tool into a session or prompt",
+			run:     importCommand,
+		},
+		"session": {
+			args:    "export [--html] [-o <file>] <name or session.json>",
+			summary: "export a session as JSON or a standalone HTML transcript",
+			run:     sessionCommand,
+		},
+		"pipeline": {
+			args:    "[--output text|json] <pipeline.yaml>",
+			summary: "run a graph of prompts, passing outputs between steps",
+			run:     pipelineCommand,
+		},
+		"serve": {
+			args:    "[--addr host:port] [--proxy url] [<dir>]",
+			summary: "serve the prompts in a directory over HTTP",
+			run:     serveCommand,
+		},
+		"pack": {
+			args:    "[-o <file>] [<dir>]",
+			summary: "bundle a prompt directory into one verified archive",
+			run:     packCommand,
+		},
+		"registry": {
+			args:    "[--registry <dir or URL>] publish <prompt_file> [name@version] | get [-o <file>] name@version | list [name]",
+			summary: "publish prompt versions to a registry and fetch pinned ones",
+			run:     registryCommand,
+		},
+		"queue": {
+			args:    "add [--input <text>] [--attempts N] [--key=value ...] <prompt_file> | work [--once] [--budget USD] | list | result <id>",
+			summary: "queue prompt runs on disk for a worker to run and retry",
+			run:     queueCommand,
+		},
+		"spend": {
+			args:    "[--since 7d] [--by model|prompt|day]",
+			summary: "report token usage and cost from the run history",
+			run:     spendCommand,
+		},
+		"help": {
+			summary: "show this help",
+			run: func(ctx context.Context, args []string) error {
+				fmt.Println(usage())
+				return nil
+			},
+		},
+	}
+}
+
+// usageError reports a malformed command line; main prints it without color
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// usage describes the command line and every subcommand
+func usage() usageError {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("Usage: runprompt [-v] [--key=value ...] <prompt_file>\n")
+	b.WriteString("       runprompt [-v] <command> [arguments]\n\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "  %-9s %s\n", name, commands[name].summary)
+	}
+	b.WriteString("\nRun 'runprompt <command> --help' for a command's arguments.")
+	return usageError(b.String())
+}
+
+// commandUsage describes one subcommand's arguments
+func commandUsage(name string) usageError {
+	return usageError(fmt.Sprintf("Usage: runprompt %s %s", name, commands[name].args))
+}
+
+// run executes the command line and returns the first error encountered;
+// main is the only place that exits. Cancelling ctx aborts in-flight requests.
+func run(ctx context.Context, args []string) error {
+	for len(args) > 0 && args[0] == "-v" {
+		verbose = true
+		args = args[1:]
+	}
+	if len(args) < 1 {
+		return usage()
+	}
+	if args[0] == "-h" || args[0] == "--help" {
+		args[0] = "help"
+	}
+
+	if err := loadUserProviders(filepath.Join(configDir(), "providers.yaml")); err != nil {
+		return fmt.Errorf("loading providers: %v", err)
+	}
+	if err := loadUserPricing(filepath.Join(configDir(), "pricing.yaml")); err != nil {
+		return fmt.Errorf("loading pricing: %v", err)
+	}
+	if err := loadUserTokenizers(filepath.Join(configDir(), "tokenizers.yaml")); err != nil {
+		return fmt.Errorf("loading tokenizers: %v", err)
+	}
+
+	name, rest := "run", args
+	if _, ok := commands[args[0]]; ok {
+		name, rest = args[0], args[1:]
+	}
+	for _, arg := range rest {
+		if arg == "-h" || arg == "--help" {
+			return commandUsage(name)
+		}
+	}
+	return commands[name].run(ctx, rest)
+}
+
+// parseFlags parses the arguments of commands that take a fixed set of
+// options rather than metadata overrides. flags maps each option name to
+// whether it takes a value; -v is accepted everywhere.
+func parseFlags(name string, args []string, flags map[string]bool) (map[string]string, []string, error) {
+	values := map[string]string{}
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-v" {
+			verbose = true
+			continue
+		}
+		if !strings.HasPrefix(arg, "--") {
+			positional = append(positional, arg)
+			continue
+		}
+		key, value, hasValue := strings.Cut(arg[2:], "=")
+		takesValue, ok := flags[key]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown option --%s for runprompt %s", key, name)
+		}
+		if takesValue && !hasValue {
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--%s requires a value", key)
+			}
+			i++
+			value = args[i]
+		}
+		values[key] = value
+	}
+	return values, positional, nil
+}
+
+// chatCommand implements runprompt chat
+func chatCommand(ctx context.Context, args []string) error {
+	verboseFlag, _, argOverrides, remaining, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+	verbose = verbose || verboseFlag
+	if len(remaining) != 1 {
+		return commandUsage("chat")
+	}
+	return runChat(ctx, remaining[0], argOverrides)
+}
+
+// renderCommand implements runprompt render, printing the rendered messages
+// as JSON so templates can be checked without calling a model
+func renderCommand(ctx context.Context, args []string) error {
+	verboseFlag, _, argOverrides, remaining, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+	verbose = verbose || verboseFlag
+	if len(remaining) != 1 {
+		return commandUsage("render")
+	}
+	snapshotFile, snapshot, err := snapshotFlags(argOverrides)
+	if err != nil {
+		return err
+	}
+	overrides := copyOverrides(argOverrides)
+	meta, template, variant, err := preparePrompt(remaining[0], argOverrides)
+	if err != nil {
+		return err
+	}
+	variables, err := snapshotVariables(snapshot, remaining[0], meta)
+	if err != nil {
+		return err
+	}
+	if snapshotFile != "" {
+		if err := writeVarSnapshot(snapshotFile, remaining[0], variant, overrides, variables); err != nil {
+			return err
+		}
+	}
+	messages, err := renderPromptMessages(compileMessages(template), variables, meta)
+	if err != nil {
+		return err
+	}
+	data, _ := json.MarshalIndent(messages, "", "  ")
+	fmt.Println(string(data))
+	return nil
+}
+
+// validateCommand implements runprompt validate, reporting every problem
+// found in each file
+func validateCommand(ctx context.Context, args []string) error {
+	_, targets, err := parseFlags("validate", args, nil)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		targets = []string{"."}
+	}
+	files, err := expandPromptArgs(targets)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, path := range files {
+		errs := lintPrompt(path)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d prompt files have errors", failed, len(files))
+	}
+	fmt.Printf("%d prompt files OK\n", len(files))
+	return nil
+}
+
+// expandPromptArgs lists the prompt files named by targets, searching
+// directories recursively for .prompt files
+func expandPromptArgs(targets []string) ([]string, error) {
+	var prompts []string
+	for _, target := range targets {
+		target, err := resolveBundle(target)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(target)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			prompts = append(prompts, target)
+			continue
+		}
+		err = filepath.WalkDir(target, func(path string, d os.DirEntry, err error) error {
+			if err == nil && d.IsDir() && d.Name() == partialsDir {
+				return filepath.SkipDir
+			}
+			if err == nil && !d.IsDir() && strings.HasSuffix(path, ".prompt") {
+				prompts = append(prompts, path)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(prompts) == 0 {
+		return nil, errNoPrompts
+	}
+	return prompts, nil
+}
+
+// testCommand implements runprompt test: each prompt with a .test-response
+// fixture is rendered and its fixture run through the prompt's output
+// transforms and schema. A .test-input file next to the prompt is used as
+// stdin. Directories are searched recursively; the default is the current
+// directory.
+func testCommand(ctx context.Context, args []string) error {
+	_, targets, err := parseFlags("test", args, nil)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		targets = []string{"."}
+	}
+	prompts, err := findTestPrompts(targets)
+	if err != nil {
+		return err
+	}
+	if len(prompts) == 0 {
+		return fmt.Errorf("no prompts with .test-response fixtures found")
+	}
+
+	failed := 0
+	for _, path := range prompts {
+		if err := testPrompt(ctx, path); err != nil {
+			fmt.Printf("❌ %s\n   %s\n", path, strings.ReplaceAll(err.Error(), "\n", "\n   "))
+			failed++
+		} else {
+			fmt.Printf("✅ %s\n", path)
+		}
+	}
+	fmt.Printf("\nPassed: %d, Failed: %d\n", len(prompts)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d prompt tests failed", failed, len(prompts))
+	}
+	return nil
+}
+
+// findTestPrompts lists the prompt files among targets that have fixtures.
+// Files named explicitly must have one.
+func findTestPrompts(targets []string) ([]string, error) {
+	var prompts []string
+	for _, target := range targets {
+		files, err := expandPromptArgs([]string{target})
+		if err == errNoPrompts {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range files {
+			_, err := os.Stat(path + ".test-response")
+			if err == nil {
+				prompts = append(prompts, path)
+			} else if path == target {
+				return nil, fmt.Errorf("%s has no .test-response fixture", target)
+			}
+		}
+	}
+	return prompts, nil
+}
+
+// testPrompt runs one prompt against its fixture
+func testPrompt(ctx context.Context, path string) error {
+	meta, template, variant, err := preparePrompt(path, map[string]interface{}{"model": "test"})
+	if err != nil {
+		return err
+	}
+	input, err := os.ReadFile(path + ".test-input")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	variables, err := inputVariables(strings.TrimSpace(string(input)), meta)
+	if err != nil {
+		return err
+	}
+	messages, err := renderPromptMessages(compileMessages(template), variables, meta)
+	if err != nil {
+		return err
+	}
+	_, err = complete(ctx, promptRun{
+		path:     path,
+		meta:     meta,
+		variant:  variant,
+		provider: "test",
+		model:    "test",
+		messages: messages,
+	})
+	return err
+}
+
+// spendCommand implements runprompt spend
+func spendCommand(ctx context.Context, args []string) error {
+	flags, positional, err := parseFlags("spend", args, map[string]bool{"since": true, "by": true})
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return commandUsage("spend")
+	}
+	return runSpend(flags["since"], flags["by"])
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFlags(t *testing.T) {
+	flags := map[string]bool{"since": true, "by": true, "force": false}
+	values, positional, err := parseFlags("spend", []string{"--since", "7d", "--by=day", "--force", "extra"}, flags)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if values["since"] != "7d" || values["by"] != "day" {
+		t.Errorf("Unexpected values: %v", values)
+	}
+	if _, ok := values["force"]; !ok {
+		t.Error("Expected --force to be set")
+	}
+	if len(positional) != 1 || positional[0] != "extra" {
+		t.Errorf("Expected positional [extra], got %v", positional)
+	}
+
+	if _, _, err := parseFlags("spend", []string{"--model", "x"}, flags); err == nil || !strings.Contains(err.Error(), "unknown option --model") {
+		t.Errorf("Expected unknown option error, got %v", err)
+	}
+	if _, _, err := parseFlags("spend", []string{"--since"}, flags); err == nil {
+		t.Error("Expected error for missing value")
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	var usage usageError
+	for _, args := range [][]string{nil, {"-v"}, {"render"}, {"serve", "a", "b"}, {"chat", "a.prompt", "b.prompt"}, {"spend", "--help"}} {
+		if err := run(context.Background(), args); !errors.As(err, &usage) {
+			t.Errorf("run(%q): expected usage error, got %v", args, err)
+		}
+	}
+	verbose = false
+}
+
+func TestValidateCommand(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.prompt")
+	bad := filepath.Join(dir, "bad.prompt")
+	os.WriteFile(good, []byte("---\nmodel: openai/gpt-4o\n---\nHello {{name}}"), 0644)
+	os.WriteFile(bad, []byte("Hello {{#items}}"), 0644)
+
+	if err := validateCommand(context.Background(), []string{good}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := validateCommand(context.Background(), []string{good, bad}); err == nil || !strings.Contains(err.Error(), "1 of 2") {
+		t.Errorf("Expected 1 of 2 files to fail, got %v", err)
+	}
+}
+
+func TestTestCommand(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	dir := t.TempDir()
+	prompt := "---\nmodel: openai/gpt-4o\noutput:\n  schema:\n    name: string\n---\nExtract {{input}}"
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("ok.prompt", prompt)
+	write("ok.prompt.test-response", `{"choices":[{"message":{"content":"{\"name\": \"Ann\"}"}}]}`)
+	write("ok.prompt.test-input", "Ann is here")
+	write("untested.prompt", prompt)
+
+	if err := testCommand(context.Background(), []string{dir}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	write("wrong.prompt", prompt)
+	write("wrong.prompt.test-response", `{"choices":[{"message":{"content":"{\"name\": 5}"}}]}`)
+	if err := testCommand(context.Background(), []string{dir}); err == nil || !strings.Contains(err.Error(), "1 of 2") {
+		t.Errorf("Expected 1 of 2 tests to fail, got %v", err)
+	}
+	if err := testCommand(context.Background(), []string{filepath.Join(dir, "untested.prompt")}); err == nil {
+		t.Error("Expected error for a prompt without a fixture")
+	}
+}
+
+func TestInputVariables(t *testing.T) {
+	vars, _ := inputVariables(`{"name": "Ann"}`, nil)
+	if vars["name"] != "Ann" || vars["STDIN"] != `{"name": "Ann"}` {
+		t.Errorf("Expected JSON fields as variables, got %v", vars)
+	}
+	if vars, _ := inputVariables("hello", nil); vars["input"] != "hello" {
+		t.Errorf("Expected raw input as input, got %v", vars)
+	}
+	meta := map[string]interface{}{"input": map[string]interface{}{"schema": map[string]interface{}{"text": "string"}}}
+	if vars, _ := inputVariables("hello", meta); vars["text"] != "hello" {
+		t.Errorf("Expected raw input bound to schema key, got %v", vars)
+	}
+}
+
+func TestInputVariablesSchema(t *testing.T) {
+	meta := map[string]interface{}{"input": map[string]interface{}{
+		"schema": map[string]interface{}{
+			"name":   "string, the person's name",
+			"age":    "integer",
+			"tone?":  "string",
+			"topics": "string",
+		},
+		"default": map[string]interface{}{"topics": "anything", "tone": "friendly"},
+	}}
+
+	vars, err := inputVariables(`{"name": "Ann", "age": 30}`, meta)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if vars["topics"] != "anything" || vars["tone"] != "friendly" {
+		t.Errorf("Expected defaults for missing inputs, got %v", vars)
+	}
+	if vars, _ := inputVariables(`{"name": "Ann", "age": 30, "tone": "terse"}`, meta); vars["tone"] != "terse" {
+		t.Errorf("Expected given input to override its default, got %v", vars["tone"])
+	}
+
+	_, err = inputVariables("", meta)
+	expected := "missing required input:\n  age\n  name (the person's name)"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected %q, got %v", expected, err)
+	}
+
+	_, err = inputVariables(`{"name": "Ann", "age": "thirty"}`, meta)
+	if err == nil || !strings.Contains(err.Error(), "input.age: expected integer, got string") {
+		t.Errorf("Expected type error for age, got %v", err)
+	}
+}
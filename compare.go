@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// compareResult is one model's entry in --models output: its run's
+// summary, or the error that stopped it
+type compareResult struct {
+	*runSummary
+	Error string `json:"error,omitempty"`
+}
+
+// compareColumnMin is the narrowest column side-by-side output uses;
+// with less room each model's result is printed below the last
+const compareColumnMin = 24
+
+// parseModelList reads the comma-separated models of --models, which may
+// be aliases
+func parseModelList(v interface{}) ([]string, error) {
+	var models []string
+	for _, m := range strings.Split(fmt.Sprintf("%v", v), ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		if containsString(models, m) {
+			return nil, fmt.Errorf("--models lists %s twice", m)
+		}
+		models = append(models, m)
+	}
+	if len(models) == 0 {
+		return nil, fmt.Errorf("--models needs a comma-separated list of models")
+	}
+	return models, nil
+}
+
+// compareModels sends base's rendered messages to each of models at once,
+// returning their results in the same order. extract, if set, picks the
+// field each output is reduced to.
+func compareModels(ctx context.Context, base promptRun, models []string, extract string) []compareResult {
+	results := make([]compareResult, len(models))
+	var wg sync.WaitGroup
+	for i, modelStr := range models {
+		wg.Add(1)
+		go func(i int, modelStr string) {
+			defer wg.Done()
+			meta := make(map[string]interface{}, len(base.meta))
+			for k, v := range base.meta {
+				meta[k] = v
+			}
+			meta["model"] = modelStr
+			delete(meta, "fallbackModels")
+			pr := base
+			pr.meta = meta
+			pr.provider, pr.model = parseModelString(modelStr)
+			pr.stream, pr.out = false, nil
+			c, err := complete(ctx, pr)
+			if err != nil {
+				results[i] = compareResult{Error: err.Error()}
+				return
+			}
+			summary := summarize(pr, c)
+			if extract != "" {
+				var data interface{}
+				if err := json.Unmarshal([]byte(c.Result), &data); err != nil {
+					results[i] = compareResult{Error: fmt.Sprintf("--extract needs a JSON response: %v", err)}
+					return
+				}
+				value, err := extractPath(data, extract)
+				if err != nil {
+					results[i] = compareResult{Error: fmt.Sprintf("--extract %s: %v", extract, err)}
+					return
+				}
+				summary.Output = value
+			}
+			results[i] = compareResult{runSummary: &summary}
+		}(i, modelStr)
+	}
+	wg.Wait()
+	return results
+}
+
+// runCompare implements --models, printing the results side by side, or
+// with --output json as an object keyed by model. It fails if any model
+// did, after printing the rest.
+func runCompare(ctx context.Context, base promptRun, models []string, extract string, jsonOutput bool) error {
+	results := compareModels(ctx, base, models, extract)
+	if jsonOutput {
+		byModel := make(map[string]compareResult, len(models))
+		for i, m := range models {
+			byModel[m] = results[i]
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(byModel); err != nil {
+			return err
+		}
+	} else {
+		writeComparison(os.Stdout, models, results, terminalWidth())
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d models failed", failed, len(models))
+	}
+	return nil
+}
+
+// terminalWidth is the width side-by-side output fills: $COLUMNS, as
+// shells set it, or 120
+func terminalWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return 120
+}
+
+// writeComparison prints each model's result in a column of its own,
+// headed by the model and ending with its cost and latency, or one after
+// another when width leaves too little room for the columns
+func writeComparison(w io.Writer, models []string, results []compareResult, width int) {
+	columns := make([][]string, len(models))
+	for i, r := range results {
+		text := ""
+		if r.Error != "" {
+			text = "error: " + r.Error
+		} else {
+			text = formatExtracted(r.Output)
+		}
+		columns[i] = append(strings.Split(text, "\n"), "", compareFooter(r))
+	}
+
+	const gap = " | "
+	columnWidth := (width - len(gap)*(len(models)-1)) / len(models)
+	if len(models) == 1 || columnWidth < compareColumnMin {
+		for i, m := range models {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "== %s ==\n", m)
+			fmt.Fprintln(w, strings.Join(columns[i], "\n"))
+		}
+		return
+	}
+
+	wrapped := make([][]string, len(models))
+	rows := 0
+	for i, lines := range columns {
+		wrapped[i] = append([]string{models[i], strings.Repeat("-", columnWidth)}, wrapLines(lines, columnWidth)...)
+		rows = max(rows, len(wrapped[i]))
+	}
+	for row := 0; row < rows; row++ {
+		cells := make([]string, len(models))
+		for i, lines := range wrapped {
+			if row < len(lines) {
+				cells[i] = lines[row]
+			}
+			if i < len(models)-1 {
+				cells[i] = padRight(cells[i], columnWidth)
+			}
+		}
+		fmt.Fprintln(w, strings.TrimRight(strings.Join(cells, gap), " "))
+	}
+}
+
+// compareFooter summarizes a model's run: its latency, tokens and cost
+func compareFooter(r compareResult) string {
+	if r.runSummary == nil {
+		return ""
+	}
+	cost := "cost unknown"
+	if r.Cost != nil {
+		cost = fmt.Sprintf("$%.4f", *r.Cost)
+	}
+	latency := time.Duration(r.LatencyMs) * time.Millisecond
+	return fmt.Sprintf("%v, %d in / %d out tokens, %s", latency.Round(10*time.Millisecond),
+		r.Usage.InputTokens, r.Usage.OutputTokens, cost)
+}
+
+// wrapLines breaks each line at spaces to fit width, splitting words
+// longer than width
+func wrapLines(lines []string, width int) []string {
+	var wrapped []string
+	for _, line := range lines {
+		line = strings.TrimRight(strings.ReplaceAll(line, "\t", "    "), " ")
+		for utf8.RuneCountInString(line) > width {
+			runes := []rune(line)
+			cut := width
+			for i := width; i > 0; i-- {
+				if runes[i] == ' ' {
+					cut = i
+					break
+				}
+			}
+			wrapped = append(wrapped, strings.TrimRight(string(runes[:cut]), " "))
+			line = strings.TrimLeft(string(runes[cut:]), " ")
+		}
+		wrapped = append(wrapped, line)
+	}
+	return wrapped
+}
+
+// padRight pads s with spaces to width runes
+func padRight(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
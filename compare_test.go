@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseModelList(t *testing.T) {
+	tests := []struct {
+		arg      string
+		expected string
+	}{
+		{"openai/gpt-4o, anthropic/claude-sonnet-4-20250514", "openai/gpt-4o anthropic/claude-sonnet-4-20250514"},
+		{"test,", "test"},
+		{"a/x,a/x", "--models lists a/x twice"},
+		{",", "--models needs a comma-separated list of models"},
+	}
+	for _, tt := range tests {
+		models, err := parseModelList(tt.arg)
+		got := strings.Join(models, " ")
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.expected {
+			t.Errorf("parseModelList(%q): expected %q, got %q", tt.arg, tt.expected, got)
+		}
+	}
+}
+
+func TestWriteComparison(t *testing.T) {
+	cost := 0.0012
+	results := []compareResult{
+		{runSummary: &runSummary{Output: "A short answer that wraps onto a second line", LatencyMs: 1234,
+			Usage: Usage{InputTokens: 10, OutputTokens: 9}, Cost: &cost}},
+		{Error: "rate limited"},
+	}
+	var b bytes.Buffer
+	writeComparison(&b, []string{"a/x", "b/y"}, results, 59)
+	expected := "" +
+		"a/x                          | b/y\n" +
+		"---------------------------- | ----------------------------\n" +
+		"A short answer that wraps    | error: rate limited\n" +
+		"onto a second line           |\n" +
+		"                             |\n" +
+		"1.23s, 10 in / 9 out tokens, |\n" +
+		"$0.0012                      |\n"
+	if b.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+
+	// Too narrow for columns
+	b.Reset()
+	writeComparison(&b, []string{"a/x", "b/y"}, results, 40)
+	expected = "== a/x ==\nA short answer that wraps onto a second line\n\n1.23s, 10 in / 9 out tokens, $0.0012\n\n" +
+		"== b/y ==\nerror: rate limited\n\n\n"
+	if b.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+func TestRunModels(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	var mu sync.Mutex
+	var prompts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		messages := body["messages"].([]interface{})
+		mu.Lock()
+		prompts = append(prompts, messages[0].(map[string]interface{})["content"].(string))
+		mu.Unlock()
+		if body["model"] == "broken" {
+			http.Error(w, "no such model", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{
+				"message": map[string]interface{}{"role": "assistant", "content": "from " + body["model"].(string)},
+			}},
+		})
+	}))
+	defer server.Close()
+	t.Setenv("RUNPROMPT_BASE_URL", server.URL)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hello.prompt")
+	writeFiles(t, dir, "hello.prompt", "---\nmodel: custom/x\n---\nHi {{name}}")
+
+	models := []string{"custom/a", "custom/b", "custom/broken"}
+	base := promptRun{path: path, meta: map[string]interface{}{"model": "custom/x", "baseURL": server.URL}, messages: []Message{{Role: "user", Content: "Hi Ada"}}}
+	results := compareModels(context.Background(), base, models, "")
+	for i, m := range []string{"a", "b"} {
+		if r := results[i]; r.runSummary == nil || r.Output != "from "+m || r.Model != "custom/"+m {
+			t.Errorf("Unexpected result for %s: %+v", m, r)
+		}
+	}
+	if !strings.Contains(results[2].Error, "no such model") {
+		t.Errorf("Expected the failure to be reported, got %+v", results[2])
+	}
+	// Every model is sent the same rendered prompt
+	if len(prompts) != 3 || prompts[0] != "Hi Ada" || prompts[1] != prompts[0] || prompts[2] != prompts[0] {
+		t.Errorf("Expected the same prompt sent to each model, got %q", prompts)
+	}
+
+	if err := run(context.Background(), []string{"--models", "custom/a", "--batch", path}); err == nil || !strings.Contains(err.Error(), "can't be combined") {
+		t.Errorf("Expected --models and --batch to conflict, got %v", err)
+	}
+	err := run(context.Background(), []string{"--models", "custom/a,custom/broken", "--name", "Ada", path})
+	if err == nil || err.Error() != "1 of 2 models failed" {
+		t.Errorf("Expected one model to fail, got %v", err)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// projectConfigName is the per-project config file, looked up from the
+// working directory upwards
+const projectConfigName = ".runprompt.yaml"
+
+// generationKeys are sampling settings that belong in the config: block but
+// may be written at the top level of a config file
+var generationKeys = []string{
+	"temperature", "topP", "topK", "maxOutputTokens", "presencePenalty", "frequencyPenalty", "stopSequences", "seed",
+}
+
+// GenerationConfig holds the sampling settings from the config: block.
+// Nil fields are left to the provider's defaults.
+type GenerationConfig struct {
+	Temperature      *float64
+	TopP             *float64
+	TopK             *int
+	MaxOutputTokens  *int
+	PresencePenalty  *float64
+	FrequencyPenalty *float64
+	StopSequences    []string
+	Seed             *int
+}
+
+// generationConfig reads the config: block from metadata. Generation keys at
+// the top level, as set by --temperature and friends, take precedence.
+func generationConfig(meta map[string]interface{}) (GenerationConfig, error) {
+	settings := map[string]interface{}{}
+	if config, ok := meta["config"].(map[string]interface{}); ok {
+		for k, v := range config {
+			settings[k] = v
+		}
+	}
+	for _, key := range generationKeys {
+		if v, ok := meta[key]; ok {
+			settings[key] = v
+		}
+	}
+
+	var gen GenerationConfig
+	floats := map[string]**float64{
+		"temperature":      &gen.Temperature,
+		"topP":             &gen.TopP,
+		"presencePenalty":  &gen.PresencePenalty,
+		"frequencyPenalty": &gen.FrequencyPenalty,
+	}
+	ints := map[string]**int{
+		"topK":            &gen.TopK,
+		"maxOutputTokens": &gen.MaxOutputTokens,
+		"seed":            &gen.Seed,
+	}
+	for key, v := range settings {
+		if field, ok := floats[key]; ok {
+			f, ok := toFloat(v)
+			if !ok {
+				return gen, fmt.Errorf("config.%s must be a number, got %v", key, v)
+			}
+			*field = &f
+		} else if field, ok := ints[key]; ok {
+			f, ok := toFloat(v)
+			if !ok || f != float64(int(f)) || f < 0 {
+				return gen, fmt.Errorf("config.%s must be a non-negative integer, got %v", key, v)
+			}
+			n := int(f)
+			*field = &n
+		} else if key == "stopSequences" {
+			if s, ok := v.(string); ok {
+				gen.StopSequences = []string{s}
+			} else {
+				gen.StopSequences = stringList(v)
+			}
+		}
+	}
+	return gen, nil
+}
+
+// toFloat converts a parsed YAML number, or a numeric string, to float64
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// configDir returns the runprompt configuration directory, honoring
+// XDG_CONFIG_HOME and defaulting to ~/.config/runprompt
+func configDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "runprompt")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "runprompt")
+}
+
+// dataDir returns the directory for state runprompt keeps between runs,
+// honoring XDG_DATA_HOME and defaulting to ~/.local/share/runprompt
+func dataDir() string {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "runprompt")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".local", "share", "runprompt")
+}
+
+// cacheDir returns the directory for files runprompt can recreate, such as
+// extracted bundles, honoring XDG_CACHE_HOME and defaulting to
+// ~/.cache/runprompt
+func cacheDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "runprompt")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".cache", "runprompt")
+}
+
+// loadUserProviders merges providers declared in a providers.yaml file into
+// the providers map. Each top-level key names a provider:
+//
+//	together:
+//	  url: https://api.together.xyz/v1/chat/completions
+//	  env: TOGETHER_API_KEY
+//	  authHeader: X-Api-Key   # send the raw key in this header instead of Bearer
+//	  optionalKey: true       # allow running without the env var set
+//	  tools: false            # no tool calling; schemas go in the prompt
+//	  headers:
+//	    X-Title: runprompt
+//	  signing:                # HMAC-sign request bodies, see Signing
+//	    secretEnv: TOGETHER_SIGNING_SECRET
+//
+// Declaring a built-in provider's name overrides only the fields given.
+// A missing file is not an error.
+func loadUserProviders(path string) error {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for name, value := range parseYAML(string(content)) {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: provider %q must be a mapping", path, name)
+		}
+		p := providers[name]
+		for key, v := range fields {
+			switch key {
+			case "url":
+				p.URL = fmt.Sprintf("%v", v)
+			case "env":
+				p.Env = fmt.Sprintf("%v", v)
+			case "endpointEnv":
+				p.EndpointEnv = fmt.Sprintf("%v", v)
+			case "authHeader":
+				p.AuthHeader = fmt.Sprintf("%v", v)
+			case "optionalKey":
+				p.OptionalKey, _ = v.(bool)
+			case "tools":
+				tools, _ := v.(bool)
+				p.NoTools = !tools
+			case "api":
+				p.API = fmt.Sprintf("%v", v)
+				if err := validAPI(p.API); err != nil {
+					return fmt.Errorf("%s: %s.api: %v", path, name, err)
+				}
+			case "headers":
+				headers, ok := v.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("%s: %s.headers must be a mapping", path, name)
+				}
+				merged := make(map[string]string)
+				for k, hv := range p.Headers {
+					merged[k] = hv
+				}
+				for k, hv := range headers {
+					merged[k] = fmt.Sprintf("%v", hv)
+				}
+				p.Headers = merged
+			case "signing":
+				signing, err := parseSigning(v)
+				if err != nil {
+					return fmt.Errorf("%s: %s: %v", path, name, err)
+				}
+				p.Signing = signing
+			default:
+				return fmt.Errorf("%s: unknown field %s.%s", path, name, key)
+			}
+		}
+		if p.URL == "" {
+			return fmt.Errorf("%s: provider %q has no url", path, name)
+		}
+		if p.Env == "" && !p.OptionalKey {
+			return fmt.Errorf("%s: provider %q has no env (set optionalKey: true for keyless servers)", path, name)
+		}
+		providers[name] = p
+		log(fmt.Sprintf("Loaded provider %s from %s", name, path))
+	}
+	return nil
+}
+
+// findProjectConfig returns the nearest .runprompt.yaml in dir or its
+// parents, or "" if there is none
+func findProjectConfig(dir string) string {
+	for {
+		path := filepath.Join(dir, projectConfigName)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// loadConfigFile reads a config file into frontmatter-shaped settings,
+// moving top-level generation settings such as temperature into config:
+func loadConfigFile(path string) (map[string]interface{}, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string]interface{}{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if errs := checkFrontmatter(string(content)); len(errs) > 0 {
+		errs[0].File = path
+		return nil, errs[0]
+	}
+
+	settings := parseYAML(string(content))
+	for _, key := range generationKeys {
+		v, ok := settings[key]
+		if !ok {
+			continue
+		}
+		config, _ := settings["config"].(map[string]interface{})
+		if config == nil {
+			config = map[string]interface{}{}
+			settings["config"] = config
+		}
+		config[key] = v
+		delete(settings, key)
+	}
+	log(fmt.Sprintf("Loaded config from %s", path))
+	return settings, nil
+}
+
+// configFile is the settings read from one config file
+type configFile struct {
+	Path     string
+	Settings map[string]interface{}
+}
+
+// loadSettings reads the global config.yaml and the project .runprompt.yaml,
+// in increasing order of precedence
+func loadSettings() ([]configFile, error) {
+	paths := []string{filepath.Join(configDir(), "config.yaml")}
+	if cwd, err := os.Getwd(); err == nil {
+		if path := findProjectConfig(cwd); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	var files []configFile
+	for _, path := range paths {
+		settings, err := loadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, configFile{path, settings})
+	}
+	return files, nil
+}
+
+// parseTimeout accepts seconds as a number or a Go duration string like "90s"
+func parseTimeout(v interface{}) (time.Duration, error) {
+	switch t := v.(type) {
+	case int:
+		return time.Duration(t) * time.Second, nil
+	case float64:
+		return time.Duration(t * float64(time.Second)), nil
+	case string:
+		if secs, err := strconv.ParseFloat(t, 64); err == nil {
+			return time.Duration(secs * float64(time.Second)), nil
+		}
+		return time.ParseDuration(t)
+	}
+	return 0, fmt.Errorf("invalid timeout: %v", v)
+}
+
+// envNameRe matches a valid environment variable name
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// requiredEnv reads requiresEnv:, the environment variables a prompt
+// needs, such as API keys for tools it refers to: one name or a list
+func requiredEnv(meta map[string]interface{}) ([]string, error) {
+	var names []string
+	switch v := meta["requiresEnv"].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		names = []string{v}
+	case []interface{}:
+		names = stringList(v)
+		if len(names) != len(v) {
+			return nil, fmt.Errorf("requiresEnv must list environment variable names, got %v", v)
+		}
+	default:
+		return nil, fmt.Errorf("requiresEnv must list environment variable names, got %v", v)
+	}
+	for _, name := range names {
+		if !envNameRe.MatchString(name) {
+			return nil, fmt.Errorf("requiresEnv: invalid environment variable name %q", name)
+		}
+	}
+	return names, nil
+}
+
+// checkRequiredEnv lists every variable named by requiresEnv: that is
+// unset or empty in one error, so a run fails before any work is done
+func checkRequiredEnv(meta map[string]interface{}) error {
+	names, err := requiredEnv(meta)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, name := range names {
+		if os.Getenv(name) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required environment variables:\n  %s", strings.Join(missing, "\n  "))
+	}
+	return nil
+}
+
+// applyRuntimeSettings checks the settings that control runprompt itself
+// rather than the request, timeout, proxy and faultInject, which each run
+// reads for itself through runLimits and runClient, and applies color.
+// NO_COLOR disables color.
+func applyRuntimeSettings(meta map[string]interface{}) error {
+	if v, ok := meta["timeout"]; ok {
+		if _, err := parseTimeout(v); err != nil {
+			return err
+		}
+	}
+	if v, ok := meta["proxy"]; ok {
+		if _, err := proxyClient(v); err != nil {
+			return err
+		}
+	}
+	if v, ok := meta["faultInject"]; ok {
+		if _, err := parseFaults(v); err != nil {
+			return err
+		}
+	}
+	color := true
+	if v, ok := meta["color"].(bool); ok {
+		color = v
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		color = false
+	}
+	if !color {
+		red, reset = "", ""
+	}
+	return nil
+}
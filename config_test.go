@@ -0,0 +1,224 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadUserProviders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "providers.yaml")
+	content := `together:
+  url: https://api.together.xyz/v1/chat/completions
+  env: TOGETHER_API_KEY
+gateway:
+  url: https://llm.corp.example/v1/chat/completions
+  env: GATEWAY_TOKEN
+  authHeader: X-Api-Key
+  headers:
+    X-Team: search
+  signing:
+    secretEnv: GATEWAY_SECRET
+openrouter:
+  headers:
+    HTTP-Referer: https://example.com
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	saved := providers["openrouter"]
+	t.Cleanup(func() {
+		delete(providers, "together")
+		delete(providers, "gateway")
+		providers["openrouter"] = saved
+	})
+
+	if err := loadUserProviders(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if p := providers["together"]; p.URL != "https://api.together.xyz/v1/chat/completions" || p.Env != "TOGETHER_API_KEY" {
+		t.Errorf("together not loaded: %+v", p)
+	}
+	if p := providers["gateway"]; p.AuthHeader != "X-Api-Key" || p.Headers["X-Team"] != "search" || p.Signing == nil || p.Signing.SecretEnv != "GATEWAY_SECRET" {
+		t.Errorf("gateway not loaded: %+v", p)
+	}
+	if p := providers["openrouter"]; p.URL != saved.URL || p.Headers["HTTP-Referer"] != "https://example.com" {
+		t.Errorf("openrouter override not merged: %+v", p)
+	}
+}
+
+func TestLoadUserProvidersErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"missing url", "foo:\n  env: FOO_KEY\n"},
+		{"missing env", "foo:\n  url: http://localhost/v1/chat/completions\n"},
+		{"unknown field", "foo:\n  url: http://x\n  env: K\n  colour: red\n"},
+		{"unknown api", "foo:\n  url: http://x\n  env: K\n  api: soap\n"},
+		{"signing without secret", "foo:\n  url: http://x\n  env: K\n  signing:\n    header: X-Sig\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "providers.yaml")
+			if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { delete(providers, "foo") })
+			if err := loadUserProviders(path); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
+
+func TestLoadUserProvidersMissingFile(t *testing.T) {
+	if err := loadUserProviders(filepath.Join(t.TempDir(), "none.yaml")); err != nil {
+		t.Errorf("Expected missing file to be ignored, got %v", err)
+	}
+}
+
+func TestLoadSettingsPrecedence(t *testing.T) {
+	configHome := t.TempDir()
+	project := t.TempDir()
+	sub := filepath.Join(project, "prompts", "nested")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(configHome, "runprompt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	global := "model: openai/gpt-4o-mini\ntemperature: 0.7\ntimeout: 30\n"
+	if err := os.WriteFile(filepath.Join(configHome, "runprompt", "config.yaml"), []byte(global), 0644); err != nil {
+		t.Fatal(err)
+	}
+	local := "model: anthropic/claude-3\nconfig:\n  maxOutputTokens: 500\n"
+	if err := os.WriteFile(filepath.Join(project, projectConfigName), []byte(local), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+	wd, _ := os.Getwd()
+	if err := os.Chdir(sub); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	files, err := loadSettings()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(files) != 2 || filepath.Base(files[1].Path) != projectConfigName {
+		t.Fatalf("Expected the global and project config files, got %v", files)
+	}
+	settings := map[string]interface{}{}
+	for _, file := range files {
+		mergeMaps(settings, file.Settings)
+	}
+	if settings["model"] != "anthropic/claude-3" {
+		t.Errorf("Expected project model to win, got %v", settings["model"])
+	}
+	if settings["timeout"] != 30 {
+		t.Errorf("Expected global timeout, got %v", settings["timeout"])
+	}
+	config, _ := settings["config"].(map[string]interface{})
+	if config["temperature"] != 0.7 || config["maxOutputTokens"] != 500 {
+		t.Errorf("Expected merged config block, got %v", settings["config"])
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	tests := []struct {
+		input    interface{}
+		expected time.Duration
+	}{
+		{30, 30 * time.Second},
+		{1.5, 1500 * time.Millisecond},
+		{"90s", 90 * time.Second},
+		{"2m", 2 * time.Minute},
+		{"45", 45 * time.Second},
+	}
+	for _, tc := range tests {
+		got, err := parseTimeout(tc.input)
+		if err != nil || got != tc.expected {
+			t.Errorf("parseTimeout(%v): Expected %v, got %v (%v)", tc.input, tc.expected, got, err)
+		}
+	}
+}
+
+func TestGenerationConfig(t *testing.T) {
+	meta := map[string]interface{}{
+		"config": map[string]interface{}{
+			"temperature":     0.2,
+			"maxOutputTokens": 500,
+			"topK":            40,
+			"stopSequences":   []interface{}{"END"},
+			"seed":            7,
+		},
+		"temperature": "0.9",
+	}
+	gen, err := generationConfig(meta)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if gen.Temperature == nil || *gen.Temperature != 0.9 {
+		t.Errorf("Expected top-level temperature 0.9 to win, got %v", gen.Temperature)
+	}
+	if gen.MaxOutputTokens == nil || *gen.MaxOutputTokens != 500 {
+		t.Errorf("Expected maxOutputTokens 500, got %v", gen.MaxOutputTokens)
+	}
+	if gen.TopK == nil || *gen.TopK != 40 {
+		t.Errorf("Expected topK 40, got %v", gen.TopK)
+	}
+	if gen.TopP != nil {
+		t.Errorf("Expected topP unset, got %v", *gen.TopP)
+	}
+	if len(gen.StopSequences) != 1 || gen.StopSequences[0] != "END" {
+		t.Errorf("Expected [END], got %v", gen.StopSequences)
+	}
+	if gen.Seed == nil || *gen.Seed != 7 {
+		t.Errorf("Expected seed 7, got %v", gen.Seed)
+	}
+}
+
+func TestGenerationConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+	}{
+		{"non-numeric temperature", map[string]interface{}{"temperature": "hot"}},
+		{"fractional tokens", map[string]interface{}{"maxOutputTokens": 10.5}},
+		{"negative topK", map[string]interface{}{"topK": -1}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := generationConfig(map[string]interface{}{"config": tc.config}); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
+
+func TestCheckRequiredEnv(t *testing.T) {
+	t.Setenv("RP_TEST_SET", "x")
+	t.Setenv("RP_TEST_EMPTY", "")
+	meta := map[string]interface{}{"requiresEnv": []interface{}{"RP_TEST_SET", "RP_TEST_EMPTY", "RP_TEST_UNSET"}}
+	err := checkRequiredEnv(meta)
+	expected := "missing required environment variables:\n  RP_TEST_EMPTY\n  RP_TEST_UNSET"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected %q, got %v", expected, err)
+	}
+	if err := checkRequiredEnv(map[string]interface{}{"requiresEnv": "RP_TEST_SET"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := checkRequiredEnv(map[string]interface{}{}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	for _, v := range []interface{}{42, []interface{}{"OK", 1}, []interface{}{"BAD-NAME"}} {
+		if _, err := requiredEnv(map[string]interface{}{"requiresEnv": v}); err == nil {
+			t.Errorf("Expected error for %v", v)
+		}
+	}
+}
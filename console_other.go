@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// setupConsole prepares the terminal for colored UTF-8 output, which
+// terminals outside Windows need no help with
+func setupConsole() (bool, func()) {
+	return true, func() {}
+}
@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestSetupConsole(t *testing.T) {
+	// Under go test, output is redirected rather than a console, which
+	// leaves colors on and needs nothing restored
+	ansi, restore := setupConsole()
+	if !ansi {
+		t.Error("Expected colors to stay on when output isn't a console")
+	}
+	restore()
+	restore()
+}
@@ -0,0 +1,59 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	enableVirtualTerminalProcessing = 0x0004
+	utf8CodePage                    = 65001
+)
+
+var (
+	kernel32               = syscall.NewLazyDLL("kernel32.dll")
+	procSetConsoleMode     = kernel32.NewProc("SetConsoleMode")
+	procGetConsoleOutputCP = kernel32.NewProc("GetConsoleOutputCP")
+	procSetConsoleOutputCP = kernel32.NewProc("SetConsoleOutputCP")
+)
+
+// setupConsole turns on ANSI escape sequences for stdout and stderr when
+// they are a Windows console, and switches the console to UTF-8 so programs
+// run from hooks print non-ASCII text correctly; runprompt's own output is
+// converted by the Go runtime. It reports whether stderr can show colors,
+// which older consoles can't, and returns a function that restores the
+// console's settings before exit.
+func setupConsole() (bool, func()) {
+	var restores []func()
+	ansi := true
+	for _, f := range []*os.File{os.Stdout, os.Stderr} {
+		h := syscall.Handle(f.Fd())
+		var mode uint32
+		if syscall.GetConsoleMode(h, &mode) != nil {
+			// Redirected to a file or pipe
+			continue
+		}
+		if mode&enableVirtualTerminalProcessing != 0 {
+			continue
+		}
+		if ok, _, _ := procSetConsoleMode.Call(uintptr(h), uintptr(mode|enableVirtualTerminalProcessing)); ok == 0 {
+			if f == os.Stderr {
+				ansi = false
+			}
+			continue
+		}
+		restores = append(restores, func() { procSetConsoleMode.Call(uintptr(h), uintptr(mode)) })
+	}
+	if cp, _, _ := procGetConsoleOutputCP.Call(); cp != 0 && cp != utf8CodePage {
+		if ok, _, _ := procSetConsoleOutputCP.Call(utf8CodePage); ok != 0 {
+			restores = append(restores, func() { procSetConsoleOutputCP.Call(cp) })
+		}
+	}
+	return ansi, func() {
+		for _, restore := range restores {
+			restore()
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// modelVersion is what a provider reports about the model that served a
+// request: the resolved model name, such as gpt-4o-2024-08-06 for gpt-4o,
+// and OpenAI's system_fingerprint of the backend configuration. Either may
+// be empty.
+type modelVersion struct {
+	Model       string
+	Fingerprint string
+}
+
+func (v modelVersion) String() string {
+	s := v.Model
+	if s == "" {
+		s = "unknown model"
+	}
+	if v.Fingerprint != "" {
+		s += " (" + v.Fingerprint + ")"
+	}
+	return s
+}
+
+// driftedFrom reports whether v differs from an earlier version. Only parts
+// both versions report are compared, as providers don't always send a
+// fingerprint.
+func (v modelVersion) driftedFrom(prev modelVersion) bool {
+	return (v.Model != "" && prev.Model != "" && v.Model != prev.Model) ||
+		(v.Fingerprint != "" && prev.Fingerprint != "" && v.Fingerprint != prev.Fingerprint)
+}
+
+// recordVersion is the model version a history record reports
+func recordVersion(rec HistoryRecord) modelVersion {
+	return modelVersion{Model: rec.ModelVersion, Fingerprint: rec.Fingerprint}
+}
+
+// lastVersion finds the latest record of the same prompt, provider and
+// requested model that reports a model version
+func lastVersion(records []HistoryRecord, rec HistoryRecord) (HistoryRecord, bool) {
+	for i := len(records) - 1; i >= 0; i-- {
+		r := records[i]
+		if r.Prompt == rec.Prompt && r.Provider == rec.Provider && r.Model == rec.Model &&
+			(r.ModelVersion != "" || r.Fingerprint != "") {
+			return r, true
+		}
+	}
+	return HistoryRecord{}, false
+}
+
+// checkModelDrift warns when the model version serving a run differs from
+// the one that served the prompt's previous recorded run, which catches
+// providers updating a model behind an unchanged name. If the prompt sets
+// onModelChange, that command, typically the prompt's eval suite, is run
+// through the shell.
+func checkModelDrift(meta map[string]interface{}, rec HistoryRecord) {
+	current := recordVersion(rec)
+	if current == (modelVersion{}) {
+		return
+	}
+	records, err := readHistory(historyPath(), time.Time{})
+	if err != nil {
+		return
+	}
+	prevRec, ok := lastVersion(records, rec)
+	if !ok || !current.driftedFrom(recordVersion(prevRec)) {
+		return
+	}
+	previous := recordVersion(prevRec)
+	fmt.Fprintf(os.Stderr, "Warning: %s/%s is now served by %s, was %s on %s\n",
+		rec.Provider, rec.Model, current, previous, prevRec.Time.Local().Format("2006-01-02"))
+
+	hook, _ := meta["onModelChange"].(string)
+	if hook == "" {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Running onModelChange: %s\n", hook)
+	if err := runDriftHook(hook, rec.Prompt, previous, current); err != nil {
+		fmt.Fprintf(os.Stderr, "onModelChange: %v\n", err)
+	}
+}
+
+// runDriftHook runs an onModelChange command with the prompt and the two
+// versions in its environment. Its output goes to stderr so the run's own
+// output stays clean.
+func runDriftHook(hook, prompt string, previous, current modelVersion) error {
+	cmd := exec.Command("sh", "-c", hook)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", hook)
+	}
+	cmd.Env = append(os.Environ(),
+		"PROMPT_FILE="+prompt,
+		"PREVIOUS_MODEL_VERSION="+previous.Model,
+		"PREVIOUS_FINGERPRINT="+previous.Fingerprint,
+		"MODEL_VERSION="+current.Model,
+		"FINGERPRINT="+current.Fingerprint,
+	)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModelVersionDrift(t *testing.T) {
+	tests := []struct {
+		name          string
+		prev, current modelVersion
+		expectedDrift bool
+	}{
+		{"same", modelVersion{"gpt-4o-2024-08-06", "fp_1"}, modelVersion{"gpt-4o-2024-08-06", "fp_1"}, false},
+		{"new model", modelVersion{"gpt-4o-2024-08-06", ""}, modelVersion{"gpt-4o-2024-11-20", ""}, true},
+		{"new fingerprint", modelVersion{"gpt-4o-2024-08-06", "fp_1"}, modelVersion{"gpt-4o-2024-08-06", "fp_2"}, true},
+		{"fingerprint missing", modelVersion{"gpt-4o-2024-08-06", "fp_1"}, modelVersion{"gpt-4o-2024-08-06", ""}, false},
+		{"model missing", modelVersion{"", "fp_1"}, modelVersion{"gpt-4o", "fp_1"}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.current.driftedFrom(tc.prev); got != tc.expectedDrift {
+				t.Errorf("Expected drift %v, got %v", tc.expectedDrift, got)
+			}
+		})
+	}
+}
+
+func TestLastVersion(t *testing.T) {
+	records := []HistoryRecord{
+		{Prompt: "a.prompt", Provider: "openai", Model: "gpt-4o", ModelVersion: "v1"},
+		{Prompt: "a.prompt", Provider: "openai", Model: "gpt-4o", ModelVersion: "v2"},
+		{Prompt: "a.prompt", Provider: "openai", Model: "gpt-4o"},
+		{Prompt: "b.prompt", Provider: "openai", Model: "gpt-4o", ModelVersion: "v3"},
+		{Prompt: "a.prompt", Provider: "openai", Model: "gpt-4o-mini", ModelVersion: "v4"},
+	}
+	rec, ok := lastVersion(records, HistoryRecord{Prompt: "a.prompt", Provider: "openai", Model: "gpt-4o"})
+	if !ok || rec.ModelVersion != "v2" {
+		t.Errorf("Expected the latest versioned run of the same prompt and model, got %+v", rec)
+	}
+	if _, ok := lastVersion(records, HistoryRecord{Prompt: "c.prompt", Provider: "openai", Model: "gpt-4o"}); ok {
+		t.Error("Expected no previous version for a new prompt")
+	}
+}
+
+func TestRecordRunDetectsDrift(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("onModelChange test uses sh")
+	}
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	if err := os.MkdirAll(dataDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "hook.txt")
+	meta := map[string]interface{}{"onModelChange": `echo "$PREVIOUS_MODEL_VERSION -> $MODEL_VERSION" > ` + out}
+
+	recordRun(meta, "a.prompt", "openai", "gpt-4o", "", "", 1, Usage{}, modelVersion{Model: "gpt-4o-2024-08-06"}, nil)
+	recordRun(meta, "a.prompt", "openai", "gpt-4o", "", "", 1, Usage{}, modelVersion{Model: "gpt-4o-2024-08-06"}, nil)
+	if _, err := os.Stat(out); err == nil {
+		t.Fatal("Expected no onModelChange run while the version is unchanged")
+	}
+
+	recordRun(meta, "a.prompt", "openai", "gpt-4o", "", "", 1, Usage{}, modelVersion{Model: "gpt-4o-2024-11-20"}, nil)
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Expected onModelChange to run: %v", err)
+	}
+	if expected := "gpt-4o-2024-08-06 -> gpt-4o-2024-11-20"; strings.TrimSpace(string(got)) != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	records, _ := readHistory(historyPath(), time.Time{})
+	if len(records) != 3 || records[2].ModelVersion != "gpt-4o-2024-11-20" {
+		t.Errorf("Expected the model version recorded, got %+v", records)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+)
+
+// escapers are the escaping modes the escape: frontmatter key selects for
+// {{name}} values, for prompts that embed data in HTML or JSON
+var escapers = map[string]func(string) string{
+	"none": nil,
+	"html": html.EscapeString,
+	"json": jsonStringEscape,
+}
+
+// escapeMode returns the escaping set by escape: in meta, or nil if values
+// render as they are
+func escapeMode(meta map[string]interface{}) (func(string) string, error) {
+	v, ok := meta["escape"]
+	if !ok {
+		return nil, nil
+	}
+	mode, _ := v.(string)
+	escape, ok := escapers[mode]
+	if !ok {
+		names := make([]string, 0, len(escapers))
+		for name := range escapers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("escape must be one of %s, got %v", strings.Join(names, ", "), v)
+	}
+	return escape, nil
+}
+
+// jsonStringEscape escapes s for use inside a JSON string literal, without
+// the surrounding quotes
+func jsonStringEscape(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	quoted := strings.TrimSuffix(buf.String(), "\n")
+	return quoted[1 : len(quoted)-1]
+}
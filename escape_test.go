@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEscapeModes(t *testing.T) {
+	vars := map[string]interface{}{
+		"text": "Tom & \"Jerry\" <b>\n\tend",
+		"obj":  map[string]interface{}{"a": "<x>"},
+	}
+	tests := []struct {
+		mode     string
+		template string
+		expected string
+	}{
+		{"", "{{text}}", "Tom & \"Jerry\" <b>\n\tend"},
+		{"none", "{{text}}", "Tom & \"Jerry\" <b>\n\tend"},
+		{"html", "{{text}}", "Tom &amp; &#34;Jerry&#34; &lt;b&gt;\n\tend"},
+		{"json", `{"note": "{{text}}"}`, `{"note": "Tom & \"Jerry\" <b>\n\tend"}`},
+		{"json", "{{{text}}}", "Tom & \"Jerry\" <b>\n\tend"},
+		{"json", `"{{upper text}}"`, `"TOM & \"JERRY\" <B>\n\tEND"`},
+		{"html", "{{{json obj}}} {{json obj}}", `{"a":"<x>"} {&#34;a&#34;:&#34;&lt;x&gt;&#34;}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.mode+" "+tc.template, func(t *testing.T) {
+			meta := map[string]interface{}{}
+			if tc.mode != "" {
+				meta["escape"] = tc.mode
+			}
+			messages, err := renderPromptMessages(compileMessages(tc.template), vars, meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := messages[0].Content; got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+
+	_, err := renderPromptMessages(compileMessages("{{text}}"), vars, map[string]interface{}{"escape": "xml"})
+	if err == nil || !strings.Contains(err.Error(), "escape must be one of html, json, none, got xml") {
+		t.Errorf("Expected an unknown mode error, got %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sessionCommand implements runprompt session
+func sessionCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "export" {
+		return commandUsage("session")
+	}
+	rest := args[1:]
+	// -o is accepted as the usual short form of --output
+	for i, arg := range rest {
+		if arg == "-o" {
+			rest[i] = "--output"
+		}
+	}
+	flags, positional, err := parseFlags("session", rest, map[string]bool{"html": false, "output": true})
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return commandUsage("session")
+	}
+	path, name, err := sessionSource(positional[0])
+	if err != nil {
+		return err
+	}
+	entries, err := readSessionEntries(path)
+	if err != nil {
+		return err
+	}
+	if entries == nil {
+		return fmt.Errorf("no session %s", positional[0])
+	}
+
+	var w io.Writer = os.Stdout
+	if out := flags["output"]; out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, ok := flags["html"]; ok {
+		return writeSessionHTML(w, name, entries, time.Now())
+	}
+	data, _ := json.MarshalIndent(entries, "", "  ")
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// sessionSource finds the file of a session given by name or as a path to
+// a session file, and the name to title it with
+func sessionSource(arg string) (string, string, error) {
+	if strings.ContainsAny(arg, `/\`) || filepath.Ext(arg) == ".json" {
+		if _, err := os.Stat(arg); err == nil {
+			return arg, strings.TrimSuffix(filepath.Base(arg), ".json"), nil
+		}
+	}
+	path, err := sessionPath(arg)
+	return path, arg, err
+}
+
+// transcriptSegment is a run of a message's text, or a fenced code block
+type transcriptSegment struct {
+	Code     bool
+	Language string
+	Text     string
+}
+
+// splitCodeBlocks splits message content at its ``` fences, so code keeps
+// its layout in the transcript. An unclosed fence runs to the end.
+func splitCodeBlocks(content string) []transcriptSegment {
+	var segments []transcriptSegment
+	var current transcriptSegment
+	var lines []string
+	flush := func() {
+		current.Text = strings.Trim(strings.Join(lines, "\n"), "\n")
+		if current.Text != "" || current.Code {
+			segments = append(segments, current)
+		}
+		lines = nil
+	}
+	for _, line := range strings.Split(content, "\n") {
+		if fence, ok := strings.CutPrefix(strings.TrimSpace(line), "```"); ok {
+			flush()
+			if current.Code {
+				current = transcriptSegment{}
+			} else {
+				current = transcriptSegment{Code: true, Language: strings.TrimSpace(fence)}
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	flush()
+	return segments
+}
+
+// transcriptMessage is a message as the HTML transcript shows it
+type transcriptMessage struct {
+	Role      string
+	Time      *time.Time
+	Collapsed bool // system prompts and tool messages start folded away
+	Segments  []transcriptSegment
+}
+
+var transcriptTemplate = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"title": func(role string) string {
+		if role == "" {
+			return ""
+		}
+		return strings.ToUpper(role[:1]) + role[1:]
+	},
+	"datetime": func(t time.Time) string { return t.Format(time.RFC3339) },
+	"local":    func(t time.Time) string { return t.Local().Format("2006-01-02 15:04") },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}}</title>
+<style>
+body { margin: 0; background: #f6f7f9; color: #1f2328; font: 15px/1.55 -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; }
+main { max-width: 46rem; margin: 0 auto; padding: 2rem 1rem 4rem; }
+header { margin-bottom: 1.5rem; }
+h1 { font-size: 1.4rem; margin: 0 0 .25rem; }
+.meta { color: #656d76; font-size: .85rem; }
+.message { background: #fff; border: 1px solid #d8dee4; border-radius: 8px; padding: .75rem 1rem; margin: .75rem 0; }
+.message.user { background: #eef5ff; border-color: #c8dcf5; margin-left: 3rem; }
+.message.assistant { margin-right: 3rem; }
+.role { font-weight: 600; font-size: .8rem; text-transform: uppercase; letter-spacing: .04em; color: #57606a; }
+.role time { font-weight: normal; text-transform: none; letter-spacing: 0; margin-left: .5rem; }
+.text { white-space: pre-wrap; overflow-wrap: anywhere; margin: .4rem 0; }
+pre { background: #f6f8fa; border: 1px solid #d8dee4; border-radius: 6px; padding: .75rem; overflow-x: auto; font: 13px/1.45 ui-monospace, SFMono-Regular, Menlo, Consolas, monospace; }
+details > summary { cursor: pointer; }
+@media (prefers-color-scheme: dark) {
+  body { background: #0d1117; color: #e6edf3; }
+  .message { background: #161b22; border-color: #30363d; }
+  .message.user { background: #132339; border-color: #1f3b5f; }
+  .role, .meta { color: #8d96a0; }
+  pre { background: #0d1117; border-color: #30363d; }
+}
+</style>
+</head>
+<body>
+<main>
+<header>
+<h1>{{.Name}}</h1>
+<div class="meta">{{len .Messages}} messages{{with .Started}} &middot; started {{local .}}{{end}} &middot; exported {{local .Exported}} with runprompt</div>
+</header>
+{{range .Messages}}<section class="message {{.Role}}">
+{{if .Collapsed}}<details>
+<summary class="role">{{title .Role}}{{with .Time}}<time datetime="{{datetime .}}">{{local .}}</time>{{end}}</summary>
+{{else}}<div class="role">{{title .Role}}{{with .Time}}<time datetime="{{datetime .}}">{{local .}}</time>{{end}}</div>
+{{end}}{{range .Segments}}{{if .Code}}<pre><code{{with .Language}} class="language-{{.}}"{{end}}>{{.Text}}</code></pre>
+{{else}}<div class="text">{{.Text}}</div>
+{{end}}{{end}}{{if .Collapsed}}</details>
+{{end}}</section>
+{{end}}</main>
+</body>
+</html>
+`))
+
+// writeSessionHTML writes a session as a standalone HTML transcript, for
+// reading in a browser without runprompt
+func writeSessionHTML(w io.Writer, name string, entries []sessionMessage, exported time.Time) error {
+	data := struct {
+		Name     string
+		Started  *time.Time
+		Exported time.Time
+		Messages []transcriptMessage
+	}{Name: name, Exported: exported}
+	for _, e := range entries {
+		if data.Started == nil {
+			data.Started = e.Time
+		}
+		data.Messages = append(data.Messages, transcriptMessage{
+			Role:      e.Role,
+			Time:      e.Time,
+			Collapsed: e.Role != "user" && e.Role != "assistant",
+			Segments:  splitCodeBlocks(e.Content),
+		})
+	}
+	return transcriptTemplate.Execute(w, data)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitCodeBlocks(t *testing.T) {
+	got := splitCodeBlocks("Run this:\n\n```sh\ngo test ./...\n```\nThen\n```\nunclosed")
+	expected := []transcriptSegment{
+		{Text: "Run this:"},
+		{Code: true, Language: "sh", Text: "go test ./..."},
+		{Text: "Then"},
+		{Code: true, Text: "unclosed"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestWriteSessionHTML(t *testing.T) {
+	at := time.Date(2025, 3, 1, 9, 30, 0, 0, time.UTC)
+	entries := []sessionMessage{
+		{Message: Message{Role: "system", Content: "Be brief."}},
+		{Message: Message{Role: "user", Content: "What is <b>?"}, Time: &at},
+		{Message: Message{Role: "assistant", Content: "A tag.\n```html\n<b>bold</b>\n```"}, Time: &at},
+	}
+	var b bytes.Buffer
+	if err := writeSessionHTML(&b, "demo", entries, at); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	html := b.String()
+	for _, want := range []string{
+		"<title>demo</title>",
+		"3 messages",
+		"<details>\n<summary class=\"role\">System</summary>",
+		`<time datetime="2025-03-01T09:30:00Z">`,
+		`<div class="text">What is &lt;b&gt;?</div>`,
+		`<pre><code class="language-html">&lt;b&gt;bold&lt;/b&gt;</code></pre>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("Expected %q in:\n%s", want, html)
+		}
+	}
+}
+
+func TestSessionExport(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	before := time.Now().Add(-time.Second)
+	if err := appendSession("demo", []Message{{Role: "user", Content: "Hi"}, {Role: "assistant", Content: "Hello"}}); err != nil {
+		t.Fatal(err)
+	}
+	path, _ := sessionPath("demo")
+	entries, err := readSessionEntries(path)
+	if err != nil || len(entries) != 2 || entries[0].Time == nil || entries[0].Time.Before(before) {
+		t.Fatalf("Expected the messages stamped with the time they were added, got %+v (%v)", entries, err)
+	}
+
+	out := filepath.Join(t.TempDir(), "demo.html")
+	// By name, or by the path to a session file
+	for _, arg := range []string{"demo", path} {
+		if err := run(context.Background(), []string{"session", "export", arg, "--html", "-o", out}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if data, _ := os.ReadFile(out); !strings.Contains(string(data), `<div class="text">Hello</div>`) {
+			t.Errorf("Expected an HTML transcript, got %s", data)
+		}
+	}
+	if err := run(context.Background(), []string{"session", "export", "missing"}); err == nil || err.Error() != "no session missing" {
+		t.Errorf("Expected an error for a missing session, got %v", err)
+	}
+}
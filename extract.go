@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// extractPath returns the value at a jq-style path such as "items[0].name"
+// or ".sentiment". Negative indexes count from the end of an array.
+func extractPath(value interface{}, path string) (interface{}, error) {
+	segments, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	current := value
+	walked := ""
+	for _, seg := range segments {
+		switch s := seg.(type) {
+		case string:
+			obj, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s is %s, not an object", describePath(walked), jsonTypeName(current))
+			}
+			v, ok := obj[s]
+			if !ok {
+				return nil, fmt.Errorf("%s has no field %q", describePath(walked), s)
+			}
+			current = v
+			walked += "." + s
+		case int:
+			arr, ok := current.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s is %s, not an array", describePath(walked), jsonTypeName(current))
+			}
+			i := s
+			if i < 0 {
+				i += len(arr)
+			}
+			if i < 0 || i >= len(arr) {
+				return nil, fmt.Errorf("index %d out of range for %s of length %d", s, describePath(walked), len(arr))
+			}
+			current = arr[i]
+			walked += fmt.Sprintf("[%d]", s)
+		}
+	}
+	return current, nil
+}
+
+// describePath names a walked path in error messages
+func describePath(walked string) string {
+	if walked == "" {
+		return "the response"
+	}
+	return strings.TrimPrefix(walked, ".")
+}
+
+// parsePath splits a path into field names (string) and indexes (int)
+func parsePath(path string) ([]interface{}, error) {
+	var segments []interface{}
+	rest := strings.TrimPrefix(strings.TrimSpace(path), ".")
+	if rest == "" {
+		return nil, nil
+	}
+	for rest != "" {
+		switch {
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("invalid path %q: missing ]", path)
+			}
+			inner := rest[1:end]
+			if unquoted, err := strconv.Unquote(inner); err == nil {
+				segments = append(segments, unquoted)
+			} else if i, err := strconv.Atoi(inner); err == nil {
+				segments = append(segments, i)
+			} else {
+				return nil, fmt.Errorf("invalid path %q: bad index %s", path, inner)
+			}
+			rest = rest[end+1:]
+		case rest[0] == '.':
+			rest = rest[1:]
+			if rest == "" || rest[0] == '.' {
+				return nil, fmt.Errorf("invalid path %q: empty field name", path)
+			}
+		default:
+			end := strings.IndexAny(rest, ".[")
+			if end == -1 {
+				end = len(rest)
+			}
+			segments = append(segments, rest[:end])
+			rest = rest[end:]
+		}
+	}
+	return segments, nil
+}
+
+// formatExtracted prints strings raw and other values as JSON, like jq -r
+func formatExtracted(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	data, _ := json.MarshalIndent(value, "", "  ")
+	return string(data)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestExtractPath(t *testing.T) {
+	var data interface{}
+	json.Unmarshal([]byte(`{"sentiment": "positive", "score": 0.9, "items": [{"name": "a"}, {"name": "b"}], "odd key": {"x": true}}`), &data)
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"sentiment", "positive"},
+		{".sentiment", "positive"},
+		{"score", "0.9"},
+		{"items[0].name", "a"},
+		{"items[-1].name", "b"},
+		{`["odd key"].x`, "true"},
+		{"items[1]", "{\n  \"name\": \"b\"\n}"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			value, err := extractPath(data, tc.path)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := formatExtracted(value); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestExtractPathErrors(t *testing.T) {
+	var data interface{}
+	json.Unmarshal([]byte(`{"items": [{"name": "a"}], "name": "x"}`), &data)
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"missing", `the response has no field "missing"`},
+		{"items[3]", "index 3 out of range for items of length 1"},
+		{"name.first", "name is string, not an object"},
+		{"items.name", "items is array, not an object"},
+		{"items[x]", `invalid path "items[x]": bad index x`},
+		{"items[0", `invalid path "items[0": missing ]`},
+		{"items..name", `invalid path "items..name": empty field name`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			_, err := extractPath(data, tc.path)
+			if err == nil || err.Error() != tc.expected {
+				t.Errorf("Expected %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
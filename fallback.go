@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// normalizeModelList turns a model: list into its first model and
+// fallbackModels, the rest of the list followed by any fallbackModels
+// already set, so the rest of runprompt sees model as a string
+func normalizeModelList(meta map[string]interface{}) error {
+	list, ok := meta["model"].([]interface{})
+	if !ok {
+		return nil
+	}
+	if len(list) == 0 {
+		return fmt.Errorf("model must name at least one model")
+	}
+	first, ok := list[0].(string)
+	if !ok {
+		return fmt.Errorf("model must be a string like openai/gpt-4o or a list of them")
+	}
+	rest := append([]interface{}{}, list[1:]...)
+	if more, ok := meta["fallbackModels"].([]interface{}); ok {
+		rest = append(rest, more...)
+	}
+	meta["model"] = first
+	if len(rest) > 0 {
+		meta["fallbackModels"] = rest
+	}
+	return nil
+}
+
+// fallbackModels reads the models tried in turn when the model fails
+func fallbackModels(meta map[string]interface{}) ([]string, error) {
+	v, ok := meta["fallbackModels"]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("fallbackModels must be a list of models")
+	}
+	models := make([]string, 0, len(list))
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("fallbackModels must be a list of models, got %v", item)
+		}
+		if provider, _ := parseModelString(s); provider == "" {
+			return nil, fmt.Errorf("no provider in fallback model %q", s)
+		}
+		models = append(models, s)
+	}
+	return models, nil
+}
+
+// canFallBack reports whether a run that failed with err may be retried on
+// another model. Not when it was cancelled or stopped by a limit, or when
+// part of a streamed reply has already been written out.
+func canFallBack(ctx context.Context, err error) bool {
+	var limit *limitError
+	var stream *streamInterruptedError
+	switch {
+	case ctx.Err() != nil, errors.As(err, &limit):
+		return false
+	case errors.As(err, &stream):
+		return stream.Received == ""
+	}
+	return true
+}
+
+// completeFallbacks runs a prompt on its model, moving on to each of
+// fallbackModels in turn when it fails. The completion's Fallback names the
+// model that answered if it wasn't the first.
+func completeFallbacks(ctx context.Context, pr promptRun) (completion, error) {
+	fallbacks, err := fallbackModels(pr.meta)
+	if err != nil {
+		return completion{}, err
+	}
+	c, err := completeModel(ctx, pr)
+	current, _ := pr.meta["model"].(string)
+	for _, modelStr := range fallbacks {
+		if err == nil || !canFallBack(ctx, err) {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %s failed, falling back to %s: %v\n", current, modelStr, err)
+		next := pr
+		next.provider, next.model = parseModelString(modelStr)
+		next.meta = make(map[string]interface{}, len(pr.meta))
+		for k, v := range pr.meta {
+			next.meta[k] = v
+		}
+		next.meta["model"] = modelStr
+		if next.provider != pr.provider {
+			// An endpoint for the first model's provider is no use to another
+			delete(next.meta, "baseURL")
+			delete(next.meta, "base_url")
+		}
+		c, err = completeModel(ctx, next)
+		c.Fallback, current = modelStr, modelStr
+	}
+	return c, err
+}
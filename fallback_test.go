@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeModelList(t *testing.T) {
+	meta := map[string]interface{}{
+		"model":          []interface{}{"anthropic/claude-sonnet-4-20250514", "openai/gpt-4o"},
+		"fallbackModels": []interface{}{"ollama/llama3"},
+	}
+	if err := normalizeModelList(meta); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]interface{}{
+		"model":          "anthropic/claude-sonnet-4-20250514",
+		"fallbackModels": []interface{}{"openai/gpt-4o", "ollama/llama3"},
+	}
+	if !reflect.DeepEqual(meta, expected) {
+		t.Errorf("Expected %v, got %v", expected, meta)
+	}
+	if err := normalizeModelList(map[string]interface{}{"model": []interface{}{}}); err == nil {
+		t.Error("Expected an error for an empty list")
+	}
+	if _, err := fallbackModels(map[string]interface{}{"fallbackModels": "openai/gpt-4o"}); err == nil {
+		t.Error("Expected an error for fallbackModels that isn't a list")
+	}
+}
+
+func TestCompleteFallback(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	var models []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		model, _ := body["model"].(string)
+		models = append(models, model)
+		if model != "good" {
+			http.Error(w, "model overloaded", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{
+				"message": map[string]interface{}{"role": "assistant", "content": "Hello"},
+			}},
+		})
+	}))
+	defer server.Close()
+	pr := promptRun{
+		path: "fallback.prompt",
+		meta: map[string]interface{}{
+			"model":          "custom/bad",
+			"baseURL":        server.URL,
+			"fallbackModels": []interface{}{"custom/worse", "custom/good", "custom/unused"},
+		},
+		provider: "custom",
+		model:    "bad",
+		messages: []Message{{Role: "user", Content: "Hi"}},
+	}
+	c, err := complete(context.Background(), pr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.Result != "Hello" || c.Fallback != "custom/good" {
+		t.Errorf("Expected Hello from custom/good, got %q from %q", c.Result, c.Fallback)
+	}
+	if strings.Join(models, " ") != "bad worse good" {
+		t.Errorf("Expected the models tried in order, got %v", models)
+	}
+	if summary := summarize(pr, c); summary.Model != "custom/good" || summary.Provider != "custom" {
+		t.Errorf("Expected the summary to name the fallback, got %s %s", summary.Provider, summary.Model)
+	}
+
+	// Once every model has failed, the last error is returned
+	models = nil
+	pr.meta["fallbackModels"] = []interface{}{"custom/worse"}
+	if _, err := complete(context.Background(), pr); err == nil || !strings.Contains(err.Error(), "model overloaded") {
+		t.Errorf("Expected the last model's error, got %v", err)
+	}
+
+	// A cancelled run isn't retried elsewhere
+	models = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := complete(ctx, pr); err == nil || len(models) != 0 {
+		t.Errorf("Expected no requests once cancelled, got %v after %v", err, models)
+	}
+}
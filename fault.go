@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFaultLatency bounds the delay a latency fault adds to a request
+const maxFaultLatency = 5 * time.Second
+
+// faultRand draws the numbers that decide which fault, if any, a request
+// gets
+var faultRand = mathrand.Float64
+
+// fault is one kind of failure and the probability a request gets it
+type fault struct {
+	kind        string // an HTTP status code, timeout, reset or latency
+	probability float64
+}
+
+// faultInjector simulates provider failures, to check that retry, timeout
+// and budget settings behave as expected before they are relied on
+type faultInjector struct {
+	faults []fault
+}
+
+// parseFaults reads a faultInject: setting, a comma-separated list of
+// kind:probability, such as 429:0.2,timeout:0.1. A kind is an HTTP status
+// code the provider answers with, timeout, where the provider never
+// answers, reset, where the connection drops, or latency, which delays the
+// request by up to maxFaultLatency. Each request gets at most one fault,
+// so the probabilities may add up to at most 1.
+func parseFaults(v interface{}) (*faultInjector, error) {
+	s, ok := v.(string)
+	if !ok || strings.TrimSpace(s) == "" {
+		return nil, fmt.Errorf("faultInject must be a list of kind:probability, such as 429:0.2,timeout:0.1, got %v", v)
+	}
+	f := &faultInjector{}
+	total := 0.0
+	for _, item := range strings.Split(s, ",") {
+		kind, p, ok := strings.Cut(strings.TrimSpace(item), ":")
+		if !ok {
+			return nil, fmt.Errorf("faultInject: %q must be kind:probability", item)
+		}
+		if kind != "timeout" && kind != "reset" && kind != "latency" {
+			if code, err := strconv.Atoi(kind); err != nil || code < 400 || code > 599 {
+				return nil, fmt.Errorf("faultInject: unknown fault %q, expected an HTTP error status, timeout, reset or latency", kind)
+			}
+		}
+		probability, err := strconv.ParseFloat(p, 64)
+		if err != nil || probability < 0 || probability > 1 {
+			return nil, fmt.Errorf("faultInject: probability of %s must be between 0 and 1, got %s", kind, p)
+		}
+		total += probability
+		f.faults = append(f.faults, fault{kind, probability})
+	}
+	if total > 1 {
+		return nil, fmt.Errorf("faultInject: probabilities add up to %g, more than 1", total)
+	}
+	return f, nil
+}
+
+// providerClient returns the client for a run's requests to its provider:
+// runClient's, failing at random as the faultInject setting says
+func providerClient(meta map[string]interface{}) (*http.Client, error) {
+	client, err := runClient(meta)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := meta["faultInject"]; ok {
+		f, err := parseFaults(v)
+		if err != nil {
+			return nil, err
+		}
+		client = f.client(client)
+	}
+	return client, nil
+}
+
+// client returns a client that sends requests through next, injecting
+// faults on the way
+func (f *faultInjector) client(next *http.Client) *http.Client {
+	transport := next.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &http.Client{Transport: &faultTransport{f, transport}, Timeout: next.Timeout}
+}
+
+// pick draws the fault for one request, or "" for none
+func (f *faultInjector) pick() string {
+	r := faultRand()
+	for _, fault := range f.faults {
+		if r < fault.probability {
+			return fault.kind
+		}
+		r -= fault.probability
+	}
+	return ""
+}
+
+type faultTransport struct {
+	injector *faultInjector
+	next     http.RoundTripper
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	kind := t.injector.pick()
+	if kind == "" {
+		return t.next.RoundTrip(req)
+	}
+	fmt.Fprintf(os.Stderr, "Injecting fault: %s\n", kind)
+	if kind == "latency" {
+		timer := time.NewTimer(time.Duration(faultRand() * float64(maxFaultLatency)))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+		case <-timer.C:
+			return t.next.RoundTrip(req)
+		}
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	switch kind {
+	case "latency":
+		return nil, req.Context().Err()
+	case "timeout":
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	case "reset":
+		return nil, errors.New("injected fault: connection reset by peer")
+	}
+	status, _ := strconv.Atoi(kind)
+	header := http.Header{"Content-Type": {"application/json"}}
+	if retryStatus(status) {
+		header.Set("Retry-After", "1")
+	}
+	body := fmt.Sprintf(`{"error":{"message":"injected fault: %d %s"}}`, status, http.StatusText(status))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFaults(t *testing.T) {
+	f, err := parseFaults("429:0.2, timeout:0.1,503:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(f.faults) != 3 || f.faults[0] != (fault{"429", 0.2}) || f.faults[1] != (fault{"timeout", 0.1}) {
+		t.Errorf("Unexpected faults: %v", f.faults)
+	}
+
+	tests := []struct {
+		value    interface{}
+		expected string
+	}{
+		{"", "must be a list"},
+		{true, "must be a list"},
+		{"429", "must be kind:probability"},
+		{"200:0.1", "unknown fault"},
+		{"slow:0.1", "unknown fault"},
+		{"429:1.5", "between 0 and 1"},
+		{"429:0.6,reset:0.6", "more than 1"},
+	}
+	for _, tt := range tests {
+		if _, err := parseFaults(tt.value); err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%v: expected an error containing %q, got %v", tt.value, tt.expected, err)
+		}
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"ok"}}]}`)
+	}))
+	defer server.Close()
+	f, err := parseFaults("429:0.2,500:0.2,reset:0.2,timeout:0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := faultRand
+	defer func() { faultRand = saved }()
+	client := f.client(httpClient)
+	send := func(draw float64) (*Exchange, error) {
+		faultRand = func() float64 { return draw }
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		return makeRequest(ctx, client, server.URL, "", "model", nil, nil, nil, GenerationConfig{}, nil, nil, "custom", nil, Limits{})
+	}
+
+	var rateLimited *retryAfterError
+	if _, err := send(0.1); !errors.As(err, &rateLimited) || rateLimited.Wait != time.Second {
+		t.Errorf("Expected a rate limit with Retry-After, got %v", err)
+	}
+	if _, err := send(0.3); err == nil || err.Error() != "injected fault: 500 Internal Server Error" {
+		t.Errorf("Expected an injected 500, got %v", err)
+	}
+	if _, err := send(0.5); err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Errorf("Expected a reset connection, got %v", err)
+	}
+	if _, err := send(0.7); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if exchange, err := send(0.9); err != nil || exchange.Status != http.StatusOK {
+		t.Errorf("Expected the request to go through, got %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+)
+
+// openOutputFifo opens the --output-fifo destination, where a reply is
+// written as it arrives: a named pipe, which blocks until a reader opens
+// it, a Unix socket, or else a file, created or truncated
+func openOutputFifo(path string) (io.WriteCloser, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		return net.Dial("unix", path)
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// sseWriter passes a streamed reply through to a serve client as
+// server-sent events: a delta event per chunk received, then a done event
+// holding the response or an error event. The event stream begins with
+// the first write, so a request that fails before any output can still be
+// answered with an ordinary error status.
+type sseWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (s *sseWriter) Write(p []byte) (int, error) {
+	if err := s.event("delta", map[string]string{"text": string(p)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// event sends one event, starting the stream if need be
+func (s *sseWriter) event(name string, v interface{}) error {
+	if !s.started {
+		s.w.Header().Set("Content-Type", "text/event-stream")
+		s.w.Header().Set("Cache-Control", "no-cache")
+		s.w.WriteHeader(http.StatusOK)
+		s.started = true
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
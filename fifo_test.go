@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// streamServer is a provider that replies "Hello", streamed in two chunks
+// when asked to stream
+func streamServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if stream, _ := body["stream"].(bool); !stream {
+			fmt.Fprint(w, `{"choices":[{"message":{"content":"Hello"}}]}`)
+			return
+		}
+		for _, chunk := range []string{"Hel", "lo"} {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", chunk)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRunOutputFifo(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("RUNPROMPT_BASE_URL", streamServer(t).URL)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hello.prompt")
+	writeFiles(t, dir, "hello.prompt", "---\nmodel: custom/x\n---\nHi")
+
+	out := filepath.Join(dir, "reply.txt")
+	if err := run(context.Background(), []string{"--output-fifo", out, path}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if data, _ := os.ReadFile(out); string(data) != "Hello\n" {
+		t.Errorf("Expected %q, got %q", "Hello\n", data)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	socketDir, err := os.MkdirTemp("", "rp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(socketDir)
+	listener, err := net.Listen("unix", filepath.Join(socketDir, "s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		data, _ := io.ReadAll(conn)
+		conn.Close()
+		received <- string(data)
+	}()
+	if err := run(context.Background(), []string{"--output-fifo", filepath.Join(socketDir, "s"), path}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := <-received; got != "Hello\n" {
+		t.Errorf("Expected %q over the socket, got %q", "Hello\n", got)
+	}
+}
+
+func TestServeEvents(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("RUNPROMPT_BASE_URL", streamServer(t).URL)
+	dir := t.TempDir()
+	writeFiles(t, dir, "hello.prompt", "---\nmodel: custom/x\n---\nHi")
+	server := httptest.NewServer(newPromptServer(dir))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL+"/prompts/hello", strings.NewReader(""))
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected an event stream, got %q", ct)
+	}
+	expected := "event: delta\ndata: {\"text\":\"Hel\"}\n\n" +
+		"event: delta\ndata: {\"text\":\"lo\"}\n\n" +
+		"event: done\ndata: {\"output\":\"Hello\",\"content\":\"Hello\",\"provider\":\"custom\",\"model\":\"custom/x\"," +
+		"\"requests\":1,\"usage\":{\"inputTokens\":0,\"outputTokens\":0},\"cost\":null,\"latencyMs\":0,\"stream\":{\"firstTokenMs\":0,\"chunks\":2}}\n\n"
+	// Timings vary from run to run
+	body = regexp.MustCompile(`"(latencyMs|firstTokenMs)":\d+`).ReplaceAll(body, []byte(`"$1":0`))
+	if string(body) != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, body)
+	}
+
+	// Without the Accept header the reply is a single JSON response
+	resp, err = http.Post(server.URL+"/prompts/hello", "text/plain", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"output":"Hello"`) {
+		t.Errorf("Expected a JSON response, got %s", body)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// outputFiles reads output.files, a map from output field to file path
+func outputFiles(outputConfig map[string]interface{}) (map[string]string, error) {
+	v, ok := outputConfig["files"]
+	if !ok {
+		return nil, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("output.files must map output fields to file paths")
+	}
+	files := make(map[string]string, len(m))
+	for field, path := range m {
+		s, ok := path.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("output.files.%s must be a file path", field)
+		}
+		files[field] = s
+	}
+	return files, nil
+}
+
+// renderPath renders a file path template. The values put into it, which
+// may come from the model's response, can't move the path out of the
+// directory named by the template's fixed start: {{title}}.md can't
+// become ../../.bashrc, and notes/{{title}}.md stays within notes.
+func renderPath(tmpl string, ctx map[string]interface{}) (string, error) {
+	path := renderTemplate(tmpl, ctx)
+	if path == "" {
+		return "", fmt.Errorf("rendered an empty path")
+	}
+	start := strings.Index(tmpl, "{{")
+	if start == -1 {
+		return path, nil
+	}
+	base := filepath.Dir(filepath.FromSlash(tmpl[:start] + "x"))
+	rel, err := filepath.Rel(base, filepath.Clean(filepath.FromSlash(path)))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("rendered %s, which is outside %s", path, base)
+	}
+	return path, nil
+}
+
+// writeOutputFiles writes fields of a structured response to files. Paths
+// are templates rendered with the input variables and the response fields.
+// String fields are written as is and other values as JSON. Existing files
+// are only replaced when force is set, and nothing is written if any target
+// exists. It returns the paths written.
+func writeOutputFiles(files map[string]string, result string, variables map[string]interface{}, force bool) ([]string, error) {
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(result), &data); err != nil {
+		return nil, fmt.Errorf("output.files needs a JSON object response: %v", err)
+	}
+	ctx := make(map[string]interface{}, len(variables)+len(data))
+	for k, v := range variables {
+		ctx[k] = v
+	}
+	for k, v := range data {
+		ctx[k] = v
+	}
+
+	fields := make([]string, 0, len(files))
+	for field := range files {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	type target struct {
+		path    string
+		content []byte
+	}
+	var targets []target
+	for _, field := range fields {
+		value, ok := data[field]
+		if !ok || value == nil {
+			log(fmt.Sprintf("No %s in response, skipping %s", field, files[field]))
+			continue
+		}
+		path, err := renderPath(files[field], ctx)
+		if err != nil {
+			return nil, fmt.Errorf("output.files.%s %v", field, err)
+		}
+		content, ok := value.(string)
+		if !ok {
+			encoded, _ := json.MarshalIndent(value, "", "  ")
+			content = string(encoded) + "\n"
+		}
+		if _, err := os.Stat(path); err == nil && !force {
+			return nil, fmt.Errorf("%s already exists (use --force to overwrite)", path)
+		}
+		targets = append(targets, target{path, []byte(content)})
+	}
+
+	var written []string
+	for _, t := range targets {
+		if dir := filepath.Dir(t.path); dir != "." {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return written, err
+			}
+		}
+		if err := os.WriteFile(t.path, t.content, 0644); err != nil {
+			return written, err
+		}
+		written = append(written, t.path)
+	}
+	return written, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteOutputFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"readme":    filepath.Join(dir, "README.md"),
+		"changelog": filepath.Join(dir, "docs", "{{version}}", "CHANGELOG.md"),
+		"meta":      filepath.Join(dir, "{{name}}.json"),
+		"notes":     filepath.Join(dir, "NOTES.md"),
+	}
+	result := `{"readme": "# Hi\n", "changelog": "- fix", "name": "pkg", "meta": {"a": 1}}`
+	vars := map[string]interface{}{"version": "1.2"}
+
+	written, err := writeOutputFiles(files, result, vars, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(written) != 3 {
+		t.Errorf("Expected 3 files written, got %v", written)
+	}
+	expected := map[string]string{
+		filepath.Join(dir, "README.md"):                   "# Hi\n",
+		filepath.Join(dir, "docs", "1.2", "CHANGELOG.md"): "- fix",
+		filepath.Join(dir, "pkg.json"):                    "{\n  \"a\": 1\n}\n",
+	}
+	for path, content := range expected {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("Expected %s to be written: %v", path, err)
+		} else if string(data) != content {
+			t.Errorf("%s: Expected %q, got %q", path, content, string(data))
+		}
+	}
+
+	if _, err := writeOutputFiles(files, `{"readme": "new", "changelog": "new"}`, vars, false); err == nil {
+		t.Error("Expected error for existing file without force")
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "docs", "1.2", "CHANGELOG.md")); string(data) != "- fix" {
+		t.Error("Expected no files to be written when one exists")
+	}
+	if _, err := writeOutputFiles(files, `{"readme": "new"}`, vars, true); err != nil {
+		t.Fatalf("Unexpected error with force: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "README.md")); string(data) != "new" {
+		t.Errorf("Expected README.md overwritten, got %q", string(data))
+	}
+
+	if _, err := writeOutputFiles(files, "plain text", vars, false); err == nil {
+		t.Error("Expected error for non-JSON response")
+	}
+
+	// A response field can't move a file out of its directory
+	files = map[string]string{"meta": filepath.Join(dir, "out", "{{name}}.json")}
+	if _, err := writeOutputFiles(files, `{"name": "../../escaped", "meta": "x"}`, vars, false); err == nil {
+		t.Error("Expected error for a path outside the directory")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "..", "escaped.json")); err == nil {
+		t.Error("Expected nothing to be written outside the directory")
+	}
+}
+
+func TestRenderPath(t *testing.T) {
+	ctx := map[string]interface{}{"title": "Q3", "up": "../../.bashrc", "abs": "/etc/passwd", "sub": "a/b"}
+	tests := []struct {
+		tmpl     string
+		expected string // "" for an error
+	}{
+		{"{{title}}.md", "Q3.md"},
+		{"notes/{{sub}}.md", "notes/a/b.md"},
+		{"../shared/{{title}}.md", "../shared/Q3.md"},
+		{"/tmp/out.md", "/tmp/out.md"},
+		{"{{up}}", ""},
+		{"notes/{{up}}.md", ""},
+		{"{{abs}}", ""},
+		{"{{missing}}", ""},
+	}
+	for _, tt := range tests {
+		got, err := renderPath(tt.tmpl, ctx)
+		if tt.expected == "" && err == nil {
+			t.Errorf("%s: expected an error, got %q", tt.tmpl, got)
+		}
+		if tt.expected != "" && (err != nil || got != tt.expected) {
+			t.Errorf("%s: expected %q, got %q (%v)", tt.tmpl, tt.expected, got, err)
+		}
+	}
+}
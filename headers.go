@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+)
+
+// userAgent identifies runprompt to providers and registries
+func userAgent() string {
+	return "runprompt/" + version
+}
+
+// headerNameRe matches a valid HTTP header name
+var headerNameRe = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// requestHeaders returns the extra headers for a request to provider. A
+// providerHeaders: block, usually set in a config file, gives defaults for
+// each provider, such as OpenRouter's attribution headers:
+//
+//	providerHeaders:
+//	  openrouter:
+//	    HTTP-Referer: https://example.com
+//	    X-Title: Example
+//
+// and a prompt's headers: block is applied on top of them.
+func requestHeaders(meta map[string]interface{}, provider string) (map[string]string, error) {
+	headers := map[string]string{}
+	if v, ok := meta["providerHeaders"]; ok {
+		byProvider, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("providerHeaders must map provider names to headers")
+		}
+		for name, v := range byProvider {
+			defaults := map[string]string{}
+			if err := addHeaders(defaults, v, "providerHeaders."+name); err != nil {
+				return nil, err
+			}
+			if name == provider {
+				headers = defaults
+			}
+		}
+	}
+	if err := addHeaders(headers, meta["headers"], "headers"); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// addHeaders copies a mapping of header names to values into headers
+func addHeaders(headers map[string]string, v interface{}, key string) error {
+	if v == nil {
+		return nil
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s must map header names to values", key)
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !headerNameRe.MatchString(name) {
+			return fmt.Errorf("%s: invalid header name %q", key, name)
+		}
+		headers[http.CanonicalHeaderKey(name)] = fmt.Sprint(fields[name])
+	}
+	return nil
+}
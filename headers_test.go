@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRequestHeaders(t *testing.T) {
+	meta := map[string]interface{}{
+		"providerHeaders": map[string]interface{}{
+			"openrouter": map[string]interface{}{"http-referer": "https://example.com", "X-Title": "Example"},
+			"openai":     map[string]interface{}{"X-Team": "search"},
+		},
+		"headers": map[string]interface{}{"X-Title": "Summarizer", "X-Retry": 2},
+	}
+	got, err := requestHeaders(meta, "openrouter")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]string{"Http-Referer": "https://example.com", "X-Title": "Summarizer", "X-Retry": "2"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	for _, meta := range []map[string]interface{}{
+		{"headers": "X-Title: a"},
+		{"headers": map[string]interface{}{"Bad Name": "x"}},
+		{"providerHeaders": []interface{}{"openrouter"}},
+		{"providerHeaders": map[string]interface{}{"openai": map[string]interface{}{"X:Y": "x"}}},
+	} {
+		if _, err := requestHeaders(meta, "openrouter"); err == nil {
+			t.Errorf("Expected error for %v", meta)
+		}
+	}
+}
+
+func TestMakeRequestHeaders(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte(`{"choices":[{"message":{"content":"ok"}}]}`))
+	}))
+	defer server.Close()
+
+	saved := providers["custom"]
+	defer func() { providers["custom"] = saved }()
+	p := saved
+	p.Headers = map[string]string{"X-Title": "provider", "X-Source": "provider"}
+	providers["custom"] = p
+
+	extra := map[string]string{"X-Title": "prompt", "Content-Type": "text/plain"}
+	if _, err := makeRequest(context.Background(), httpClient, server.URL, "", "model", nil, nil, nil, GenerationConfig{}, nil, extra, "custom", nil, Limits{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ua := got.Get("User-Agent"); !strings.HasPrefix(ua, "runprompt/") {
+		t.Errorf("Expected a runprompt User-Agent, got %q", ua)
+	}
+	if got.Get("X-Title") != "prompt" || got.Get("X-Source") != "provider" {
+		t.Errorf("Expected prompt headers over provider headers, got %v", got)
+	}
+	if ct := got.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected the request's own Content-Type to win, got %q", ct)
+	}
+}
+
+func TestLintHeaders(t *testing.T) {
+	problems := lintSource(t, "---\nmodel: test\nheaders:\n  X Title: a\n---\nHi\n")
+	expected := `3:1: headers: invalid header name "X Title"`
+	if len(problems) != 1 || problems[0] != expected {
+		t.Errorf("Expected %q, got %q", expected, problems)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// HelperFunc implements a template helper, called as {{name arg...}}.
+// Arguments that are quoted strings or numbers arrive as string and
+// float64 literals; any other argument is a variable, resolved against the
+// context like {{name}}, and is nil if it resolves to nothing. The helper
+// returns the text to render in place of the tag.
+type HelperFunc func(args []interface{}) (string, error)
+
+var (
+	helpersMu sync.RWMutex
+	helpers   = map[string]HelperFunc{
+		"json":      jsonHelper,
+		"upper":     stringHelper(strings.ToUpper),
+		"lower":     stringHelper(strings.ToLower),
+		"trim":      stringHelper(strings.TrimSpace),
+		"truncate":  truncateHelper,
+		"uuid":      uuidHelper,
+		"sha256":    sha256Helper,
+		"randomInt": randomIntHelper,
+	}
+)
+
+// bareHelpers are also called without arguments, as {{uuid}}, unless a
+// variable of the same name is set
+var bareHelpers = map[string]bool{"uuid": true}
+
+// RegisterHelper makes fn available to templates as {{name arg...}},
+// replacing any helper of the same name. Templates compiled before the
+// helper is registered treat its tags as variables, so register helpers
+// before loading prompts. A registered helper is only called with
+// arguments: {{name}} alone is always a variable.
+func RegisterHelper(name string, fn HelperFunc) {
+	helpersMu.Lock()
+	defer helpersMu.Unlock()
+	helpers[name] = fn
+}
+
+// lookupHelper returns the helper registered under name
+func lookupHelper(name string) (HelperFunc, bool) {
+	helpersMu.RLock()
+	defer helpersMu.RUnlock()
+	fn, ok := helpers[name]
+	return fn, ok
+}
+
+// helperArgs splits a helper's arguments at whitespace, keeping quoted
+// strings together with their quotes. Strings have no escapes; a string
+// holding " is quoted with ' instead.
+func helperArgs(s string) ([]string, error) {
+	var args []string
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			return args, nil
+		}
+		end := strings.IndexFunc(s, unicode.IsSpace)
+		if q := s[0]; q == '"' || q == '\'' {
+			close := strings.IndexByte(s[1:], q)
+			if close == -1 {
+				return nil, fmt.Errorf("unterminated string %s", s)
+			}
+			end = close + 2
+		}
+		if end == -1 {
+			end = len(s)
+		}
+		args = append(args, s[:end])
+		s = s[end:]
+	}
+}
+
+// helperLiteral returns the value of a quoted string or number argument,
+// and false for an argument that names a variable
+func helperLiteral(arg string) (interface{}, bool) {
+	if len(arg) >= 2 && (arg[0] == '"' || arg[0] == '\'') && arg[len(arg)-1] == arg[0] {
+		return arg[1 : len(arg)-1], true
+	}
+	if f, err := strconv.ParseFloat(arg, 64); err == nil {
+		return f, true
+	}
+	return nil, false
+}
+
+// helperString formats a helper argument the way {{name}} renders it
+func helperString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// stringHelper makes a one-argument helper from a string function
+func stringHelper(fn func(string) string) HelperFunc {
+	return func(args []interface{}) (string, error) {
+		if len(args) != 1 {
+			return "", fmt.Errorf("takes 1 argument, got %d", len(args))
+		}
+		return fn(helperString(args[0])), nil
+	}
+}
+
+// jsonHelper renders a value as compact JSON, so objects and lists can be
+// embedded in a prompt
+func jsonHelper(args []interface{}) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("takes 1 argument, got %d", len(args))
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(args[0]); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// truncateHelper cuts a value to at most a number of characters
+func truncateHelper(args []interface{}) (string, error) {
+	if len(args) != 2 {
+		return "", fmt.Errorf("takes a value and a length, got %d arguments", len(args))
+	}
+	n, ok := toFloat(args[1])
+	if !ok || n < 0 || n != float64(int(n)) {
+		return "", fmt.Errorf("length must be a non-negative integer, got %v", args[1])
+	}
+	runes := []rune(helperString(args[0]))
+	if len(runes) > int(n) {
+		runes = runes[:int(n)]
+	}
+	return string(runes), nil
+}
+
+// uuidHelper renders a random version 4 UUID, for identifying a run
+func uuidHelper(args []interface{}) (string, error) {
+	if len(args) != 0 {
+		return "", fmt.Errorf("takes no arguments, got %d", len(args))
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
+
+// sha256Helper renders the hex SHA-256 digest of a value, as {{name}}
+// renders it, for fingerprinting content
+func sha256Helper(args []interface{}) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("takes 1 argument, got %d", len(args))
+	}
+	sum := sha256.Sum256([]byte(helperString(args[0])))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// randomIntHelper renders a random integer between two bounds, inclusive
+func randomIntHelper(args []interface{}) (string, error) {
+	if len(args) != 2 {
+		return "", fmt.Errorf("takes a minimum and a maximum, got %d arguments", len(args))
+	}
+	var bounds [2]int
+	for i, arg := range args {
+		n, ok := toFloat(arg)
+		if !ok || n != float64(int(n)) {
+			return "", fmt.Errorf("bounds must be integers, got %v", arg)
+		}
+		bounds[i] = int(n)
+	}
+	if bounds[0] > bounds[1] {
+		return "", fmt.Errorf("minimum %d is over maximum %d", bounds[0], bounds[1])
+	}
+	return strconv.Itoa(bounds[0] + mathrand.Intn(bounds[1]-bounds[0]+1)), nil
+}
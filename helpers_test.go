@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestTemplateHelpers(t *testing.T) {
+	vars := map[string]interface{}{
+		"name":  "  Ann Lee ",
+		"user":  map[string]interface{}{"name": "Ann", "tags": []interface{}{"a", "<b>"}},
+		"text":  "Grüße aus Köln",
+		"items": []interface{}{"one", "two"},
+	}
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"upper", "{{upper user.name}}", "ANN"},
+		{"lower", "{{lower 'MiXeD'}}", "mixed"},
+		{"trim", "[{{trim name}}]", "[Ann Lee]"},
+		{"json", "{{json user}}", `{"name":"Ann","tags":["a","<b>"]}`},
+		{"json string", `{{json 'say "hi"'}}`, `"say \"hi\""`},
+		{"truncate", "{{truncate text 5}}", "Grüße"},
+		{"truncate short", "{{truncate user.name 10}}", "Ann"},
+		{"sha256", "{{sha256 'abc'}}", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"sha256 variable", "{{sha256 user.name}}", "17239b6e250110330eda64a29c610bf146f89883371fab093feda03bec61b646"},
+		{"randomInt single value", "{{randomInt 7 7}}", "7"},
+		{"quoted spaces", `{{upper "a b"}}`, "A B"},
+		{"missing variable", "[{{upper missing}}]", "[]"},
+		{"in each", "{{#each items}}{{upper .}} {{/each}}", "ONE TWO "},
+		{"helper name alone is a variable", "{{upper}}", ""},
+		{"unknown helper", "{{shout name}}", ""},
+		{"unterminated string", `{{upper "abc}}`, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := renderTemplate(tc.template, vars); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestTemplateHelperErrors(t *testing.T) {
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{upper a b}}", `template:1:1: helper "upper": takes 1 argument, got 2`},
+		{"x\n {{truncate a}}", `template:2:2: helper "truncate": takes a value and a length, got 1 arguments`},
+		{"{{truncate a -1}}", `helper "truncate": length must be a non-negative integer, got -1`},
+		{"{{randomInt 5 1}}", `helper "randomInt": minimum 5 is over maximum 1`},
+		{"{{randomInt 1 2.5}}", `helper "randomInt": bounds must be integers, got 2.5`},
+		{"{{uuid a}}", `helper "uuid": takes no arguments, got 1`},
+	}
+	for _, tc := range tests {
+		_, err := compileTemplate(tc.template).render(map[string]interface{}{"a": "x"}, renderOptions{})
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%q: expected error containing %q, got %v", tc.template, tc.expected, err)
+		}
+	}
+
+	_, err := compileTemplate("{{upper nmae}}").RenderStrict(map[string]interface{}{"name": "Ann"})
+	if err == nil || !strings.Contains(err.Error(), `undefined variable "nmae"`) {
+		t.Errorf("Expected strict mode to report the undefined argument, got %v", err)
+	}
+}
+
+func TestRegisterHelper(t *testing.T) {
+	RegisterHelper("repeat", func(args []interface{}) (string, error) {
+		n, ok := toFloat(args[len(args)-1])
+		if len(args) != 2 || !ok {
+			return "", fmt.Errorf("takes a value and a count")
+		}
+		return strings.Repeat(helperString(args[0]), int(n)), nil
+	})
+	defer func() {
+		helpersMu.Lock()
+		delete(helpers, "repeat")
+		helpersMu.Unlock()
+	}()
+
+	got := renderTemplate("{{repeat word 3}}", map[string]interface{}{"word": "ab"})
+	if got != "ababab" {
+		t.Errorf("Expected %q, got %q", "ababab", got)
+	}
+}
+
+func TestRandomHelpers(t *testing.T) {
+	uuidRe := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	first := renderTemplate("{{uuid}}", nil)
+	if !uuidRe.MatchString(first) {
+		t.Errorf("Expected a version 4 UUID, got %q", first)
+	}
+	if second := renderTemplate("{{uuid}}", nil); second == first {
+		t.Errorf("Expected a new UUID each render, got %q twice", first)
+	}
+	if got := renderTemplate("{{uuid}}", map[string]interface{}{"uuid": "run-1"}); got != "run-1" {
+		t.Errorf("Expected a uuid variable to win, got %q", got)
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 200; i++ {
+		got := renderTemplate("{{randomInt -1 1}}", nil)
+		if got != "-1" && got != "0" && got != "1" {
+			t.Fatalf("Expected a value from -1 to 1, got %q", got)
+		}
+		seen[got] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected every value from -1 to 1, got %v", seen)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// HistoryRecord is one run in the local history store
+type HistoryRecord struct {
+	Time         time.Time `json:"time"`
+	Prompt       string    `json:"prompt"`
+	Provider     string    `json:"provider"`
+	Model        string    `json:"model"`
+	Variant      string    `json:"variant,omitempty"`
+	Requests     int       `json:"requests"`
+	InputTokens  int       `json:"inputTokens"`
+	OutputTokens int       `json:"outputTokens"`
+	// Cost is in USD, or nil when the model's price is unknown
+	Cost *float64 `json:"cost,omitempty"`
+	// ModelVersion and Fingerprint are what the provider reported serving
+	// the run, to detect model updates behind an unchanged name
+	ModelVersion string `json:"modelVersion,omitempty"`
+	Fingerprint  string `json:"fingerprint,omitempty"`
+	// Job is the queue job the run belongs to, if any
+	Job string `json:"job,omitempty"`
+	// Stream times the final reply when it was streamed
+	Stream *streamStats `json:"stream,omitempty"`
+}
+
+// historyPath returns the history store, one JSON record per line
+func historyPath() string {
+	return filepath.Join(dataDir(), "history.jsonl")
+}
+
+// historyEnabled reports whether runs should be recorded; history: false in
+// frontmatter or a config file turns recording off
+func historyEnabled(meta map[string]interface{}) bool {
+	v, ok := meta["history"].(bool)
+	return !ok || v
+}
+
+// appendHistory adds a record to the history store, locking it so lines
+// from concurrent runs are never interleaved
+func appendHistory(path string, rec HistoryRecord) error {
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	data, _ := json.Marshal(rec)
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// recordRun appends a run to the history store unless meta turns history
+// off, first warning if the model version serving it has changed. job is
+// the queue job being run, or "", and stream the timings of a streamed
+// reply, or nil. Failing to record is reported but does
+// not fail the run.
+func recordRun(meta map[string]interface{}, path, provider, model, variant, job string, requests int, usage Usage, served modelVersion, stream *streamStats) {
+	if !historyEnabled(meta) {
+		return
+	}
+	prompt, err := filepath.Abs(path)
+	if err != nil {
+		prompt = path
+	}
+	rec := HistoryRecord{
+		Time:         time.Now().UTC(),
+		Prompt:       prompt,
+		Provider:     provider,
+		Model:        model,
+		Variant:      variant,
+		Requests:     requests,
+		InputTokens:  usage.InputTokens,
+		OutputTokens: usage.OutputTokens,
+		Cost:         usageCost(model, usage),
+		ModelVersion: served.Model,
+		Fingerprint:  served.Fingerprint,
+		Job:          job,
+		Stream:       stream,
+	}
+	checkModelDrift(meta, rec)
+	if err := appendHistory(historyPath(), rec); err != nil {
+		fmt.Fprintf(os.Stderr, "Recording history: %v\n", err)
+	}
+}
+
+// readHistory returns the records at or after since. Unparseable lines,
+// such as one cut short by a crash, are skipped.
+func readHistory(path string, since time.Time) ([]HistoryRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []HistoryRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec HistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if !rec.Time.Before(since) {
+			records = append(records, rec)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// parseSince parses a --since value: a duration such as 7d, 2w or 12h, or a
+// date in YYYY-MM-DD form
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, now.Location()); err == nil {
+		return t, nil
+	}
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if n, err := strconv.Atoi(strings.TrimSuffix(s, suffix)); err == nil && strings.HasSuffix(s, suffix) {
+			return now.Add(-time.Duration(n) * unit), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --since %q: use a duration like 7d or 12h, or a date like 2024-01-31", s)
+	}
+	return now.Add(-d), nil
+}
+
+// spendRow aggregates usage for one group in a spend report
+type spendRow struct {
+	key          string
+	runs         int
+	inputTokens  int
+	outputTokens int
+	cost         float64
+	unpriced     int
+}
+
+// writeSpendReport prints usage and cost grouped by model, prompt or day
+func writeSpendReport(w io.Writer, records []HistoryRecord, by string) error {
+	keyFor := map[string]func(HistoryRecord) string{
+		"model":  func(r HistoryRecord) string { return r.Provider + "/" + r.Model },
+		"prompt": func(r HistoryRecord) string { return r.Prompt },
+		"day":    func(r HistoryRecord) string { return r.Time.Local().Format("2006-01-02") },
+	}[by]
+	if keyFor == nil {
+		return fmt.Errorf("invalid --by %q: use model, prompt or day", by)
+	}
+
+	rows := map[string]*spendRow{}
+	total := &spendRow{key: "TOTAL"}
+	for _, rec := range records {
+		key := keyFor(rec)
+		row, ok := rows[key]
+		if !ok {
+			row = &spendRow{key: key}
+			rows[key] = row
+		}
+		for _, r := range []*spendRow{row, total} {
+			r.runs++
+			r.inputTokens += rec.InputTokens
+			r.outputTokens += rec.OutputTokens
+			if rec.Cost != nil {
+				r.cost += *rec.Cost
+			} else {
+				r.unpriced++
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(rows))
+	for key := range rows {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\tRUNS\tINPUT\tOUTPUT\tCOST\t\n", strings.ToUpper(by))
+	for _, key := range keys {
+		writeSpendRow(tw, rows[key])
+	}
+	writeSpendRow(tw, total)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if total.unpriced > 0 {
+		fmt.Fprintf(w, "\n* %d run(s) used models without a known price, not included in COST; add prices to %s\n",
+			total.unpriced, filepath.Join(configDir(), "pricing.yaml"))
+	}
+	return nil
+}
+
+func writeSpendRow(w io.Writer, r *spendRow) {
+	cost := fmt.Sprintf("$%.4f", r.cost)
+	if r.unpriced > 0 {
+		cost += "*"
+	}
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t\n", r.key, r.runs, r.inputTokens, r.outputTokens, cost)
+}
+
+// runSpend prints the spend report for runs since a --since value, grouped
+// by model unless by is set
+func runSpend(since, by string) error {
+	start := time.Time{}
+	if since != "" {
+		t, err := parseSince(since, time.Now())
+		if err != nil {
+			return err
+		}
+		start = t
+	}
+	if by == "" {
+		by = "model"
+	}
+	records, err := readHistory(historyPath(), start)
+	if err != nil {
+		return fmt.Errorf("reading history: %v", err)
+	}
+	if len(records) == 0 {
+		fmt.Println("No runs recorded.")
+		return nil
+	}
+	return writeSpendReport(os.Stdout, records, by)
+}
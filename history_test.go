@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runprompt", "history.jsonl")
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	cost := 0.01
+	for _, rec := range []HistoryRecord{
+		{Time: now.Add(-72 * time.Hour), Model: "old"},
+		{Time: now, Model: "gpt-4o", Cost: &cost},
+	} {
+		if err := appendHistory(path, rec); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(`{"time":"2024-05-10T`)
+	f.Close()
+
+	records, err := readHistory(path, now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(records) != 1 || records[0].Model != "gpt-4o" || *records[0].Cost != cost {
+		t.Errorf("Expected the recent gpt-4o run, got %+v", records)
+	}
+
+	records, err = readHistory(filepath.Join(t.TempDir(), "missing.jsonl"), time.Time{})
+	if err != nil || records != nil {
+		t.Errorf("Expected no records for missing file, got %v %v", records, err)
+	}
+}
+
+func TestHistoryEnabled(t *testing.T) {
+	if !historyEnabled(map[string]interface{}{}) {
+		t.Error("Expected history on by default")
+	}
+	if historyEnabled(map[string]interface{}{"history": false}) {
+		t.Error("Expected history: false to turn history off")
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		input    string
+		expected time.Time
+	}{
+		{"7d", now.Add(-7 * 24 * time.Hour)},
+		{"2w", now.Add(-14 * 24 * time.Hour)},
+		{"12h", now.Add(-12 * time.Hour)},
+		{"2024-05-01", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseSince(tt.input, now)
+		if err != nil {
+			t.Errorf("parseSince(%q): unexpected error: %v", tt.input, err)
+		} else if !got.Equal(tt.expected) {
+			t.Errorf("parseSince(%q): expected %v, got %v", tt.input, tt.expected, got)
+		}
+	}
+	if _, err := parseSince("last week", now); err == nil {
+		t.Error("Expected error for invalid --since")
+	}
+}
+
+func TestWriteSpendReport(t *testing.T) {
+	a, b := 0.25, 0.5
+	day := time.Date(2024, 5, 10, 12, 0, 0, 0, time.Local)
+	records := []HistoryRecord{
+		{Time: day, Prompt: "a.prompt", Provider: "openai", Model: "gpt-4o", InputTokens: 100, OutputTokens: 10, Cost: &a},
+		{Time: day, Prompt: "b.prompt", Provider: "openai", Model: "gpt-4o", InputTokens: 200, OutputTokens: 20, Cost: &b},
+		{Time: day.Add(24 * time.Hour), Prompt: "a.prompt", Provider: "ollama", Model: "llama3", InputTokens: 50, OutputTokens: 5},
+	}
+
+	var out strings.Builder
+	if err := writeSpendReport(&out, records, "model"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	report := out.String()
+	for _, want := range []string{"openai/gpt-4o", "$0.7500", "ollama/llama3", "$0.0000*", "1 run(s) used models without a known price"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Expected report to contain %q, got:\n%s", want, report)
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(report), "\n")
+	if total := strings.Fields(lines[3]); len(total) != 5 || total[0] != "TOTAL" || total[1] != "3" || total[2] != "350" {
+		t.Errorf("Expected TOTAL row with 3 runs and 350 input tokens, got %q", lines[3])
+	}
+
+	out.Reset()
+	if err := writeSpendReport(&out, records, "day"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), "2024-05-10") || !strings.Contains(out.String(), "2024-05-11") {
+		t.Errorf("Expected a row per day, got:\n%s", out.String())
+	}
+
+	if err := writeSpendReport(&out, records, "week"); err == nil {
+		t.Error("Expected error for invalid --by")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// importFormats convert exported conversations from other tools into
+// messages, returning the model used if the export records it
+var importFormats = map[string]func(data []byte, conversation string) ([]Message, string, error){
+	"openai-playground": parsePlaygroundExport,
+	"chatgpt":           parseChatGPTExport,
+}
+
+// importCommand implements runprompt import: an exported conversation
+// becomes a session (--session), a prompt file with the conversation as
+// few-shot examples (--prompt), or that prompt printed to stdout
+func importCommand(ctx context.Context, args []string) error {
+	flags, positional, err := parseFlags("import", args, map[string]bool{
+		"from": true, "session": true, "prompt": true, "conversation": true, "force": false,
+	})
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || flags["from"] == "" {
+		return commandUsage("import")
+	}
+	parse, ok := importFormats[flags["from"]]
+	if !ok {
+		return fmt.Errorf("unknown format %q for --from (use chatgpt or openai-playground)", flags["from"])
+	}
+	if flags["session"] != "" && flags["prompt"] != "" {
+		return fmt.Errorf("use one of --session or --prompt")
+	}
+	_, force := flags["force"]
+
+	data, err := os.ReadFile(positional[0])
+	if err != nil {
+		return err
+	}
+	messages, model, err := parse(data, flags["conversation"])
+	if err != nil {
+		return fmt.Errorf("%s: %v", positional[0], err)
+	}
+	if len(messages) == 0 {
+		return fmt.Errorf("%s: no messages to import", positional[0])
+	}
+
+	if name := flags["session"]; name != "" {
+		if err := writeSession(name, messages, force); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Imported %d messages into session %s\n", len(messages), name)
+		return nil
+	}
+
+	for i, m := range messages {
+		if strings.Contains(m.Content, "{{") || roleMarkerRe.MatchString(m.Content) {
+			fmt.Fprintf(os.Stderr, "Warning: message %d contains template syntax that will be interpreted when the prompt runs\n", i+1)
+		}
+	}
+	prompt := conversationPrompt(messages, model)
+	path := flags["prompt"]
+	if path == "" {
+		fmt.Print(prompt)
+		return nil
+	}
+	if _, err := os.Stat(path); err == nil && !force {
+		return fmt.Errorf("%s already exists (use --force to overwrite)", path)
+	}
+	if err := os.WriteFile(path, []byte(prompt), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+	return nil
+}
+
+// conversationPrompt writes a prompt file that replays messages as few-shot
+// examples and sends stdin as the next user message. A final unanswered
+// user message is dropped, since stdin takes its place.
+func conversationPrompt(messages []Message, model string) string {
+	if last := len(messages) - 1; messages[last].Role == "user" {
+		messages = messages[:last]
+	}
+	var b strings.Builder
+	if model != "" {
+		fmt.Fprintf(&b, "---\nmodel: %s\n---\n", model)
+	}
+	for _, m := range messages {
+		fmt.Fprintf(&b, "{{role %q}}\n%s\n\n", m.Role, strings.TrimSpace(m.Content))
+	}
+	b.WriteString("{{role \"user\"}}\n{{STDIN}}\n")
+	return b.String()
+}
+
+// parsePlaygroundExport reads an OpenAI Playground export, or any chat
+// completions request body: {"model": ..., "messages": [...]}. A bare
+// array of messages is accepted too.
+func parsePlaygroundExport(data []byte, conversation string) ([]Message, string, error) {
+	var export struct {
+		Model    string            `json:"model"`
+		Messages []json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(data, &export.Messages); err != nil {
+		if err := json.Unmarshal(data, &export); err != nil {
+			return nil, "", fmt.Errorf("not a playground export: %v", err)
+		}
+	}
+
+	var messages []Message
+	for _, raw := range export.Messages {
+		var m struct {
+			Role    string          `json:"role"`
+			Content json.RawMessage `json:"content"`
+		}
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return nil, "", err
+		}
+		role := normalizeRole(m.Role)
+		if role == "developer" {
+			role = "system"
+		}
+		if role != "system" && role != "user" && role != "assistant" {
+			log(fmt.Sprintf("Skipping %s message", m.Role))
+			continue
+		}
+		if text := playgroundText(m.Content); text != "" {
+			messages = append(messages, Message{Role: role, Content: text})
+		}
+	}
+	model := ""
+	if export.Model != "" {
+		model = "openai/" + export.Model
+	}
+	return messages, model, nil
+}
+
+// playgroundText returns message content given as a string or as a list of
+// content parts, keeping only the text parts
+func playgroundText(content json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return text
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	json.Unmarshal(content, &parts)
+	var texts []string
+	for _, p := range parts {
+		if p.Text != "" {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// chatGPTConversation is one conversation in a ChatGPT data export's
+// conversations.json. Messages form a tree; current_node is the last
+// message of the branch shown in the app.
+type chatGPTConversation struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	CurrentNode string `json:"current_node"`
+	Model       string `json:"default_model_slug"`
+	Mapping     map[string]struct {
+		Parent  string `json:"parent"`
+		Message *struct {
+			Author struct {
+				Role string `json:"role"`
+			} `json:"author"`
+			Content struct {
+				ContentType string        `json:"content_type"`
+				Parts       []interface{} `json:"parts"`
+			} `json:"content"`
+			Metadata struct {
+				Hidden bool `json:"is_visually_hidden_from_conversation"`
+			} `json:"metadata"`
+		} `json:"message"`
+	} `json:"mapping"`
+}
+
+// parseChatGPTExport reads conversations.json from a ChatGPT data export,
+// or a single conversation from it. With several conversations, one must be
+// chosen by id or title.
+func parseChatGPTExport(data []byte, conversation string) ([]Message, string, error) {
+	var conversations []chatGPTConversation
+	if err := json.Unmarshal(data, &conversations); err != nil {
+		var single chatGPTConversation
+		if err := json.Unmarshal(data, &single); err != nil || single.Mapping == nil {
+			return nil, "", fmt.Errorf("not a ChatGPT export")
+		}
+		conversations = []chatGPTConversation{single}
+	}
+
+	var chosen *chatGPTConversation
+	for i := range conversations {
+		c := &conversations[i]
+		if (conversation == "" && len(conversations) == 1) || (conversation != "" && (c.ID == conversation || c.Title == conversation)) {
+			chosen = c
+			break
+		}
+	}
+	if chosen == nil {
+		titles := make([]string, 0, len(conversations))
+		for _, c := range conversations {
+			titles = append(titles, fmt.Sprintf("%q", c.Title))
+		}
+		if conversation == "" {
+			return nil, "", fmt.Errorf("the export has %d conversations; choose one with --conversation <title or id>: %s",
+				len(conversations), strings.Join(titles, ", "))
+		}
+		return nil, "", fmt.Errorf("no conversation %q (available: %s)", conversation, strings.Join(titles, ", "))
+	}
+
+	// Walk from the current message back to the root
+	var messages []Message
+	seen := map[string]bool{}
+	for id := chosen.CurrentNode; id != "" && !seen[id]; id = chosen.Mapping[id].Parent {
+		seen[id] = true
+		m := chosen.Mapping[id].Message
+		if m == nil || m.Metadata.Hidden || m.Content.ContentType != "text" {
+			continue
+		}
+		role := m.Author.Role
+		if role != "system" && role != "user" && role != "assistant" {
+			continue
+		}
+		var texts []string
+		for _, part := range m.Content.Parts {
+			if s, ok := part.(string); ok && s != "" {
+				texts = append(texts, s)
+			}
+		}
+		if len(texts) > 0 {
+			messages = append(messages, Message{Role: role, Content: strings.Join(texts, "\n")})
+		}
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	model := ""
+	if chosen.Model != "" && chosen.Model != "auto" {
+		model = "openai/" + chosen.Model
+	}
+	return messages, model, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const playgroundExport = `{
+  "model": "gpt-4o",
+  "messages": [
+    {"role": "developer", "content": "You translate to French."},
+    {"role": "user", "content": [{"type": "input_text", "text": "Hello"}]},
+    {"role": "assistant", "content": "Bonjour"},
+    {"role": "tool", "content": "ignored"},
+    {"role": "user", "content": "Goodbye"}
+  ]
+}`
+
+const chatGPTExport = `[{
+  "id": "c1",
+  "title": "French lesson",
+  "current_node": "n4",
+  "default_model_slug": "gpt-4o",
+  "mapping": {
+    "root": {"parent": "", "message": null},
+    "n1": {"parent": "root", "message": {"author": {"role": "system"}, "content": {"content_type": "text", "parts": [""]}, "metadata": {"is_visually_hidden_from_conversation": true}}},
+    "n2": {"parent": "n1", "message": {"author": {"role": "user"}, "content": {"content_type": "text", "parts": ["Hello"]}}},
+    "n3": {"parent": "n2", "message": {"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["Bonjour"]}}},
+    "n3b": {"parent": "n2", "message": {"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["Salut"]}}},
+    "n4": {"parent": "n3", "message": {"author": {"role": "user"}, "content": {"content_type": "text", "parts": ["Goodbye", {"asset": "image"}]}}}
+  }
+}, {"id": "c2", "title": "Other", "current_node": "", "mapping": {}}]`
+
+func TestParsePlaygroundExport(t *testing.T) {
+	messages, model, err := parsePlaygroundExport([]byte(playgroundExport), "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []Message{
+		{Role: "system", Content: "You translate to French."},
+		{Role: "user", Content: "Hello"},
+		{Role: "assistant", Content: "Bonjour"},
+		{Role: "user", Content: "Goodbye"},
+	}
+	if model != "openai/gpt-4o" || len(messages) != len(expected) {
+		t.Fatalf("Expected %v with openai/gpt-4o, got %v with %q", expected, messages, model)
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(messages[i], expected[i]) {
+			t.Errorf("Message %d: expected %v, got %v", i, expected[i], messages[i])
+		}
+	}
+
+	messages, _, err = parsePlaygroundExport([]byte(`[{"role": "user", "content": "Hi"}]`), "")
+	if err != nil || len(messages) != 1 {
+		t.Errorf("Expected a bare message array to be accepted, got %v, %v", messages, err)
+	}
+}
+
+func TestParseChatGPTExport(t *testing.T) {
+	messages, model, err := parseChatGPTExport([]byte(chatGPTExport), "French lesson")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if model != "openai/gpt-4o" {
+		t.Errorf("Expected openai/gpt-4o, got %q", model)
+	}
+	var got []string
+	for _, m := range messages {
+		got = append(got, m.Role+":"+m.Content)
+	}
+	expected := "user:Hello,assistant:Bonjour,user:Goodbye"
+	if strings.Join(got, ",") != expected {
+		t.Errorf("Expected %s, got %s", expected, strings.Join(got, ","))
+	}
+
+	if _, _, err := parseChatGPTExport([]byte(chatGPTExport), ""); err == nil || !strings.Contains(err.Error(), "2 conversations") {
+		t.Errorf("Expected an error asking to choose a conversation, got %v", err)
+	}
+	if _, _, err := parseChatGPTExport([]byte(chatGPTExport), "Missing"); err == nil {
+		t.Error("Expected an error for an unknown conversation")
+	}
+	if _, _, err := parseChatGPTExport([]byte(`{"messages": []}`), ""); err == nil {
+		t.Error("Expected an error for a non-ChatGPT file")
+	}
+}
+
+func TestConversationPrompt(t *testing.T) {
+	messages := []Message{
+		{Role: "system", Content: "You translate to French."},
+		{Role: "user", Content: "Hello"},
+		{Role: "assistant", Content: "Bonjour"},
+		{Role: "user", Content: "Goodbye"},
+	}
+	prompt := conversationPrompt(messages, "openai/gpt-4o")
+	expected := `---
+model: openai/gpt-4o
+---
+{{role "system"}}
+You translate to French.
+
+{{role "user"}}
+Hello
+
+{{role "assistant"}}
+Bonjour
+
+{{role "user"}}
+{{STDIN}}
+`
+	if prompt != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, prompt)
+	}
+
+	_, template, err := parsePromptSource("imported.prompt", "", []byte(prompt))
+	if err != nil {
+		t.Fatalf("Generated prompt does not parse: %v", err)
+	}
+	rendered := renderMessages(template, map[string]interface{}{"STDIN": "Thanks"})
+	if len(rendered) != 4 || rendered[3].Content != "Thanks" {
+		t.Errorf("Expected stdin as the last message, got %v", rendered)
+	}
+}
+
+func TestImportCommandSession(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	export := filepath.Join(t.TempDir(), "export.json")
+	os.WriteFile(export, []byte(playgroundExport), 0644)
+
+	args := []string{"--from", "openai-playground", "--session", "french", export}
+	if err := importCommand(context.Background(), args); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	messages, err := loadSession("french")
+	if err != nil || len(messages) != 4 {
+		t.Errorf("Expected 4 imported messages, got %v, %v", messages, err)
+	}
+	if err := importCommand(context.Background(), args); err == nil {
+		t.Error("Expected an error replacing a session without --force")
+	}
+	if err := importCommand(context.Background(), append([]string{"--force"}, args...)); err != nil {
+		t.Errorf("Unexpected error with --force: %v", err)
+	}
+	if err := importCommand(context.Background(), []string{"--from", "bard", export}); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// includeTagRe matches an {{include "other.prompt"}} tag
+var includeTagRe = regexp.MustCompile(`\{\{\s*include\s+"([^"]*)"\s*\}\}`)
+
+// maxIncludeDepth bounds how deeply prompts may include or import others
+const maxIncludeDepth = 10
+
+// importSkipKeys are frontmatter keys that identify a prompt file, so they
+// are not taken from the prompts it extends or imports
+var importSkipKeys = []string{"name", "version", "imports", "extends"}
+
+// includePrompts composes a prompt from others. Each {{include "file"}}
+// tag is replaced by that prompt's template. The prompt named by extends:
+// is its parent: the parent's frontmatter is inherited, each key
+// overridable, and its template is used if the prompt has none. The
+// prompts listed in imports: are placed before the template with their
+// frontmatter merged over the parent's and beneath the prompt's own. Files
+// are relative to the prompt and may select a named prompt as
+// file.prompt#name. stack holds the prompts being parsed, to catch cycles.
+func includePrompts(meta map[string]interface{}, template, filePath string, firstLine int, stack []string, sources *sourceSet) (map[string]interface{}, string, []error) {
+	dir := filepath.Dir(filePath)
+	var errs []error
+	if strings.Contains(template, "include") {
+		var b strings.Builder
+		pos := 0
+		for _, loc := range includeTagRe.FindAllStringSubmatchIndex(template, -1) {
+			b.WriteString(template[pos:loc[0]])
+			pos = loc[1]
+			_, included, err, parseErr := parseIncluded(template[loc[2]:loc[3]], dir, stack, sources)
+			if err != nil {
+				errs = append(errs, locateErrors([]*sourceError{newSourceError(template, loc[0], "%v", err)}, filePath, firstLine)...)
+				continue
+			}
+			if parseErr != nil {
+				errs = append(errs, unjoin(parseErr)...)
+				continue
+			}
+			b.WriteString(included)
+		}
+		b.WriteString(template[pos:])
+		template = b.String()
+	}
+
+	base := map[string]interface{}{}
+	if v, ok := meta["extends"]; ok {
+		ref, _ := v.(string)
+		if ref == "" {
+			return meta, template, append(errs, fmt.Errorf("%s: extends must be a prompt file, got %v", filePath, v))
+		}
+		parent, parentTemplate, err, parseErr := parseIncluded(ref, dir, stack, sources)
+		if err != nil {
+			return meta, template, append(errs, fmt.Errorf("%s: extends: %v", filePath, err))
+		}
+		if parseErr != nil {
+			return meta, template, append(errs, unjoin(parseErr)...)
+		}
+		for _, key := range importSkipKeys {
+			delete(parent, key)
+		}
+		base = parent
+		if strings.TrimSpace(template) == "" {
+			template = parentTemplate
+		}
+	}
+
+	imports, err := importList(meta["imports"])
+	if err != nil {
+		return meta, template, append(errs, fmt.Errorf("%s: %v", filePath, err))
+	}
+	var parts []string
+	for _, ref := range imports {
+		imported, importedTemplate, err, parseErr := parseIncluded(ref, dir, stack, sources)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: imports: %v", filePath, err))
+			continue
+		}
+		if parseErr != nil {
+			errs = append(errs, unjoin(parseErr)...)
+			continue
+		}
+		for _, key := range importSkipKeys {
+			delete(imported, key)
+		}
+		mergeMaps(base, imported)
+		if roleMarkerRe.MatchString(importedTemplate) {
+			// Return to the user role, so the importing template doesn't
+			// continue the imported prompt's last message
+			importedTemplate += "\n<<<user>>>"
+		}
+		parts = append(parts, importedTemplate)
+	}
+	if len(base) == 0 && len(parts) == 0 {
+		return meta, template, errs
+	}
+	return mergeMaps(base, meta), strings.Join(append(parts, template), "\n"), errs
+}
+
+// includeKey identifies a prompt in an include stack
+func includeKey(file, name string) string {
+	key, _ := filepath.Abs(file)
+	if name != "" {
+		key += "#" + name
+	}
+	return key
+}
+
+// importList reads imports:, one file or a list of them
+func importList(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok || s == "" {
+				return nil, fmt.Errorf("imports must list prompt files, got %v", item)
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("imports must list prompt files, got %v", v)
+}
+
+// parseIncluded parses a prompt named by an include or import, relative to
+// dir, returning its frontmatter and template. A file that can't be
+// included is reported as err; problems inside it, already located in that
+// file, as parseErr.
+func parseIncluded(ref, dir string, stack []string, sources *sourceSet) (meta map[string]interface{}, template string, err, parseErr error) {
+	if ref == "" {
+		return nil, "", fmt.Errorf("include has no file"), nil
+	}
+	path := ref
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, filepath.FromSlash(ref))
+	}
+	file, name := splitPromptName(path)
+	if containsString(stack, includeKey(file, name)) {
+		return nil, "", fmt.Errorf("include cycle through %s", ref), nil
+	}
+	if len(stack) >= maxIncludeDepth {
+		return nil, "", fmt.Errorf("includes nested more than %d deep", maxIncludeDepth), nil
+	}
+	content, err := sources.read(file)
+	if os.IsNotExist(err) {
+		return nil, "", fmt.Errorf("included prompt %s not found", ref), nil
+	}
+	if err != nil {
+		return nil, "", err, nil
+	}
+	meta, template, parseErr = parsePromptStack(file, name, content, stack, sources)
+	return meta, template, nil, parseErr
+}
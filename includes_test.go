@@ -0,0 +1,119 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIncludes(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir,
+		"shared/style.prompt", "---\nmodel: openai/gpt-4o\n---\nWrite plainly{{#if audience}} for {{audience}}{{/if}}.",
+		"shared/many.prompt", "--- name: short ---\nOne line.\n--- name: long ---\nA page.",
+		"ask.prompt", "---\nmodel: test\n---\nSummarize {{text}}.\n{{include \"shared/style.prompt\"}} {{ include \"shared/many.prompt#short\" }}",
+	)
+	meta, template, err := parsePromptFile(filepath.Join(dir, "ask.prompt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta["model"] != "test" {
+		t.Errorf("Expected includes to leave the frontmatter alone, got model %v", meta["model"])
+	}
+	got := renderTemplate(template, map[string]interface{}{"text": "this", "audience": "kids"})
+	if expected := "Summarize this.\nWrite plainly for kids. One line."; got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestImports(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir,
+		"base.prompt", "---\nname: base\nmodel: openai/gpt-4o\nconfig:\n  temperature: 0.2\n  seed: 1\n---\n{{role \"system\"}}\nYou are terse.",
+		"tone.prompt", "---\nconfig:\n  seed: 2\n---\nBe kind.",
+		"ask.prompt", "---\nimports:\n  - base.prompt\n  - tone.prompt\nconfig:\n  temperature: 0.7\n---\nHi {{name}}",
+	)
+	meta, template, err := parsePromptFile(filepath.Join(dir, "ask.prompt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"temperature": 0.7, "seed": 2}
+	if meta["model"] != "openai/gpt-4o" || !reflect.DeepEqual(meta["config"], expected) {
+		t.Errorf("Expected merged frontmatter, got %v", meta)
+	}
+	if _, ok := meta["name"]; ok {
+		t.Errorf("Expected name not to be imported, got %v", meta["name"])
+	}
+	messages := renderCompiledMessages(compileMessages(template), map[string]interface{}{"name": "Ann"})
+	expectedMessages := []Message{{Role: "system", Content: "You are terse."}, {Role: "user", Content: "Be kind.\nHi Ann"}}
+	if !reflect.DeepEqual(messages, expectedMessages) {
+		t.Errorf("Expected %v, got %v", expectedMessages, messages)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir,
+		"missing.prompt", "Hi\n{{include \"nope.prompt\"}}",
+		"a.prompt", "A {{include \"b.prompt\"}}",
+		"b.prompt", "B\n{{include \"a.prompt\"}}",
+		"broken.prompt", "---\nimports: broken-base.prompt\n---\nHi",
+		"broken-base.prompt", "{{#if x}}open",
+		"badlist.prompt", "---\nimports: [1]\n---\nHi",
+	)
+	tests := []struct {
+		file     string
+		expected string
+	}{
+		{"missing.prompt", "missing.prompt:2:1: included prompt nope.prompt not found"},
+		{"a.prompt", "b.prompt:2:1: include cycle through a.prompt"},
+		{"broken.prompt", "broken-base.prompt:1:1: unclosed section {{#if x}}"},
+		{"badlist.prompt", "imports must list prompt files"},
+	}
+	for _, tc := range tests {
+		_, _, err := parsePromptFile(filepath.Join(dir, tc.file))
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.file, tc.expected, err)
+		}
+	}
+}
+
+func TestExtends(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir,
+		"_root.prompt", "---\nmodel: openai/gpt-4o\nconfig:\n  temperature: 0.2\n---\nDefault template",
+		"_base.prompt", "---\nextends: _root.prompt\nname: base\nconfig:\n  maxOutputTokens: 100\noutput:\n  schema:\n    title: string\n---\n",
+		"team/summarize.prompt", "---\nextends: ../_base.prompt\nconfig:\n  temperature: 0.5\n---\nSummarize {{text}}",
+		"team/empty.prompt", "---\nextends: ../_base.prompt\n---\n",
+	)
+	meta, template, err := parsePromptFile(filepath.Join(dir, "team", "summarize.prompt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"temperature": 0.5, "maxOutputTokens": 100}
+	if meta["model"] != "openai/gpt-4o" || !reflect.DeepEqual(meta["config"], expected) || meta["output"] == nil {
+		t.Errorf("Expected inherited frontmatter, got %v", meta)
+	}
+	if _, ok := meta["name"]; ok || template != "Summarize {{text}}" {
+		t.Errorf("Expected the child's own template and no name, got %q and %v", template, meta["name"])
+	}
+
+	_, template, err = parsePromptFile(filepath.Join(dir, "team", "empty.prompt"))
+	if err != nil || template != "Default template" {
+		t.Errorf("Expected the inherited template, got %q (%v)", template, err)
+	}
+
+	writeFiles(t, dir,
+		"loop.prompt", "---\nextends: loop.prompt\n---\nHi",
+		"bad.prompt", "---\nextends: [a, b]\n---\nHi",
+	)
+	for file, expected := range map[string]string{
+		"loop.prompt": "extends: include cycle through loop.prompt",
+		"bad.prompt":  "extends must be a prompt file",
+	} {
+		if _, _, err := parsePromptFile(filepath.Join(dir, file)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected error containing %q, got %v", file, expected, err)
+		}
+	}
+}
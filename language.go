@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// languageNames are the languages output.language can require, by ISO 639-1
+// code, named as the corrective prompt names them
+var languageNames = map[string]string{
+	"en": "English", "de": "German", "fr": "French", "es": "Spanish", "it": "Italian",
+	"pt": "Portuguese", "nl": "Dutch", "sv": "Swedish", "pl": "Polish", "cs": "Czech",
+	"tr": "Turkish", "fi": "Finnish", "ru": "Russian", "uk": "Ukrainian", "el": "Greek",
+	"ar": "Arabic", "fa": "Persian", "he": "Hebrew", "hi": "Hindi", "th": "Thai",
+	"zh": "Chinese", "ja": "Japanese", "ko": "Korean",
+}
+
+// stopwords are frequent words that set apart the languages written in
+// Latin script. Words common to several of them are left out.
+var stopwords = map[string][]string{
+	"en": {"the", "and", "is", "are", "of", "to", "that", "it", "with", "for", "was", "this", "you", "not", "have", "be", "which", "they", "we", "there", "would", "what", "from", "by", "will"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ein", "eine", "zu", "den", "mit", "sich", "auch", "auf", "für", "von", "dem", "wir", "ich", "sie", "werden", "wird", "sind", "bei", "nach", "oder", "aber", "noch", "kann", "wie"},
+	"fr": {"le", "les", "et", "est", "une", "des", "du", "qui", "dans", "pour", "pas", "sur", "avec", "ce", "elle", "nous", "vous", "sont", "mais", "au", "aux", "cette", "être", "très", "ils"},
+	"es": {"el", "los", "las", "y", "es", "una", "del", "por", "para", "como", "más", "pero", "está", "son", "muy", "también", "esta", "este", "hay", "sus", "al", "lo"},
+	"it": {"il", "gli", "è", "di", "che", "non", "per", "sono", "della", "dello", "nel", "nella", "alla", "anche", "più", "questo", "questa", "ma", "ci", "hanno", "essere"},
+	"pt": {"os", "é", "do", "da", "dos", "das", "não", "um", "em", "mais", "na", "ao", "isso", "também", "são", "você", "muito", "pelo", "pela", "uma", "o"},
+	"nl": {"het", "een", "van", "dat", "niet", "op", "te", "zijn", "voor", "met", "ook", "maar", "aan", "bij", "wordt", "hij", "naar", "zij", "wij", "ik", "er"},
+	"sv": {"och", "att", "det", "är", "som", "på", "för", "med", "av", "inte", "jag", "till", "har", "ett", "men", "kan", "vi", "också", "om"},
+	"pl": {"się", "nie", "jest", "że", "jak", "ale", "są", "oraz", "być", "przez", "może", "już", "tego", "który", "która", "w", "z", "na"},
+	"cs": {"je", "ve", "jako", "jsou", "není", "které", "který", "také", "jsem", "už", "což", "byl", "bylo", "se", "v", "pro"},
+	"tr": {"ve", "bir", "bu", "için", "ile", "çok", "olarak", "daha", "gibi", "ama", "değil", "var", "yok", "olan", "kadar", "sonra", "şey"},
+	"fi": {"ja", "ei", "että", "oli", "hän", "mutta", "kun", "ovat", "myös", "niin", "tai", "joka", "mitä", "kuin", "ole", "tämä", "vain"},
+}
+
+// stopwordLanguages maps each stopword to the languages it belongs to
+var stopwordLanguages = func() map[string][]string {
+	m := map[string][]string{}
+	for lang, words := range stopwords {
+		for _, w := range words {
+			m[w] = append(m[w], lang)
+		}
+	}
+	return m
+}()
+
+// minLanguageEvidence is how many stopwords a text must contain before its
+// language is judged
+const minLanguageEvidence = 3
+
+// outputLanguage reads output.language, the language the response must be
+// written in, or "" if any will do
+func outputLanguage(outputConfig map[string]interface{}) (string, error) {
+	v, ok := outputConfig["language"]
+	if !ok {
+		return "", nil
+	}
+	code, _ := v.(string)
+	code = strings.ToLower(code)
+	if _, ok := languageNames[code]; !ok {
+		codes := make([]string, 0, len(languageNames))
+		for c := range languageNames {
+			codes = append(codes, c)
+		}
+		sort.Strings(codes)
+		return "", fmt.Errorf("output.language must be one of %s, got %v", strings.Join(codes, ", "), v)
+	}
+	return code, nil
+}
+
+// languageText returns the prose of a response for language detection: the
+// string values of a JSON response, or else the text itself
+func languageText(text string) string {
+	var data interface{}
+	if err := json.Unmarshal([]byte(text), &data); err != nil {
+		return text
+	}
+	var b strings.Builder
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case string:
+			b.WriteString(v)
+			b.WriteString("\n")
+		case []interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		case map[string]interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+	walk(data)
+	return b.String()
+}
+
+// detectLanguage guesses the language text is written in, reporting false
+// when there is too little to go on. Languages with their own script are
+// told by it; those written in Latin script by their commonest words.
+func detectLanguage(text string) (string, bool) {
+	counts := map[*unicode.RangeTable]int{}
+	scripts := []*unicode.RangeTable{
+		unicode.Latin, unicode.Cyrillic, unicode.Greek, unicode.Arabic, unicode.Hebrew,
+		unicode.Devanagari, unicode.Thai, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul,
+	}
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for _, script := range scripts {
+			if unicode.Is(script, r) {
+				counts[script]++
+				break
+			}
+		}
+	}
+	if letters == 0 {
+		return "", false
+	}
+	kana := counts[unicode.Hiragana] + counts[unicode.Katakana]
+	switch {
+	case counts[unicode.Latin]*2 > letters:
+		return detectLatinLanguage(text)
+	case kana > 0 && (kana+counts[unicode.Han])*2 > letters:
+		return "ja", true
+	case counts[unicode.Hangul]*2 > letters:
+		return "ko", true
+	case counts[unicode.Han]*2 > letters:
+		return "zh", true
+	case counts[unicode.Cyrillic]*2 > letters:
+		if strings.ContainsAny(text, "іїєґІЇЄҐ") {
+			return "uk", true
+		}
+		return "ru", true
+	case counts[unicode.Greek]*2 > letters:
+		return "el", true
+	case counts[unicode.Arabic]*2 > letters:
+		if strings.ContainsAny(text, "پچژگ") {
+			return "fa", true
+		}
+		return "ar", true
+	case counts[unicode.Hebrew]*2 > letters:
+		return "he", true
+	case counts[unicode.Devanagari]*2 > letters:
+		return "hi", true
+	case counts[unicode.Thai]*2 > letters:
+		return "th", true
+	}
+	return "", false
+}
+
+// detectLatinLanguage scores text against each language's stopwords. The
+// best must have enough evidence and clearly beat the runner-up.
+func detectLatinLanguage(text string) (string, bool) {
+	scores := map[string]int{}
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	for _, w := range words {
+		for _, lang := range stopwordLanguages[w] {
+			scores[lang]++
+		}
+	}
+	best, first, second := "", 0, 0
+	for lang, score := range scores {
+		switch {
+		case score > first || (score == first && lang < best):
+			best, first, second = lang, score, max(first, second)
+		case score > second:
+			second = score
+		}
+	}
+	if first < minLanguageEvidence || first*2 < second*3 {
+		return "", false
+	}
+	return best, true
+}
+
+// languagePrompt asks the model to answer again in the required language
+func languagePrompt(want, got string) string {
+	return fmt.Sprintf("Your answer is in %s. Answer in %s.", languageNames[got], languageNames[want])
+}
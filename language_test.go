@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"The report shows that sales were up, and we expect this to continue.", "en"},
+		{"Der Bericht zeigt, dass die Umsätze gestiegen sind, und wir erwarten, dass es so weitergeht.", "de"},
+		{"Le rapport montre que les ventes sont en hausse et nous pensons que cette tendance va durer.", "fr"},
+		{"El informe muestra que las ventas están subiendo y esperamos que esta tendencia siga por mucho tiempo.", "es"},
+		{"Il rapporto mostra che le vendite sono in crescita e che questa tendenza continuerà anche nel futuro.", "it"},
+		{"O relatório mostra que as vendas estão em alta e isso não deve mudar, você também acha?", "pt"},
+		{"Het rapport laat zien dat de verkoop is gestegen en we verwachten dat dit zo blijft voor een tijd.", "nl"},
+		{"Rapporten visar att försäljningen har ökat och vi tror att det kommer att fortsätta.", "sv"},
+		{"Raport pokazuje, że sprzedaż rośnie i nie jest to już zaskoczenie, ale może się zmienić.", "pl"},
+		{"Отчёт показывает, что продажи растут.", "ru"},
+		{"Звіт показує, що продажі зростають і це триває.", "uk"},
+		{"報告書によると、売上は伸びています。", "ja"},
+		{"报告显示销售额正在增长。", "zh"},
+		{"보고서에 따르면 매출이 증가하고 있습니다.", "ko"},
+		{"Η έκθεση δείχνει ότι οι πωλήσεις αυξάνονται.", "el"},
+		{"Sales up.", ""},
+		{"42 + 17 = 59", ""},
+	}
+	for _, tt := range tests {
+		got, _ := detectLanguage(tt.text)
+		if got != tt.expected {
+			t.Errorf("detectLanguage(%q): expected %q, got %q", tt.text, tt.expected, got)
+		}
+	}
+}
+
+func TestLanguageText(t *testing.T) {
+	got := languageText(`{"title": "Der Bericht", "count": 3, "tags": ["und", "die"]}`)
+	for _, s := range []string{"Der Bericht", "und", "die"} {
+		if !strings.Contains(got, s) {
+			t.Errorf("Expected %q in %q", s, got)
+		}
+	}
+	if strings.Contains(got, "title") || strings.Contains(got, "3") {
+		t.Errorf("Expected only string values, got %q", got)
+	}
+}
+
+func TestOutputLanguage(t *testing.T) {
+	if got, err := outputLanguage(map[string]interface{}{"language": "DE"}); err != nil || got != "de" {
+		t.Errorf("Expected de, got %q (%v)", got, err)
+	}
+	if _, err := outputLanguage(map[string]interface{}{"language": "german"}); err == nil || !strings.Contains(err.Error(), "must be one of") {
+		t.Errorf("Expected an error for an unknown language, got %v", err)
+	}
+}
+
+func TestCompleteLanguage(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	english := "The report shows that sales were up, and we expect this to continue."
+	german := "Der Bericht zeigt, dass die Umsätze gestiegen sind, und wir erwarten mehr."
+	for _, tt := range []struct {
+		replies  []string
+		expected string
+		requests int
+	}{
+		{[]string{german}, german, 1},
+		{[]string{english, german}, german, 2},
+		// After one corrective request the answer is kept as it is
+		{[]string{english, english}, english, 2},
+	} {
+		var requests []map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			requests = append(requests, body)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"choices": []interface{}{map[string]interface{}{
+					"message": map[string]interface{}{"role": "assistant", "content": tt.replies[len(requests)-1]},
+				}},
+			})
+		}))
+		c, err := complete(context.Background(), promptRun{
+			path: "language.prompt",
+			meta: map[string]interface{}{
+				"baseURL": server.URL,
+				"output":  map[string]interface{}{"language": "de"},
+			},
+			provider: "custom",
+			model:    "x",
+			messages: []Message{{Role: "user", Content: "Summarize the report."}},
+		})
+		server.Close()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if c.Result != tt.expected || len(requests) != tt.requests {
+			t.Errorf("Expected %q after %d requests, got %q after %d", tt.expected, tt.requests, c.Result, len(requests))
+		}
+		if len(requests) > 1 {
+			messages := requests[1]["messages"].([]interface{})
+			last := messages[len(messages)-1].(map[string]interface{})
+			if last["content"] != "Your answer is in English. Answer in German." {
+				t.Errorf("Expected the corrective prompt, got %v", last["content"])
+			}
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits bound a run that makes more than one model call, such as one that
+// re-prompts the model to repair its output. They are set in a limits:
+// block:
+//
+//	limits:
+//	  callTimeout: 30s     # each model call; defaults to timeout
+//	  totalTimeout: 2m     # the whole run
+//	  maxTokens: 20000     # input plus output tokens across all calls
+//	  maxRequestBytes: 8MB # the body posted to the provider
+//	  maxResponseBytes: 1MB
+//	  rateLimitRetries: 3  # calls retried after a Retry-After
+//	  maxRetryWait: 1m     # the longest Retry-After waited for
+//	  maxInputTokens: 8000 # the estimated input of each call
+//	  maxCost: 0.50        # the estimated cost of the run, in USD
+//	  maxToolRounds: 10    # rounds of tool calls answered, 10 by default
+//	  toolTimeout: 1m      # each tool command or MCP call
+//
+// The size, retry and cost limits also apply to single calls, so a prompt
+// interpolating a huge file, or a provider sending a runaway response, fails
+// with a clear error instead of being posted or buffered. Zero means no
+// limit, except for rateLimitRetries, where it turns retrying off.
+type Limits struct {
+	CallTimeout      time.Duration
+	TotalTimeout     time.Duration
+	MaxTokens        int
+	MaxRequestBytes  int64
+	MaxResponseBytes int64
+	RateLimitRetries int
+	MaxRetryWait     time.Duration
+	MaxInputTokens   int
+	MaxCost          float64
+	MaxToolRounds    int
+	ToolTimeout      time.Duration
+}
+
+// Default size limits, far above any normal request or response
+const (
+	defaultMaxRequestBytes  = 32 << 20
+	defaultMaxResponseBytes = 16 << 20
+)
+
+// Termination states reported when a limit stops a run
+const (
+	stopCallTimeout  = "call_timeout"
+	stopTotalTimeout = "total_timeout"
+	stopTokenBudget  = "token_budget"
+	stopRequestSize  = "request_too_large"
+	stopResponseSize = "response_too_large"
+	stopInputTokens  = "input_too_large"
+	stopCostLimit    = "cost_limit"
+	stopBudget       = "budget"
+	stopToolRounds   = "tool_rounds"
+	stopToolTimeout  = "tool_timeout"
+)
+
+// limitFlags are the command line options that set a limit, mapped to the
+// setting in the limits: block
+var limitFlags = map[string]string{
+	"max-cost":         "maxCost",
+	"max-input-tokens": "maxInputTokens",
+}
+
+// limitError reports which limit stopped a run. State is one of the stop*
+// constants so callers can tell the limits apart.
+type limitError struct {
+	State  string
+	Detail string
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("stopped (%s): %s", e.State, e.Detail)
+}
+
+// runLimits reads the limits: block. Without callTimeout, each call gets
+// the timeout setting.
+func runLimits(meta map[string]interface{}) (Limits, error) {
+	limits := Limits{
+		CallTimeout:      defaultTimeout,
+		MaxRequestBytes:  defaultMaxRequestBytes,
+		MaxResponseBytes: defaultMaxResponseBytes,
+		RateLimitRetries: defaultRateLimitRetries,
+		MaxRetryWait:     defaultMaxRetryWait,
+		MaxToolRounds:    defaultMaxToolRounds,
+	}
+	if v, ok := meta["timeout"]; ok {
+		d, err := parseTimeout(v)
+		if err != nil {
+			return limits, err
+		}
+		limits.CallTimeout = d
+	}
+	block, ok := meta["limits"]
+	if !ok {
+		return limits, nil
+	}
+	fields, ok := block.(map[string]interface{})
+	if !ok {
+		return limits, fmt.Errorf("limits must be a mapping")
+	}
+	for key, v := range fields {
+		var err error
+		switch key {
+		case "callTimeout":
+			limits.CallTimeout, err = parseTimeout(v)
+		case "totalTimeout":
+			limits.TotalTimeout, err = parseTimeout(v)
+		case "maxTokens":
+			n, ok := v.(int)
+			if !ok || n <= 0 {
+				err = fmt.Errorf("must be a positive integer, got %v", v)
+			}
+			limits.MaxTokens = n
+		case "maxRequestBytes":
+			limits.MaxRequestBytes, err = parseSize(v)
+		case "maxResponseBytes":
+			limits.MaxResponseBytes, err = parseSize(v)
+		case "rateLimitRetries":
+			n, ok := v.(int)
+			if !ok || n < 0 {
+				err = fmt.Errorf("must be a non-negative integer, got %v", v)
+			}
+			limits.RateLimitRetries = n
+		case "maxRetryWait":
+			limits.MaxRetryWait, err = parseTimeout(v)
+			if err == nil && limits.MaxRetryWait < 0 {
+				err = fmt.Errorf("must not be negative, got %v", v)
+			}
+		case "maxInputTokens":
+			n, ok := v.(int)
+			if !ok || n <= 0 {
+				err = fmt.Errorf("must be a positive integer, got %v", v)
+			}
+			limits.MaxInputTokens = n
+		case "maxCost":
+			f, ok := toFloat(v)
+			if !ok || f <= 0 {
+				err = fmt.Errorf("must be a positive amount in USD, got %v", v)
+			}
+			limits.MaxCost = f
+		case "maxToolRounds":
+			n, ok := v.(int)
+			if !ok || n <= 0 {
+				err = fmt.Errorf("must be a positive integer, got %v", v)
+			}
+			limits.MaxToolRounds = n
+		case "toolTimeout":
+			limits.ToolTimeout, err = parseTimeout(v)
+		default:
+			return limits, fmt.Errorf("unknown setting limits.%s", key)
+		}
+		if err != nil {
+			return limits, fmt.Errorf("limits.%s: %v", key, err)
+		}
+	}
+	return limits, nil
+}
+
+// timeoutError labels a model call that failed because callCtx or total, the
+// context for the whole run, ran out of time. Other errors are returned as is.
+func (l Limits) timeoutError(err error, callCtx, total context.Context) error {
+	if !errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	if l.TotalTimeout > 0 && errors.Is(total.Err(), context.DeadlineExceeded) {
+		return &limitError{State: stopTotalTimeout, Detail: fmt.Sprintf("run exceeded %v", l.TotalTimeout)}
+	}
+	return &limitError{State: stopCallTimeout, Detail: fmt.Sprintf("model call exceeded %v", l.CallTimeout)}
+}
+
+// checkRequestSize reports a request body over the size limit
+func (l Limits) checkRequestSize(body []byte) error {
+	if l.MaxRequestBytes > 0 && int64(len(body)) > l.MaxRequestBytes {
+		return &limitError{State: stopRequestSize, Detail: fmt.Sprintf(
+			"request body is %s, over the %s limit set by limits.maxRequestBytes", formatSize(int64(len(body))), formatSize(l.MaxRequestBytes))}
+	}
+	return nil
+}
+
+// responseReader limits how much of a response body is read, failing once
+// it passes the size limit
+func (l Limits) responseReader(r io.Reader) io.Reader {
+	if l.MaxResponseBytes <= 0 {
+		return r
+	}
+	return &sizeLimitedReader{r: r, limit: l.MaxResponseBytes, left: l.MaxResponseBytes}
+}
+
+type sizeLimitedReader struct {
+	r     io.Reader
+	limit int64
+	left  int64
+}
+
+func (s *sizeLimitedReader) Read(p []byte) (int, error) {
+	// Read one byte past the limit to tell a response of exactly the limit
+	// from a longer one
+	if int64(len(p)) > s.left+1 {
+		p = p[:s.left+1]
+	}
+	n, err := s.r.Read(p)
+	if int64(n) > s.left {
+		return int(s.left), &limitError{State: stopResponseSize, Detail: fmt.Sprintf(
+			"response is over the %s limit set by limits.maxResponseBytes", formatSize(s.limit))}
+	}
+	s.left -= int64(n)
+	return n, err
+}
+
+// sizeUnits are the suffixes parseSize accepts, in binary multiples
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}, {"", 1}}
+
+// parseSize accepts a byte count as a number or a string like "512KB",
+// "10MB" or "1GB"
+func parseSize(v interface{}) (int64, error) {
+	switch s := v.(type) {
+	case int:
+		if s >= 0 {
+			return int64(s), nil
+		}
+	case string:
+		upper := strings.ToUpper(strings.TrimSpace(s))
+		for _, unit := range sizeUnits {
+			if number, ok := strings.CutSuffix(upper, unit.suffix); ok {
+				n, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+				if err == nil && n >= 0 {
+					return int64(n * float64(unit.bytes)), nil
+				}
+				break
+			}
+		}
+	}
+	return 0, fmt.Errorf("must be a size like 10MB, got %v", v)
+}
+
+// formatSize writes a byte count in the largest whole unit
+func formatSize(n int64) string {
+	for _, unit := range sizeUnits {
+		if n >= unit.bytes && unit.bytes > 1 {
+			return strconv.FormatFloat(float64(n)/float64(unit.bytes), 'f', 1, 64) + " " + unit.suffix
+		}
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// checkBudget refuses a call before it is sent if its estimated input is
+// over maxInputTokens, or if its estimated cost, with what the run has
+// spent so far, would go over maxCost. Output is priced at
+// config.maxOutputTokens when set, or else not counted.
+func (l Limits) checkBudget(ctx context.Context, provider, model string, messages []Message, gen GenerationConfig, spent Usage) error {
+	if l.MaxInputTokens == 0 && l.MaxCost == 0 {
+		return nil
+	}
+	tokens, _, _ := countTokens(ctx, provider, model, messages)
+	if l.MaxInputTokens > 0 && tokens > l.MaxInputTokens {
+		return &limitError{State: stopInputTokens, Detail: fmt.Sprintf(
+			"request is about %d input tokens, over the %d limit set by limits.maxInputTokens", tokens, l.MaxInputTokens)}
+	}
+	if l.MaxCost == 0 {
+		return nil
+	}
+	projected := Usage{InputTokens: spent.InputTokens + tokens, OutputTokens: spent.OutputTokens}
+	if gen.MaxOutputTokens != nil {
+		projected.OutputTokens += *gen.MaxOutputTokens
+	}
+	cost := usageCost(model, projected)
+	if cost == nil {
+		return fmt.Errorf("limits.maxCost needs a price for %s; add one to %s", model, filepath.Join(configDir(), "pricing.yaml"))
+	}
+	if *cost > l.MaxCost {
+		return &limitError{State: stopCostLimit, Detail: fmt.Sprintf(
+			"run would cost about $%.4f, over the $%g limit set by limits.maxCost", *cost, l.MaxCost)}
+	}
+	return nil
+}
+
+// checkTokens reports whether usage has reached the token budget
+func (l Limits) checkTokens(usage Usage) error {
+	used := usage.InputTokens + usage.OutputTokens
+	if l.MaxTokens > 0 && used >= l.MaxTokens {
+		return &limitError{State: stopTokenBudget, Detail: fmt.Sprintf("used %d of %d tokens", used, l.MaxTokens)}
+	}
+	return nil
+}
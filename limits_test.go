@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunLimits(t *testing.T) {
+	limits, err := runLimits(map[string]interface{}{
+		"timeout": 60,
+		"limits": map[string]interface{}{
+			"totalTimeout":     "2m",
+			"maxTokens":        1000,
+			"maxRequestBytes":  "1.5 MB",
+			"maxResponseBytes": 0,
+			"maxInputTokens":   500,
+			"maxCost":          0.25,
+			"maxToolRounds":    3,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := Limits{CallTimeout: time.Minute, TotalTimeout: 2 * time.Minute, MaxTokens: 1000, MaxRequestBytes: 3 << 19,
+		RateLimitRetries: defaultRateLimitRetries, MaxRetryWait: defaultMaxRetryWait, MaxInputTokens: 500, MaxCost: 0.25, MaxToolRounds: 3}
+	if limits != expected {
+		t.Errorf("Expected %+v, got %+v", expected, limits)
+	}
+
+	limits, _ = runLimits(map[string]interface{}{"limits": map[string]interface{}{"callTimeout": "5s"}})
+	if limits.CallTimeout != 5*time.Second {
+		t.Errorf("Expected callTimeout to override timeout, got %v", limits.CallTimeout)
+	}
+	if limits, _ := runLimits(map[string]interface{}{}); limits.CallTimeout != defaultTimeout {
+		t.Errorf("Expected default call timeout %v, got %v", defaultTimeout, limits.CallTimeout)
+	}
+	if limits, _ := runLimits(map[string]interface{}{}); limits.MaxRequestBytes != defaultMaxRequestBytes || limits.MaxResponseBytes != defaultMaxResponseBytes {
+		t.Errorf("Expected default size limits, got %+v", limits)
+	}
+
+	for _, block := range []interface{}{
+		"30s",
+		map[string]interface{}{"maxTokens": -1},
+		map[string]interface{}{"callTimeout": "soon"},
+		map[string]interface{}{"toolTimeot": "5s"},
+		map[string]interface{}{"maxRequestBytes": "lots"},
+		map[string]interface{}{"maxResponseBytes": -5},
+		map[string]interface{}{"rateLimitRetries": "often"},
+		map[string]interface{}{"maxRetryWait": "-1s"},
+		map[string]interface{}{"maxInputTokens": 0},
+		map[string]interface{}{"maxCost": "cheap"},
+	} {
+		if _, err := runLimits(map[string]interface{}{"limits": block}); err == nil {
+			t.Errorf("Expected error for limits %v", block)
+		}
+	}
+}
+
+// limitServer replies with invalid structured output after delay, reporting
+// 100 tokens of usage per call
+func limitServer(t *testing.T, delay time.Duration) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{
+				"message": map[string]interface{}{"role": "assistant", "content": `{"name": 5}`},
+			}},
+			"usage": map[string]interface{}{"prompt_tokens": 80, "completion_tokens": 20},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestCompleteLimits(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	tests := []struct {
+		name   string
+		delay  time.Duration
+		limits map[string]interface{}
+		state  string
+		calls  int32
+	}{
+		{"token budget", 0, map[string]interface{}{"maxTokens": 150}, stopTokenBudget, 2},
+		{"call timeout", 200 * time.Millisecond, map[string]interface{}{"callTimeout": "50ms"}, stopCallTimeout, 1},
+		{"total timeout", 60 * time.Millisecond, map[string]interface{}{"totalTimeout": "100ms"}, stopTotalTimeout, 0},
+		{"request size", 0, map[string]interface{}{"maxRequestBytes": 20}, stopRequestSize, 0},
+		{"response size", 0, map[string]interface{}{"maxResponseBytes": "100B"}, stopResponseSize, 1},
+	}
+	for _, tt := range tests {
+		server, calls := limitServer(t, tt.delay)
+		meta := map[string]interface{}{
+			"baseURL": server.URL,
+			"limits":  tt.limits,
+			"output": map[string]interface{}{
+				"schema":     map[string]interface{}{"name": "string"},
+				"maxRetries": 5,
+			},
+		}
+		_, err := complete(context.Background(), promptRun{
+			path:     "limits.prompt",
+			meta:     meta,
+			provider: "custom",
+			model:    "x",
+			messages: []Message{{Role: "user", Content: "Extract the name."}},
+		})
+		var limitErr *limitError
+		if !errors.As(err, &limitErr) || limitErr.State != tt.state {
+			t.Errorf("%s: expected %s, got %v", tt.name, tt.state, err)
+		}
+		if n := atomic.LoadInt32(calls); tt.calls > 0 && n != tt.calls {
+			t.Errorf("%s: expected %d calls, got %d", tt.name, tt.calls, n)
+		}
+	}
+}
+
+func TestCompleteNoCallTimeout(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	for _, meta := range []map[string]interface{}{
+		{"limits": map[string]interface{}{"callTimeout": 0}},
+		{"timeout": 0},
+	} {
+		server, calls := limitServer(t, 10*time.Millisecond)
+		meta["baseURL"] = server.URL
+		c, err := complete(context.Background(), promptRun{
+			path:     "limits.prompt",
+			meta:     meta,
+			provider: "custom",
+			model:    "x",
+			messages: []Message{{Role: "user", Content: "Extract the name."}},
+		})
+		if err != nil || c.Reply != `{"name": 5}` {
+			t.Errorf("%v: expected the call to finish without a deadline, got %q %v", meta, c.Reply, err)
+		}
+		if n := atomic.LoadInt32(calls); n != 1 {
+			t.Errorf("%v: expected 1 call, got %d", meta, n)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected int64
+	}{
+		{4096, 4096},
+		{"512", 512},
+		{"512B", 512},
+		{"2kb", 2048},
+		{"10MB", 10 << 20},
+		{"1 GB", 1 << 30},
+	}
+	for _, tc := range tests {
+		if got, err := parseSize(tc.value); err != nil || got != tc.expected {
+			t.Errorf("%v: expected %d, got %d (%v)", tc.value, tc.expected, got, err)
+		}
+	}
+	if got := formatSize(3 << 19); got != "1.5 MB" {
+		t.Errorf("Expected %q, got %q", "1.5 MB", got)
+	}
+}
+
+func TestResponseReader(t *testing.T) {
+	limits := Limits{MaxResponseBytes: 5}
+	if data, err := io.ReadAll(limits.responseReader(strings.NewReader("12345"))); err != nil || string(data) != "12345" {
+		t.Errorf("Expected the whole response at the limit, got %q (%v)", data, err)
+	}
+	data, err := io.ReadAll(limits.responseReader(strings.NewReader("123456")))
+	var limitErr *limitError
+	if !errors.As(err, &limitErr) || limitErr.State != stopResponseSize {
+		t.Errorf("Expected %s, got %v", stopResponseSize, err)
+	}
+	if string(data) != "12345" {
+		t.Errorf("Expected reading to stop at the limit, got %q", data)
+	}
+}
+
+func TestCheckBudget(t *testing.T) {
+	// About 1000 tokens of content, 1007 with the chat framing
+	messages := []Message{{Role: "user", Content: strings.Repeat("abcd", 1000)}}
+	maxOutput := 1000
+	tests := []struct {
+		name     string
+		limits   Limits
+		model    string
+		gen      GenerationConfig
+		spent    Usage
+		expected string
+	}{
+		{"no limits", Limits{}, "claude-sonnet-4", GenerationConfig{}, Usage{}, ""},
+		{"input tokens", Limits{MaxInputTokens: 500}, "claude-sonnet-4", GenerationConfig{}, Usage{},
+			"stopped (input_too_large): request is about 1007 input tokens, over the 500 limit set by limits.maxInputTokens"},
+		{"under cost", Limits{MaxCost: 0.01}, "claude-sonnet-4", GenerationConfig{}, Usage{}, ""},
+		{"max output", Limits{MaxCost: 0.01}, "claude-sonnet-4", GenerationConfig{MaxOutputTokens: &maxOutput}, Usage{},
+			"stopped (cost_limit): run would cost about $0.0180, over the $0.01 limit set by limits.maxCost"},
+		{"spent", Limits{MaxCost: 0.01}, "claude-sonnet-4", GenerationConfig{}, Usage{InputTokens: 1000, OutputTokens: 400},
+			"stopped (cost_limit): run would cost about $0.0120, over the $0.01 limit set by limits.maxCost"},
+		{"unpriced", Limits{MaxCost: 0.01}, "llama3", GenerationConfig{}, Usage{}, "limits.maxCost needs a price for llama3"},
+	}
+	for _, tt := range tests {
+		err := tt.limits.checkBudget(context.Background(), "anthropic", tt.model, messages, tt.gen, tt.spent)
+		if tt.expected == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if tt.expected != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.expected)) {
+			t.Errorf("%s: expected %q, got %v", tt.name, tt.expected, err)
+		}
+	}
+}
+
+func TestLimitFlags(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	meta := map[string]interface{}{"limits": map[string]interface{}{"maxTokens": 100}}
+	meta, _, _, err := resolvePrompt(meta, "Hi", map[string]interface{}{"max-cost": 0.5, "max-input-tokens": 2000}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	limits, err := runLimits(meta)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if limits.MaxCost != 0.5 || limits.MaxInputTokens != 2000 || limits.MaxTokens != 100 {
+		t.Errorf("Expected the flags merged into limits, got %+v", limits)
+	}
+}
+
+func TestRunJSONLimitState(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	server, _ := limitServer(t, 60*time.Millisecond)
+	t.Setenv("RUNPROMPT_BASE_URL", server.URL)
+	dir := t.TempDir()
+	writeFiles(t, dir, "p.prompt", "---\nmodel: custom/x\nlimits:\n  totalTimeout: 100ms\noutput:\n  schema:\n    name: string\n  maxRetries: 5\n---\nExtract the name.")
+
+	stdout := os.Stdout
+	f, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = f
+	err = run(context.Background(), []string{"--output", "json", filepath.Join(dir, "p.prompt")})
+	os.Stdout = stdout
+	f.Close()
+	var limitErr *limitError
+	if !errors.As(err, &limitErr) || limitErr.State != stopTotalTimeout {
+		t.Errorf("Expected %s, got %v", stopTotalTimeout, err)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(dir, "stdout"))
+	var summary runSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatalf("Expected the JSON envelope, got %q: %v", data, err)
+	}
+	if summary.State != stopTotalTimeout || !strings.Contains(summary.Error, "100ms") || summary.Requests == 0 || summary.Output != nil {
+		t.Errorf("Expected the termination state in the envelope, got %+v", summary)
+	}
+}
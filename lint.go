@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// frontmatterKeys are the settings a prompt's frontmatter may use, beyond
+// the generation settings that may also be written at the top level
+var frontmatterKeys = []string{
+	"name", "description", "version", "metadata",
+	"model", "config", "input", "output", "stream", "variants", "when",
+	"timeout", "color", "baseURL", "base_url", "history", "limits", "signing",
+	"strictVariables", "partials", "locale", "onModelChange", "escape",
+	"streamRetry", "system", "headers", "providerHeaders",
+	"imports", "extends", "proxy", "requiresEnv",
+	"faultInject", "fallbackModels", "modelAliases", "bestOf", "allowedModels", "tools", "mcpServers",
+}
+
+// inputKeys and outputKeys are the settings of the input: and output: blocks
+var (
+	inputKeys  = []string{"schema", "default", "messages"}
+	outputKeys = []string{"format", "schema", "useTools", "cleanup", "repair", "maxRetries", "transform", "files", "validate", "rules", "language", "sink", "media"}
+)
+
+// lintPrompt checks a prompt file without calling a model: frontmatter and
+// template syntax, unknown keys, the model's provider, schemas and the
+// values of settings. Every problem found is returned with its location.
+func lintPrompt(path string) []error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return []error{err}
+	}
+	metaStr, template, bodyLine, ok := splitFrontmatter(string(content))
+
+	// Syntax errors are reported by parsing, once per named prompt
+	sections := splitNamedPrompts(template, bodyLine)
+	names := []string{""}
+	if len(sections) > 0 {
+		names = names[:0]
+		for _, s := range sections {
+			names = append(names, s.Name)
+		}
+	}
+	var errs []error
+	for _, name := range names {
+		if _, _, err := parsePromptSource(path, name, content); err != nil {
+			errs = append(errs, unjoin(err)...)
+		}
+	}
+	if len(errs) > 0 {
+		return dedupeErrors(errs)
+	}
+
+	if ok {
+		errs = append(errs, lintFrontmatter(path, metaStr, 2)...)
+	}
+	for _, section := range sections {
+		body, skipped := trimTemplate(section.Body)
+		if sectionMeta, _, _, ok := splitFrontmatter(body); ok {
+			errs = append(errs, lintFrontmatter(path, sectionMeta, section.Line+skipped+1)...)
+		}
+	}
+	return errs
+}
+
+// unjoin splits an error from errors.Join into its parts
+func unjoin(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+// dedupeErrors drops repeats, such as a frontmatter error reported once for
+// each named prompt in a file
+func dedupeErrors(errs []error) []error {
+	seen := map[string]bool{}
+	var unique []error
+	for _, err := range errs {
+		if !seen[err.Error()] {
+			seen[err.Error()] = true
+			unique = append(unique, err)
+		}
+	}
+	return unique
+}
+
+// frontmatterLinter checks one frontmatter block, locating problems by the
+// line their key is on
+type frontmatterLinter struct {
+	file      string
+	lines     []string
+	keyLines  map[string]int // dotted key path to index in lines
+	firstLine int            // file line of lines[0]
+	aliases   map[string]string
+	errs      []error
+}
+
+func lintFrontmatter(file, metaStr string, firstLine int) []error {
+	meta, keyLines, _ := parseYAMLDocument(metaStr)
+	l := &frontmatterLinter{
+		file:      file,
+		lines:     strings.Split(metaStr, "\n"),
+		keyLines:  keyLines,
+		firstLine: firstLine,
+		aliases:   map[string]string{},
+	}
+	// Models may be aliases from the config files or the prompt itself
+	files, _ := loadSettings()
+	for _, f := range append(files, configFile{file, meta}) {
+		aliases, err := modelAliases(f.Settings)
+		if err != nil {
+			if f.Path == file {
+				l.report("modelAliases", "%v", err)
+			}
+			continue
+		}
+		for name, model := range aliases {
+			l.aliases[name] = model
+		}
+	}
+	l.lintSettings(meta, "")
+	sort.SliceStable(l.errs, func(i, j int) bool {
+		return l.errs[i].(*sourceError).Line < l.errs[j].(*sourceError).Line
+	})
+	return l.errs
+}
+
+// report records a problem at the line of key, or of its nearest parent
+func (l *frontmatterLinter) report(key string, format string, args ...interface{}) {
+	for {
+		if i, ok := l.keyLines[key]; ok {
+			line := l.lines[i]
+			l.errs = append(l.errs, &sourceError{
+				File: l.file,
+				Line: l.firstLine + i,
+				Col:  len(line) - len(strings.TrimLeft(line, " \t")) + 1,
+				Msg:  fmt.Sprintf(format, args...),
+				Text: line,
+			})
+			return
+		}
+		dot := strings.LastIndex(key, ".")
+		if dot == -1 {
+			l.errs = append(l.errs, &sourceError{File: l.file, Line: l.firstLine, Col: 1, Msg: fmt.Sprintf(format, args...)})
+			return
+		}
+		key = key[:dot]
+	}
+}
+
+// lintSettings checks a map of frontmatter settings found at prefix: the
+// top level, or the overrides in a variant or when: block
+func (l *frontmatterLinter) lintSettings(meta map[string]interface{}, prefix string) {
+	known := append(append([]string{}, frontmatterKeys...), generationKeys...)
+	if strings.HasPrefix(prefix, "variants.") {
+		known = append(known, "weight", "template")
+	}
+	l.checkKeys(meta, prefix, known)
+
+	if v, ok := meta["model"]; ok {
+		// A list is the model followed by its fallbacks
+		list, isList := v.([]interface{})
+		if !isList {
+			list = []interface{}{v}
+		} else if len(list) == 0 {
+			l.report(prefix+"model", "model must name at least one model")
+		}
+		for _, m := range list {
+			if err := l.checkModel(m); err != nil {
+				l.report(prefix+"model", "%v", err)
+			}
+		}
+	}
+	if v, ok := meta["bestOf"]; ok {
+		aliases := make(map[string]interface{}, len(l.aliases))
+		for name, model := range l.aliases {
+			aliases[name] = model
+		}
+		if _, err := parseBestOf(map[string]interface{}{"bestOf": v, "modelAliases": aliases}); err != nil {
+			l.report(prefix+"bestOf", "%v", err)
+		}
+	}
+	if v, ok := meta["tools"]; ok {
+		if _, err := parseTools(map[string]interface{}{"tools": v}); err != nil {
+			l.report(prefix+"tools", "%v", err)
+		}
+	}
+	if v, ok := meta["mcpServers"]; ok {
+		if _, err := parseMCPServers(map[string]interface{}{"mcpServers": v}); err != nil {
+			l.report(prefix+"mcpServers", "%v", err)
+		}
+	}
+	if v, ok := meta["allowedModels"]; ok {
+		if _, err := allowedModels(map[string]interface{}{"allowedModels": v}); err != nil {
+			l.report(prefix+"allowedModels", "%v", err)
+		} else if name, ok := meta["model"].(string); ok {
+			// The prompt's own model has to be one it allows
+			model, err := resolveAlias(l.aliases, name)
+			if err == nil {
+				err = checkAllowedModel(meta, model)
+			}
+			if err != nil {
+				l.report(prefix+"model", "%v", err)
+			}
+		}
+	}
+	if v, ok := meta["fallbackModels"]; ok {
+		if _, err := fallbackModels(map[string]interface{}{"fallbackModels": v}); err != nil {
+			l.report(prefix+"fallbackModels", "%v", err)
+		} else {
+			for _, m := range v.([]interface{}) {
+				if err := l.checkModel(m); err != nil {
+					l.report(prefix+"fallbackModels", "%v", err)
+				}
+			}
+		}
+	}
+	config, _ := meta["config"].(map[string]interface{})
+	l.checkKeys(config, prefix+"config.", generationKeys)
+	for _, key := range generationKeys {
+		// Check each setting alone so problems are reported at its line
+		if v, ok := config[key]; ok {
+			if _, err := generationConfig(map[string]interface{}{"config": map[string]interface{}{key: v}}); err != nil {
+				l.report(prefix+"config."+key, "%v", err)
+			}
+		}
+		if v, ok := meta[key]; ok {
+			if _, err := generationConfig(map[string]interface{}{key: v}); err != nil {
+				l.report(prefix+key, "%v", err)
+			}
+		}
+	}
+	if v, ok := meta["timeout"]; ok {
+		if _, err := parseTimeout(v); err != nil {
+			l.report(prefix+"timeout", "%v", err)
+		}
+	}
+	if v, ok := meta["proxy"]; ok {
+		if _, err := proxyClient(v); err != nil {
+			l.report(prefix+"proxy", "%v", err)
+		}
+	}
+	if v, ok := meta["faultInject"]; ok {
+		if _, err := parseFaults(v); err != nil {
+			l.report(prefix+"faultInject", "%v", err)
+		}
+	}
+	if _, err := requiredEnv(meta); err != nil {
+		l.report(prefix+"requiresEnv", "%v", err)
+	}
+	if _, ok := meta["limits"]; ok {
+		if _, err := runLimits(map[string]interface{}{"limits": meta["limits"]}); err != nil {
+			l.report(prefix+"limits", "%v", err)
+		}
+	}
+	if v, ok := meta["signing"]; ok {
+		if _, err := parseSigning(v); err != nil {
+			l.report(prefix+"signing", "%v", err)
+		}
+	}
+	if v, ok := meta["escape"]; ok {
+		if _, err := escapeMode(map[string]interface{}{"escape": v}); err != nil {
+			l.report(prefix+"escape", "%v", err)
+		}
+	}
+	if v, ok := meta["system"]; ok {
+		if system, ok := v.(string); !ok {
+			l.report(prefix+"system", "system must be text, such as a | block")
+		} else {
+			for _, err := range checkTemplate(system) {
+				l.report(prefix+"system", "%s", err.Msg)
+			}
+		}
+	}
+	for _, key := range []string{"headers", "providerHeaders"} {
+		// Checked apart so each is reported at its own line
+		if v, ok := meta[key]; ok {
+			if _, err := requestHeaders(map[string]interface{}{key: v}, ""); err != nil {
+				l.report(prefix+key, "%v", err)
+			}
+		}
+	}
+	if v, ok := meta["partials"]; ok {
+		if _, ok := v.(map[string]interface{}); !ok {
+			l.report(prefix+"partials", "partials must map names to files")
+		}
+	}
+	if input, ok := meta["input"].(map[string]interface{}); ok {
+		l.checkKeys(input, prefix+"input.", inputKeys)
+		l.lintSchema(input["schema"], prefix+"input.schema")
+		if _, err := conversationMode(input); err != nil {
+			l.report(prefix+"input.messages", "%v", err)
+		}
+	}
+	if output, ok := meta["output"].(map[string]interface{}); ok {
+		l.checkKeys(output, prefix+"output.", outputKeys)
+		l.lintSchema(output["schema"], prefix+"output.schema")
+		if _, err := retrySetting(output); err != nil {
+			l.report(prefix+"output.maxRetries", "%v", err)
+		}
+		if _, err := parseTransforms(output["transform"]); err != nil {
+			l.report(prefix+"output.transform", "%v", err)
+		}
+		if _, err := outputFiles(output); err != nil {
+			l.report(prefix+"output.files", "%v", err)
+		}
+		if _, err := outputLanguage(output); err != nil {
+			l.report(prefix+"output.language", "%v", err)
+		}
+		if _, err := parseSinks(output); err != nil {
+			l.report(prefix+"output.sink", "%v", err)
+		}
+		if _, err := mediaPath(output); err != nil {
+			l.report(prefix+"output.media", "%v", err)
+		}
+		for _, key := range []string{"validate", "rules"} {
+			// Checked apart so each is reported at its own line
+			if v, ok := output[key]; ok {
+				if _, err := parseOutputRules(map[string]interface{}{key: v}); err != nil {
+					l.report(prefix+"output."+key, "%v", err)
+				}
+			}
+		}
+	}
+
+	for _, block := range []string{"variants", "when"} {
+		entries, ok := meta[block].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for name, v := range entries {
+			if overrides, ok := v.(map[string]interface{}); ok {
+				l.lintSettings(overrides, prefix+block+"."+name+".")
+			}
+		}
+	}
+}
+
+// checkKeys reports keys of m that are not in known
+func (l *frontmatterLinter) checkKeys(m map[string]interface{}, prefix string, known []string) {
+	for key := range m {
+		if !containsString(known, key) {
+			msg := fmt.Sprintf("unknown key %q", key)
+			if suggestion := closestKey(key, known); suggestion != "" {
+				msg += fmt.Sprintf(", did you mean %q?", suggestion)
+			}
+			l.report(prefix+key, "%s", msg)
+		}
+	}
+}
+
+// lintSchema reports problems in a picoschema
+func (l *frontmatterLinter) lintSchema(schema interface{}, key string) {
+	if schema == nil {
+		return
+	}
+	fields, ok := schema.(map[string]interface{})
+	if !ok {
+		l.report(key, "schema must be a mapping of fields")
+		return
+	}
+	for _, problem := range checkPicoschema(fields, "") {
+		l.report(key+"."+problem.field, "%s", problem.msg)
+	}
+}
+
+// checkModel checks a model, which may be one of the aliases in scope
+func (l *frontmatterLinter) checkModel(v interface{}) error {
+	if name, ok := v.(string); ok {
+		model, err := resolveAlias(l.aliases, name)
+		if err != nil {
+			return err
+		}
+		v = model
+	}
+	return checkModel(v)
+}
+
+// checkModel verifies a model string names a known provider
+func checkModel(v interface{}) error {
+	s, ok := v.(string)
+	if !ok || s == "" {
+		return fmt.Errorf("model must be a string like openai/gpt-4o")
+	}
+	provider, model := parseModelString(s)
+	if provider == "test" {
+		return nil
+	}
+	if provider == "" || model == "" {
+		return fmt.Errorf("model %q must be written provider/model", s)
+	}
+	if _, ok := providers[provider]; !ok {
+		names := make([]string, 0, len(providers))
+		for name := range providers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown provider %q (known: %s)", provider, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// closestKey suggests the known key nearest to a misspelt one, if any is
+// within two edits
+func closestKey(key string, known []string) string {
+	best, bestDistance := "", 3
+	for _, candidate := range known {
+		if d := editDistance(strings.ToLower(key), strings.ToLower(candidate)); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+var errNoPrompts = errors.New("no .prompt files found")
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func lintSource(t *testing.T, content string) []string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "lint.prompt")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var problems []string
+	for _, err := range lintPrompt(path) {
+		// Keep the location and message, without the file and source excerpt
+		first := strings.SplitN(err.Error(), "\n", 2)[0]
+		problems = append(problems, strings.TrimPrefix(first, path+":"))
+	}
+	return problems
+}
+
+func TestLintPrompt(t *testing.T) {
+	problems := lintSource(t, `---
+model: opnai/gpt-4o
+temprature: 0.5
+config:
+  maxOutputTokens: lots
+output:
+  maxRetries: 2
+  schema:
+    name: strin
+    status(enum): [open, closed]
+---
+Hello {{name}}
+`)
+	expected := []string{
+		`2:1: unknown provider "opnai" (known: anthropic, azureopenai, custom, googleai, openai, openrouter)`,
+		`3:1: unknown key "temprature", did you mean "temperature"?`,
+		`5:3: config.maxOutputTokens must be a non-negative integer, got lots`,
+		`9:5: unknown type "strin" (use string, number, integer, boolean, null, any)`,
+	}
+	if strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(problems, "\n"))
+	}
+}
+
+func TestLintEscape(t *testing.T) {
+	problems := lintSource(t, "---\nmodel: openai/gpt-4o\nescape: xml\n---\nHi {{name}}\n")
+	expected := "3:1: escape must be one of html, json, none, got xml"
+	if len(problems) != 1 || problems[0] != expected {
+		t.Errorf("Expected %q, got %q", expected, problems)
+	}
+}
+
+func TestLintSystem(t *testing.T) {
+	problems := lintSource(t, "---\nmodel: test\nsystem: |\n  You are {{#if x}}terse.\n---\nHi\n")
+	expected := "3:1: unclosed section {{#if x}}"
+	if len(problems) != 1 || problems[0] != expected {
+		t.Errorf("Expected %q, got %q", expected, problems)
+	}
+	problems = lintSource(t, "---\nmodel: test\nsystem: [a]\n---\nHi\n")
+	if len(problems) != 1 || !strings.Contains(problems[0], "system must be text") {
+		t.Errorf("Expected a system type problem, got %q", problems)
+	}
+}
+
+func TestLintInputMessages(t *testing.T) {
+	problems := lintSource(t, "---\nmodel: test\ninput:\n  messages: last\n---\nHi\n")
+	expected := "4:3: input.messages must be user, system or false, got last"
+	if len(problems) != 1 || problems[0] != expected {
+		t.Errorf("Expected %q, got %q", expected, problems)
+	}
+}
+
+func TestLintPromptClean(t *testing.T) {
+	problems := lintSource(t, `---
+model: anthropic/claude-sonnet-4
+temperature: 0.2
+output:
+  schema:
+    name: string, the person's name
+    tags?(array): string
+  transform: [trim]
+variants:
+  short:
+    weight: 2
+    config:
+      maxOutputTokens: 100
+---
+Hello {{name}}
+`)
+	if len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+}
+
+func TestLintOutputRules(t *testing.T) {
+	problems := lintSource(t, `---
+model: test
+output:
+  schema:
+    score: number
+  validate:
+    score:
+      mn: 0
+  rules: ["score is high"]
+---
+Hi
+`)
+	expected := []string{
+		`6:3: output.validate.score: unknown constraint "mn" (use min, max, minLength, maxLength, pattern)`,
+		`9:3: output.rules: invalid rule "score is high", expected a comparison like "end_date >= start_date"`,
+	}
+	if strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(problems, "\n"))
+	}
+}
+
+func TestLintPromptSyntax(t *testing.T) {
+	problems := lintSource(t, "---\nmodel openai/gpt-4o\n---\nHello {{#items}}\n")
+	if len(problems) != 2 || !strings.HasPrefix(problems[0], "2:1: expected") || !strings.HasPrefix(problems[1], "4:7: unclosed section") {
+		t.Errorf("Expected frontmatter and template errors, got %v", problems)
+	}
+}
+
+func TestLintNamedPrompts(t *testing.T) {
+	problems := lintSource(t, `---
+model: openai/gpt-4o
+---
+--- name: summarize ---
+Summarize: {{text}}
+
+--- name: translate ---
+---
+modle: anthropic/claude-3
+---
+Translate: {{text}}
+`)
+	if len(problems) != 1 || problems[0] != `9:1: unknown key "modle", did you mean "model"?` {
+		t.Errorf("Expected unknown key in the translate section, got %v", problems)
+	}
+}
+
+func TestCheckModel(t *testing.T) {
+	for _, model := range []string{"openai/gpt-4o", "test", "openrouter/anthropic/claude-3"} {
+		if err := checkModel(model); err != nil {
+			t.Errorf("checkModel(%q): unexpected error: %v", model, err)
+		}
+	}
+	for _, model := range []interface{}{"gpt-4o", "nope/x", 5} {
+		if err := checkModel(model); err == nil {
+			t.Errorf("checkModel(%v): expected error", model)
+		}
+	}
+}
+
+func TestClosestKey(t *testing.T) {
+	known := []string{"model", "output", "temperature"}
+	if got := closestKey("ouptut", known); got != "output" {
+		t.Errorf("Expected output, got %q", got)
+	}
+	if got := closestKey("banana", known); got != "" {
+		t.Errorf("Expected no suggestion, got %q", got)
+	}
+}
+
+func TestLintRequiresEnv(t *testing.T) {
+	problems := lintSource(t, "---\nmodel: test\nrequiresEnv: [JIRA-TOKEN]\n---\nHi\n")
+	expected := `3:1: requiresEnv: invalid environment variable name "JIRA-TOKEN"`
+	if len(problems) != 1 || problems[0] != expected {
+		t.Errorf("Expected %q, got %q", expected, problems)
+	}
+}
+
+func TestLintModelList(t *testing.T) {
+	problems := lintSource(t, "---\nmodel: [openai/gpt-4o, opnai/gpt-4o-mini]\nfallbackModels: [anthropic/claude-sonnet-4-20250514]\n---\nHi\n")
+	expected := `2:1: unknown provider "opnai" (known: anthropic, azureopenai, custom, googleai, openai, openrouter)`
+	if len(problems) != 1 || problems[0] != expected {
+		t.Errorf("Expected %q, got %q", expected, problems)
+	}
+}
+
+func TestLintAllowedModels(t *testing.T) {
+	problems := lintSource(t, "---\nmodel: openai/gpt-4o-mini\nallowedModels: [anthropic/claude-*]\n---\nHi\n")
+	expected := "2:1: openai/gpt-4o-mini is not allowed for this prompt, whose allowedModels are anthropic/claude-*"
+	if len(problems) != 1 || problems[0] != expected {
+		t.Errorf("Expected %q, got %q", expected, problems)
+	}
+	if problems := lintSource(t, "---\nmodel: openai/gpt-4o\nallowedModels: [openai/gpt-4o*]\n---\nHi\n"); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %q", problems)
+	}
+}
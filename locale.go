@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// requestedLocale returns the locale a run asks for, from --locale or
+// RUNPROMPT_LOCALE
+func requestedLocale(argOverrides map[string]interface{}) string {
+	if v, ok := argOverrides["locale"]; ok {
+		return fmt.Sprintf("%v", v)
+	}
+	return os.Getenv("RUNPROMPT_LOCALE")
+}
+
+// localizedPath returns the translation of a prompt file for a locale,
+// kept next to it with the locale before the extension: summarize.de.prompt
+// for summarize.prompt. A regional locale such as de-AT falls back to de,
+// then to the file itself. A #name suffix is kept.
+func localizedPath(path, locale string) string {
+	if locale == "" {
+		return path
+	}
+	filePath, name := splitPromptName(path)
+	base, ok := strings.CutSuffix(filePath, ".prompt")
+	if !ok {
+		return path
+	}
+	for _, candidate := range localeFallbacks(locale) {
+		localized := base + "." + candidate + ".prompt"
+		if promptFileExists(localized) {
+			log(fmt.Sprintf("Using %s for locale %s", localized, locale))
+			if name != "" {
+				localized += "#" + name
+			}
+			return localized
+		}
+	}
+	return path
+}
+
+// localeFallbacks lists the locales to try for a locale, most specific
+// first: de-AT gives de-AT and de
+func localeFallbacks(locale string) []string {
+	locale = strings.ReplaceAll(locale, "_", "-")
+	fallbacks := []string{locale}
+	for i := strings.LastIndex(locale, "-"); i > 0; i = strings.LastIndex(locale, "-") {
+		locale = locale[:i]
+		fallbacks = append(fallbacks, locale)
+	}
+	return fallbacks
+}
+
+// promptFileExists reports whether a prompt file exists, including inside
+// a bundle
+func promptFileExists(path string) bool {
+	resolved, err := resolveBundle(path)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(resolved)
+	return err == nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalizedPath(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir,
+		"summarize.prompt", "---\nmodel: test\n---\nSummarize: {{STDIN}}",
+		"summarize.de.prompt", "---\nmodel: test\n---\nFasse zusammen ({{locale}}): {{STDIN}}",
+		"summarize.fr-CA.prompt", "---\nmodel: test\n---\nRésume: {{STDIN}}",
+	)
+	base := filepath.Join(dir, "summarize.prompt")
+	tests := []struct {
+		locale   string
+		expected string
+	}{
+		{"", "summarize.prompt"},
+		{"de", "summarize.de.prompt"},
+		{"de-AT", "summarize.de.prompt"},
+		{"de_AT", "summarize.de.prompt"},
+		{"fr-CA", "summarize.fr-CA.prompt"},
+		{"fr", "summarize.prompt"},
+		{"es", "summarize.prompt"},
+	}
+	for _, tc := range tests {
+		if got := filepath.Base(localizedPath(base, tc.locale)); got != tc.expected {
+			t.Errorf("Locale %q: expected %q, got %q", tc.locale, tc.expected, got)
+		}
+	}
+	if got := localizedPath(base+"#short", "de"); !strings.HasSuffix(got, "summarize.de.prompt#short") {
+		t.Errorf("Expected the #name suffix kept, got %q", got)
+	}
+}
+
+func TestLocaleVariable(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir,
+		"summarize.prompt", "---\nmodel: test\n---\nSummarize: {{STDIN}}",
+		"summarize.de.prompt", "---\nmodel: test\n---\nFasse zusammen ({{locale}}): {{STDIN}}",
+	)
+	path := filepath.Join(dir, "summarize.prompt")
+
+	meta, template, _, err := preparePrompt(path, map[string]interface{}{"locale": "de"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	variables, err := inputVariables("Text", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := renderPromptMessages(compileMessages(template), variables, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := messages[0].Content; got != "Fasse zusammen (de): Text" {
+		t.Errorf("Expected the German prompt, got %q", got)
+	}
+
+	t.Setenv("RUNPROMPT_LOCALE", "es")
+	_, template, _, err = preparePrompt(path, map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template != "Summarize: {{STDIN}}" {
+		t.Errorf("Expected the base prompt for an untranslated locale, got %q", template)
+	}
+}
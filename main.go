@@ -2,21 +2,43 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
-	"strconv"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // Provider configuration
 type Provider struct {
 	URL string
 	Env string
+	// EndpointEnv names an env var whose value replaces {endpoint} in URL
+	EndpointEnv string
+	// AuthHeader is the header carrying the raw API key; empty means Bearer auth
+	AuthHeader string
+	// OptionalKey allows requests without an API key, e.g. for local servers
+	OptionalKey bool
+	// Headers are extra headers sent with every request
+	Headers map[string]string
+	// NoTools marks providers without tool calling support; output schemas
+	// are then requested through prompt instructions and validated locally
+	NoTools bool
+	// API selects the adapter for the provider's request format; empty
+	// means OpenAI-compatible
+	API string
+	// Signing HMAC-signs request bodies; nil means requests are unsigned
+	Signing *Signing
 }
 
 var providers = map[string]Provider{
@@ -30,22 +52,43 @@ var providers = map[string]Provider{
 	},
 	"anthropic": {
 		URL: "https://api.anthropic.com/v1/messages",
+		API: "anthropic",
 		Env: "ANTHROPIC_API_KEY",
 	},
 	"openai": {
 		URL: "https://api.openai.com/v1/chat/completions",
 		Env: "OPENAI_API_KEY",
 	},
+	"azureopenai": {
+		URL:         "{endpoint}/openai/deployments/{model}/chat/completions?api-version={apiVersion}",
+		Env:         "AZURE_OPENAI_API_KEY",
+		EndpointEnv: "AZURE_OPENAI_ENDPOINT",
+		AuthHeader:  "api-key",
+	},
+	// custom is any OpenAI-compatible server; its URL comes from baseURL
+	"custom": {
+		Env:         "CUSTOM_API_KEY",
+		OptionalKey: true,
+		NoTools:     true,
+	},
 }
 
-const (
-	red     = "\033[31m"
-	reset   = "\033[0m"
-	timeout = 120 * time.Second
+// azureAPIVersion is used unless AZURE_OPENAI_API_VERSION is set
+const azureAPIVersion = "2024-10-21"
+
+// defaultTimeout bounds each call unless the timeout setting or
+// limits.callTimeout changes it
+const defaultTimeout = 120 * time.Second
+
+var (
+	red   = "\033[31m"
+	reset = "\033[0m"
 )
 
+// version is set at release build time via -ldflags
+var version = "dev"
+
 var verbose = false
-var promptPath = ""
 
 func log(msg string) {
 	if verbose {
@@ -53,394 +96,322 @@ func log(msg string) {
 	}
 }
 
-// parsePromptFile reads and parses a .prompt file
+// parsePromptFile reads and parses a .prompt file. A path of the form
+// file.prompt#name selects one prompt from a multi-prompt file. Malformed
+// frontmatter lines and unbalanced template tags are reported with their
+// file position.
 func parsePromptFile(path string) (map[string]interface{}, string, error) {
-	content, err := os.ReadFile(path)
+	filePath, name := splitPromptName(path)
+	filePath, err := resolveBundle(filePath)
 	if err != nil {
 		return nil, "", err
 	}
-
-	contentStr := string(content)
-	if !strings.HasPrefix(contentStr, "---") {
-		return map[string]interface{}{}, strings.TrimSpace(contentStr), nil
-	}
-
-	parts := strings.SplitN(contentStr, "---", 3)
-	if len(parts) < 3 {
-		return map[string]interface{}{}, strings.TrimSpace(contentStr), nil
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, "", err
 	}
+	return parsePromptSource(filePath, name, content)
+}
 
-	metaStr := strings.TrimSpace(parts[1])
-	template := strings.TrimSpace(parts[2])
-	meta := parseYAML(metaStr)
-
-	return meta, template, nil
+// parsePromptSource parses the content of a prompt file, selecting the named
+// prompt when name is set; filePath is used in error messages
+func parsePromptSource(filePath, name string, content []byte) (map[string]interface{}, string, error) {
+	return parsePromptStack(filePath, name, content, nil, nil)
 }
 
-// parseYAML is a simple YAML parser for frontmatter
-func parseYAML(s string) map[string]interface{} {
-	result := make(map[string]interface{})
-	type stackItem struct {
-		obj    map[string]interface{}
-		indent int
+// parsePromptStack parses a prompt like parsePromptSource, as included by
+// the prompts in stack. The files it includes are recorded in sources,
+// which may be nil.
+func parsePromptStack(filePath, name string, content []byte, stack []string, sources *sourceSet) (map[string]interface{}, string, error) {
+	var errs []error
+	meta := map[string]interface{}{}
+	metaStr, template, bodyLine, ok := splitFrontmatter(string(content))
+	if ok {
+		errs = append(errs, locateErrors(checkFrontmatter(metaStr), filePath, 2)...)
+		meta = parseYAML(metaStr)
 	}
-	stack := []stackItem{{result, -1}}
-
-	lines := strings.Split(s, "\n")
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
-			continue
-		}
 
-		indent := len(line) - len(strings.TrimLeft(line, " \t"))
-
-		// Pop stack while indent <= top indent
-		for len(stack) > 1 && indent <= stack[len(stack)-1].indent {
-			stack = stack[:len(stack)-1]
-		}
-
-		// Match key: value
-		re := regexp.MustCompile(`^(\s*)([^:]+):\s*(.*)`)
-		match := re.FindStringSubmatch(line)
-		if match == nil {
-			continue
+	sections := splitNamedPrompts(template, bodyLine)
+	if len(sections) > 0 || name != "" {
+		section, err := selectNamedPrompt(sections, filePath, name)
+		if err != nil {
+			return nil, "", err
 		}
-
-		key := strings.TrimSpace(match[2])
-		value := strings.TrimSpace(match[3])
-		parent := stack[len(stack)-1].obj
-
-		if value != "" {
-			parent[key] = parseYAMLValue(value)
-		} else {
-			newMap := make(map[string]interface{})
-			parent[key] = newMap
-			stack = append(stack, stackItem{newMap, indent})
+		body, skipped := trimTemplate(section.Body)
+		start := section.Line + skipped
+		sectionMeta, sectionTemplate, sectionLine, ok := splitFrontmatter(body)
+		if ok {
+			errs = append(errs, locateErrors(checkFrontmatter(sectionMeta), filePath, start+1)...)
+			for k, v := range parseYAML(sectionMeta) {
+				meta[k] = v
+			}
 		}
+		template = sectionTemplate
+		bodyLine = start + sectionLine - 1
 	}
 
-	return result
-}
-
-// parseYAMLValue parses a YAML value string
-func parseYAMLValue(s string) interface{} {
-	s = strings.TrimSpace(s)
-	if s == "" {
-		return nil
-	}
-	if strings.ToLower(s) == "true" {
-		return true
+	errs = append(errs, locateErrors(checkTemplate(template), filePath, bodyLine)...)
+	if len(errs) > 0 {
+		return nil, "", errors.Join(errs...)
 	}
-	if strings.ToLower(s) == "false" {
-		return false
+	meta, template, errs = includePrompts(meta, template, filePath, bodyLine, append(stack, includeKey(filePath, name)), sources)
+	if len(errs) > 0 {
+		return nil, "", errors.Join(errs...)
 	}
-	// Integer
-	if matched, _ := regexp.MatchString(`^-?\d+$`, s); matched {
-		if i, err := strconv.Atoi(s); err == nil {
-			return i
-		}
+	template, errs = expandPartials(template, filePath, bodyLine, meta, sources)
+	if len(errs) > 0 {
+		return nil, "", errors.Join(errs...)
 	}
-	// Float
-	if matched, _ := regexp.MatchString(`^-?\d+\.\d+$`, s); matched {
-		if f, err := strconv.ParseFloat(s, 64); err == nil {
-			return f
-		}
-	}
-	// Try JSON or nested YAML
-	if strings.Contains(s, "\n") || strings.HasPrefix(s, "{") {
-		var jsonVal interface{}
-		if err := json.Unmarshal([]byte(s), &jsonVal); err == nil {
-			return jsonVal
-		}
-		parsed := parseYAML(s)
-		if len(parsed) > 0 {
-			return parsed
-		}
+	return meta, template, nil
+}
+
+// locateErrors sets the file of each error and shifts its line number so
+// that line 1 of the checked text maps to firstLine of the file
+func locateErrors(errs []*sourceError, file string, firstLine int) []error {
+	located := make([]error, 0, len(errs))
+	for _, e := range errs {
+		e.File = file
+		e.Line += firstLine - 1
+		located = append(located, e)
 	}
-	return s
+	return located
 }
 
-// renderTemplate renders a Handlebars-style template
-func renderTemplate(template string, variables map[string]interface{}) string {
-	return render(template, variables)
+// namedPrompt is one "--- name: xyz ---" section of a multi-prompt file
+type namedPrompt struct {
+	Name string
+	Body string
+	Line int // file line the body starts on
 }
 
-func lookup(name string, ctx map[string]interface{}) interface{} {
-	name = strings.TrimSpace(name)
-	if name == "." {
-		if v, ok := ctx["."]; ok {
-			return v
-		}
-		return ctx
+var namedPromptRe = regexp.MustCompile(`^---\s*name:\s*([\w.-]+)\s*---\s*$`)
+
+// splitPromptName splits file.prompt#name into the file path and prompt
+// name. Paths of existing files are returned unchanged.
+func splitPromptName(path string) (string, string) {
+	idx := strings.LastIndex(path, "#")
+	if idx == -1 {
+		return path, ""
 	}
-	// Handle @index, @first, @last, @key
-	if strings.HasPrefix(name, "@") {
-		if v, ok := ctx[name]; ok {
-			return v
-		}
-		return ""
+	if _, err := os.Stat(path); err == nil {
+		return path, ""
 	}
-	parts := strings.Split(name, ".")
-	var current interface{} = ctx
-	for _, part := range parts {
-		if m, ok := current.(map[string]interface{}); ok {
-			current = m[part]
-		} else {
-			return ""
+	return path[:idx], path[idx+1:]
+}
+
+// splitNamedPrompts splits a template body on "--- name: xyz ---" lines.
+// Text before the first separator is ignored. firstLine is the file line
+// the body starts on.
+func splitNamedPrompts(body string, firstLine int) []namedPrompt {
+	var sections []namedPrompt
+	var current []string
+	flush := func() {
+		if len(sections) > 0 {
+			sections[len(sections)-1].Body = strings.Join(current, "\n")
 		}
+		current = nil
 	}
-	if current == nil {
-		return ""
+	for i, line := range strings.Split(body, "\n") {
+		if m := namedPromptRe.FindStringSubmatch(strings.TrimRight(line, " \t")); m != nil {
+			flush()
+			sections = append(sections, namedPrompt{Name: m[1], Line: firstLine + i + 1})
+			continue
+		}
+		current = append(current, line)
 	}
-	return current
+	flush()
+	return sections
 }
 
-// findMatchingClose finds the closing tag for a section
-func findMatchingClose(tmpl string, key string, openTag string, closeTag string) int {
-	depth := 1
-	pos := 0
-	for depth > 0 && pos < len(tmpl) {
-		nextOpen := strings.Index(tmpl[pos:], openTag)
-		nextClose := strings.Index(tmpl[pos:], closeTag)
-
-		if nextClose == -1 {
-			return -1
-		}
-
-		if nextOpen != -1 && nextOpen < nextClose {
-			depth++
-			pos += nextOpen + len(openTag)
-		} else {
-			depth--
-			if depth == 0 {
-				return pos + nextClose
-			}
-			pos += nextClose + len(closeTag)
+// selectNamedPrompt picks the section called name from a multi-prompt file
+func selectNamedPrompt(sections []namedPrompt, path, name string) (namedPrompt, error) {
+	names := make([]string, 0, len(sections))
+	for _, section := range sections {
+		if section.Name == name {
+			return section, nil
 		}
+		names = append(names, section.Name)
+	}
+	if len(sections) == 0 {
+		return namedPrompt{}, fmt.Errorf("%s does not contain named prompts", path)
+	}
+	available := strings.Join(names, ", ")
+	if name == "" {
+		return namedPrompt{}, fmt.Errorf("%s contains several prompts; select one with %s#<name> (available: %s)",
+			path, path, available)
 	}
-	return -1
+	return namedPrompt{}, fmt.Errorf("no prompt named %q in %s (available: %s)", name, path, available)
 }
 
-// processSection finds and processes {{#key}}...{{/key}} or {{^key}}...{{/key}}
-func processSection(tmpl string, ctx map[string]interface{}, inverted bool) string {
-	var result strings.Builder
-	pos := 0
-
-	prefix := "{{#"
-	if inverted {
-		prefix = "{{^"
+// splitFrontmatter separates the --- delimited frontmatter from the template
+// body and returns the 1-based line the body starts on. It tolerates a UTF-8
+// BOM, CRLF line endings and trailing whitespace on delimiter lines. Leading
+// blank lines and trailing whitespace are removed from the body, but
+// indentation of its first line is kept.
+func splitFrontmatter(content string) (string, string, int, bool) {
+	content = strings.TrimPrefix(content, "\uFEFF")
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+
+	lines := strings.Split(content, "\n")
+	if len(lines) == 0 || strings.TrimRight(lines[0], " \t") != "---" {
+		body, skipped := trimTemplate(content)
+		return "", body, 1 + skipped, false
 	}
-
-	for pos < len(tmpl) {
-		// Find next section start
-		startIdx := strings.Index(tmpl[pos:], prefix)
-		if startIdx == -1 {
-			result.WriteString(tmpl[pos:])
-			break
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimRight(lines[i], " \t") == "---" {
+			metaStr := strings.Join(lines[1:i], "\n")
+			body, skipped := trimTemplate(strings.Join(lines[i+1:], "\n"))
+			return metaStr, body, i + 2 + skipped, true
 		}
+	}
+	body, skipped := trimTemplate(content)
+	return "", body, 1 + skipped, false
+}
 
-		// Write content before section
-		result.WriteString(tmpl[pos : pos+startIdx])
-		pos += startIdx
-
-		// Find the key
-		keyStart := pos + len(prefix)
-		keyEnd := strings.Index(tmpl[keyStart:], "}}")
-		if keyEnd == -1 {
-			result.WriteString(tmpl[pos:])
+// trimTemplate drops leading blank lines and trailing whitespace, returning
+// the number of lines dropped from the start
+func trimTemplate(s string) (string, int) {
+	s = strings.TrimRight(s, " \t\n")
+	skipped := 0
+	for {
+		nl := strings.Index(s, "\n")
+		if nl == -1 || strings.TrimSpace(s[:nl]) != "" {
 			break
 		}
-		key := strings.TrimSpace(tmpl[keyStart : keyStart+keyEnd])
+		s = s[nl+1:]
+		skipped++
+	}
+	if strings.TrimSpace(s) == "" {
+		return "", skipped
+	}
+	return s, skipped
+}
 
-		openTag := fmt.Sprintf("%s%s}}", prefix, key)
-		closeTag := fmt.Sprintf("{{/%s}}", key)
+// sourceError is an error at a line and column of a prompt file
+type sourceError struct {
+	File string
+	Line int
+	Col  int
+	Msg  string
+	Text string // the offending source line
+}
 
-		// Find the matching close tag
-		innerStart := pos + len(openTag)
-		closeIdx := findMatchingClose(tmpl[innerStart:], key, openTag, closeTag)
-		if closeIdx == -1 {
-			result.WriteString(tmpl[pos:])
+func (e *sourceError) Error() string {
+	loc := fmt.Sprintf("%d:%d", e.Line, e.Col)
+	if e.File != "" {
+		loc = e.File + ":" + loc
+	}
+	if e.Text == "" {
+		return fmt.Sprintf("%s: %s", loc, e.Msg)
+	}
+	// Keep tabs so the caret lines up with the source line
+	var caret strings.Builder
+	for i, r := range []rune(e.Text) {
+		if i >= e.Col-1 {
 			break
 		}
-
-		inner := tmpl[innerStart : innerStart+closeIdx]
-		val := lookup(key, ctx)
-
-		if inverted {
-			// Inverted section - render if falsy
-			switch v := val.(type) {
-			case []interface{}:
-				if len(v) == 0 {
-					result.WriteString(render(inner, ctx))
-				}
-			case bool:
-				if !v {
-					result.WriteString(render(inner, ctx))
-				}
-			case string:
-				if v == "" {
-					result.WriteString(render(inner, ctx))
-				}
-			case nil:
-				result.WriteString(render(inner, ctx))
-			}
+		if r == '\t' {
+			caret.WriteRune('\t')
 		} else {
-			// Normal section
-			switch v := val.(type) {
-			case []interface{}:
-				for i, item := range v {
-					itemCtx := make(map[string]interface{})
-					if m, ok := item.(map[string]interface{}); ok {
-						for k, val := range m {
-							itemCtx[k] = val
-						}
-					} else {
-						itemCtx["_value"] = item
-					}
-					itemCtx["@index"] = i
-					itemCtx["@first"] = i == 0
-					itemCtx["@last"] = i == len(v)-1
-					itemCtx["."] = item
-					result.WriteString(render(inner, itemCtx))
-				}
-			case bool:
-				if v {
-					result.WriteString(render(inner, ctx))
-				}
-			case string:
-				if v != "" {
-					result.WriteString(render(inner, ctx))
-				}
-			case int, int64, float64:
-				result.WriteString(render(inner, ctx))
-			case map[string]interface{}:
-				result.WriteString(render(inner, v))
-			case nil:
-				// Don't render
-			default:
-				if val != nil {
-					result.WriteString(render(inner, ctx))
-				}
-			}
+			caret.WriteRune(' ')
 		}
-
-		pos = innerStart + closeIdx + len(closeTag)
 	}
-
-	return result.String()
+	return fmt.Sprintf("%s: %s\n    %s\n    %s^", loc, e.Msg, e.Text, caret.String())
 }
 
-// processEach finds and processes {{#each key}}...{{/each}}
-func processEach(tmpl string, ctx map[string]interface{}) string {
-	eachRe := regexp.MustCompile(`\{\{#each\s+(\w+)\}\}`)
-	var result strings.Builder
-	pos := 0
-
-	for pos < len(tmpl) {
-		loc := eachRe.FindStringIndex(tmpl[pos:])
-		if loc == nil {
-			result.WriteString(tmpl[pos:])
-			break
-		}
+// newSourceError locates byte offset pos within src as a line and column
+func newSourceError(src string, pos int, format string, args ...interface{}) *sourceError {
+	lineStart := strings.LastIndex(src[:pos], "\n") + 1
+	lineEnd := strings.Index(src[pos:], "\n")
+	if lineEnd == -1 {
+		lineEnd = len(src)
+	} else {
+		lineEnd += pos
+	}
+	return &sourceError{
+		Line: strings.Count(src[:pos], "\n") + 1,
+		Col:  utf8.RuneCountInString(src[lineStart:pos]) + 1,
+		Msg:  fmt.Sprintf(format, args...),
+		Text: src[lineStart:lineEnd],
+	}
+}
 
-		result.WriteString(tmpl[pos : pos+loc[0]])
+// checkTemplate reports unterminated tags and unbalanced section tags
+func checkTemplate(tmpl string) []*sourceError {
+	type openTag struct {
+		name    string
+		tag     string
+		pos     int
+		hasElse bool
+	}
+	var errs []*sourceError
+	var stack []openTag
 
-		match := eachRe.FindStringSubmatch(tmpl[pos:])
-		if match == nil {
-			result.WriteString(tmpl[pos:])
+	pos := 0
+	for {
+		start := strings.Index(tmpl[pos:], "{{")
+		if start == -1 {
 			break
 		}
-		key := match[1]
-
-		closeTag := "{{/each}}"
-
-		innerStart := pos + loc[1]
-		closeIdx := strings.Index(tmpl[innerStart:], closeTag)
-		if closeIdx == -1 {
-			result.WriteString(tmpl[pos:])
+		start += pos
+		end := strings.Index(tmpl[start:], "}}")
+		if end == -1 {
+			errs = append(errs, newSourceError(tmpl, start, "unterminated tag, missing }}"))
 			break
 		}
-
-		inner := tmpl[innerStart : innerStart+closeIdx]
-		val := lookup(key, ctx)
-
-		switch v := val.(type) {
-		case []interface{}:
-			for i, item := range v {
-				itemCtx := make(map[string]interface{})
-				if m, ok := item.(map[string]interface{}); ok {
-					for k, val := range m {
-						itemCtx[k] = val
-					}
-				}
-				itemCtx["@index"] = i
-				itemCtx["@first"] = i == 0
-				itemCtx["@last"] = i == len(v)-1
-				itemCtx["."] = item
-				result.WriteString(render(inner, itemCtx))
+		end += start
+		tag := tmpl[start : end+2]
+		inner, _, _ := whitespaceControl(tmpl[start+2 : end])
+		inner = strings.TrimSpace(inner)
+		pos = end + 2
+
+		switch {
+		case strings.HasPrefix(inner, "!"):
+			continue
+		case strings.HasPrefix(inner, "#"), strings.HasPrefix(inner, "^"):
+			name := strings.TrimSpace(inner[1:])
+			if name == "" {
+				errs = append(errs, newSourceError(tmpl, start, "section tag %s has no name", tag))
+				continue
 			}
-		case map[string]interface{}:
-			keys := make([]string, 0, len(v))
-			for k := range v {
-				keys = append(keys, k)
-			}
-			for i, k := range keys {
-				item := v[k]
-				itemCtx := make(map[string]interface{})
-				if m, ok := item.(map[string]interface{}); ok {
-					for key, val := range m {
-						itemCtx[key] = val
-					}
+			if helper, arg := splitHelper(name); arg != "" && inner[0] == '#' {
+				if _, ok := blockHelpers[helper]; ok {
+					name = helper
 				}
-				itemCtx["@key"] = k
-				itemCtx["@index"] = i
-				itemCtx["@first"] = i == 0
-				itemCtx["@last"] = i == len(keys)-1
-				itemCtx["."] = item
-				result.WriteString(render(inner, itemCtx))
 			}
-		}
-
-		pos = innerStart + closeIdx + len(closeTag)
-	}
-
-	return result.String()
-}
-
-func render(tmpl string, ctx map[string]interface{}) string {
-	// Remove comments: {{! ... }}
-	commentRe := regexp.MustCompile(`(?s)\{\{!.*?\}\}`)
-	tmpl = commentRe.ReplaceAllString(tmpl, "")
-
-	// Process {{#each key}}...{{/each}}
-	tmpl = processEach(tmpl, ctx)
-
-	// Process sections: {{#key}}...{{/key}}
-	tmpl = processSection(tmpl, ctx, false)
-
-	// Process inverted sections: {{^key}}...{{/key}}
-	tmpl = processSection(tmpl, ctx, true)
-
-	// Process variables
-	varRe := regexp.MustCompile(`\{\{([^#^/}]+)\}\}`)
-	tmpl = varRe.ReplaceAllStringFunc(tmpl, func(match string) string {
-		submatches := varRe.FindStringSubmatch(match)
-		if len(submatches) < 2 {
-			return match
-		}
-		key := strings.TrimSpace(submatches[1])
-		val := lookup(key, ctx)
-		// Handle special "." lookup for non-dict items in lists
-		if key == "." {
-			if dotVal, ok := ctx["."]; ok {
-				return fmt.Sprintf("%v", dotVal)
+			stack = append(stack, openTag{name: name, tag: tag, pos: start})
+		case strings.HasPrefix(inner, "/"):
+			name := strings.TrimSpace(inner[1:])
+			if len(stack) == 0 {
+				errs = append(errs, newSourceError(tmpl, start, "closing tag %s has no matching open tag", tag))
+				continue
+			}
+			top := stack[len(stack)-1]
+			if top.name != name {
+				openErr := newSourceError(tmpl, top.pos, "")
+				errs = append(errs, newSourceError(tmpl, start, "closing tag %s does not match %s opened at %d:%d",
+					tag, top.tag, openErr.Line, openErr.Col))
+				continue
+			}
+			stack = stack[:len(stack)-1]
+		case inner == "else" || strings.HasPrefix(inner, "else "):
+			if len(stack) == 0 || !isElseTag(inner, stack[len(stack)-1].name) {
+				errs = append(errs, newSourceError(tmpl, start, "%s is not inside an if, unless, each or with block", tag))
+				continue
 			}
+			top := &stack[len(stack)-1]
+			if top.hasElse {
+				errs = append(errs, newSourceError(tmpl, start, "%s follows the {{else}} of %s", tag, top.tag))
+			}
+			top.hasElse = inner == "else"
+		case inner == "":
+			errs = append(errs, newSourceError(tmpl, start, "empty tag"))
 		}
-		return fmt.Sprintf("%v", val)
-	})
-
-	return tmpl
+	}
+	for _, open := range stack {
+		errs = append(errs, newSourceError(tmpl, open.pos, "unclosed section %s", open.tag))
+	}
+	return errs
 }
 
 // parseModelString parses "provider/model" format
@@ -455,70 +426,73 @@ func parseModelString(modelStr string) (string, string) {
 	return parts[0], parts[1]
 }
 
-// getProviderConfig returns URL and API key for a provider
-func getProviderConfig(provider string) (string, string) {
+// getProviderConfig returns URL and API key for a provider. A non-empty
+// baseURL replaces the provider's default endpoint host and path prefix.
+func getProviderConfig(provider, model, baseURL string) (string, string, error) {
 	config, ok := providers[provider]
 	if !ok {
-		fmt.Fprintf(os.Stderr, "Unknown provider: %s\n", provider)
-		os.Exit(1)
+		return "", "", fmt.Errorf("unknown provider: %s", provider)
 	}
 	apiKey := os.Getenv(config.Env)
-	if apiKey == "" {
-		fmt.Fprintf(os.Stderr, "Missing API key: %s\n", config.Env)
-		os.Exit(1)
+	if apiKey == "" && !config.OptionalKey {
+		return "", "", fmt.Errorf("missing API key: %s", config.Env)
 	}
-	return config.URL, apiKey
-}
-
-// buildSchemaTool builds a tool definition from output schema
-func buildSchemaTool(schema map[string]interface{}) map[string]interface{} {
-	properties := make(map[string]interface{})
-	required := []string{}
-
-	for key, value := range schema {
-		cleanKey := strings.TrimSuffix(key, "?")
-		isOptional := strings.HasSuffix(key, "?")
-
-		var typeStr, description string
-		if s, ok := value.(string); ok {
-			parts := strings.SplitN(s, ",", 2)
-			typeStr = strings.TrimSpace(parts[0])
-			if len(parts) > 1 {
-				description = strings.TrimSpace(parts[1])
-			}
-		} else {
-			typeStr = "string"
-		}
 
-		jsonType := "string"
-		switch typeStr {
-		case "number":
-			jsonType = "number"
-		case "boolean":
-			jsonType = "boolean"
+	url := config.URL
+	if baseURL != "" {
+		url = withBaseURL(baseURL, config.URL)
+	} else if url == "" {
+		return "", "", fmt.Errorf("provider %s requires baseURL or RUNPROMPT_BASE_URL", provider)
+	}
+	if config.EndpointEnv != "" && strings.Contains(url, "{endpoint}") {
+		endpoint := strings.TrimRight(os.Getenv(config.EndpointEnv), "/")
+		if endpoint == "" {
+			return "", "", fmt.Errorf("missing endpoint: %s", config.EndpointEnv)
 		}
+		url = strings.ReplaceAll(url, "{endpoint}", endpoint)
+	}
+	apiVersion := os.Getenv("AZURE_OPENAI_API_VERSION")
+	if apiVersion == "" {
+		apiVersion = azureAPIVersion
+	}
+	url = strings.ReplaceAll(url, "{model}", model)
+	url = strings.ReplaceAll(url, "{apiVersion}", apiVersion)
+	return url, apiKey, nil
+}
 
-		prop := map[string]interface{}{"type": jsonType}
-		if description != "" {
-			prop["description"] = description
-		}
-		properties[cleanKey] = prop
+// withBaseURL builds an endpoint URL from a base URL such as
+// http://localhost:8000/v1, appending the chat path the provider expects
+// unless the base URL already includes it
+func withBaseURL(baseURL, defaultURL string) string {
+	path := "/chat/completions"
+	if strings.HasSuffix(defaultURL, "/messages") {
+		path = "/messages"
+	}
+	baseURL = strings.TrimRight(baseURL, "/")
+	if strings.HasSuffix(baseURL, path) {
+		return baseURL
+	}
+	return baseURL + path
+}
 
-		if !isOptional {
-			required = append(required, cleanKey)
-		}
+// getBaseURL returns the per-prompt endpoint override, preferring the
+// RUNPROMPT_BASE_URL env var over the baseURL frontmatter key
+func getBaseURL(meta map[string]interface{}) string {
+	if baseURL, ok := meta["base_url"].(string); ok && baseURL != "" {
+		return baseURL
 	}
+	baseURL, _ := meta["baseURL"].(string)
+	return baseURL
+}
 
+// buildSchemaTool builds a tool definition from output schema
+func buildSchemaTool(schema map[string]interface{}) map[string]interface{} {
 	return map[string]interface{}{
 		"type": "function",
 		"function": map[string]interface{}{
 			"name":        "extract",
 			"description": "Extract structured data",
-			"parameters": map[string]interface{}{
-				"type":       "object",
-				"properties": properties,
-				"required":   required,
-			},
+			"parameters":  picoschemaObject(schema),
 		},
 	}
 }
@@ -554,200 +528,314 @@ func extractErrorMessage(errorBody string) string {
 	return errorBody
 }
 
-// loadTestResponse loads a .test-response file
-func loadTestResponse(path string) map[string]interface{} {
-	testFile := path + ".test-response"
-	content, err := os.ReadFile(testFile)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Test response file not found: %s\n", testFile)
-		os.Exit(1)
-	}
-	log(fmt.Sprintf("Loaded test response from: %s", testFile))
-
-	var response map[string]interface{}
-	if err := json.Unmarshal(content, &response); err != nil {
-		fmt.Fprintf(os.Stderr, "Error parsing test response: %v\n", err)
-		os.Exit(1)
-	}
-	return response
-}
-
-// saveResponse saves API response to file
-func saveResponse(response map[string]interface{}, provider, savePath string) {
-	responseWithProvider := map[string]interface{}{"_provider": provider}
-	for k, v := range response {
-		responseWithProvider[k] = v
+// makeRequest makes an API request to the provider. When stream is set, the
+// provider's SSE endpoint is used and tokens are written to it as they arrive.
+// The request is sent with client, and is bounded by ctx, or by the limits'
+// call timeout if ctx has no deadline of its own, and its body and response
+// by the size limits. extra
+// headers are sent over the provider's own, beneath the adapter's auth
+// headers. The returned Exchange records the request alongside the decoded
+// response.
+func makeRequest(ctx context.Context, client *http.Client, url, apiKey, model string, messages []Message, outputConfig map[string]interface{}, tools []Tool, gen GenerationConfig, signing *Signing, extra map[string]string, provider string, stream io.Writer, limits Limits) (*Exchange, error) {
+	var schema map[string]interface{}
+	if outputConfig != nil {
+		schema, _ = outputConfig["schema"].(map[string]interface{})
 	}
+	adapter := adapterFor(provider)
+	body, headers := adapter.BuildRequest(model, messages, schema, tools, gen, apiKey)
+	headers["Content-Type"] = "application/json"
 
-	data, _ := json.MarshalIndent(responseWithProvider, "", "  ")
-	if err := os.WriteFile(savePath, data, 0644); err != nil {
-		fmt.Fprintf(os.Stderr, "Error saving response: %v\n", err)
+	if stream != nil && !adapter.Capabilities().Streaming {
+		log(fmt.Sprintf("Provider %s does not support streaming; waiting for the full response", provider))
+		stream = nil
 	}
-	log(fmt.Sprintf("Saved response to: %s", savePath))
-}
-
-// makeRequest makes an API request to the provider
-func makeRequest(url, apiKey, model, prompt string, outputConfig map[string]interface{}, provider string) map[string]interface{} {
-	client := &http.Client{Timeout: timeout}
-
-	var body map[string]interface{}
-	headers := map[string]string{
-		"Content-Type": "application/json",
-	}
-
-	if provider == "anthropic" {
-		headers["x-api-key"] = apiKey
-		headers["anthropic-version"] = "2023-06-01"
-		body = map[string]interface{}{
-			"model":      model,
-			"max_tokens": 4096,
-			"messages":   []map[string]interface{}{{"role": "user", "content": prompt}},
-		}
-		if outputConfig != nil {
-			if schema, ok := outputConfig["schema"].(map[string]interface{}); ok && len(schema) > 0 {
-				tool := buildSchemaTool(schema)
-				funcDef := tool["function"].(map[string]interface{})
-				body["tools"] = []map[string]interface{}{{
-					"name":         funcDef["name"],
-					"description":  funcDef["description"],
-					"input_schema": funcDef["parameters"],
-				}}
-				body["tool_choice"] = map[string]interface{}{"type": "tool", "name": "extract"}
-			}
-		}
-	} else {
-		headers["Authorization"] = fmt.Sprintf("Bearer %s", apiKey)
-		body = map[string]interface{}{
-			"model":    model,
-			"messages": []map[string]interface{}{{"role": "user", "content": prompt}},
-		}
-		if outputConfig != nil {
-			if schema, ok := outputConfig["schema"].(map[string]interface{}); ok && len(schema) > 0 {
-				tool := buildSchemaTool(schema)
-				body["tools"] = []interface{}{tool}
-				body["tool_choice"] = map[string]interface{}{
-					"type":     "function",
-					"function": map[string]interface{}{"name": "extract"},
-				}
-			}
-		}
+	if stream != nil {
+		body["stream"] = true
 	}
 
 	jsonBody, _ := json.Marshal(body)
+	if err := limits.checkRequestSize(jsonBody); err != nil {
+		return nil, err
+	}
 	log(fmt.Sprintf("Request URL: %s", url))
 	log(fmt.Sprintf("Request body: %s", string(jsonBody)))
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonBody))
+	if _, ok := ctx.Deadline(); !ok && limits.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.CallTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonBody))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating request: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("creating request: %v", err)
 	}
 
+	req.Header.Set("User-Agent", userAgent())
+	for k, v := range providers[provider].Headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range extra {
+		req.Header.Set(k, v)
+	}
 	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
+	if signing != nil {
+		if err := signing.Sign(req.Header, jsonBody, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	exchange := &Exchange{URL: url, Header: req.Header.Clone(), Body: body, Started: time.Now()}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s%v%s\n", red, err, reset)
-		os.Exit(1)
+		return nil, err
 	}
 	defer resp.Body.Close()
+	responseReader := limits.responseReader(resp.Body)
+
+	if stream != nil && resp.StatusCode < 400 {
+		var received strings.Builder
+		response, err := adapter.ParseStream(responseReader, io.MultiWriter(stream, &received))
+		if err != nil {
+			// End the partially streamed line before the error is reported
+			fmt.Fprintln(os.Stderr)
+			var tooLarge *limitError
+			if errors.As(err, &tooLarge) {
+				return nil, err
+			}
+			return nil, &streamInterruptedError{Received: received.String(), Cause: err}
+		}
+		exchange.Duration = time.Since(exchange.Started)
+		exchange.Status = resp.StatusCode
+		exchange.Response = response
+		return exchange, nil
+	}
 
-	responseBody, _ := io.ReadAll(resp.Body)
+	responseBody, err := io.ReadAll(responseReader)
+	if err != nil {
+		return nil, err
+	}
 	log(fmt.Sprintf("Response: %s", string(responseBody)))
 
 	if resp.StatusCode >= 400 {
 		message := extractErrorMessage(string(responseBody))
-		fmt.Fprintf(os.Stderr, "%s%s%s\n", red, message, reset)
-		os.Exit(1)
+		if wait, ok := retryAfter(resp.Header, time.Now()); ok && retryStatus(resp.StatusCode) {
+			return nil, &retryAfterError{Status: resp.StatusCode, Wait: wait, Message: message}
+		}
+		return nil, fmt.Errorf("%s", message)
 	}
 
 	var response map[string]interface{}
 	if err := json.Unmarshal(responseBody, &response); err != nil {
-		fmt.Fprintf(os.Stderr, "Error parsing response: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("parsing response: %v", err)
 	}
 
-	return response
+	exchange.Duration = time.Since(exchange.Started)
+	exchange.Status = resp.StatusCode
+	exchange.Response = response
+	return exchange, nil
 }
 
-// extractResponse extracts the content from API response
-func extractResponse(response map[string]interface{}, outputConfig map[string]interface{}, provider string) string {
-	if provider == "anthropic" {
-		content, ok := response["content"].([]interface{})
-		if !ok {
-			return ""
+// applyOverrides applies RUNPROMPT_* environment variable overrides.
+// Variables named like credentials, such as RUNPROMPT_API_KEY, are skipped so
+// that a key never becomes a setting that is logged or shown.
+func applyOverrides(meta map[string]interface{}) map[string]interface{} {
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 {
+			continue
 		}
-		for _, block := range content {
-			b, ok := block.(map[string]interface{})
-			if !ok {
-				continue
-			}
-			if b["type"] == "tool_use" {
-				input, _ := b["input"].(map[string]interface{})
-				result, _ := json.MarshalIndent(input, "", "  ")
-				return string(result)
+		key := parts[0]
+		value := parts[1]
+		if strings.HasPrefix(key, "RUNPROMPT_") && !secretSetting(key) {
+			metaKey := strings.ToLower(key[10:])
+			parsed := parseYAMLValue(value)
+			if parsed != nil {
+				log(fmt.Sprintf("Override from env %s: %v", key, parsed))
+				meta[metaKey] = parsed
 			}
-			if b["type"] == "text" {
-				text, _ := b["text"].(string)
-				return text
+		}
+	}
+	return meta
+}
+
+// mergeMaps deep-merges src into dst: nested maps are merged key by key,
+// any other value in src replaces the one in dst
+func mergeMaps(dst, src map[string]interface{}) map[string]interface{} {
+	for k, v := range src {
+		srcMap, srcIsMap := v.(map[string]interface{})
+		dstMap, dstIsMap := dst[k].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			copied := make(map[string]interface{}, len(dstMap))
+			for dk, dv := range dstMap {
+				copied[dk] = dv
 			}
+			dst[k] = mergeMaps(copied, srcMap)
+		} else {
+			dst[k] = v
 		}
-		return ""
 	}
+	return dst
+}
 
-	// OpenAI-compatible format
-	choices, ok := response["choices"].([]interface{})
-	if !ok || len(choices) == 0 {
-		return ""
+// matchCondition evaluates a when: condition against the environment.
+// "NAME=value" and "NAME!=value" compare an environment variable; a bare
+// word such as "prod" matches the RUNPROMPT_ENV environment variable.
+func matchCondition(cond string) bool {
+	cond = strings.TrimSpace(cond)
+	if i := strings.Index(cond, "!="); i != -1 {
+		return os.Getenv(strings.TrimSpace(cond[:i])) != strings.TrimSpace(cond[i+2:])
 	}
-	choice, ok := choices[0].(map[string]interface{})
-	if !ok {
-		return ""
+	if i := strings.Index(cond, "="); i != -1 {
+		return os.Getenv(strings.TrimSpace(cond[:i])) == strings.TrimSpace(cond[i+1:])
 	}
-	message, ok := choice["message"].(map[string]interface{})
+	return os.Getenv("RUNPROMPT_ENV") == cond
+}
+
+// applyWhen merges every when: block whose condition matches into the
+// frontmatter, in sorted condition order, and removes the when: key
+func applyWhen(meta map[string]interface{}, trace *configTrace) map[string]interface{} {
+	when, ok := meta["when"].(map[string]interface{})
 	if !ok {
-		return ""
+		return meta
 	}
-	toolCalls, ok := message["tool_calls"].([]interface{})
-	if ok && len(toolCalls) > 0 {
-		tc, ok := toolCalls[0].(map[string]interface{})
-		if ok {
-			fn, ok := tc["function"].(map[string]interface{})
-			if ok {
-				args, _ := fn["arguments"].(string)
-				return args
+	delete(meta, "when")
+
+	conds := make([]string, 0, len(when))
+	for cond := range when {
+		conds = append(conds, cond)
+	}
+	sort.Strings(conds)
+	for _, cond := range conds {
+		block, ok := when[cond].(map[string]interface{})
+		if !ok || !matchCondition(cond) {
+			continue
+		}
+		log(fmt.Sprintf("Applying when: %s", cond))
+		mergeMaps(meta, block)
+		trace.stage(meta, "when: "+cond)
+	}
+	return meta
+}
+
+// pickVariant chooses a variant name by weight (default 1) given r in [0, 1)
+func pickVariant(variants map[string]interface{}, r float64) string {
+	names := make([]string, 0, len(variants))
+	for name := range variants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	weights := make([]float64, len(names))
+	total := 0.0
+	for i, name := range names {
+		weights[i] = 1
+		if v, ok := variants[name].(map[string]interface{}); ok {
+			switch w := v["weight"].(type) {
+			case int:
+				weights[i] = float64(w)
+			case float64:
+				weights[i] = w
 			}
 		}
+		if weights[i] < 0 {
+			weights[i] = 0
+		}
+		total += weights[i]
+	}
+
+	target := r * total
+	for i, name := range names {
+		if target < weights[i] {
+			return name
+		}
+		target -= weights[i]
+	}
+	if len(names) == 0 {
+		return ""
 	}
-	content, _ := message["content"].(string)
-	return content
+	return names[len(names)-1]
 }
 
-// applyOverrides applies RUNPROMPT_* environment variable overrides
-func applyOverrides(meta map[string]interface{}) map[string]interface{} {
-	for _, env := range os.Environ() {
-		parts := strings.SplitN(env, "=", 2)
-		if len(parts) != 2 {
-			continue
+// applyVariant selects a variant from the variants: frontmatter block, either
+// the requested one or a weighted random pick, and applies its overrides.
+// A variant's template key replaces the prompt template. It returns the
+// updated metadata, template and the name of the variant that was applied.
+func applyVariant(meta map[string]interface{}, template, requested string) (map[string]interface{}, string, string, error) {
+	variants, ok := meta["variants"].(map[string]interface{})
+	if !ok || len(variants) == 0 {
+		if requested != "" {
+			return nil, "", "", fmt.Errorf("variant %q requested but the prompt declares no variants", requested)
 		}
-		key := parts[0]
-		value := parts[1]
-		if strings.HasPrefix(key, "RUNPROMPT_") {
-			metaKey := strings.ToLower(key[10:])
-			parsed := parseYAMLValue(value)
-			if parsed != nil {
-				log(fmt.Sprintf("Override from env %s: %v", key, parsed))
-				meta[metaKey] = parsed
+		return meta, template, "", nil
+	}
+
+	name := requested
+	if name == "" {
+		name = pickVariant(variants, rand.Float64())
+	}
+	variant, ok := variants[name]
+	if !ok {
+		names := make([]string, 0, len(variants))
+		for n := range variants {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, "", "", fmt.Errorf("unknown variant %q (available: %s)", name, strings.Join(names, ", "))
+	}
+
+	delete(meta, "variants")
+	if overrides, ok := variant.(map[string]interface{}); ok {
+		for k, v := range overrides {
+			switch k {
+			case "weight":
+			case "template":
+				if t, ok := v.(string); ok {
+					template = t
+				}
+			default:
+				mergeMaps(meta, map[string]interface{}{k: v})
 			}
 		}
 	}
-	return meta
+	return meta, template, name, nil
+}
+
+// boolFlags are options that never take a separate value, so the argument
+// after them is not consumed (--stream file.prompt)
+var boolFlags = map[string]bool{
+	"stream":        true,
+	"reset-session": true,
+	"force":         true,
+	"strict":        true,
+	"show-config":   true,
+	"estimate":      true,
+	"json":          true,
+	"batch":         true,
+	"safe":          true,
+	"map-reduce":    true,
+}
+
+// listFlags are options that may be given more than once, collecting
+// their values in a list (--then a.prompt --then b.prompt)
+var listFlags = map[string]bool{
+	"then": true,
+}
+
+// setOverride records an option's value, appending to the list of a
+// listFlags option
+func setOverride(overrides map[string]interface{}, key string, value interface{}) {
+	if !listFlags[key] {
+		overrides[key] = value
+		return
+	}
+	list, _ := overrides[key].([]interface{})
+	overrides[key] = append(list, value)
 }
 
 // parseArgs parses command line arguments
-func parseArgs(args []string) (bool, string, map[string]interface{}, []string) {
+func parseArgs(args []string) (bool, string, map[string]interface{}, []string, error) {
 	verboseFlag := false
 	saveResponsePath := ""
 	overrides := make(map[string]interface{})
@@ -762,22 +850,21 @@ func parseArgs(args []string) (bool, string, map[string]interface{}, []string) {
 				i++
 				saveResponsePath = args[i]
 			} else {
-				fmt.Fprintln(os.Stderr, "--save-response requires a file path")
-				os.Exit(1)
+				return false, "", nil, nil, fmt.Errorf("--save-response requires a file path")
 			}
 		} else if strings.HasPrefix(arg, "--save-response=") {
 			saveResponsePath = arg[len("--save-response="):]
 		} else if strings.HasPrefix(arg, "--") {
 			if strings.Contains(arg, "=") {
 				parts := strings.SplitN(arg[2:], "=", 2)
-				overrides[parts[0]] = parseYAMLValue(parts[1])
+				setOverride(overrides, parts[0], parseYAMLValue(parts[1]))
 			} else {
 				key := arg[2:]
-				if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") && !boolFlags[key] {
 					i++
-					overrides[key] = parseYAMLValue(args[i])
+					setOverride(overrides, key, parseYAMLValue(args[i]))
 				} else {
-					overrides[key] = true
+					setOverride(overrides, key, true)
 				}
 			}
 		} else {
@@ -785,7 +872,7 @@ func parseArgs(args []string) (bool, string, map[string]interface{}, []string) {
 		}
 	}
 
-	return verboseFlag, saveResponsePath, overrides, remaining
+	return verboseFlag, saveResponsePath, overrides, remaining, nil
 }
 
 // readStdin reads from stdin if available
@@ -801,43 +888,586 @@ func readStdin() string {
 	return strings.TrimSpace(string(data))
 }
 
-func main() {
-	verboseFlag, saveResponsePath, argOverrides, remaining := parseArgs(os.Args[1:])
-	verbose = verboseFlag
+// preparePrompt loads a prompt file and resolves its effective metadata
+// with resolvePrompt, then checks its runtime settings such as the timeout.
+// It returns the metadata, template and the name of the variant in use.
+func preparePrompt(path string, argOverrides map[string]interface{}) (map[string]interface{}, string, string, error) {
+	return tracePrompt(path, argOverrides, nil)
+}
+
+// tracePrompt is preparePrompt, recording where each setting came from in
+// trace
+func tracePrompt(path string, argOverrides map[string]interface{}, trace *configTrace) (map[string]interface{}, string, string, error) {
+	path = localizedPath(path, requestedLocale(argOverrides))
+	meta, template, err := parsePromptFile(path)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("reading prompt file: %v", err)
+	}
+	trace.stage(meta, path)
+	meta, template, variant, err := resolvePrompt(meta, template, argOverrides, trace)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if err := applyRuntimeSettings(meta); err != nil {
+		return nil, "", "", err
+	}
+	return meta, template, variant, nil
+}
 
-	if len(remaining) < 1 {
-		fmt.Fprintln(os.Stderr, "Usage: runprompt [-v] [--save-response <file>] [--key=value ...] <prompt_file>")
-		os.Exit(1)
+// resolvePrompt applies when: blocks, the selected variant, config files,
+// RUNPROMPT_* env vars and overrides to parsed metadata, in increasing order
+// of precedence. Each step is recorded in trace, which may be nil.
+func resolvePrompt(meta map[string]interface{}, template string, argOverrides map[string]interface{}, trace *configTrace) (map[string]interface{}, string, string, error) {
+	meta = applyWhen(meta, trace)
+
+	requestedVariant := os.Getenv("RUNPROMPT_VARIANT")
+	if v, ok := argOverrides["variant"]; ok {
+		requestedVariant = fmt.Sprintf("%v", v)
+		delete(argOverrides, "variant")
+	}
+	meta, template, variant, err := applyVariant(meta, template, requestedVariant)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if variant != "" {
+		log(fmt.Sprintf("Using variant: %s", variant))
+		trace.stage(meta, "variant "+variant)
 	}
+	safe, _ := argOverrides["safe"].(bool)
+	if safe {
+		restrictPrompt(meta)
+	}
+	delete(argOverrides, "safe")
+	allowed, restricted := meta["allowedModels"]
 
-	promptPath = remaining[0]
-	meta, template, err := parsePromptFile(promptPath)
+	files, err := loadSettings()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading prompt file: %v\n", err)
-		os.Exit(1)
+		return nil, "", "", fmt.Errorf("loading config: %v", err)
+	}
+	global := filepath.Join(configDir(), "config.yaml")
+	for _, file := range files {
+		if safe && file.Path != global {
+			// The project config comes with the prompts, not from the user
+			restrictPrompt(file.Settings)
+		}
+		mergeMaps(meta, file.Settings)
+		trace.stage(meta, file.Path)
 	}
 
 	meta = applyOverrides(meta)
+	trace.stageFunc(meta, func(key string) string { return "$RUNPROMPT_" + strings.ToUpper(key) })
+	if v, ok := argOverrides["strict"]; ok {
+		// --strict is shorthand for strictVariables
+		argOverrides["strictVariables"] = v
+		delete(argOverrides, "strict")
+	}
+	if v, ok := argOverrides["fault-inject"]; ok {
+		argOverrides["faultInject"] = v
+		delete(argOverrides, "fault-inject")
+	}
+	for flag, key := range limitFlags {
+		if v, ok := argOverrides[flag]; ok {
+			setLimit(meta, key, v)
+			delete(argOverrides, flag)
+		}
+	}
 	for key, value := range argOverrides {
 		log(fmt.Sprintf("Override from arg --%s: %v", key, value))
 		meta[key] = value
 	}
+	trace.stageFunc(meta, func(key string) string { return "--" + key })
+	if err := normalizeModelList(meta); err != nil {
+		return nil, "", "", err
+	}
+	if err := applyModelAliases(meta); err != nil {
+		return nil, "", "", err
+	}
+	keepAllowedModels(meta, allowed, restricted)
+	return meta, template, variant, nil
+}
+
+// setLimit sets one setting of the limits: block, leaving the block that
+// meta came with unchanged
+func setLimit(meta map[string]interface{}, key string, value interface{}) {
+	limits := map[string]interface{}{}
+	if block, ok := meta["limits"].(map[string]interface{}); ok {
+		for k, v := range block {
+			limits[k] = v
+		}
+	}
+	limits[key] = value
+	meta["limits"] = limits
+}
 
+// resolveModel returns the provider and model named by the model key
+func resolveModel(meta map[string]interface{}) (string, string, error) {
 	modelStr, _ := meta["model"].(string)
 	if modelStr == "" {
-		fmt.Fprintln(os.Stderr, "No model specified in prompt file")
-		os.Exit(1)
+		return "", "", fmt.Errorf("no model specified in prompt file")
 	}
 
 	provider, model := parseModelString(modelStr)
 	if provider == "" {
-		fmt.Fprintln(os.Stderr, "No provider in model string")
-		os.Exit(1)
+		return "", "", fmt.Errorf("no provider in model string")
 	}
+	return provider, model, nil
+}
 
-	rawInput := readStdin()
-	variables := map[string]interface{}{"STDIN": rawInput}
+func main() {
+	ansi, restoreConsole := setupConsole()
+	if !ansi {
+		red, reset = "", ""
+	}
+	// Ctrl-C cancels ctx, which aborts any request in flight
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		// Restore the default handling, so a second Ctrl-C exits at once
+		<-ctx.Done()
+		stop()
+	}()
+	err := run(ctx, os.Args[1:])
+	interrupted := ctx.Err() != nil
+	stop()
+	status := report(os.Stderr, err, interrupted)
+	restoreConsole()
+	if status != 0 {
+		os.Exit(status)
+	}
+}
+
+// exitInterrupted is the exit status of a run cancelled by Ctrl-C, the
+// shell's 128 plus the signal number
+const exitInterrupted = 130
+
+// report prints the error a run ended with and returns the exit status: 1,
+// or exitInterrupted if the run failed because it was interrupted
+func report(w io.Writer, err error, interrupted bool) int {
+	var usage usageError
+	var stream *streamInterruptedError
+	switch {
+	case err == nil:
+		return 0
+	case interrupted && errors.As(err, &stream) && stream.Received != "":
+		fmt.Fprintf(w, "%sinterrupted after %d characters, the reply above is incomplete%s\n", red, len([]rune(stream.Received)), reset)
+		return exitInterrupted
+	case interrupted:
+		fmt.Fprintf(w, "%sinterrupted%s\n", red, reset)
+		return exitInterrupted
+	case errors.As(err, &usage):
+		fmt.Fprintln(w, err)
+	default:
+		fmt.Fprintf(w, "%s%v%s\n", red, err, reset)
+	}
+	return 1
+}
+
+// runCommand implements runprompt run, which is also the bare form:
+// render a prompt with stdin as input, send it and print the result
+func runCommand(ctx context.Context, args []string) error {
+	verboseFlag, saveResponsePath, argOverrides, remaining, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+	verbose = verbose || verboseFlag
+	if len(remaining) != 1 {
+		return commandUsage("run")
+	}
+	path := remaining[0]
+
+	session := ""
+	if v, ok := argOverrides["session"]; ok {
+		session = fmt.Sprintf("%v", v)
+		delete(argOverrides, "session")
+	}
+	reset, _ := argOverrides["reset-session"].(bool)
+	delete(argOverrides, "reset-session")
+	force, _ := argOverrides["force"].(bool)
+	delete(argOverrides, "force")
+	estimate, _ := argOverrides["estimate"].(bool)
+	delete(argOverrides, "estimate")
+	batch, _ := argOverrides["batch"].(bool)
+	delete(argOverrides, "batch")
+	mapReduce, _ := argOverrides["map-reduce"].(bool)
+	delete(argOverrides, "map-reduce")
+	for _, flag := range []string{"rate", "progress", "input-format"} {
+		if _, ok := argOverrides[flag]; ok && !batch {
+			return fmt.Errorf("--%s requires --batch", flag)
+		}
+	}
+	_, setConcurrency := argOverrides["concurrency"]
+	if setConcurrency && !batch && !mapReduce {
+		return fmt.Errorf("--concurrency requires --batch or --map-reduce")
+	}
+	concurrency, rate, err := batchFlags(argOverrides)
+	if err != nil {
+		return err
+	}
+	if mapReduce && !setConcurrency {
+		concurrency = defaultMapConcurrency
+	}
+	chunkTokens, reduce, err := mapReduceFlags(argOverrides, mapReduce)
+	if err != nil {
+		return err
+	}
+	progressMode := "auto"
+	if v, ok := argOverrides["progress"]; ok {
+		progressMode = fmt.Sprintf("%v", v)
+		delete(argOverrides, "progress")
+	}
+	inputFormat := "jsonl"
+	if v, ok := argOverrides["input-format"]; ok {
+		inputFormat = fmt.Sprintf("%v", v)
+		delete(argOverrides, "input-format")
+	}
+	if inputFormat != "jsonl" && inputFormat != "csv" {
+		return fmt.Errorf("--input-format must be jsonl or csv, got %q", inputFormat)
+	}
+	// --output json prints a runSummary instead of the bare result, and
+	// --json is short for it
+	outputFormat := "text"
+	if v, ok := argOverrides["output"]; ok {
+		outputFormat = fmt.Sprintf("%v", v)
+		delete(argOverrides, "output")
+	}
+	if jsonFlag, _ := argOverrides["json"].(bool); jsonFlag {
+		outputFormat = "json"
+	}
+	delete(argOverrides, "json")
+	if outputFormat != "text" && outputFormat != "json" {
+		return fmt.Errorf("--output must be text or json, got %q", outputFormat)
+	}
+	jsonOutput := outputFormat == "json"
+	extract := ""
+	if v, ok := argOverrides["extract"]; ok {
+		extract = fmt.Sprintf("%v", v)
+		delete(argOverrides, "extract")
+	}
+	fifo := ""
+	if v, ok := argOverrides["output-fifo"]; ok {
+		fifo = fmt.Sprintf("%v", v)
+		delete(argOverrides, "output-fifo")
+	}
+	var models []string
+	if v, ok := argOverrides["models"]; ok {
+		delete(argOverrides, "models")
+		if models, err = parseModelList(v); err != nil {
+			return err
+		}
+	}
+	var chain []string
+	if v, ok := argOverrides["then"]; ok {
+		delete(argOverrides, "then")
+		if chain, err = thenPrompts(v); err != nil {
+			return err
+		}
+	}
+	snapshotFile, snapshot, err := snapshotFlags(argOverrides)
+	if err != nil {
+		return err
+	}
+	if reset && session == "" {
+		return fmt.Errorf("--reset-session requires --session <name>")
+	}
+	if batch && (snapshotFile != "" || snapshot != nil) {
+		return fmt.Errorf("--batch can't be combined with --snapshot-vars or --from-snapshot")
+	}
+	if batch && (session != "" || estimate || fifo != "" || saveResponsePath != "") {
+		return fmt.Errorf("--batch can't be combined with --session, --estimate, --output-fifo or --save-response")
+	}
+	if models != nil && (batch || session != "" || estimate || fifo != "" || saveResponsePath != "") {
+		return fmt.Errorf("--models can't be combined with --batch, --session, --estimate, --output-fifo or --save-response")
+	}
+	if chain != nil && (batch || models != nil || session != "" || estimate || fifo != "") {
+		return fmt.Errorf("--then can't be combined with --batch, --models, --session, --estimate or --output-fifo")
+	}
+	if mapReduce && (batch || models != nil || session != "" || estimate || snapshotFile != "" || snapshot != nil) {
+		return fmt.Errorf("--map-reduce can't be combined with --batch, --models, --session, --estimate, --snapshot-vars or --from-snapshot")
+	}
+	if show, _ := argOverrides["show-config"].(bool); show {
+		delete(argOverrides, "show-config")
+		trace := newConfigTrace()
+		if _, _, _, err := tracePrompt(path, argOverrides, trace); err != nil {
+			return err
+		}
+		trace.write(os.Stdout)
+		return nil
+	}
+
+	overrides := copyOverrides(argOverrides)
+	meta, template, variant, err := preparePrompt(path, argOverrides)
+	if err != nil {
+		return err
+	}
+	if err := checkRequiredEnv(meta); err != nil {
+		return err
+	}
+	provider, model, err := resolveModel(meta)
+	if err != nil {
+		return err
+	}
+	if batch {
+		outputConfig, _ := meta["output"].(map[string]interface{})
+		files, err := outputFiles(outputConfig)
+		if err != nil {
+			return err
+		}
+		sinks, err := parseSinks(outputConfig)
+		if err != nil {
+			return err
+		}
+		total := countBatchLines(os.Stdin)
+		var in batchInput = newLineInput(os.Stdin)
+		var results batchOutput = newJSONLOutput(os.Stdout)
+		if inputFormat == "csv" {
+			// Less the header, and approximate when fields span lines
+			total = max(total-1, 0)
+			csvIn, err := newCSVInput(os.Stdin)
+			if err != nil {
+				return fmt.Errorf("reading batch input: %v", err)
+			}
+			in = csvIn
+			if !jsonOutput {
+				if results, err = newCSVOutput(os.Stdout, csvIn.header); err != nil {
+					return err
+				}
+			}
+		}
+		progress, err := newBatchProgress(progressMode, model, total)
+		if err != nil {
+			return err
+		}
+		base := promptRun{path: path, meta: meta, variant: variant, provider: provider, model: model}
+		opts := batchOptions{concurrency: concurrency, rate: rate, extract: extract, files: files, sinks: sinks, force: force, progress: progress}
+		return runBatch(ctx, in, results, base, template, opts)
+	}
+
+	var history []Message
+	if reset {
+		if err := resetSession(session); err != nil {
+			return err
+		}
+	} else if session != "" {
+		if history, err = loadSession(session); err != nil {
+			return fmt.Errorf("loading session: %v", err)
+		}
+	}
+
+	var variables map[string]interface{}
+	if mapReduce {
+		// The prompt runs on each chunk of the input, and the reduce prompt,
+		// or the prompt again, on their results joined as its input
+		input := readStdin()
+		var partials []string
+		base := promptRun{path: path, meta: meta, variant: variant, provider: provider, model: model}
+		if partials, err = mapChunks(ctx, base, template, input, chunkTokens, concurrency); err != nil {
+			return err
+		}
+		if partials != nil {
+			input = strings.Join(partials, "\n\n")
+			if reduce != "" {
+				log(fmt.Sprintf("Reducing the results of %d chunks with %s", len(partials), reduce))
+				path = reduce
+				if meta, template, variant, err = preparePrompt(path, copyOverrides(overrides)); err != nil {
+					return err
+				}
+				if err := checkRequiredEnv(meta); err != nil {
+					return err
+				}
+				if provider, model, err = resolveModel(meta); err != nil {
+					return err
+				}
+			}
+		}
+		variables, err = inputVariables(input, meta)
+	} else {
+		variables, err = snapshotVariables(snapshot, path, meta)
+	}
+	if err != nil {
+		return err
+	}
+	if snapshotFile != "" {
+		if err := writeVarSnapshot(snapshotFile, path, variant, overrides, variables); err != nil {
+			return err
+		}
+	}
+	messages, err := renderPromptMessages(compileMessages(template), variables, meta)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		log(fmt.Sprintf("Rendered %s message: %s", m.Role, m.Content))
+	}
+	messages = withSession(history, messages)
+	if estimate {
+		// Count what would be sent and stop short of sending it
+		gen, err := generationConfig(meta)
+		if err != nil {
+			return err
+		}
+		writeEstimate(ctx, os.Stdout, provider, model, messages, gen)
+		return nil
+	}
+	if models != nil {
+		aliases, _ := modelAliases(meta)
+		for i, m := range models {
+			if models[i], err = resolveAlias(aliases, m); err != nil {
+				return err
+			}
+			if provider, _ := parseModelString(models[i]); provider == "" {
+				return fmt.Errorf("--models: no provider in model string %q", m)
+			}
+		}
+		// Comparisons are printed, not written to output.files or sinks
+		base := promptRun{path: path, meta: meta, variant: variant, messages: messages}
+		return runCompare(ctx, base, models, extract, jsonOutput)
+	}
+
+	outputConfig, _ := meta["output"].(map[string]interface{})
+	files, err := outputFiles(outputConfig)
+	if err != nil {
+		return err
+	}
+	sinks, err := parseSinks(outputConfig)
+	if err != nil {
+		return err
+	}
+	mediaFiles, err := mediaPath(outputConfig)
+	if err != nil {
+		return err
+	}
+	stream, _ := meta["stream"].(bool)
+	var out io.WriteCloser
+	if fifo != "" {
+		// The reply streams to the FIFO, and stdout still gets the result
+		if out, err = openOutputFifo(fifo); err != nil {
+			return fmt.Errorf("opening --output-fifo: %v", err)
+		}
+		defer out.Close()
+		stream = true
+	}
+	if stream && extract != "" && out == nil {
+		log("Output is extracted from the whole response, not streaming")
+		stream = false
+	}
+	if stream && chain != nil {
+		log("Output is passed on to --then, not streaming")
+		stream = false
+	}
 
+	pr := promptRun{
+		path:     path,
+		meta:     meta,
+		variant:  variant,
+		provider: provider,
+		model:    model,
+		messages: messages,
+		stream:   stream,
+		out:      out,
+		savePath: saveResponsePath,
+	}
+	if stream && jsonOutput && out == nil {
+		// Still streamed, to time the reply, but only the JSON is printed
+		pr.out = io.Discard
+	}
+	c, err := complete(ctx, pr)
+	if err != nil {
+		var limit *limitError
+		if jsonOutput && errors.As(err, &limit) {
+			// Scripts read why the run stopped, and what it used, from the
+			// envelope rather than stderr
+			summary := summarize(pr, c)
+			summary.Output, summary.State, summary.Error = nil, limit.State, limit.Detail
+			if err := writeSummary(summary); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+	var mediaWritten []string
+	if len(c.Media) > 0 {
+		// Media is written to files, and its data: URLs replaced by their paths
+		mediaWritten, err = writeMedia(mediaFiles, c.Media, variables, path, force)
+		for _, path := range mediaWritten {
+			fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+		}
+		if err != nil {
+			return err
+		}
+		c.Result = replaceInlineMedia(c.Result, c.Media, mediaWritten)
+		c.Reply = replaceInlineMedia(c.Reply, c.Media, mediaWritten)
+	}
+	result := c.Result
+	switch {
+	case out != nil && !c.Streamed:
+		fmt.Fprintln(out, result)
+	case out != nil:
+		fmt.Fprintln(out)
+	case c.Streamed && !jsonOutput:
+		// End the line the tokens were written on as they arrived
+		fmt.Println()
+	}
+
+	if len(files) > 0 {
+		written, err := writeOutputFiles(files, result, variables, force)
+		for _, path := range written {
+			fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if session != "" {
+		turn := append(messages[len(history):len(messages):len(messages)], Message{Role: "assistant", Content: c.Reply})
+		if err := appendSession(session, turn); err != nil {
+			return fmt.Errorf("saving session: %v", err)
+		}
+	}
+	summary := summarize(pr, c)
+	summary.Media = mediaWritten
+	if chain != nil {
+		// The first prompt's sinks get its own output, and the chain's last
+		// output is what's printed
+		if err := deliverSinks(ctx, sinks, pr, c, variables); err != nil {
+			return err
+		}
+		sinks = nil
+		if summary, err = runChain(ctx, chain, c.Result, overrides, force); err != nil {
+			return err
+		}
+		result = formatExtracted(summary.Output)
+	}
+	if extract != "" {
+		var data interface{}
+		if err := json.Unmarshal([]byte(result), &data); err != nil {
+			return fmt.Errorf("--extract needs a JSON response: %v", err)
+		}
+		value, err := extractPath(data, extract)
+		if err != nil {
+			return fmt.Errorf("--extract %s: %v", extract, err)
+		}
+		result = formatExtracted(value)
+		summary.Output = value
+	}
+	if jsonOutput {
+		if err := writeSummary(summary); err != nil {
+			return err
+		}
+	} else if !c.Streamed || out != nil {
+		fmt.Println(result)
+	}
+	return deliverSinks(ctx, sinks, pr, c, variables)
+}
+
+// inputVariables turns raw input into template variables. A JSON object
+// supplies variables directly; other input is bound to the first key of
+// input.schema, or to "input". The raw text is always available as STDIN.
+// Missing variables take their input.default values, and the result is
+// checked against input.schema.
+func inputVariables(rawInput string, meta map[string]interface{}) (map[string]interface{}, error) {
+	variables := map[string]interface{}{"STDIN": rawInput}
+	inputConfig, _ := meta["input"].(map[string]interface{})
+	inputSchema, _ := inputConfig["schema"].(map[string]interface{})
 	if rawInput != "" {
 		var parsed map[string]interface{}
 		if err := json.Unmarshal([]byte(rawInput), &parsed); err == nil {
@@ -845,45 +1475,413 @@ func main() {
 				variables[k] = v
 			}
 			log("Parsed input as JSON")
-		} else {
+		} else if len(inputSchema) > 0 {
 			log("Input is not JSON, treating as raw string")
-			if inputConfig, ok := meta["input"].(map[string]interface{}); ok {
-				if inputSchema, ok := inputConfig["schema"].(map[string]interface{}); ok && len(inputSchema) > 0 {
-					// Get first key from schema
-					for firstKey := range inputSchema {
-						variables[firstKey] = rawInput
-						break
-					}
-				} else {
-					variables["input"] = rawInput
-				}
-			} else {
-				variables["input"] = rawInput
+			// Get first key from schema
+			for firstKey := range inputSchema {
+				variables[firstKey] = rawInput
+				break
 			}
+		} else {
+			log("Input is not JSON, treating as raw string")
+			variables["input"] = rawInput
+		}
+	}
+	if locale, ok := meta["locale"].(string); ok {
+		if _, set := variables["locale"]; !set {
+			variables["locale"] = locale
 		}
 	}
+	if err := applyInputSchema(variables, inputConfig); err != nil {
+		return nil, err
+	}
+	return variables, nil
+}
+
+// promptRun is a rendered prompt ready to send to its model
+type promptRun struct {
+	path     string // the prompt file, for test fixtures and history
+	meta     map[string]interface{}
+	variant  string
+	provider string
+	model    string
+	messages []Message
+	stream   bool      // write the reply as it arrives
+	out      io.Writer // where a streamed reply is written, stdout if nil
+	savePath string    // --save-response file, if any
+	job      string    // the queue job being run, if any
+}
 
-	prompt := renderTemplate(template, variables)
-	log(fmt.Sprintf("Rendered prompt: %s", prompt))
+// completion is the outcome of a prompt run
+type completion struct {
+	Reply        string        // the model's final reply, as received
+	Result       string        // the reply after output transforms
+	Streamed     bool          // the reply was already written as it arrived
+	Requests     int           // model calls made, counting retries
+	Usage        Usage         // tokens used across all calls
+	FinishReason string        // why the final reply ended, in OpenAI's vocabulary
+	Latency      time.Duration // from the first request to the final reply
+	Stream       *streamStats  // timings of the final reply, if it was streamed
+	Fallback     string        // the fallback model that answered, if any
+	Media        []Media       // images and audio in the final reply
+}
+
+// runSummary reports a prompt run as JSON, as serve responds and
+// --output json prints. Output is the parsed JSON when the prompt declares
+// an output schema, and Content the model's reply before any transforms.
+// Cost is in USD, or null when the model's price is unknown.
+type runSummary struct {
+	Output       interface{}  `json:"output"`
+	Content      string       `json:"content"`
+	Provider     string       `json:"provider"`
+	Model        string       `json:"model"`
+	Variant      string       `json:"variant,omitempty"`
+	FinishReason string       `json:"finishReason,omitempty"`
+	Requests     int          `json:"requests"`
+	Usage        Usage        `json:"usage"`
+	Cost         *float64     `json:"cost"`
+	LatencyMs    int64        `json:"latencyMs"`
+	Stream       *streamStats `json:"stream,omitempty"`
+	Media        []string     `json:"media,omitempty"` // the files media in the reply was written to
+	State        string       `json:"state,omitempty"` // the termination state of a run a limit stopped
+	Error        string       `json:"error,omitempty"`
+}
+
+// writeSummary prints a runSummary on one line, for --output json
+func writeSummary(summary runSummary) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(summary)
+}
 
+// summarize builds the runSummary of a completed run
+func summarize(pr promptRun, c completion) runSummary {
+	modelName, _ := pr.meta["model"].(string)
+	if c.Fallback != "" {
+		modelName = c.Fallback
+		pr.provider, pr.model = parseModelString(c.Fallback)
+	}
+	summary := runSummary{
+		Output:       c.Result,
+		Content:      c.Reply,
+		Provider:     pr.provider,
+		Model:        modelName,
+		Variant:      pr.variant,
+		FinishReason: c.FinishReason,
+		Requests:     c.Requests,
+		Usage:        c.Usage,
+		Cost:         usageCost(pr.model, c.Usage),
+		LatencyMs:    c.Latency.Milliseconds(),
+		Stream:       c.Stream,
+	}
+	if outputConfig, _ := pr.meta["output"].(map[string]interface{}); outputConfig["schema"] != nil {
+		var data interface{}
+		if err := json.Unmarshal([]byte(c.Result), &data); err == nil {
+			summary.Output = data
+		}
+	}
+	return summary
+}
+
+// streamRetry reports whether a stream that fails partway is retried
+// without streaming, set by streamRetry: true
+func streamRetry(meta map[string]interface{}) bool {
+	retry, _ := meta["streamRetry"].(bool)
+	return retry
+}
+
+// complete sends a prompt run to its model, or to fallbackModels if it
+// fails, as many times at once as bestOf asks and keeping the best
+func complete(ctx context.Context, pr promptRun) (completion, error) {
+	best, err := parseBestOf(pr.meta)
+	if err != nil {
+		return completion{}, err
+	}
+	if best.N > 1 {
+		return completeBestOf(ctx, pr, best)
+	}
+	return completeFallbacks(ctx, pr)
+}
+
+// completeModel sends a prompt run to its model and applies output
+// transforms. Structured output is checked against the schema, re-prompting
+// the model with the problems found up to output.maxRetries times. A
+// response in another language than output.language is asked for again
+// once.
+func completeModel(ctx context.Context, pr promptRun) (completion, error) {
+	provider, model, meta := pr.provider, pr.model, pr.meta
+	modelStr, _ := meta["model"].(string)
+	if err := checkAllowedModel(meta, modelStr); err != nil {
+		return completion{}, err
+	}
 	outputConfig, _ := meta["output"].(map[string]interface{})
+	transforms, err := parseTransforms(outputConfig["transform"])
+	if err != nil {
+		return completion{}, err
+	}
+	rules, err := parseOutputRules(outputConfig)
+	if err != nil {
+		return completion{}, err
+	}
+	language, err := outputLanguage(outputConfig)
+	if err != nil {
+		return completion{}, err
+	}
+	tools, err := parseTools(meta)
+	if err != nil {
+		return completion{}, err
+	}
+	if provider != "test" {
+		var closeMCP func()
+		if tools, closeMCP, err = connectMCPServers(ctx, meta, tools); err != nil {
+			return completion{}, err
+		}
+		defer closeMCP()
+	}
+	if len(tools) > 0 && provider != "test" && !adapterFor(provider).Capabilities().Tools {
+		fmt.Fprintf(os.Stderr, "Warning: provider %s isn't known to support tool calling, sending the prompt's tools anyway\n", provider)
+	}
 
-	var result string
-	if provider == "test" {
-		response := loadTestResponse(promptPath)
-		testProvider, _ := response["_provider"].(string)
-		if testProvider == "" {
-			testProvider = "openai"
+	// Without tool support, or with tools of the prompt's own to call, ask
+	// for JSON in the prompt and validate locally
+	messages := pr.messages
+	requestOutput := outputConfig
+	schema, _ := outputConfig["schema"].(map[string]interface{})
+	validateLocally := len(schema) > 0 && provider != "test" && (len(tools) > 0 || !usesTools(provider, outputConfig))
+	if validateLocally {
+		log("Requesting JSON through instructions, not a tool call")
+		messages = appendToLastUser(messages, schemaInstructions(schema))
+		requestOutput = nil
+	}
+	stream := pr.stream
+	if stream && (len(transforms) > 0 || len(schema) > 0 || rules != nil || language != "") {
+		log("Output is transformed or validated as a whole, not streaming")
+		stream = false
+	}
+	if stream && len(tools) > 0 {
+		log("Tools may be called before the answer, not streaming")
+		stream = false
+	}
+	out := pr.out
+	if out == nil {
+		out = os.Stdout
+	}
+	streamTo := func() io.Writer {
+		if stream {
+			return out
 		}
-		result = extractResponse(response, outputConfig, testProvider)
-	} else {
-		url, apiKey := getProviderConfig(provider)
-		response := makeRequest(url, apiKey, model, prompt, outputConfig, provider)
-		if saveResponsePath != "" {
-			saveResponse(response, provider, saveResponsePath)
+		return nil
+	}
+
+	var url, apiKey string
+	var gen GenerationConfig
+	var signing *Signing
+	var headers map[string]string
+	if provider != "test" {
+		if url, apiKey, err = getProviderConfig(provider, model, getBaseURL(meta)); err != nil {
+			return completion{}, err
+		}
+		if headers, err = requestHeaders(meta, provider); err != nil {
+			return completion{}, err
+		}
+		if gen, err = generationConfig(meta); err != nil {
+			return completion{}, err
+		}
+		if signing, err = signingFor(meta, provider); err != nil {
+			return completion{}, err
+		}
+	}
+	limits, err := runLimits(meta)
+	if err != nil {
+		return completion{}, err
+	}
+	client, err := providerClient(meta)
+	if err != nil {
+		return completion{}, err
+	}
+	if limits.TotalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.TotalTimeout)
+		defer cancel()
+	}
+	var usage Usage
+	var served modelVersion
+	var finishReason string
+	var media []Media
+	var calls []ToolCall
+	var streamed *streamStats
+	requests := 0
+	started := time.Now()
+	send := func(conversation []Message) (string, error) {
+		if provider == "test" {
+			response, err := loadTestResponse(pr.path)
+			if err != nil {
+				return "", err
+			}
+			testProvider, _ := response["_provider"].(string)
+			if testProvider == "" {
+				testProvider = "openai"
+			}
+			result := extractResponse(response, outputConfig, testProvider)
+			finishReason, media = result.FinishReason, result.Media
+			return result.Text, result.refused()
+		}
+		if err := limits.checkBudget(ctx, provider, model, conversation, gen, usage); err != nil {
+			return "", err
+		}
+		var meter *streamMeter
+		exchange, err := limits.retryRateLimited(ctx, func() (*Exchange, error) {
+			// Zero means the call has no deadline of its own
+			callCtx, cancel := ctx, context.CancelFunc(func() {})
+			if limits.CallTimeout > 0 {
+				callCtx, cancel = context.WithTimeout(ctx, limits.CallTimeout)
+			}
+			defer cancel()
+			var w io.Writer
+			meter = nil
+			if to := streamTo(); to != nil {
+				meter = newStreamMeter(to)
+				w = meter
+			}
+			exchange, err := makeRequest(callCtx, client, url, apiKey, model, conversation, requestOutput, tools, gen, signing, headers, provider, w, limits)
+			var interrupted *streamInterruptedError
+			if errors.As(err, &interrupted) && callCtx.Err() == nil && streamRetry(meta) {
+				fmt.Fprintf(os.Stderr, "%v\nRetrying without streaming\n", err)
+				if interrupted.Received != "" {
+					// Keep the complete reply off the partial one's line
+					fmt.Fprintln(out)
+				}
+				stream, meter = false, nil
+				exchange, err = makeRequest(callCtx, client, url, apiKey, model, conversation, requestOutput, tools, gen, signing, headers, provider, nil, limits)
+			}
+			if err != nil {
+				return nil, limits.timeoutError(err, callCtx, ctx)
+			}
+			return exchange, nil
+		})
+		if err != nil {
+			return "", err
 		}
-		result = extractResponse(response, outputConfig, provider)
+		if pr.savePath != "" {
+			if err := saveResponse(exchange, provider, pr.variant, pr.savePath); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+		}
+		response := extractResponse(exchange.Response, outputConfig, provider)
+		requests++
+		served = response.version()
+		finishReason, media, calls = response.FinishReason, response.Media, response.ToolCalls
+		streamed = meter.stats(response.Usage.OutputTokens)
+		usage.InputTokens += response.Usage.InputTokens
+		usage.OutputTokens += response.Usage.OutputTokens
+		log(fmt.Sprintf("Request cost: %s", describeCost(model, response.Usage)))
+		return response.Text, response.refused()
 	}
+	defer func() {
+		if requests > 0 {
+			recordRun(meta, pr.path, provider, model, pr.variant, pr.job, requests, usage, served, streamed)
+		}
+	}()
 
-	fmt.Println(result)
+	structured := len(schema) > 0 || rules != nil
+	maxRetries := 0
+	if structured && provider != "test" {
+		if maxRetries, err = retrySetting(outputConfig); err != nil {
+			return completion{}, err
+		}
+	}
+	conversation := messages
+	var reply, result string
+	languageRetried := provider == "test"
+	// A failed run still reports what its calls used
+	failed := func(err error) (completion, error) {
+		return completion{Requests: requests, Usage: usage}, err
+	}
+	toolRounds := 0
+	for attempt := 0; ; attempt++ {
+		if reply, err = send(conversation); err != nil {
+			return failed(err)
+		}
+		if len(tools) > 0 && len(calls) > 0 {
+			// Run the tools the model called and send it their results
+			if toolRounds >= limits.MaxToolRounds {
+				return failed(&limitError{State: stopToolRounds, Detail: fmt.Sprintf("the model was still calling tools after %d rounds", toolRounds)})
+			}
+			if err := limits.checkTokens(usage); err != nil {
+				return failed(err)
+			}
+			toolRounds++
+			conversation = append(conversation[:len(conversation):len(conversation)], Message{Role: "assistant", ToolCalls: calls})
+			results, err := runToolCalls(ctx, tools, calls, limits.ToolTimeout)
+			if err != nil {
+				return failed(err)
+			}
+			conversation = append(conversation, results...)
+			// Tool rounds don't count toward output.maxRetries
+			attempt--
+			continue
+		}
+		var problems []string
+		result, err = applyTransforms(reply, transforms)
+		if err != nil {
+			problems = []string{err.Error()}
+		} else if structured {
+			if validateLocally && cleanupEnabled(outputConfig) {
+				result = extractJSONText(result)
+			}
+			if repairEnabled(outputConfig) {
+				result = repairOutput(result)
+			}
+			var value interface{}
+			if value, problems = validateStructuredOutput(result, schema); len(problems) == 0 {
+				problems = rules.check(value)
+			}
+		}
+		if len(problems) == 0 && language != "" {
+			if got, ok := detectLanguage(languageText(result)); ok && got != language {
+				if languageRetried {
+					fmt.Fprintf(os.Stderr, "Warning: response is in %s, not %s\n", languageNames[got], languageNames[language])
+					break
+				}
+				if err := limits.checkTokens(usage); err != nil {
+					return failed(err)
+				}
+				log(fmt.Sprintf("Response is in %s, not %s, asking again", languageNames[got], languageNames[language]))
+				languageRetried = true
+				conversation = append(conversation[:len(conversation):len(conversation)],
+					Message{Role: "assistant", Content: reply},
+					Message{Role: "user", Content: languagePrompt(language, got)})
+				// The corrective request doesn't count toward output.maxRetries
+				attempt--
+				continue
+			}
+		}
+		if len(problems) == 0 {
+			break
+		}
+		if attempt >= maxRetries {
+			if !structured {
+				return failed(fmt.Errorf("output transform: %s", problems[0]))
+			}
+			return failed(fmt.Errorf("response does not match the output schema:\n  %s", strings.Join(problems, "\n  ")))
+		}
+		if err := limits.checkTokens(usage); err != nil {
+			return failed(err)
+		}
+		log(fmt.Sprintf("Invalid output, retrying (%d/%d): %s", attempt+1, maxRetries, strings.Join(problems, "; ")))
+		conversation = append(conversation[:len(conversation):len(conversation)],
+			Message{Role: "assistant", Content: reply},
+			Message{Role: "user", Content: repairPrompt(problems)})
+	}
+	return completion{
+		Reply:        reply,
+		Result:       result,
+		Streamed:     stream && provider != "test",
+		Requests:     requests,
+		Usage:        usage,
+		FinishReason: finishReason,
+		Latency:      time.Since(started),
+		Stream:       streamed,
+		Media:        media,
+	}, nil
 }
@@ -1,7 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestBasicInterpolation(t *testing.T) {
@@ -236,6 +246,10 @@ func TestYAMLParsing(t *testing.T) {
 		{"boolean false", "enabled: false", map[string]interface{}{"enabled": false}},
 		{"integer", "count: 42", map[string]interface{}{"count": 42}},
 		{"float", "rate: 3.14", map[string]interface{}{"rate": 3.14}},
+		{"trailing comment", "timeout: 60   # seconds", map[string]interface{}{"timeout": 60}},
+		{"hash in word", "lang: C#", map[string]interface{}{"lang": "C#"}},
+		{"double quoted", `title: "a # b: c"`, map[string]interface{}{"title": "a # b: c"}},
+		{"single quoted", `name: 'it''s' # note`, map[string]interface{}{"name": "it's"}},
 	}
 
 	for _, tc := range tests {
@@ -250,6 +264,26 @@ func TestYAMLParsing(t *testing.T) {
 	}
 }
 
+func TestYAMLFlowSequence(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []interface{}
+	}{
+		{`["END", "STOP"]`, []interface{}{"END", "STOP"}},
+		{`[a, 'b', 3]`, []interface{}{"a", "b", 3}},
+		{`[]`, []interface{}{}},
+		{`["a, b", [1, 2]]`, []interface{}{"a, b", []interface{}{1, 2}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.value, func(t *testing.T) {
+			got := fmt.Sprintf("%#v", parseYAMLValue(tc.value))
+			if expected := fmt.Sprintf("%#v", tc.expected); got != expected {
+				t.Errorf("Expected %s, got %s", expected, got)
+			}
+		})
+	}
+}
+
 func TestParseModelString(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -275,3 +309,560 @@ func TestParseModelString(t *testing.T) {
 		})
 	}
 }
+
+func TestGetProviderConfigAzure(t *testing.T) {
+	t.Setenv("AZURE_OPENAI_API_KEY", "secret")
+	t.Setenv("AZURE_OPENAI_ENDPOINT", "https://example.openai.azure.com/")
+	t.Setenv("AZURE_OPENAI_API_VERSION", "2024-06-01")
+
+	url, apiKey, err := getProviderConfig("azureopenai", "my-deployment", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "https://example.openai.azure.com/openai/deployments/my-deployment/chat/completions?api-version=2024-06-01"
+	if url != expected {
+		t.Errorf("URL: Expected %q, got %q", expected, url)
+	}
+	if apiKey != "secret" {
+		t.Errorf("API key: Expected %q, got %q", "secret", apiKey)
+	}
+}
+
+func TestGetProviderConfigErrors(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "")
+	t.Setenv("AZURE_OPENAI_API_KEY", "secret")
+	t.Setenv("AZURE_OPENAI_ENDPOINT", "")
+
+	tests := []struct {
+		name     string
+		provider string
+		expected string
+	}{
+		{"unknown provider", "nope", "unknown provider: nope"},
+		{"missing key", "openai", "missing API key: OPENAI_API_KEY"},
+		{"missing endpoint", "azureopenai", "missing endpoint: AZURE_OPENAI_ENDPOINT"},
+		{"custom without base URL", "custom", "provider custom requires baseURL or RUNPROMPT_BASE_URL"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := getProviderConfig(tc.provider, "model", "")
+			if err == nil || err.Error() != tc.expected {
+				t.Errorf("Expected %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestSplitFrontmatter(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		meta     string
+		template string
+		line     int
+		ok       bool
+	}{
+		{"basic", "---\nmodel: test\n---\nHello", "model: test", "Hello", 4, true},
+		{"no frontmatter", "\n\nHello\n\n", "", "Hello", 3, false},
+		{"crlf", "---\r\nmodel: test\r\n---\r\nHello\r\nWorld\r\n", "model: test", "Hello\nWorld", 4, true},
+		{"bom", "\uFEFF---\nmodel: test\n---\nHello", "model: test", "Hello", 4, true},
+		{"delimiter trailing spaces", "---  \nmodel: test\n---\t\nHello", "model: test", "Hello", 4, true},
+		{"leading indentation kept", "---\nmodel: test\n---\n\n    indented\n", "model: test", "    indented", 5, true},
+		{"dashes in body", "---\nmodel: test\n---\nA\n---\nB", "model: test", "A\n---\nB", 4, true},
+		{"unterminated", "---\nmodel: test\nHello", "", "---\nmodel: test\nHello", 1, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			meta, template, line, ok := splitFrontmatter(tc.content)
+			if meta != tc.meta || template != tc.template || line != tc.line || ok != tc.ok {
+				t.Errorf("Expected (%q, %q, %d, %v), got (%q, %q, %d, %v)",
+					tc.meta, tc.template, tc.line, tc.ok, meta, template, line, ok)
+			}
+		})
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		expected []string
+	}{
+		{"balanced", "{{#a}}{{#each b}}{{.}}{{/each}}{{/a}}{{^c}}x{{/c}}", nil},
+		{"comment with braces", "{{! {{#a}} }}ok", nil},
+		{"unclosed section", "Hi\n  {{#items}}x", []string{"2:3: unclosed section {{#items}}"}},
+		{"stray close", "{{/a}}", []string{"1:1: closing tag {{/a}} has no matching open tag"}},
+		{"mismatched close", "{{#a}}\n{{/b}}", []string{"2:1: closing tag {{/b}} does not match {{#a}} opened at 1:1",
+			"1:1: unclosed section {{#a}}"}},
+		{"unterminated tag", "Hello {{name", []string{"1:7: unterminated tag, missing }}"}},
+		{"empty tag", "{{ }}", []string{"1:1: empty tag"}},
+		{"if else", "{{#if a}}x{{else if b}}y{{else}}z{{/if}}{{#unless c}}{{/unless}}", nil},
+		{"each else", "{{#each a}}x{{else}}none{{/each}}", nil},
+		{"with else", "{{#with a}}{{b}}{{else}}none{{/with}}", nil},
+		{"unclosed if", "{{#if a}}x", []string{"1:1: unclosed section {{#if a}}"}},
+		{"stray else", "a{{else}}b", []string{"1:2: {{else}} is not inside an if, unless, each or with block"}},
+		{"else in section", "{{#a}}{{else}}{{/a}}", []string{"1:7: {{else}} is not inside an if, unless, each or with block"}},
+		{"second else", "{{#if a}}{{else}}{{else}}{{/if}}", []string{"1:18: {{else}} follows the {{else}} of {{#if a}}"}},
+		{"whitespace control", "{{~#if a~}} {{~else~}} {{~/if~}}{{~! c ~}}", nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			errs := checkTemplate(tc.template)
+			if len(errs) != len(tc.expected) {
+				t.Fatalf("Expected %d errors, got %d: %v", len(tc.expected), len(errs), errs)
+			}
+			for i, e := range errs {
+				got := fmt.Sprintf("%d:%d: %s", e.Line, e.Col, e.Msg)
+				if got != tc.expected[i] {
+					t.Errorf("Expected %q, got %q", tc.expected[i], got)
+				}
+			}
+		})
+	}
+}
+
+func TestSourceErrorFormat(t *testing.T) {
+	err := &sourceError{File: "a.prompt", Line: 7, Col: 3, Msg: "unclosed section {{#x}}", Text: "\t {{#x}}"}
+	expected := "a.prompt:7:3: unclosed section {{#x}}\n    \t {{#x}}\n    \t ^"
+	if err.Error() != expected {
+		t.Errorf("Expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestParsePromptFileErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.prompt")
+	content := "---\nmodel: test\nnot yaml\n---\n\nHello {{#name}}"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := parsePromptFile(path)
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	for _, want := range []string{path + ":3:1: expected \"key: value\"", path + ":6:7: unclosed section {{#name}}"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to contain %q, got %q", want, err.Error())
+		}
+	}
+}
+
+func TestGetProviderConfigBaseURL(t *testing.T) {
+	t.Setenv("CUSTOM_API_KEY", "")
+	t.Setenv("OPENAI_API_KEY", "sk-test")
+	tests := []struct {
+		name     string
+		provider string
+		baseURL  string
+		expected string
+	}{
+		{"custom", "custom", "http://localhost:8000/v1", "http://localhost:8000/v1/chat/completions"},
+		{"custom trailing slash", "custom", "http://localhost:1234/v1/", "http://localhost:1234/v1/chat/completions"},
+		{"custom full path", "custom", "http://gw/v1/chat/completions", "http://gw/v1/chat/completions"},
+		{"openai override", "openai", "https://gateway.example.com/openai/v1", "https://gateway.example.com/openai/v1/chat/completions"},
+		{"anthropic override", "anthropic", "https://gateway.example.com/v1", "https://gateway.example.com/v1/messages"},
+	}
+
+	t.Setenv("ANTHROPIC_API_KEY", "sk-ant")
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			url, _, err := getProviderConfig(tc.provider, "model", tc.baseURL)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if url != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, url)
+			}
+		})
+	}
+}
+
+func TestNamedPrompts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "multi.prompt")
+	content := `---
+model: openai/gpt-4o
+---
+Shared notes are ignored.
+
+--- name: summarize ---
+Summarize: {{text}}
+
+--- name: translate ---
+---
+model: anthropic/claude-3
+---
+Translate: {{text}}
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		model    string
+		template string
+	}{
+		{"summarize", "openai/gpt-4o", "Summarize: {{text}}"},
+		{"translate", "anthropic/claude-3", "Translate: {{text}}"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			meta, template, err := parsePromptFile(path + "#" + tc.name)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if meta["model"] != tc.model {
+				t.Errorf("Model: Expected %q, got %v", tc.model, meta["model"])
+			}
+			if template != tc.template {
+				t.Errorf("Template: Expected %q, got %q", tc.template, template)
+			}
+		})
+	}
+
+	if _, _, err := parsePromptFile(path); err == nil || !strings.Contains(err.Error(), "available: summarize, translate") {
+		t.Errorf("Expected error listing available prompts, got %v", err)
+	}
+	if _, _, err := parsePromptFile(path + "#missing"); err == nil {
+		t.Error("Expected error for missing prompt name")
+	}
+}
+
+func TestNamedPromptErrorLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "multi.prompt")
+	content := "--- name: a ---\nfine\n--- name: b ---\n\nbroken {{#x}}\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := parsePromptFile(path + "#b")
+	if err == nil || !strings.Contains(err.Error(), path+":5:8: unclosed section") {
+		t.Errorf("Expected error at line 5, got %v", err)
+	}
+}
+
+func TestPickVariant(t *testing.T) {
+	variants := map[string]interface{}{
+		"A": map[string]interface{}{"weight": 3},
+		"B": map[string]interface{}{"weight": 1},
+	}
+	tests := []struct {
+		r        float64
+		expected string
+	}{
+		{0, "A"},
+		{0.74, "A"},
+		{0.75, "B"},
+		{0.99, "B"},
+	}
+	for _, tc := range tests {
+		if got := pickVariant(variants, tc.r); got != tc.expected {
+			t.Errorf("r=%v: Expected %q, got %q", tc.r, tc.expected, got)
+		}
+	}
+}
+
+func TestApplyVariant(t *testing.T) {
+	meta := map[string]interface{}{
+		"model":  "openai/gpt-4o-mini",
+		"config": map[string]interface{}{"temperature": 0.2, "maxOutputTokens": 100},
+		"variants": map[string]interface{}{
+			"A": map[string]interface{}{},
+			"B": map[string]interface{}{
+				"model":    "openai/gpt-4o",
+				"config":   map[string]interface{}{"temperature": 0.9},
+				"template": "Be terse: {{STDIN}}",
+			},
+		},
+	}
+	meta, template, name, err := applyVariant(meta, "{{STDIN}}", "B")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if name != "B" || template != "Be terse: {{STDIN}}" || meta["model"] != "openai/gpt-4o" {
+		t.Errorf("Variant not applied: name=%q template=%q model=%v", name, template, meta["model"])
+	}
+	config := meta["config"].(map[string]interface{})
+	if config["temperature"] != 0.9 || config["maxOutputTokens"] != 100 {
+		t.Errorf("Expected config to be deep-merged, got %v", config)
+	}
+
+	if _, _, _, err := applyVariant(map[string]interface{}{}, "", "B"); err == nil {
+		t.Error("Expected error when requesting a variant without variants")
+	}
+}
+
+func TestApplyWhen(t *testing.T) {
+	t.Setenv("RUNPROMPT_ENV", "prod")
+	t.Setenv("REGION", "eu")
+
+	meta := map[string]interface{}{
+		"model":  "openai/gpt-4o-mini",
+		"config": map[string]interface{}{"temperature": 0.7, "maxOutputTokens": 200},
+		"when": map[string]interface{}{
+			"prod":       map[string]interface{}{"model": "openai/gpt-4o", "config": map[string]interface{}{"temperature": 0.1}},
+			"dev":        map[string]interface{}{"model": "test"},
+			"REGION=eu":  map[string]interface{}{"baseURL": "https://eu.example.com/v1"},
+			"REGION!=eu": map[string]interface{}{"baseURL": "https://us.example.com/v1"},
+		},
+	}
+	meta = applyWhen(meta, nil)
+
+	if meta["model"] != "openai/gpt-4o" {
+		t.Errorf("Model: Expected %q, got %v", "openai/gpt-4o", meta["model"])
+	}
+	if meta["baseURL"] != "https://eu.example.com/v1" {
+		t.Errorf("baseURL: Expected eu endpoint, got %v", meta["baseURL"])
+	}
+	config := meta["config"].(map[string]interface{})
+	if config["temperature"] != 0.1 || config["maxOutputTokens"] != 200 {
+		t.Errorf("Expected config to be deep-merged, got %v", config)
+	}
+	if _, ok := meta["when"]; ok {
+		t.Error("Expected when: to be removed")
+	}
+}
+
+func TestParseArgsBoolFlags(t *testing.T) {
+	_, _, overrides, remaining, err := parseArgs([]string{"--stream", "a.prompt", "--session", "work", "--reset-session"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(remaining) != 1 || remaining[0] != "a.prompt" {
+		t.Errorf("Expected [a.prompt], got %v", remaining)
+	}
+	if overrides["stream"] != true || overrides["reset-session"] != true {
+		t.Errorf("Expected bool flags set, got %v", overrides)
+	}
+	if overrides["session"] != "work" {
+		t.Errorf("Expected session %q, got %v", "work", overrides["session"])
+	}
+}
+
+func TestMakeRequestDeadline(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := makeRequest(ctx, httpClient, server.URL, "", "model", nil, nil, nil, GenerationConfig{}, nil, nil, "custom", nil, Limits{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+
+	_, err = makeRequest(context.Background(), httpClient, server.URL, "", "model", nil, nil, nil, GenerationConfig{}, nil, nil, "custom", nil, Limits{CallTimeout: 50 * time.Millisecond})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected configured timeout to apply, got %v", err)
+	}
+}
+
+func TestRunRepairsInvalidOutput(t *testing.T) {
+	replies := []string{`{"name": 5}`, "```json\n{\"name\": \"Ann\"}\n```"}
+	var requests []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, body)
+		reply := replies[min(len(requests), len(replies))-1]
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{
+				"message": map[string]interface{}{"role": "assistant", "content": reply},
+			}},
+		})
+	}))
+	defer server.Close()
+
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("RUNPROMPT_BASE_URL", server.URL)
+	path := filepath.Join(t.TempDir(), "extract.prompt")
+	prompt := "---\nmodel: custom/x\noutput:\n  schema:\n    name: string\n---\nExtract the name."
+	if err := os.WriteFile(path, []byte(prompt), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run(context.Background(), []string{path}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(requests))
+	}
+	messages := requests[1]["messages"].([]interface{})
+	last := messages[len(messages)-1].(map[string]interface{})
+	if !strings.Contains(last["content"].(string), "$.name: expected string, got number") {
+		t.Errorf("Expected repair prompt with validation error, got %v", last["content"])
+	}
+
+	requests = nil
+	replies = []string{`{"name": 5}`}
+	prompt = strings.Replace(prompt, "output:\n", "output:\n  maxRetries: 0\n", 1)
+	if err := os.WriteFile(path, []byte(prompt), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(context.Background(), []string{path}); err == nil {
+		t.Error("Expected schema error without retries")
+	}
+	if len(requests) != 1 {
+		t.Errorf("Expected 1 request, got %d", len(requests))
+	}
+
+	records, err := readHistory(historyPath(), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Requests != 2 || records[1].Requests != 1 {
+		t.Errorf("Expected runs of 2 and 1 requests in history, got %+v", records)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	replies := []string{`{"name": 5}`, `{"name": "Ann"}`}
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{
+				"message":       map[string]interface{}{"role": "assistant", "content": replies[min(calls, len(replies))-1]},
+				"finish_reason": "stop",
+			}},
+			"usage": map[string]interface{}{"prompt_tokens": 1000, "completion_tokens": 100},
+		})
+	}))
+	defer server.Close()
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+
+	pr := promptRun{
+		path: "extract.prompt",
+		meta: map[string]interface{}{
+			"model":   "custom/gpt-4o",
+			"baseURL": server.URL,
+			"output":  map[string]interface{}{"schema": map[string]interface{}{"name": "string"}},
+		},
+		provider: "custom",
+		model:    "gpt-4o",
+		messages: []Message{{Role: "user", Content: "Extract the name."}},
+	}
+	c, err := complete(context.Background(), pr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.Latency <= 0 {
+		t.Errorf("Expected the run's latency, got %v", c.Latency)
+	}
+	c.Latency = 1500 * time.Millisecond
+	data, _ := json.Marshal(summarize(pr, c))
+	expected := `{"output":{"name":"Ann"},"content":"{\"name\": \"Ann\"}","provider":"custom","model":"custom/gpt-4o",` +
+		`"finishReason":"stop","requests":2,"usage":{"inputTokens":2000,"outputTokens":200},"cost":0.007,"latencyMs":1500}`
+	if string(data) != expected {
+		t.Errorf("Expected %s, got %s", expected, data)
+	}
+}
+
+func TestRunRepairsRuleViolations(t *testing.T) {
+	replies := []string{`{"start": "2024-05-01", "end": "2024-04-01"}`, `{"start": "2024-04-01", "end": "2024-05-01"}`}
+	var requests []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, body)
+		reply := replies[min(len(requests), len(replies))-1]
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{
+				"message": map[string]interface{}{"role": "assistant", "content": reply},
+			}},
+		})
+	}))
+	defer server.Close()
+
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("RUNPROMPT_BASE_URL", server.URL)
+	path := filepath.Join(t.TempDir(), "dates.prompt")
+	prompt := "---\nmodel: custom/x\noutput:\n  schema:\n    start: string\n    end: string\n  rules: [\"end >= start\"]\n---\nExtract the dates."
+	if err := os.WriteFile(path, []byte(prompt), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run(context.Background(), []string{path}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(requests))
+	}
+	messages := requests[1]["messages"].([]interface{})
+	last := messages[len(messages)-1].(map[string]interface{})
+	if !strings.Contains(last["content"].(string), `rule "end >= start" failed`) {
+		t.Errorf("Expected repair prompt with the failed rule, got %v", last["content"])
+	}
+}
+
+func TestRunInterruptedStream(t *testing.T) {
+	var streamed []bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		stream, _ := body["stream"].(bool)
+		streamed = append(streamed, stream)
+		if stream {
+			// The connection closes before the response finishes
+			fmt.Fprint(w, `data: {"choices":[{"index":0,"delta":{"content":"Par"}}]}`+"\n\n")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{
+				"message": map[string]interface{}{"role": "assistant", "content": "Partial no more"},
+			}},
+		})
+	}))
+	defer server.Close()
+
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("RUNPROMPT_BASE_URL", server.URL)
+	path := filepath.Join(t.TempDir(), "stream.prompt")
+	if err := os.WriteFile(path, []byte("---\nmodel: custom/x\nstream: true\n---\nHi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := run(context.Background(), []string{path})
+	expected := "response stream interrupted after 3 characters, the reply above is incomplete: the connection closed before the response finished"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected %q, got %v", expected, err)
+	}
+
+	streamed = nil
+	if err := run(context.Background(), []string{"--streamRetry=true", path}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(streamed) != 2 || !streamed[0] || streamed[1] {
+		t.Errorf("Expected a streamed request then a retry without streaming, got %v", streamed)
+	}
+}
+
+func TestReport(t *testing.T) {
+	tests := []struct {
+		err         error
+		interrupted bool
+		status      int
+		expected    string
+	}{
+		{nil, false, 0, ""},
+		{nil, true, 0, ""},
+		{errors.New("no model specified"), false, 1, "no model specified"},
+		{usageError("usage: runprompt"), false, 1, "usage: runprompt\n"},
+		{context.Canceled, true, exitInterrupted, "interrupted"},
+	}
+	for _, tc := range tests {
+		var buf strings.Builder
+		if status := report(&buf, tc.err, tc.interrupted); status != tc.status || !strings.Contains(buf.String(), tc.expected) {
+			t.Errorf("%v: expected %d and %q, got %d and %q", tc.err, tc.status, tc.expected, status, buf.String())
+		}
+	}
+}
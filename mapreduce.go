@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// defaultChunkTokens is the size --map-reduce splits input into when
+// --chunk-tokens doesn't set it
+const defaultChunkTokens = 4000
+
+// defaultMapConcurrency is how many chunks are sent at once when
+// --concurrency doesn't say
+const defaultMapConcurrency = 4
+
+// mapReduceFlags takes --chunk-tokens and --reduce out of the overrides,
+// which are only used with --map-reduce
+func mapReduceFlags(argOverrides map[string]interface{}, mapReduce bool) (int, string, error) {
+	chunkTokens, reduce := defaultChunkTokens, ""
+	_, setChunk := argOverrides["chunk-tokens"]
+	_, setReduce := argOverrides["reduce"]
+	if (setChunk || setReduce) && !mapReduce {
+		return 0, "", fmt.Errorf("--chunk-tokens and --reduce require --map-reduce")
+	}
+	if v, ok := argOverrides["chunk-tokens"]; ok {
+		delete(argOverrides, "chunk-tokens")
+		n, ok := v.(int)
+		if !ok || n < 1 {
+			return 0, "", fmt.Errorf("--chunk-tokens must be a positive integer, got %v", v)
+		}
+		chunkTokens = n
+	}
+	if v, ok := argOverrides["reduce"]; ok {
+		delete(argOverrides, "reduce")
+		if reduce, ok = v.(string); !ok || reduce == "" {
+			return 0, "", fmt.Errorf("--reduce needs a prompt file")
+		}
+	}
+	return chunkTokens, reduce, nil
+}
+
+// chunkText splits text into chunks of at most limit tokens, between
+// paragraphs where it can, then lines, then words. A word longer than a
+// chunk is cut, at the average number of characters per token.
+func chunkText(text string, limit int, count func(string) int) []string {
+	var chunks []string
+	for _, c := range splitText(text, limit, count, []string{"\n\n", "\n", " "}) {
+		if c = strings.TrimSpace(c); c != "" {
+			chunks = append(chunks, c)
+		}
+	}
+	return chunks
+}
+
+func splitText(text string, limit int, count func(string) int, seps []string) []string {
+	if count(text) <= limit {
+		return []string{text}
+	}
+	if len(seps) == 0 {
+		var chunks []string
+		runes := []rune(text)
+		for size := limit * charsPerToken; len(runes) > 0; runes = runes[min(size, len(runes)):] {
+			chunks = append(chunks, string(runes[:min(size, len(runes))]))
+		}
+		return chunks
+	}
+	// Pieces are packed into chunks while their counts, which are close
+	// to additive at whitespace, fit
+	sep := seps[0]
+	sepTokens := count(sep)
+	var chunks []string
+	current, size := "", 0
+	for _, piece := range strings.Split(text, sep) {
+		n := count(piece)
+		if current != "" && size+sepTokens+n <= limit {
+			current, size = current+sep+piece, size+sepTokens+n
+			continue
+		}
+		if current != "" {
+			chunks = append(chunks, current)
+		}
+		if n <= limit {
+			current, size = piece, n
+			continue
+		}
+		parts := splitText(piece, limit, count, seps[1:])
+		chunks = append(chunks, parts[:len(parts)-1]...)
+		current = parts[len(parts)-1]
+		size = count(current)
+	}
+	if current != "" {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// mapChunks implements the map half of --map-reduce: it splits input into
+// chunks of chunkTokens, renders the prompt with each as its input and
+// CHUNK and CHUNKS as its number and the count, and returns the results in
+// order. Input that fits in one chunk isn't split, and gives no results.
+func mapChunks(ctx context.Context, base promptRun, template, input string, chunkTokens, concurrency int) ([]string, error) {
+	chunks := chunkText(input, chunkTokens, tokenCounter(ctx, base.provider, base.model))
+	if len(chunks) < 2 {
+		log("Input fits in one chunk, running the prompt on all of it")
+		return nil, nil
+	}
+	log(fmt.Sprintf("Split the input into %d chunks of up to %d tokens", len(chunks), chunkTokens))
+
+	// The first chunk to fail stops the rest
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([]string, len(chunks))
+	var mu sync.Mutex
+	var failed error
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func(i int, chunk string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				return
+			}
+			result, err := mapChunk(ctx, base, template, chunk, i+1, len(chunks))
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if failed == nil {
+					failed = fmt.Errorf("chunk %d of %d: %v", i+1, len(chunks), err)
+					cancel()
+				}
+				return
+			}
+			results[i] = result
+			log(fmt.Sprintf("Chunk %d of %d done", i+1, len(chunks)))
+		}(i, chunk)
+	}
+	wg.Wait()
+	if failed != nil {
+		return nil, failed
+	}
+	return results, nil
+}
+
+// mapChunk runs the prompt on chunk n of count
+func mapChunk(ctx context.Context, base promptRun, template, chunk string, n, count int) (string, error) {
+	variables, err := inputVariables(chunk, base.meta)
+	if err != nil {
+		return "", err
+	}
+	variables["CHUNK"], variables["CHUNKS"] = n, count
+	messages, err := renderPromptMessages(compileMessages(template), variables, base.meta)
+	if err != nil {
+		return "", err
+	}
+	pr := base
+	pr.messages, pr.out = messages, io.Discard
+	c, err := complete(ctx, pr)
+	if err != nil {
+		return "", err
+	}
+	return c.Result, nil
+}
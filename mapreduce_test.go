@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChunkText(t *testing.T) {
+	words := func(s string) int { return len(strings.Fields(s)) }
+	tests := []struct {
+		text     string
+		limit    int
+		count    func(string) int
+		expected []string
+	}{
+		{"a b c", 4, words, []string{"a b c"}},
+		{"a b c\n\nd e\n\nf g h i j k", 4, words, []string{"a b c", "d e", "f g h i", "j k"}},
+		{"a b\nc d\ne f", 4, words, []string{"a b\nc d", "e f"}},
+		{"abcdefghij", 1, heuristicTokens, []string{"abcd", "efgh", "ij"}},
+		{"  \n\n  ", 4, words, nil},
+	}
+	for _, tt := range tests {
+		if got := chunkText(tt.text, tt.limit, tt.count); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%q: expected %q, got %q", tt.text, tt.expected, got)
+		}
+	}
+}
+
+// echoServer replies with the last message it was sent, and fails requests
+// that mention "broken"
+func echoServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []Message `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		content := body.Messages[len(body.Messages)-1].Content
+		if strings.Contains(content, "broken") {
+			http.Error(w, `{"error":{"message":"bad chunk"}}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{
+				"message": map[string]interface{}{"role": "assistant", "content": "[" + content + "]"},
+			}},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMapChunks(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	server := echoServer(t)
+	base := promptRun{
+		path:     "summarize.prompt",
+		meta:     map[string]interface{}{"baseURL": server.URL},
+		provider: "custom",
+		model:    "x",
+	}
+	template := "Part {{CHUNK}} of {{CHUNKS}}: {{input}}"
+	input := strings.Repeat("a", 40) + "\n\n" + strings.Repeat("b", 40) + "\n\n" + strings.Repeat("c", 40)
+
+	results, err := mapChunks(context.Background(), base, template, input, 10, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []string{
+		"[Part 1 of 3: " + strings.Repeat("a", 40) + "]",
+		"[Part 2 of 3: " + strings.Repeat("b", 40) + "]",
+		"[Part 3 of 3: " + strings.Repeat("c", 40) + "]",
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %q, got %q", expected, results)
+	}
+
+	if results, err := mapChunks(context.Background(), base, template, "short", 10, 2); err != nil || results != nil {
+		t.Errorf("Expected input that fits in a chunk not to be split, got %q %v", results, err)
+	}
+
+	input = strings.Repeat("a", 40) + "\n\nbroken"
+	if _, err := mapChunks(context.Background(), base, template, input, 10, 1); err == nil || !strings.Contains(err.Error(), "chunk 2 of 2") {
+		t.Errorf("Expected the failing chunk to be named, got %v", err)
+	}
+}
+
+func TestMapReduceFlags(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeFiles(t, dir, "p.prompt", "---\nmodel: test\n---\nSummarize")
+	path := dir + "/p.prompt"
+	for _, args := range [][]string{
+		{"--chunk-tokens", "100", path},
+		{"--reduce", "combine.prompt", path},
+		{"--concurrency", "2", path},
+		{"--map-reduce", "--chunk-tokens", "0", path},
+		{"--map-reduce", "--batch", path},
+	} {
+		if err := run(context.Background(), args); err == nil {
+			t.Errorf("Expected error for %v", args)
+		}
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mcpServer is a Model Context Protocol server a prompt takes tools from,
+// declared in an mcpServers: mapping by name:
+//
+//	mcpServers:
+//	  files:
+//	    command: npx -y @modelcontextprotocol/server-filesystem .
+//	  search:
+//	    url: http://localhost:8931/sse
+//	    headers:
+//	      Authorization: Bearer abc123
+//
+// A server with a command is started for the run and spoken to on its stdin
+// and stdout; one with a url is reached over SSE.
+type mcpServer struct {
+	Name    string
+	Command string
+	Env     map[string]string
+	URL     string
+	Headers map[string]string
+}
+
+// mcpProtocolVersion is the version of MCP runprompt speaks, the one that
+// defines the stdio and SSE transports
+const mcpProtocolVersion = "2024-11-05"
+
+// mcpConnectTimeout bounds starting a server and listing its tools
+const mcpConnectTimeout = 30 * time.Second
+
+// parseMCPServers reads the MCP servers a prompt declares, in name order
+func parseMCPServers(meta map[string]interface{}) ([]mcpServer, error) {
+	v, ok := meta["mcpServers"]
+	if !ok {
+		return nil, nil
+	}
+	block, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("mcpServers must map server names to a command or url")
+	}
+	names := make([]string, 0, len(block))
+	for name := range block {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	servers := make([]mcpServer, 0, len(names))
+	for _, name := range names {
+		if !pipelineStepNameRe.MatchString(name) {
+			return nil, fmt.Errorf("mcpServers: %q needs a name of letters, digits, - and _", name)
+		}
+		fields, ok := block[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("mcpServers.%s must be a mapping", name)
+		}
+		server := mcpServer{Name: name}
+		for key, value := range fields {
+			switch key {
+			case "command":
+				server.Command, _ = value.(string)
+			case "url":
+				server.URL, _ = value.(string)
+			case "env", "headers":
+				m, ok := value.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("mcpServers.%s.%s must map names to values", name, key)
+				}
+				strs := make(map[string]string, len(m))
+				for k, v := range m {
+					strs[k] = fmt.Sprintf("%v", v)
+				}
+				if key == "env" {
+					server.Env = strs
+				} else {
+					server.Headers = strs
+				}
+			default:
+				return nil, fmt.Errorf("mcpServers.%s: unknown field %s", name, key)
+			}
+		}
+		switch {
+		case (server.Command == "") == (server.URL == ""):
+			return nil, fmt.Errorf("mcpServers.%s needs either a command or a url", name)
+		case server.URL != "":
+			if u, err := url.Parse(server.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("mcpServers.%s.url must be an http or https URL", name)
+			}
+			if server.Env != nil {
+				return nil, fmt.Errorf("mcpServers.%s: env only applies to servers started with a command", name)
+			}
+		case server.Headers != nil:
+			return nil, fmt.Errorf("mcpServers.%s: headers only apply to servers with a url", name)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// connectMCPServers connects to the prompt's MCP servers and adds their
+// tools to tools, each named for its server: the read_file tool of the files
+// server is files_read_file. The returned function disconnects them.
+func connectMCPServers(ctx context.Context, meta map[string]interface{}, tools []Tool) ([]Tool, func(), error) {
+	servers, err := parseMCPServers(meta)
+	if err != nil || len(servers) == 0 {
+		return tools, func() {}, err
+	}
+	client, err := runClient(meta)
+	if err != nil {
+		return nil, nil, err
+	}
+	var clients []*mcpClient
+	closeAll := func() {
+		for _, c := range clients {
+			c.close()
+		}
+	}
+	for _, server := range servers {
+		c, err := connectMCP(ctx, server, client)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("MCP server %s: %v", server.Name, err)
+		}
+		clients = append(clients, c)
+		serverTools, err := c.listTools(ctx)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("MCP server %s: listing tools: %v", server.Name, err)
+		}
+		for _, tool := range serverTools {
+			if _, ok := findTool(tools, tool.Name); ok {
+				closeAll()
+				return nil, nil, fmt.Errorf("MCP server %s has a tool %s, which the prompt already has", server.Name, tool.Name)
+			}
+			tools = append(tools, tool)
+		}
+		log(fmt.Sprintf("Connected to MCP server %s, with %d tools", server.Name, len(serverTools)))
+	}
+	return tools, closeAll, nil
+}
+
+// mcpTransport carries JSON-RPC messages to and from a server
+type mcpTransport interface {
+	send(msg []byte) error
+	// messages delivers what the server sends, and is closed when the
+	// connection ends
+	messages() <-chan []byte
+	close()
+}
+
+// mcpMessage is a JSON-RPC request, notification or response
+type mcpMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  interface{}     `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *mcpError       `json:"error,omitempty"`
+}
+
+type mcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *mcpError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// mcpClient makes requests of one server, one at a time
+type mcpClient struct {
+	server    mcpServer
+	transport mcpTransport
+	nextID    int
+}
+
+// connectMCP starts or connects to server, over HTTP with client, and
+// goes through MCP's initialization handshake
+func connectMCP(ctx context.Context, server mcpServer, client *http.Client) (*mcpClient, error) {
+	var transport mcpTransport
+	var err error
+	if server.Command != "" {
+		transport, err = startMCPStdio(ctx, server)
+	} else {
+		transport, err = connectMCPSSE(ctx, server, client)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &mcpClient{server: server, transport: transport}
+	initCtx, cancel := context.WithTimeout(ctx, mcpConnectTimeout)
+	defer cancel()
+	var result struct {
+		ProtocolVersion string `json:"protocolVersion"`
+		ServerInfo      struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"serverInfo"`
+	}
+	err = c.request(initCtx, "initialize", map[string]interface{}{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]interface{}{},
+		"clientInfo":      map[string]interface{}{"name": "runprompt", "version": version},
+	}, &result)
+	if err == nil {
+		err = c.notify("notifications/initialized")
+	}
+	if err != nil {
+		c.close()
+		return nil, fmt.Errorf("initializing: %v", err)
+	}
+	log(fmt.Sprintf("MCP server %s is %s %s, speaking protocol %s", server.Name, result.ServerInfo.Name, result.ServerInfo.Version, result.ProtocolVersion))
+	return c, nil
+}
+
+func (c *mcpClient) close() {
+	c.transport.close()
+}
+
+// request sends a request and decodes its result into result, answering
+// any requests the server makes in the meantime
+func (c *mcpClient) request(ctx context.Context, method string, params, result interface{}) error {
+	c.nextID++
+	id := json.RawMessage(strconv.Itoa(c.nextID))
+	data, err := json.Marshal(mcpMessage{JSONRPC: "2.0", ID: id, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	if err := c.transport.send(data); err != nil {
+		return err
+	}
+	for {
+		var raw []byte
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-c.transport.messages():
+			if !ok {
+				return fmt.Errorf("the server closed the connection")
+			}
+			raw = msg
+		}
+		var msg mcpMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			log(fmt.Sprintf("MCP server %s sent a message that isn't JSON: %s", c.server.Name, raw))
+			continue
+		}
+		switch {
+		case msg.Method != "" && msg.ID != nil:
+			c.reply(msg)
+		case msg.Method != "":
+			log(fmt.Sprintf("MCP server %s: %s", c.server.Name, msg.Method))
+		case bytes.Equal(msg.ID, id):
+			if msg.Error != nil {
+				return msg.Error
+			}
+			if result == nil {
+				return nil
+			}
+			return json.Unmarshal(msg.Result, result)
+		}
+	}
+}
+
+// reply answers a request from the server: pings, and no to anything else
+func (c *mcpClient) reply(req mcpMessage) {
+	resp := mcpMessage{JSONRPC: "2.0", ID: req.ID}
+	if req.Method == "ping" {
+		resp.Result = json.RawMessage("{}")
+	} else {
+		resp.Error = &mcpError{Code: -32601, Message: "runprompt doesn't support " + req.Method}
+	}
+	data, _ := json.Marshal(resp)
+	if err := c.transport.send(data); err != nil {
+		log(fmt.Sprintf("MCP server %s: answering %s: %v", c.server.Name, req.Method, err))
+	}
+}
+
+// notify sends a notification, which has no response
+func (c *mcpClient) notify(method string) error {
+	data, err := json.Marshal(mcpMessage{JSONRPC: "2.0", Method: method})
+	if err != nil {
+		return err
+	}
+	return c.transport.send(data)
+}
+
+// mcpToolNameRe matches the characters providers don't allow in tool names
+var mcpToolNameRe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// listTools lists the server's tools, page by page
+func (c *mcpClient) listTools(ctx context.Context) ([]Tool, error) {
+	listCtx, cancel := context.WithTimeout(ctx, mcpConnectTimeout)
+	defer cancel()
+	var tools []Tool
+	cursor := ""
+	for {
+		params := map[string]interface{}{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		var page struct {
+			Tools []struct {
+				Name        string                 `json:"name"`
+				Description string                 `json:"description"`
+				InputSchema map[string]interface{} `json:"inputSchema"`
+			} `json:"tools"`
+			NextCursor string `json:"nextCursor"`
+		}
+		if err := c.request(listCtx, "tools/list", params, &page); err != nil {
+			return nil, err
+		}
+		for _, t := range page.Tools {
+			schema := t.InputSchema
+			if schema == nil {
+				schema = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+			}
+			tools = append(tools, Tool{
+				Name:        c.server.Name + "_" + mcpToolNameRe.ReplaceAllString(t.Name, "_"),
+				Description: t.Description,
+				InputSchema: schema,
+				mcp:         c,
+				mcpName:     t.Name,
+			})
+		}
+		if page.NextCursor == "" || page.NextCursor == cursor {
+			return tools, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// callTool calls one of the server's tools and returns the text of its
+// result. A result the server marks as an error is returned as one.
+func (c *mcpClient) callTool(ctx context.Context, name, args string) (string, error) {
+	var result struct {
+		Content []struct {
+			Type     string `json:"type"`
+			Text     string `json:"text"`
+			MimeType string `json:"mimeType"`
+			Resource struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"resource"`
+		} `json:"content"`
+		IsError bool `json:"isError"`
+	}
+	err := c.request(ctx, "tools/call", map[string]interface{}{"name": name, "arguments": toolArgumentsObject(args)}, &result)
+	if err != nil {
+		return "", err
+	}
+	parts := make([]string, 0, len(result.Content))
+	for _, item := range result.Content {
+		switch {
+		case item.Type == "text":
+			parts = append(parts, item.Text)
+		case item.Type == "resource" && item.Resource.Text != "":
+			parts = append(parts, item.Resource.Text)
+		case item.Type == "resource":
+			parts = append(parts, fmt.Sprintf("[resource %s]", item.Resource.URI))
+		default:
+			parts = append(parts, fmt.Sprintf("[%s %s]", item.Type, item.MimeType))
+		}
+	}
+	text := strings.Join(parts, "\n")
+	if result.IsError {
+		return "", fmt.Errorf("%s", text)
+	}
+	return text, nil
+}
+
+// mcpStdio speaks to a server started as a command, a message per line
+type mcpStdio struct {
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	incoming chan []byte
+	stop     chan struct{}
+}
+
+func startMCPStdio(ctx context.Context, server mcpServer) (*mcpStdio, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", server.Command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", server.Command)
+	}
+	cmd.Env = os.Environ()
+	for k, v := range server.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	if verbose {
+		cmd.Stderr = os.Stderr
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting %s: %v", server.Command, err)
+	}
+	t := &mcpStdio{cmd: cmd, stdin: stdin, incoming: make(chan []byte, 16), stop: make(chan struct{})}
+	go func() {
+		defer close(t.incoming)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			select {
+			case t.incoming <- append([]byte{}, line...):
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+	return t, nil
+}
+
+func (t *mcpStdio) send(msg []byte) error {
+	_, err := t.stdin.Write(append(msg, '\n'))
+	return err
+}
+
+func (t *mcpStdio) messages() <-chan []byte { return t.incoming }
+
+// close closes the server's stdin, which tells it to exit, and kills it if
+// it hasn't within a few seconds
+func (t *mcpStdio) close() {
+	close(t.stop)
+	t.stdin.Close()
+	exited := make(chan struct{})
+	go func() {
+		t.cmd.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(2 * time.Second):
+		t.cmd.Process.Kill()
+		<-exited
+	}
+}
+
+// mcpSSE speaks to a server over HTTP: its messages arrive as events on a
+// stream, and ours are posted to the endpoint the stream's first event names
+type mcpSSE struct {
+	client   *http.Client
+	endpoint string
+	headers  map[string]string
+	body     io.ReadCloser
+	cancel   context.CancelFunc
+	incoming chan []byte
+	stop     chan struct{}
+}
+
+func connectMCPSSE(ctx context.Context, server mcpServer, client *http.Client) (*mcpSSE, error) {
+	streamCtx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(streamCtx, "GET", server.URL, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	for k, v := range server.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("connecting to %s: %s", server.URL, resp.Status)
+	}
+
+	t := &mcpSSE{client: client, headers: server.Headers, body: resp.Body, cancel: cancel, incoming: make(chan []byte, 16), stop: make(chan struct{})}
+	endpoint := make(chan string, 1)
+	ended := make(chan struct{})
+	go func() {
+		defer close(t.incoming)
+		defer close(ended)
+		event, data := "", []string{}
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event:"):
+				event = strings.TrimSpace(line[len("event:"):])
+			case strings.HasPrefix(line, "data:"):
+				data = append(data, strings.TrimPrefix(line[len("data:"):], " "))
+			case line == "" && len(data) > 0:
+				payload := strings.Join(data, "\n")
+				if event == "endpoint" {
+					select {
+					case endpoint <- payload:
+					default:
+					}
+				} else if event == "" || event == "message" {
+					select {
+					case t.incoming <- []byte(payload):
+					case <-t.stop:
+						return
+					}
+				}
+				event, data = "", data[:0]
+			}
+		}
+	}()
+
+	timer := time.NewTimer(mcpConnectTimeout)
+	defer timer.Stop()
+	select {
+	case path := <-endpoint:
+		u, err := resp.Request.URL.Parse(path)
+		if err != nil {
+			t.close()
+			return nil, fmt.Errorf("the server sent an invalid endpoint %q", path)
+		}
+		// The server's headers, credentials among them, go with every post
+		if configured, err := url.Parse(server.URL); err != nil || u.Scheme != configured.Scheme || u.Host != configured.Host {
+			t.close()
+			return nil, fmt.Errorf("the server sent an endpoint %s that isn't on %s", u.Redacted(), server.URL)
+		}
+		t.endpoint = u.String()
+		return t, nil
+	case <-ended:
+		t.close()
+		return nil, fmt.Errorf("the server's stream ended before it sent an endpoint")
+	case <-timer.C:
+		t.close()
+		return nil, fmt.Errorf("the server sent no endpoint within %v", mcpConnectTimeout)
+	case <-ctx.Done():
+		t.close()
+		return nil, ctx.Err()
+	}
+}
+
+func (t *mcpSSE) send(msg []byte) error {
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("posting to %s: %s", t.endpoint, resp.Status)
+	}
+	return nil
+}
+
+func (t *mcpSSE) messages() <-chan []byte { return t.incoming }
+
+func (t *mcpSSE) close() {
+	close(t.stop)
+	t.cancel()
+	t.body.Close()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseMCPServers(t *testing.T) {
+	servers, err := parseMCPServers(parseYAML(`mcpServers:
+  search:
+    url: http://localhost:8931/sse
+    headers:
+      Authorization: Bearer abc
+  files:
+    command: npx server-filesystem .
+    env:
+      DEBUG: 1`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(servers) != 2 || servers[0].Name != "files" || servers[0].Env["DEBUG"] != "1" || servers[1].Headers["Authorization"] != "Bearer abc" {
+		t.Errorf("Expected the files and search servers, got %+v", servers)
+	}
+
+	for _, content := range []string{
+		"mcpServers: [files]",
+		"mcpServers:\n  files: npx server",
+		"mcpServers:\n  files:\n    args: [x]",
+		"mcpServers:\n  files:\n    env:\n      A: b",
+		"mcpServers:\n  files:\n    command: x\n    url: http://localhost/sse",
+		"mcpServers:\n  files:\n    url: ftp://localhost/sse",
+		"mcpServers:\n  files:\n    command: x\n    headers:\n      A: b",
+		"mcpServers:\n  my files:\n    command: x",
+	} {
+		if _, err := parseMCPServers(parseYAML(content)); err == nil {
+			t.Errorf("Expected error for %q", content)
+		}
+	}
+}
+
+// mcpTools is the tools/list result of the test servers
+const mcpTools = `{"tools":[{"name":"read.file","description":"Read a file","inputSchema":{"type":"object","properties":{"path":{"type":"string"}}}}]}`
+
+func TestMCPStdio(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test server is a sh script")
+	}
+	// The server answers each request in turn, with the arguments of the
+	// tool call echoed back
+	script := filepath.Join(t.TempDir(), "server.sh")
+	os.WriteFile(script, []byte(`read line
+echo '{"jsonrpc":"2.0","id":1,"result":{"protocolVersion":"2024-11-05","serverInfo":{"name":"test","version":"1"}}}'
+read line
+read line
+echo '{"jsonrpc":"2.0","method":"notifications/message","params":{}}'
+echo '{"jsonrpc":"2.0","id":2,"result":`+mcpTools+`}'
+read line
+echo '{"jsonrpc":"2.0","id":3,"result":{"content":[{"type":"text","text":"got it"}]}}'
+read line
+echo '{"jsonrpc":"2.0","id":4,"result":{"content":[{"type":"text","text":"no such file"}],"isError":true}}'
+`), 0644)
+
+	meta := map[string]interface{}{"mcpServers": map[string]interface{}{
+		"files": map[string]interface{}{"command": "sh " + script},
+	}}
+	tools, closeMCP, err := connectMCPServers(context.Background(), meta, []Tool{{Name: "echo", Command: "cat"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer closeMCP()
+	if len(tools) != 2 || tools[1].Name != "files_read_file" || tools[1].mcpName != "read.file" {
+		t.Fatalf("Expected the echo and files_read_file tools, got %+v", tools)
+	}
+	if props, _ := tools[1].parameters()["properties"].(map[string]interface{}); props["path"] == nil {
+		t.Errorf("Expected the server's input schema, got %v", tools[1].parameters())
+	}
+	if out, err := tools[1].run(context.Background(), `{"path":"a.txt"}`); err != nil || out != "got it" {
+		t.Errorf("Expected %q, got %q (%v)", "got it", out, err)
+	}
+	if _, err := tools[1].run(context.Background(), `{"path":"b.txt"}`); err == nil || err.Error() != "no such file" {
+		t.Errorf("Expected the tool's error, got %v", err)
+	}
+}
+
+func TestMCPSSE(t *testing.T) {
+	responses := make(chan string, 4)
+	var calls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer abc" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "GET" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "event: endpoint\ndata: /messages?session=1\n\n")
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case resp := <-responses:
+					fmt.Fprintf(w, "event: message\ndata: %s\n\n", resp)
+					w.(http.Flusher).Flush()
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+		var req mcpMessage
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.URL.Query().Get("session") != "1" {
+			t.Errorf("Expected the endpoint's session, got %s", r.URL)
+		}
+		w.WriteHeader(http.StatusAccepted)
+		result := "{}"
+		switch req.Method {
+		case "notifications/initialized":
+			return
+		case "tools/list":
+			result = mcpTools
+		case "tools/call":
+			params, _ := json.Marshal(req.Params)
+			calls = append(calls, string(params))
+			result = `{"content":[{"type":"text","text":"contents of a.txt"}]}`
+		}
+		responses <- fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":%s}`, req.ID, result)
+	}))
+	defer server.Close()
+
+	meta := map[string]interface{}{"mcpServers": map[string]interface{}{
+		"remote": map[string]interface{}{
+			"url":     server.URL + "/sse",
+			"headers": map[string]interface{}{"Authorization": "Bearer abc"},
+		},
+	}}
+	tools, closeMCP, err := connectMCPServers(context.Background(), meta, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer closeMCP()
+	if len(tools) != 1 || tools[0].Name != "remote_read_file" {
+		t.Fatalf("Expected the remote_read_file tool, got %+v", tools)
+	}
+	out, err := tools[0].run(context.Background(), `{"path":"a.txt"}`)
+	if err != nil || out != "contents of a.txt" {
+		t.Errorf("Expected %q, got %q (%v)", "contents of a.txt", out, err)
+	}
+	if len(calls) != 1 || !strings.Contains(calls[0], `"arguments":{"path":"a.txt"}`) || !strings.Contains(calls[0], `"name":"read.file"`) {
+		t.Errorf("Expected a call of read.file with its arguments, got %v", calls)
+	}
+
+	meta["mcpServers"].(map[string]interface{})["remote"].(map[string]interface{})["headers"] = map[string]interface{}{}
+	if _, _, err := connectMCPServers(context.Background(), meta, nil); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected a 401 error, got %v", err)
+	}
+}
+
+func TestMCPSSEEndpointHost(t *testing.T) {
+	var posted int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posted, 1)
+	}))
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "event: endpoint\ndata: %s/messages\n\n", other.URL)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	meta := map[string]interface{}{"mcpServers": map[string]interface{}{
+		"remote": map[string]interface{}{
+			"url":     server.URL + "/sse",
+			"headers": map[string]interface{}{"Authorization": "Bearer abc"},
+		},
+	}}
+	_, _, err := connectMCPServers(context.Background(), meta, nil)
+	if err == nil || !strings.Contains(err.Error(), "isn't on "+server.URL) {
+		t.Errorf("Expected the endpoint on another host to be refused, got %v", err)
+	}
+	if n := atomic.LoadInt32(&posted); n != 0 {
+		t.Errorf("Expected nothing posted to the other host, got %d requests", n)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Media is an image or audio clip a model returned as base64 data, in a
+// field of its own or as a data: URL in its text
+type Media struct {
+	MIME   string // the media type, or "" to detect it from the data
+	Data   string // base64-encoded content
+	Inline string // the data: URL as it appeared in the text, if it did
+}
+
+// dataURLRe matches base64 data: URLs of images, audio and video
+var dataURLRe = regexp.MustCompile(`data:((?:image|audio|video)/[A-Za-z0-9.+-]+);base64,([A-Za-z0-9+/]+=*)`)
+
+// parseDataURL reads a base64 data: URL
+func parseDataURL(s string) (Media, bool) {
+	m := dataURLRe.FindStringSubmatch(s)
+	if m == nil || m[0] != strings.TrimSpace(s) {
+		return Media{}, false
+	}
+	return Media{MIME: m[1], Data: m[2]}, true
+}
+
+// inlineMedia finds the data: URLs in a reply's text
+func inlineMedia(text string) []Media {
+	var media []Media
+	for _, m := range dataURLRe.FindAllStringSubmatch(text, -1) {
+		media = append(media, Media{MIME: m[1], Data: m[2], Inline: m[0]})
+	}
+	return media
+}
+
+// mediaExtensions are the file extensions media is written with, by type
+var mediaExtensions = map[string]string{
+	"image/png":     "png",
+	"image/jpeg":    "jpg",
+	"image/gif":     "gif",
+	"image/webp":    "webp",
+	"image/svg+xml": "svg",
+	"audio/wav":     "wav",
+	"audio/wave":    "wav",
+	"audio/x-wav":   "wav",
+	"audio/mpeg":    "mp3",
+	"audio/mp3":     "mp3",
+	"audio/ogg":     "ogg",
+	"audio/flac":    "flac",
+	"audio/aac":     "aac",
+	"audio/pcm":     "pcm",
+	"video/mp4":     "mp4",
+	"video/webm":    "webm",
+}
+
+// decode returns the media's content, type and file extension. Media
+// sent without a type, as OpenAI's audio is, is typed by its content.
+func (m Media) decode() ([]byte, string, string, error) {
+	data, err := base64.StdEncoding.DecodeString(m.Data)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("decoding base64 media: %v", err)
+	}
+	mime := m.MIME
+	if mime == "" {
+		mime, _, _ = strings.Cut(http.DetectContentType(data), ";")
+	}
+	ext, ok := mediaExtensions[mime]
+	if !ok {
+		ext = "bin"
+	}
+	return data, mime, ext, nil
+}
+
+// defaultMediaPath names media files when output.media doesn't
+const defaultMediaPath = "{{prompt}}-{{timestamp}}-{{index}}.{{ext}}"
+
+// mediaPath reads output.media, the path template media files are written
+// to, rendered with the input variables and prompt, timestamp, index
+// (from 1), ext and mime
+func mediaPath(outputConfig map[string]interface{}) (string, error) {
+	v, ok := outputConfig["media"]
+	if !ok {
+		return defaultMediaPath, nil
+	}
+	s, ok := v.(string)
+	if !ok || s == "" {
+		return "", fmt.Errorf("output.media must be a file path template")
+	}
+	return s, nil
+}
+
+// writeMedia writes each of media to a file named by the path template and
+// returns the paths, in order. Existing files are only replaced when force
+// is set, and nothing is written if any target exists.
+func writeMedia(pathTemplate string, media []Media, variables map[string]interface{}, prompt string, force bool) ([]string, error) {
+	ctx := make(map[string]interface{}, len(variables)+5)
+	for k, v := range variables {
+		ctx[k] = v
+	}
+	ctx["prompt"] = strings.TrimSuffix(filepath.Base(prompt), filepath.Ext(prompt))
+	ctx["timestamp"] = time.Now().Format("20060102-150405")
+
+	type target struct {
+		path    string
+		content []byte
+	}
+	var targets []target
+	for i, m := range media {
+		content, mime, ext, err := m.decode()
+		if err != nil {
+			return nil, err
+		}
+		ctx["index"], ctx["mime"], ctx["ext"] = i+1, mime, ext
+		path, err := renderPath(pathTemplate, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("output.media %v", err)
+		}
+		for _, t := range targets {
+			if t.path == path {
+				return nil, fmt.Errorf("output.media names two files %s; use {{index}} in the path", path)
+			}
+		}
+		if _, err := os.Stat(path); err == nil && !force {
+			return nil, fmt.Errorf("%s already exists (use --force to overwrite)", path)
+		}
+		targets = append(targets, target{path, content})
+	}
+
+	var written []string
+	for _, t := range targets {
+		if dir := filepath.Dir(t.path); dir != "." {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return written, err
+			}
+		}
+		if err := os.WriteFile(t.path, t.content, 0644); err != nil {
+			return written, err
+		}
+		written = append(written, t.path)
+	}
+	return written, nil
+}
+
+// replaceInlineMedia puts the paths media was written to in place of the
+// data: URLs it appeared as in text
+func replaceInlineMedia(text string, media []Media, paths []string) string {
+	for i, m := range media {
+		if m.Inline != "" && i < len(paths) {
+			text = strings.ReplaceAll(text, m.Inline, paths[i])
+		}
+	}
+	return text
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pngData is the start of a PNG file, enough for its type to be detected
+var pngData = base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"))
+
+func TestExtractMedia(t *testing.T) {
+	wav := base64.StdEncoding.EncodeToString([]byte("RIFF\x24\x00\x00\x00WAVEfmt "))
+	tests := []struct {
+		name     string
+		provider string
+		response string
+		text     string
+		mimes    []string
+	}{
+		{"openai audio", "openai",
+			`{"choices":[{"message":{"role":"assistant","content":null,"audio":{"id":"a1","data":"` + wav + `","transcript":"Hello there"}}}]}`,
+			"Hello there", []string{"audio/wave"}},
+		{"openrouter images", "openrouter",
+			`{"choices":[{"message":{"role":"assistant","content":"Here it is","images":[{"type":"image_url","image_url":{"url":"data:image/png;base64,` + pngData + `"}}]}}]}`,
+			"Here it is", []string{"image/png"}},
+		{"inline data URL", "openai",
+			`{"choices":[{"message":{"role":"assistant","content":"![cat](data:image/png;base64,` + pngData + `)"}}]}`,
+			"![cat](data:image/png;base64," + pngData + ")", []string{"image/png"}},
+		{"anthropic image block", "anthropic",
+			`{"content":[{"type":"text","text":"Drawn"},{"type":"image","source":{"type":"base64","media_type":"image/png","data":"` + pngData + `"}}]}`,
+			"Drawn", []string{"image/png"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var response map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.response), &response); err != nil {
+				t.Fatal(err)
+			}
+			result := extractResponse(response, nil, tc.provider)
+			if result.Text != tc.text {
+				t.Errorf("Text: Expected %q, got %q", tc.text, result.Text)
+			}
+			var mimes []string
+			for _, m := range result.Media {
+				_, mime, _, err := m.decode()
+				if err != nil {
+					t.Fatal(err)
+				}
+				mimes = append(mimes, mime)
+			}
+			if strings.Join(mimes, ",") != strings.Join(tc.mimes, ",") {
+				t.Errorf("Media: Expected %v, got %v", tc.mimes, mimes)
+			}
+		})
+	}
+}
+
+func TestWriteMedia(t *testing.T) {
+	dir := t.TempDir()
+	inline := "data:image/png;base64," + pngData
+	media := []Media{{MIME: "image/png", Data: pngData, Inline: inline}, {Data: pngData}}
+	template := filepath.Join(dir, "out", "{{prompt}}-{{name}}-{{index}}.{{ext}}")
+	paths, err := writeMedia(template, media, map[string]interface{}{"name": "cat"}, "draw.prompt", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(dir, "out", "draw-cat-1.png"), filepath.Join(dir, "out", "draw-cat-2.png")}
+	if strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, paths)
+	}
+	if data, err := os.ReadFile(paths[0]); err != nil || !strings.HasPrefix(string(data), "\x89PNG") {
+		t.Errorf("Expected the decoded image, got %q %v", data, err)
+	}
+	if got := replaceInlineMedia("![cat]("+inline+")", media, paths); got != "![cat]("+paths[0]+")" {
+		t.Errorf("Expected the path in place of the data URL, got %q", got)
+	}
+
+	if _, err := writeMedia(template, media, map[string]interface{}{"name": "cat"}, "draw.prompt", false); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("Expected existing files to be kept, got %v", err)
+	}
+	if _, err := writeMedia(filepath.Join(dir, "one.{{ext}}"), media, nil, "draw.prompt", false); err == nil || !strings.Contains(err.Error(), "{{index}}") {
+		t.Errorf("Expected two media with one path to be an error, got %v", err)
+	}
+
+	// The type comes from the response, and can't move the file elsewhere
+	evil := []Media{{MIME: "../../evil", Data: pngData}}
+	if _, err := writeMedia(filepath.Join(dir, "out", "{{mime}}.bin"), evil, nil, "draw.prompt", false); err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Errorf("Expected a path outside the directory to be refused, got %v", err)
+	}
+}
+
+func TestRunMedia(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	dir := t.TempDir()
+	out := filepath.ToSlash(filepath.Join(dir, "images"))
+	writeFiles(t, dir,
+		"draw.prompt", "---\nmodel: test\noutput:\n  media: "+out+"/{{index}}.{{ext}}\n---\nDraw a cat",
+		"draw.prompt.test-response", `{"choices":[{"message":{"content":"![cat](data:image/png;base64,`+pngData+`)"}}]}`)
+	if err := run(context.Background(), []string{filepath.Join(dir, "draw.prompt")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "images", "1.png")); err != nil {
+		t.Errorf("Expected the image to be written: %v", err)
+	}
+}
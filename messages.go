@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Message is one message of a chat conversation
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// ToolCalls are the tools an assistant message called, and ToolCallID
+	// the call a "tool" message gives the result of
+	ToolCalls  []ToolCall `json:"toolCalls,omitempty"`
+	ToolCallID string     `json:"toolCallId,omitempty"`
+}
+
+// roleMarkerRe matches dotprompt-style {{role "system"}} markers and
+// <<<system>>> delimiters
+var roleMarkerRe = regexp.MustCompile(`\{\{\s*role\s+"(\w+)"\s*\}\}|<<<(\w+)>>>`)
+
+// normalizeRole maps dotprompt's "model" role onto "assistant"
+func normalizeRole(role string) string {
+	role = strings.ToLower(role)
+	if role == "model" {
+		return "assistant"
+	}
+	return role
+}
+
+// messageTemplate is one compiled message of a template
+type messageTemplate struct {
+	Role string
+	Body *Template
+}
+
+// compileMessages splits a template into messages at role markers and
+// compiles each part. Text before the first marker is a user message. Each
+// part is compiled separately, so markers must not appear inside sections.
+func compileMessages(template string) []messageTemplate {
+	var parts []messageTemplate
+	role := "user"
+	pos := 0
+	for _, loc := range roleMarkerRe.FindAllStringSubmatchIndex(template, -1) {
+		parts = append(parts, messageTemplate{role, compileTemplateRange(template, pos, loc[0])})
+		if loc[2] != -1 {
+			role = normalizeRole(template[loc[2]:loc[3]])
+		} else {
+			role = normalizeRole(template[loc[4]:loc[5]])
+		}
+		pos = loc[1]
+	}
+	return append(parts, messageTemplate{role, compileTemplateRange(template, pos, len(template))})
+}
+
+// renderCompiledMessages renders compiled message templates, dropping
+// messages that render empty
+func renderCompiledMessages(parts []messageTemplate, variables map[string]interface{}) []Message {
+	messages, _ := renderPromptMessages(parts, variables, nil)
+	return messages
+}
+
+// renderPromptMessages renders compiled message templates like
+// renderCompiledMessages, with the settings of a prompt's metadata: its
+// input and output schemas for {{schema}}, its escape mode, and
+// strictVariables, which makes a variable that resolves to nothing an error
+// rather than an empty string. A system: template in the metadata renders
+// as the first message. A conversation given as a messages input variable
+// is placed around the rendered messages, as set by input.messages.
+func renderPromptMessages(parts []messageTemplate, variables map[string]interface{}, meta map[string]interface{}) ([]Message, error) {
+	escape, err := escapeMode(meta)
+	if err != nil {
+		return nil, err
+	}
+	opts := renderOptions{strict: strictVariables(meta), schemas: map[string]string{}, escape: escape}
+	for _, name := range []string{"input", "output"} {
+		config, _ := meta[name].(map[string]interface{})
+		if schema, ok := config["schema"].(map[string]interface{}); ok && len(schema) > 0 {
+			opts.schemas[name] = describeSchema(name, picoschemaObject(schema))
+		}
+	}
+
+	var messages []Message
+	var errs []error
+	if system, _ := meta["system"].(string); system != "" {
+		content, err := compileTemplate(system).render(variables, opts)
+		for _, err := range unjoin(err) {
+			if err, ok := err.(*sourceError); ok {
+				// Locate problems in the frontmatter's system: text
+				err.File = "system"
+			}
+		}
+		if err != nil {
+			errs = append(errs, err)
+		} else if content = strings.TrimSpace(content); content != "" {
+			messages = append(messages, Message{Role: "system", Content: content})
+		}
+	}
+	for _, part := range parts {
+		content, err := part.Body.render(variables, opts)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		content = strings.TrimSpace(content)
+		if content != "" {
+			messages = append(messages, Message{Role: part.Role, Content: content})
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	inputConfig, _ := meta["input"].(map[string]interface{})
+	mode, err := conversationMode(inputConfig)
+	if err != nil {
+		return nil, err
+	}
+	if conversation, ok := inputConversation(variables["messages"]); ok && mode != "" {
+		log(fmt.Sprintf("Sending %d input messages as the conversation", len(conversation)))
+		return withConversation(conversation, messages, mode), nil
+	}
+	return messages, nil
+}
+
+// conversationMode reads input.messages, which says where the rendered
+// template goes when the input is a conversation: "user", the default,
+// after it, or "system", before it as one system message. false sends the
+// template alone, leaving messages an ordinary variable.
+func conversationMode(inputConfig map[string]interface{}) (string, error) {
+	switch v := inputConfig["messages"].(type) {
+	case nil:
+		return "user", nil
+	case bool:
+		if !v {
+			return "", nil
+		}
+	case string:
+		if v == "user" || v == "system" {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("input.messages must be user, system or false, got %v", inputConfig["messages"])
+}
+
+// inputConversation reads a messages input variable as a chat
+// conversation: a list of objects with a role and content, as in a chat
+// completions request. Content may be a list of parts, of which the text
+// is kept, and messages in roles other than system, user and assistant,
+// such as tool results, are skipped. Anything else isn't a conversation.
+func inputConversation(v interface{}) ([]Message, bool) {
+	items, ok := v.([]interface{})
+	if !ok || len(items) == 0 {
+		return nil, false
+	}
+	messages := make([]Message, 0, len(items))
+	for _, item := range items {
+		m, _ := item.(map[string]interface{})
+		role, _ := m["role"].(string)
+		if role == "" {
+			return nil, false
+		}
+		role = normalizeRole(role)
+		if role == "developer" {
+			role = "system"
+		}
+		if role != "system" && role != "user" && role != "assistant" {
+			log(fmt.Sprintf("Skipping %s message", role))
+			continue
+		}
+		var content string
+		switch c := m["content"].(type) {
+		case string:
+			content = c
+		case []interface{}:
+			var texts []string
+			for _, part := range c {
+				if text, _ := part.(map[string]interface{})["text"].(string); text != "" {
+					texts = append(texts, text)
+				}
+			}
+			content = strings.Join(texts, "\n")
+		default:
+			return nil, false
+		}
+		messages = append(messages, Message{Role: role, Content: content})
+	}
+	return messages, true
+}
+
+// withConversation places rendered messages around an input conversation.
+// In user mode the rendered system messages come first and the others
+// after the conversation; in system mode everything rendered is joined
+// into one system message before it.
+func withConversation(conversation, rendered []Message, mode string) []Message {
+	var before, after []Message
+	if mode == "system" {
+		var texts []string
+		for _, m := range rendered {
+			texts = append(texts, m.Content)
+		}
+		if len(texts) > 0 {
+			before = []Message{{Role: "system", Content: strings.Join(texts, "\n\n")}}
+		}
+	} else {
+		for _, m := range rendered {
+			if m.Role == "system" {
+				before = append(before, m)
+			} else {
+				after = append(after, m)
+			}
+		}
+	}
+	messages := append(before, conversation...)
+	return append(messages, after...)
+}
+
+// strictVariables reports whether a prompt renders in strict mode, set by
+// strictVariables: true in the frontmatter or --strict
+func strictVariables(meta map[string]interface{}) bool {
+	strict, _ := meta["strictVariables"].(bool)
+	return strict
+}
+
+// renderMessages renders a template into chat messages
+func renderMessages(template string, variables map[string]interface{}) []Message {
+	return renderCompiledMessages(compileMessages(template), variables)
+}
+
+// splitSystem separates system messages, joined into one string, from the
+// rest of the conversation, as the Anthropic API expects
+func splitSystem(messages []Message) (string, []Message) {
+	var system []string
+	var rest []Message
+	for _, m := range messages {
+		if m.Role == "system" {
+			system = append(system, m.Content)
+		} else {
+			rest = append(rest, m)
+		}
+	}
+	return strings.Join(system, "\n\n"), rest
+}
+
+// appendToLastUser appends text to the last user message, adding one if the
+// conversation has none
+func appendToLastUser(messages []Message, text string) []Message {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			messages[i].Content += text
+			return messages
+		}
+	}
+	return append(messages, Message{Role: "user", Content: strings.TrimSpace(text)})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		expected []Message
+	}{
+		{"no markers", "Hello {{name}}", []Message{{Role: "user", Content: "Hello Ann"}}},
+		{"dotprompt markers", "{{role \"system\"}}\nYou are terse.\n{{role \"user\"}}\nHi {{name}}",
+			[]Message{{Role: "system", Content: "You are terse."}, {Role: "user", Content: "Hi Ann"}}},
+		{"delimiters", "<<<system>>>Be kind.<<<user>>>Q<<<assistant>>>A<<<user>>>Q2",
+			[]Message{{Role: "system", Content: "Be kind."}, {Role: "user", Content: "Q"}, {Role: "assistant", Content: "A"}, {Role: "user", Content: "Q2"}}},
+		{"model role", "{{ role \"model\" }}Sure.", []Message{{Role: "assistant", Content: "Sure."}}},
+		{"text before marker", "Intro\n<<<system>>>Rules", []Message{{Role: "user", Content: "Intro"}, {Role: "system", Content: "Rules"}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := renderMessages(tc.template, map[string]interface{}{"name": "Ann"})
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRenderPromptMessagesStrict(t *testing.T) {
+	template := "<<<system>>>Be kind.\n<<<user>>>\nHi {{name}}, re: {{topic}}"
+	parts := compileMessages(template)
+	vars := map[string]interface{}{"name": "Ann"}
+
+	if _, err := renderPromptMessages(parts, vars, nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err := renderPromptMessages(parts, vars, map[string]interface{}{"strictVariables": true})
+	if err == nil {
+		t.Fatal("Expected an error for the missing variable")
+	}
+	// Positions count from the start of the whole template
+	expected := `template:3:18: undefined variable "topic"`
+	if !strings.Contains(err.Error(), expected) {
+		t.Errorf("Expected error containing %q, got %q", expected, err.Error())
+	}
+}
+
+func TestRenderPromptMessagesSchema(t *testing.T) {
+	meta := map[string]interface{}{
+		"output": map[string]interface{}{"schema": map[string]interface{}{"name": "string"}},
+	}
+	parts := compileMessages("Extract the name.\n\n{{schema output}}")
+	messages, err := renderPromptMessages(parts, nil, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Extract the name.\n\nRespond with a JSON object with these fields:\n- name (string)"
+	if len(messages) != 1 || messages[0].Content != expected {
+		t.Errorf("Expected %q, got %v", expected, messages)
+	}
+
+	// A missing schema renders nothing, or fails in strict mode
+	parts = compileMessages("Hi{{schema input}}")
+	if messages, _ := renderPromptMessages(parts, nil, meta); messages[0].Content != "Hi" {
+		t.Errorf("Expected %q, got %q", "Hi", messages[0].Content)
+	}
+	meta["strictVariables"] = true
+	_, err = renderPromptMessages(parts, nil, meta)
+	if err == nil || !strings.Contains(err.Error(), "no input schema declared") {
+		t.Errorf("Expected a missing schema error, got %v", err)
+	}
+}
+
+func TestRenderPromptMessagesSystem(t *testing.T) {
+	meta, template, err := parsePromptSource("t.prompt", "", []byte("---\nsystem: |\n  You are {{persona}}.\n\n  Be brief.\n---\n<<<system>>>Use British spelling.<<<user>>>Hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := renderPromptMessages(compileMessages(template), map[string]interface{}{"persona": "a pilot"}, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Message{{Role: "system", Content: "You are a pilot.\n\nBe brief."}, {Role: "system", Content: "Use British spelling."}, {Role: "user", Content: "Hi"}}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected %v, got %v", expected, messages)
+	}
+
+	meta["strictVariables"] = true
+	_, err = renderPromptMessages(compileMessages(template), nil, meta)
+	if expected := `system:1:9: undefined variable "persona"`; err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("Expected error containing %q, got %v", expected, err)
+	}
+}
+
+func TestRenderPromptMessagesConversation(t *testing.T) {
+	input := `{"messages": [
+		{"role": "developer", "content": "Be terse."},
+		{"role": "user", "content": [{"type": "text", "text": "Hi"}]},
+		{"role": "tool", "content": "{}"},
+		{"role": "assistant", "content": "Hello."}
+	], "lang": "French"}`
+	template := "<<<system>>>Reply in {{lang}}.<<<user>>>Summarize the conversation."
+	conversation := []Message{{Role: "system", Content: "Be terse."}, {Role: "user", Content: "Hi"}, {Role: "assistant", Content: "Hello."}}
+	tests := []struct {
+		mode     interface{}
+		expected []Message
+	}{
+		{nil, append(append([]Message{{Role: "system", Content: "Reply in French."}}, conversation...), Message{Role: "user", Content: "Summarize the conversation."})},
+		{"system", append([]Message{{Role: "system", Content: "Reply in French.\n\nSummarize the conversation."}}, conversation...)},
+		{false, []Message{{Role: "system", Content: "Reply in French."}, {Role: "user", Content: "Summarize the conversation."}}},
+	}
+	for _, tc := range tests {
+		meta := map[string]interface{}{"input": map[string]interface{}{}}
+		if tc.mode != nil {
+			meta["input"] = map[string]interface{}{"messages": tc.mode}
+		}
+		variables, err := inputVariables(input, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages, err := renderPromptMessages(compileMessages(template), variables, meta)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", tc.mode, err)
+		}
+		if !reflect.DeepEqual(messages, tc.expected) {
+			t.Errorf("%v: expected %v, got %v", tc.mode, tc.expected, messages)
+		}
+	}
+
+	// Other messages variables are left alone
+	for _, v := range []interface{}{"text", []interface{}{"a", "b"}, []interface{}{map[string]interface{}{"content": "x"}}} {
+		if _, ok := inputConversation(v); ok {
+			t.Errorf("Expected %v not to be a conversation", v)
+		}
+	}
+	_, err := renderPromptMessages(nil, nil, map[string]interface{}{"input": map[string]interface{}{"messages": "assistant"}})
+	if err == nil || !strings.Contains(err.Error(), "input.messages must be user, system or false") {
+		t.Errorf("Expected an input.messages error, got %v", err)
+	}
+}
+
+func TestSplitSystem(t *testing.T) {
+	system, rest := splitSystem([]Message{{Role: "system", Content: "A"}, {Role: "user", Content: "Q"}, {Role: "system", Content: "B"}})
+	if system != "A\n\nB" || !reflect.DeepEqual(rest, []Message{{Role: "user", Content: "Q"}}) {
+		t.Errorf("Got %q %v", system, rest)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// partialsDir is the directory next to a prompt file that {{> name}}
+// partials are read from, as <name>.prompt. Prompt searches skip it, so
+// partials are never run on their own.
+const partialsDir = "_partials"
+
+// stdPartials are the partials shipped with runprompt, used as
+// {{> std/name}}. They are versioned with the binary, so prompts can rely on
+// their wording.
+//
+//go:embed std/*.prompt
+var stdPartials embed.FS
+
+// stdPrefix starts the names of the standard partials
+const stdPrefix = "std/"
+
+// maxPartialDepth bounds how deeply partials may include other partials
+const maxPartialDepth = 10
+
+// partialTagRe matches a {{> name}} partial tag
+var partialTagRe = regexp.MustCompile(`\{\{>\s*([^\s{}]*)\s*\}\}`)
+
+// partialExpander inlines the partials of one prompt file. Partials are
+// found through the prompt's partials: frontmatter, a map of names to
+// files relative to the prompt, then among the standard partials for std/
+// names, and otherwise in the _partials directory next to it.
+type partialExpander struct {
+	dir     string
+	paths   map[string]interface{}
+	sources *sourceSet
+}
+
+// expandPartials replaces each {{> name}} tag in a prompt's template with
+// the named partial, so partials render with the surrounding context and
+// may contain role markers. The template starts on line firstLine of
+// filePath, which is used to locate errors. The partials read are recorded
+// in sources, which may be nil.
+func expandPartials(template, filePath string, firstLine int, meta map[string]interface{}, sources *sourceSet) (string, []error) {
+	if !strings.Contains(template, "{{>") {
+		return template, nil
+	}
+	paths, _ := meta["partials"].(map[string]interface{})
+	x := partialExpander{dir: filepath.Dir(filePath), paths: paths, sources: sources}
+	return x.expand(template, filePath, firstLine, nil)
+}
+
+// expand inlines the partials in src, read from file starting at firstLine.
+// stack holds the names of the partials being expanded, to catch cycles.
+func (x *partialExpander) expand(src, file string, firstLine int, stack []string) (string, []error) {
+	var b strings.Builder
+	var errs []error
+	pos := 0
+	for _, loc := range partialTagRe.FindAllStringSubmatchIndex(src, -1) {
+		b.WriteString(src[pos:loc[0]])
+		pos = loc[1]
+		name := src[loc[2]:loc[3]]
+		fail := func(format string, args ...interface{}) {
+			errs = append(errs, locateErrors([]*sourceError{newSourceError(src, loc[0], format, args...)}, file, firstLine)...)
+		}
+
+		if name == "" {
+			fail("partial tag has no name")
+			continue
+		}
+		if containsString(stack, name) {
+			fail("partial %q includes itself", name)
+			continue
+		}
+		if len(stack) >= maxPartialDepth {
+			fail("partials nested more than %d deep", maxPartialDepth)
+			continue
+		}
+		content, path, err := x.read(name)
+		if err != nil {
+			fail("%v", err)
+			continue
+		}
+		partial := strings.TrimSuffix(content, "\n")
+		if syntaxErrs := locateErrors(checkTemplate(partial), path, 1); len(syntaxErrs) > 0 {
+			errs = append(errs, syntaxErrs...)
+			continue
+		}
+		expanded, partialErrs := x.expand(partial, path, 1, append(stack, name))
+		errs = append(errs, partialErrs...)
+		b.WriteString(expanded)
+	}
+	b.WriteString(src[pos:])
+	return b.String(), errs
+}
+
+// read returns the content of the named partial and the path its errors
+// are reported at
+func (x *partialExpander) read(name string) (string, string, error) {
+	if _, ok := x.paths[name]; !ok && strings.HasPrefix(name, stdPrefix) {
+		content, err := stdPartials.ReadFile(name + ".prompt")
+		if err != nil {
+			return "", "", fmt.Errorf("no standard partial %q (available: %s)", name, strings.Join(stdPartialNames(), ", "))
+		}
+		return string(content), name + ".prompt", nil
+	}
+	path, err := x.path(name)
+	if err != nil {
+		return "", "", err
+	}
+	content, err := x.sources.read(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = fmt.Errorf("partial %q not found (looked for %s)", name, path)
+		}
+		return "", "", err
+	}
+	return string(content), path, nil
+}
+
+// stdPartialNames lists the standard partials, as they are included
+func stdPartialNames() []string {
+	files, _ := fs.Glob(stdPartials, "std/*.prompt")
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = strings.TrimSuffix(file, ".prompt")
+	}
+	return names
+}
+
+// path finds the file of the named partial
+func (x *partialExpander) path(name string) (string, error) {
+	if p, ok := x.paths[name]; ok {
+		s, ok := p.(string)
+		if !ok || s == "" {
+			return "", fmt.Errorf("partials.%s must be a file path", name)
+		}
+		if filepath.IsAbs(s) {
+			return s, nil
+		}
+		return filepath.Join(x.dir, filepath.FromSlash(s)), nil
+	}
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid partial name %q", name)
+	}
+	return filepath.Join(x.dir, partialsDir, clean+".prompt"), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files, given as path and content pairs, under dir
+func writeFiles(t *testing.T, dir string, files ...string) {
+	t.Helper()
+	for i := 0; i < len(files); i += 2 {
+		path := filepath.Join(dir, filepath.FromSlash(files[i]))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(files[i+1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPartials(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir,
+		"_partials/persona.prompt", "{{role \"system\"}}\nYou are {{assistant}}.\n",
+		"_partials/sign/off.prompt", "Thanks, {{> name}}",
+		"_partials/name.prompt", "{{#if name}}{{name}}{{else}}friend{{/if}}",
+		"shared/legal.txt", "No advice.",
+		"ask.prompt", "---\nmodel: test\npartials:\n  legal: shared/legal.txt\n---\n{{> persona}}\n{{role \"user\"}}\n{{> legal }} {{> sign/off}}",
+	)
+	meta, template, err := parsePromptFile(filepath.Join(dir, "ask.prompt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := renderPromptMessages(compileMessages(template), map[string]interface{}{"assistant": "terse"}, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Message{{Role: "system", Content: "You are terse."}, {Role: "user", Content: "No advice. Thanks, friend"}}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected %v, got %v", expected, messages)
+	}
+}
+
+func TestPartialErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    []string
+		expected string
+	}{
+		{"missing", []string{"p.prompt", "Hi\n{{> nope}}"},
+			`p.prompt:2:1: partial "nope" not found`},
+		{"cycle", []string{"p.prompt", "{{> a}}", "_partials/a.prompt", "{{> b}}", "_partials/b.prompt", "x{{> a}}"},
+			`b.prompt:1:2: partial "a" includes itself`},
+		{"syntax", []string{"p.prompt", "{{> a}}", "_partials/a.prompt", "\n{{#if x}}"},
+			`a.prompt:2:1: unclosed section {{#if x}}`},
+		{"escape", []string{"p.prompt", "{{> ../secret}}"},
+			`invalid partial name "../secret"`},
+		{"bad path", []string{"p.prompt", "---\npartials:\n  a: [x]\n---\n{{> a}}"},
+			`p.prompt:5:1: partials.a must be a file path`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, tc.files...)
+			_, _, err := parsePromptFile(filepath.Join(dir, "p.prompt"))
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("Expected error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestPartialsSkippedInSearches(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, "a.prompt", "---\nmodel: test\n---\n{{> b}}", "_partials/b.prompt", "B")
+	prompts, err := expandPromptArgs([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prompts) != 1 || filepath.Base(prompts[0]) != "a.prompt" {
+		t.Errorf("Expected only a.prompt, got %v", prompts)
+	}
+	if _, ok := newPromptServer(dir).promptPath("_partials/b"); ok {
+		t.Error("Expected partials not to be served")
+	}
+}
+
+func TestStdPartials(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir,
+		"ask.prompt", "---\nmodel: test\n---\nList three colors.\n{{> std/json-instructions}}",
+		"mine.prompt", "---\nmodel: test\npartials:\n  std/no-reasoning: short.txt\n---\n{{> std/no-reasoning}}",
+		"short.txt", "Be short.",
+		"bad.prompt", "{{> std/nope}}",
+	)
+	_, template, err := parsePromptFile(filepath.Join(dir, "ask.prompt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(template, "List three colors.\nRespond with a single valid JSON value") {
+		t.Errorf("Expected the standard partial to be inlined, got %q", template)
+	}
+	// A partial named in frontmatter takes precedence
+	if _, template, err = parsePromptFile(filepath.Join(dir, "mine.prompt")); err != nil || template != "Be short." {
+		t.Errorf("Expected the prompt's own partial, got %q (%v)", template, err)
+	}
+	_, _, err = parsePromptFile(filepath.Join(dir, "bad.prompt"))
+	if err == nil || !strings.Contains(err.Error(), `no standard partial "std/nope" (available: std/citations, std/json-instructions, std/no-reasoning)`) {
+		t.Errorf("Expected an unknown standard partial error, got %v", err)
+	}
+
+	for _, name := range stdPartialNames() {
+		content, _ := stdPartials.ReadFile(name + ".prompt")
+		if errs := checkTemplate(string(content)); len(errs) > 0 {
+			t.Errorf("%s: %v", name, errs[0])
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// A pipeline file runs prompts as the steps of a graph, each step's input
+// variables taken from the outputs of the steps before it:
+//
+//	steps:
+//	  - name: extract
+//	    prompt: extract.prompt          # reads the pipeline's stdin
+//	  - name: bio
+//	    prompt: generate-bio.prompt
+//	    model: anthropic/claude-sonnet-4-20250514
+//	    inputs:
+//	      name: extract.name            # a field of extract's output
+//	      job: extract.occupation
+//	    vars:
+//	      tone: friendly
+//
+// Steps run as soon as the steps they take inputs from, or list in after,
+// have finished, so independent steps run at once.
+type pipelineStep struct {
+	Name   string
+	Prompt string
+	Model  string
+	Inputs map[string]pipelineRef
+	Vars   map[string]interface{}
+	After  []string
+}
+
+// pipelineRef is a step's output, or the value at a path within it
+type pipelineRef struct {
+	Step string
+	Path string
+}
+
+// pipelineStepNameRe matches the names steps may have
+var pipelineStepNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// parsePipelineRef reads a reference such as extract.name or items[0]
+func parsePipelineRef(s string) pipelineRef {
+	end := strings.IndexAny(s, ".[")
+	if end == -1 {
+		return pipelineRef{Step: s}
+	}
+	return pipelineRef{Step: s[:end], Path: s[end:]}
+}
+
+// needs lists the steps that must finish before s runs
+func (s pipelineStep) needs() []string {
+	needs := append([]string{}, s.After...)
+	for _, ref := range s.Inputs {
+		if !containsString(needs, ref.Step) {
+			needs = append(needs, ref.Step)
+		}
+	}
+	return needs
+}
+
+// parsePipeline reads a pipeline file's steps, checking that every
+// reference names a step and that they form no cycle
+func parsePipeline(content string) ([]pipelineStep, error) {
+	doc := parseYAML(content)
+	for key := range doc {
+		if key != "steps" {
+			return nil, fmt.Errorf("unknown field %s", key)
+		}
+	}
+	list, ok := doc["steps"].([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("steps must list the pipeline's steps")
+	}
+	steps := make([]pipelineStep, 0, len(list))
+	for i, item := range list {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("step %d must be a mapping", i+1)
+		}
+		step := pipelineStep{Inputs: map[string]pipelineRef{}, Vars: map[string]interface{}{}}
+		for key, value := range fields {
+			switch key {
+			case "name":
+				step.Name = fmt.Sprintf("%v", value)
+			case "prompt":
+				step.Prompt, _ = value.(string)
+			case "model":
+				step.Model, _ = value.(string)
+			case "inputs":
+				inputs, ok := value.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("step %d: inputs must map variables to step outputs", i+1)
+				}
+				for name, ref := range inputs {
+					s, ok := ref.(string)
+					if !ok || s == "" {
+						return nil, fmt.Errorf("step %d: inputs.%s must name a step output like extract.name", i+1, name)
+					}
+					step.Inputs[name] = parsePipelineRef(s)
+				}
+			case "vars":
+				vars, ok := value.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("step %d: vars must map variables to values", i+1)
+				}
+				step.Vars = vars
+			case "after":
+				after, ok := value.([]interface{})
+				if !ok {
+					after = []interface{}{value}
+				}
+				for _, name := range after {
+					step.After = append(step.After, fmt.Sprintf("%v", name))
+				}
+			default:
+				return nil, fmt.Errorf("step %d: unknown field %s", i+1, key)
+			}
+		}
+		if !pipelineStepNameRe.MatchString(step.Name) {
+			return nil, fmt.Errorf("step %d needs a name of letters, digits, - and _", i+1)
+		}
+		if step.Prompt == "" {
+			return nil, fmt.Errorf("step %s needs a prompt", step.Name)
+		}
+		for _, s := range steps {
+			if s.Name == step.Name {
+				return nil, fmt.Errorf("two steps are named %s", step.Name)
+			}
+		}
+		steps = append(steps, step)
+	}
+
+	byName := make(map[string]pipelineStep, len(steps))
+	for _, s := range steps {
+		byName[s.Name] = s
+	}
+	for _, s := range steps {
+		for _, need := range s.needs() {
+			if _, ok := byName[need]; !ok {
+				return nil, fmt.Errorf("step %s refers to no step %s", s.Name, need)
+			}
+		}
+	}
+	// Depth-first search for a step that depends on itself
+	state := map[string]int{} // 1 while being visited, 2 when done
+	var visit func(name string, chain []string) error
+	visit = func(name string, chain []string) error {
+		chain = append(chain, name)
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("steps depend on each other in a cycle: %s", strings.Join(chain, " -> "))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, need := range byName[name].needs() {
+			if err := visit(need, chain); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		return nil
+	}
+	for _, s := range steps {
+		if err := visit(s.Name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return steps, nil
+}
+
+// pipelineResult is one step's entry in pipeline output: its run's
+// summary, or the error that stopped or skipped it
+type pipelineResult struct {
+	*runSummary
+	Error string `json:"error,omitempty"`
+}
+
+// runPipeline runs the steps, each once its needs have finished, and
+// returns their results in the same order. Steps that need a failed step
+// are skipped. input is the pipeline's stdin, given to steps without inputs.
+func runPipeline(ctx context.Context, dir string, steps []pipelineStep, input string) []pipelineResult {
+	results := make([]pipelineResult, len(steps))
+	done := make(map[string]chan struct{}, len(steps))
+	index := make(map[string]int, len(steps))
+	for i, s := range steps {
+		done[s.Name] = make(chan struct{})
+		index[s.Name] = i
+	}
+	var wg sync.WaitGroup
+	for i, step := range steps {
+		wg.Add(1)
+		go func(i int, step pipelineStep) {
+			defer wg.Done()
+			defer close(done[step.Name])
+			for _, need := range step.needs() {
+				<-done[need]
+				if results[index[need]].Error != "" {
+					results[i] = pipelineResult{Error: fmt.Sprintf("skipped because step %s failed", need)}
+					return
+				}
+			}
+			stepInput := input
+			if len(step.Inputs) > 0 || len(step.Vars) > 0 {
+				variables := map[string]interface{}{}
+				for name, ref := range step.Inputs {
+					value, err := extractPath(results[index[ref.Step]].Output, ref.Path)
+					if err != nil {
+						results[i] = pipelineResult{Error: fmt.Sprintf("input %s from %s%s: %v", name, ref.Step, ref.Path, err)}
+						return
+					}
+					variables[name] = value
+				}
+				for name, value := range step.Vars {
+					variables[name] = value
+				}
+				data, _ := json.Marshal(variables)
+				stepInput = string(data)
+			}
+			log(fmt.Sprintf("Step %s: running %s", step.Name, step.Prompt))
+			summary, err := runPipelineStep(ctx, dir, step, stepInput, nil, false)
+			if err != nil {
+				results[i] = pipelineResult{Error: err.Error()}
+				return
+			}
+			results[i] = pipelineResult{runSummary: &summary}
+		}(i, step)
+	}
+	wg.Wait()
+	return results
+}
+
+// runPipelineStep renders a step's prompt with input and sends it, with
+// the step's model in place of the prompt's. The prompt is prepared as a
+// single run's is, so its locale, timeout, proxy and faultInject settings
+// are its own, and its output.files are written, replacing existing files
+// only with force. The summary's Output is the reply decoded as JSON when
+// it is JSON, so later steps can read fields. argOverrides are applied as
+// --key=value settings are, beneath the step's model.
+func runPipelineStep(ctx context.Context, dir string, step pipelineStep, input string, argOverrides map[string]interface{}, force bool) (runSummary, error) {
+	path := step.Prompt
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	overrides := make(map[string]interface{}, len(argOverrides)+1)
+	for k, v := range argOverrides {
+		overrides[k] = v
+	}
+	if step.Model != "" {
+		overrides["model"] = step.Model
+	}
+	meta, template, variant, err := preparePrompt(path, overrides)
+	if err != nil {
+		return runSummary{}, err
+	}
+	if err := checkRequiredEnv(meta); err != nil {
+		return runSummary{}, err
+	}
+	provider, model, err := resolveModel(meta)
+	if err != nil {
+		return runSummary{}, err
+	}
+	variables, err := inputVariables(input, meta)
+	if err != nil {
+		return runSummary{}, err
+	}
+	messages, err := renderPromptMessages(compileMessages(template), variables, meta)
+	if err != nil {
+		return runSummary{}, err
+	}
+	outputConfig, _ := meta["output"].(map[string]interface{})
+	sinks, err := parseSinks(outputConfig)
+	if err != nil {
+		return runSummary{}, err
+	}
+	files, err := outputFiles(outputConfig)
+	if err != nil {
+		return runSummary{}, err
+	}
+	pr := promptRun{
+		path:     path,
+		meta:     meta,
+		variant:  variant,
+		provider: provider,
+		model:    model,
+		messages: messages,
+		out:      io.Discard,
+	}
+	c, err := complete(ctx, pr)
+	if err != nil {
+		return runSummary{}, err
+	}
+	if len(files) > 0 {
+		written, err := writeOutputFiles(files, c.Result, variables, force)
+		for _, path := range written {
+			fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+		}
+		if err != nil {
+			return runSummary{}, err
+		}
+	}
+	if err := deliverSinks(ctx, sinks, pr, c, variables); err != nil {
+		return runSummary{}, err
+	}
+	summary := summarize(pr, c)
+	if s, ok := summary.Output.(string); ok {
+		var data interface{}
+		if err := json.Unmarshal([]byte(s), &data); err == nil {
+			summary.Output = data
+		}
+	}
+	return summary, nil
+}
+
+// thenPrompts reads the prompts given with --then
+func thenPrompts(v interface{}) ([]string, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	prompts := make([]string, 0, len(list))
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("--then needs a prompt file")
+		}
+		prompts = append(prompts, s)
+	}
+	return prompts, nil
+}
+
+// runChain implements --then, running each prompt in turn with the output
+// of the one before as its input, decoded as variables when it is JSON,
+// and with the settings given on the command line, --safe among them.
+// Each prompt writes its own output.files, replacing existing files only
+// with force. It returns the last prompt's summary.
+func runChain(ctx context.Context, prompts []string, input string, argOverrides map[string]interface{}, force bool) (runSummary, error) {
+	var summary runSummary
+	for _, path := range prompts {
+		log(fmt.Sprintf("Passing the output on to %s", path))
+		var err error
+		if summary, err = runPipelineStep(ctx, "", pipelineStep{Name: path, Prompt: path}, input, argOverrides, force); err != nil {
+			return summary, fmt.Errorf("--then %s: %v", path, err)
+		}
+		input = formatExtracted(summary.Output)
+	}
+	return summary, nil
+}
+
+// pipelineCommand implements runprompt pipeline. It prints the output of
+// the last step, or with --output json every step's result keyed by name,
+// and fails if any step did.
+func pipelineCommand(ctx context.Context, args []string) error {
+	flags, positional, err := parseFlags("pipeline", args, map[string]bool{"output": true})
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return commandUsage("pipeline")
+	}
+	jsonOutput := false
+	switch flags["output"] {
+	case "", "text":
+	case "json":
+		jsonOutput = true
+	default:
+		return fmt.Errorf("--output must be text or json, got %q", flags["output"])
+	}
+	content, err := os.ReadFile(positional[0])
+	if err != nil {
+		return err
+	}
+	steps, err := parsePipeline(string(content))
+	if err != nil {
+		return fmt.Errorf("%s: %v", positional[0], err)
+	}
+
+	results := runPipeline(ctx, filepath.Dir(positional[0]), steps, readStdin())
+	failed := 0
+	for i, r := range results {
+		if r.Error != "" {
+			fmt.Fprintf(os.Stderr, "Step %s: %s\n", steps[i].Name, r.Error)
+			failed++
+		}
+	}
+	if jsonOutput {
+		byStep := make(map[string]pipelineResult, len(steps))
+		for i, s := range steps {
+			byStep[s.Name] = results[i]
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(byStep); err != nil {
+			return err
+		}
+	} else if last := results[len(results)-1]; last.runSummary != nil {
+		fmt.Println(formatExtracted(last.Output))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d steps failed", failed, len(steps))
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParsePipeline(t *testing.T) {
+	steps, err := parsePipeline(`steps:
+  - name: extract
+    prompt: extract.prompt
+  - name: bio
+    prompt: bio.prompt
+    model: openai/gpt-4o-mini
+    inputs:
+      name: extract.name
+      first: extract.items[0]
+    after: [extract]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 2 || steps[1].Model != "openai/gpt-4o-mini" {
+		t.Fatalf("got %+v", steps)
+	}
+	if ref := steps[1].Inputs["first"]; ref != (pipelineRef{Step: "extract", Path: ".items[0]"}) {
+		t.Errorf("Expected extract .items[0], got %+v", ref)
+	}
+	if needs := steps[1].needs(); len(needs) != 1 || needs[0] != "extract" {
+		t.Errorf("Expected bio to need extract once, got %v", needs)
+	}
+
+	errors := []struct {
+		content string
+		err     string
+	}{
+		{"steps: []", "steps must list"},
+		{"steps:\n  - prompt: a.prompt", "needs a name"},
+		{"steps:\n  - name: a", "needs a prompt"},
+		{"steps:\n  - name: a\n    prompt: a.prompt\n  - name: a\n    prompt: b.prompt", "two steps are named a"},
+		{"steps:\n  - name: a\n    prompt: a.prompt\n    inputs:\n      x: b.field", "refers to no step b"},
+		{"steps:\n  - name: a\n    prompt: a.prompt\n    after: b\n  - name: b\n    prompt: b.prompt\n    after: a", "cycle: a -> b -> a"},
+		{"steps:\n  - name: a\n    prompt: a.prompt\n    retries: 2", "unknown field retries"},
+	}
+	for _, tc := range errors {
+		if _, err := parsePipeline(tc.content); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: Expected error containing %q, got %v", tc.content, tc.err, err)
+		}
+	}
+}
+
+func TestRunPipeline(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeFiles(t, dir,
+		"extract.prompt", "---\nmodel: test\noutput:\n  files:\n    name: "+filepath.Join(dir, "name.txt")+"\n---\nExtract: {{STDIN}}",
+		"extract.prompt.test-response", `{"choices":[{"message":{"content":"{\"name\":\"Ada\",\"occupation\":\"engineer\"}"}}]}`,
+		// The step's model replaces the prompt's, which has no key here
+		"bio.prompt", "---\nmodel: openai/gpt-4o\n---\nWrite about {{name}}, a {{job}}, {{tone}}ly.",
+		"bio.prompt.test-response", `{"choices":[{"message":{"content":"Ada builds things."}}]}`,
+		"broken.prompt", "---\nmodel: test\n---\nHi",
+	)
+	steps, err := parsePipeline(`steps:
+  - name: extract
+    prompt: extract.prompt
+  - name: bio
+    prompt: bio.prompt
+    model: test
+    inputs:
+      name: extract.name
+      job: extract.occupation
+    vars:
+      tone: friend
+  - name: broken
+    prompt: broken.prompt
+  - name: after-broken
+    prompt: bio.prompt
+    after: broken
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := runPipeline(context.Background(), dir, steps, "Ada is an engineer")
+	if results[0].Error != "" || results[1].Error != "" {
+		t.Fatalf("Expected extract and bio to succeed, got %+v %+v", results[0], results[1])
+	}
+	if data, ok := results[0].Output.(map[string]interface{}); !ok || data["name"] != "Ada" {
+		t.Errorf("Expected extract's output decoded, got %v", results[0].Output)
+	}
+	if content, err := os.ReadFile(filepath.Join(dir, "name.txt")); err != nil || string(content) != "Ada" {
+		t.Errorf("Expected extract's output.files written, got %q, %v", content, err)
+	}
+	if results[1].Output != "Ada builds things." {
+		t.Errorf("Expected bio's output, got %v", results[1].Output)
+	}
+	if results[2].Error == "" {
+		t.Error("Expected broken to fail without a fixture")
+	}
+	if !strings.Contains(results[3].Error, "skipped because step broken failed") {
+		t.Errorf("Expected after-broken to be skipped, got %q", results[3].Error)
+	}
+}
+
+func TestRunPipelineBadInput(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeFiles(t, dir,
+		"a.prompt", "---\nmodel: test\n---\nHi",
+		"a.prompt.test-response", `{"choices":[{"message":{"content":"plain text"}}]}`,
+		"pipeline.yaml", "steps:\n  - name: a\n    prompt: a.prompt\n  - name: b\n    prompt: a.prompt\n    inputs:\n      x: a.missing\n",
+	)
+	err := run(context.Background(), []string{"pipeline", filepath.Join(dir, "pipeline.yaml")})
+	if err == nil || err.Error() != "1 of 2 steps failed" {
+		t.Errorf("Expected 1 of 2 steps failed, got %v", err)
+	}
+}
+
+func TestRunThen(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeFiles(t, dir,
+		"extract.prompt", "---\nmodel: test\n---\nExtract",
+		"extract.prompt.test-response", `{"choices":[{"message":{"content":"{\"name\":\"Ada\"}"}}]}`,
+		// Strict, so the run fails unless name arrives from extract
+		"bio.prompt", "---\nmodel: test\nstrictVariables: true\n---\nWrite about {{name}}",
+		"bio.prompt.test-response", `{"choices":[{"message":{"content":"{\"bio\":\"Ada builds things.\"}"}}]}`,
+		"shout.prompt", "---\nmodel: test\nstrictVariables: true\n---\nShout {{bio}}",
+		"shout.prompt.test-response", `{"choices":[{"message":{"content":"ADA BUILDS THINGS."}}]}`,
+	)
+	_, _, overrides, _, err := parseArgs([]string{"--then", "a.prompt", "--then=b.prompt", "x.prompt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompts, err := thenPrompts(overrides["then"]); err != nil || len(prompts) != 2 || prompts[1] != "b.prompt" {
+		t.Errorf("Expected both --then prompts, got %v %v", prompts, err)
+	}
+
+	summary, err := runChain(context.Background(), []string{filepath.Join(dir, "bio.prompt"), filepath.Join(dir, "shout.prompt")}, `{"name":"Ada"}`, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Output != "ADA BUILDS THINGS." {
+		t.Errorf("Expected the last prompt's output, got %v", summary.Output)
+	}
+	if _, err := runChain(context.Background(), []string{filepath.Join(dir, "shout.prompt")}, "plain", nil, false); err == nil || !strings.Contains(err.Error(), "--then "+filepath.Join(dir, "shout.prompt")) {
+		t.Errorf("Expected the failing prompt to be named, got %v", err)
+	}
+
+	extract := filepath.Join(dir, "extract.prompt")
+	if err := run(context.Background(), []string{extract, "--then", filepath.Join(dir, "bio.prompt")}); err != nil {
+		t.Errorf("Expected the chain to run, got %v", err)
+	}
+	if err := run(context.Background(), []string{"--models", "openai/a", "--then", "bio.prompt", extract}); err == nil || !strings.Contains(err.Error(), "can't be combined") {
+		t.Errorf("Expected --then and --models to conflict, got %v", err)
+	}
+
+	// --safe applies to the prompts passed on to as well
+	sinkFile := filepath.Join(dir, "sink.txt")
+	writeFiles(t, dir,
+		"sink.prompt", "---\nmodel: test\noutput:\n  sink:\n    - type: file\n      path: "+filepath.ToSlash(sinkFile)+"\n---\nShout {{bio}}",
+		"sink.prompt.test-response", `{"choices":[{"message":{"content":"ADA"}}]}`,
+	)
+	if err := run(context.Background(), []string{"--safe", extract, "--then", filepath.Join(dir, "bio.prompt"), "--then", filepath.Join(dir, "sink.prompt")}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := os.Stat(sinkFile); err == nil {
+		t.Error("Expected --safe to skip the chained prompt's sink")
+	}
+	if err := run(context.Background(), []string{extract, "--then", filepath.Join(dir, "bio.prompt"), "--then", filepath.Join(dir, "sink.prompt")}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := os.Stat(sinkFile); err != nil {
+		t.Errorf("Expected the sink to be written without --safe, got %v", err)
+	}
+}
+
+func TestRunThenPromptSettings(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	server, calls := limitServer(t, 100*time.Millisecond)
+	t.Setenv("RUNPROMPT_BASE_URL", server.URL)
+	dir := t.TempDir()
+	name := filepath.Join(dir, "name.txt")
+	writeFiles(t, dir,
+		"first.prompt", "---\nmodel: custom/x\n---\nExtract the name.",
+		"second.prompt", "---\nmodel: custom/x\noutput:\n  files:\n    name: "+filepath.ToSlash(name)+"\n---\nAgain: {{name}}",
+		"slow.prompt", "---\nmodel: custom/x\ntimeout: 20ms\n---\nAgain: {{name}}",
+		"name.txt", "old",
+	)
+	first, second := filepath.Join(dir, "first.prompt"), filepath.Join(dir, "second.prompt")
+
+	if err := run(context.Background(), []string{first, "--then", second}); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("Expected the second prompt's output.files to refuse to replace name.txt, got %v", err)
+	}
+	if err := run(context.Background(), []string{"--force", first, "--then", second}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if content, err := os.ReadFile(name); err != nil || string(content) != "5\n" {
+		t.Errorf("Expected the second prompt's output.files written, got %q, %v", content, err)
+	}
+
+	// Only the second prompt's timeout is short enough to fail
+	atomic.StoreInt32(calls, 0)
+	err := run(context.Background(), []string{first, "--then", filepath.Join(dir, "slow.prompt")})
+	if err == nil || !strings.Contains(err.Error(), "--then "+filepath.Join(dir, "slow.prompt")) {
+		t.Errorf("Expected the second prompt to time out, got %v", err)
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Errorf("Expected the first prompt to finish and the second to be tried, got %d calls", n)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Price is the cost of a model in USD per million tokens
+type Price struct {
+	Input  float64
+	Output float64
+}
+
+// prices holds list prices for common models, keyed by model name prefix.
+// Add or correct entries in pricing.yaml in the config directory.
+var prices = map[string]Price{
+	"gpt-4o":            {2.50, 10},
+	"gpt-4o-mini":       {0.15, 0.60},
+	"gpt-4.1":           {2, 8},
+	"gpt-4.1-mini":      {0.40, 1.60},
+	"gpt-4.1-nano":      {0.10, 0.40},
+	"o3-mini":           {1.10, 4.40},
+	"o4-mini":           {1.10, 4.40},
+	"claude-opus-4":     {15, 75},
+	"claude-sonnet-4":   {3, 15},
+	"claude-3-7-sonnet": {3, 15},
+	"claude-3-5-sonnet": {3, 15},
+	"claude-3-5-haiku":  {0.80, 4},
+	"gemini-2.5-pro":    {1.25, 10},
+	"gemini-2.5-flash":  {0.30, 2.50},
+	"gemini-2.0-flash":  {0.10, 0.40},
+	"gemini-1.5-pro":    {1.25, 5},
+}
+
+// loadUserPricing merges a pricing.yaml file into the price table:
+//
+//	my-finetune:
+//	  input: 0.5    # USD per million input tokens
+//	  output: 1.5
+//
+// A missing file is not an error.
+func loadUserPricing(path string) error {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for model, value := range parseYAML(string(content)) {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: price for %q must be a mapping", path, model)
+		}
+		var p Price
+		for key, v := range fields {
+			f, ok := toFloat(v)
+			if !ok {
+				return fmt.Errorf("%s: %s.%s must be a number", path, model, key)
+			}
+			switch key {
+			case "input":
+				p.Input = f
+			case "output":
+				p.Output = f
+			default:
+				return fmt.Errorf("%s: unknown field %s.%s", path, model, key)
+			}
+		}
+		prices[model] = p
+	}
+	return nil
+}
+
+// priceFor finds the price of a model by longest matching prefix, ignoring
+// any vendor path as in OpenRouter's "anthropic/claude-sonnet-4"
+func priceFor(model string) (Price, bool) {
+	if i := strings.LastIndex(model, "/"); i != -1 {
+		model = model[i+1:]
+	}
+	best := ""
+	for prefix := range prices {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return Price{}, false
+	}
+	return prices[best], true
+}
+
+// describeCost describes what a request cost, for verbose output
+func describeCost(model string, usage Usage) string {
+	tokens := fmt.Sprintf("%d input and %d output tokens", usage.InputTokens, usage.OutputTokens)
+	if cost := usageCost(model, usage); cost != nil {
+		return fmt.Sprintf("$%.4f for %s", *cost, tokens)
+	}
+	return fmt.Sprintf("unknown for %s, no price for %s", tokens, model)
+}
+
+// usageCost returns the cost of a request in USD, or nil if the model's
+// price is unknown
+func usageCost(model string, usage Usage) *float64 {
+	p, ok := priceFor(model)
+	if !ok {
+		return nil
+	}
+	cost := (float64(usage.InputTokens)*p.Input + float64(usage.OutputTokens)*p.Output) / 1e6
+	return &cost
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPriceFor(t *testing.T) {
+	tests := []struct {
+		model string
+		price Price
+		ok    bool
+	}{
+		{"gpt-4o", Price{2.50, 10}, true},
+		{"gpt-4o-mini-2024-07-18", Price{0.15, 0.60}, true},
+		{"anthropic/claude-sonnet-4", Price{3, 15}, true},
+		{"claude-sonnet-4-20250514", Price{3, 15}, true},
+		{"llama3", Price{}, false},
+	}
+	for _, tt := range tests {
+		price, ok := priceFor(tt.model)
+		if ok != tt.ok || price != tt.price {
+			t.Errorf("priceFor(%q): expected %v %v, got %v %v", tt.model, tt.price, tt.ok, price, ok)
+		}
+	}
+}
+
+func TestUsageCost(t *testing.T) {
+	cost := usageCost("gpt-4o", Usage{InputTokens: 1000, OutputTokens: 500})
+	if cost == nil || math.Abs(*cost-0.0075) > 1e-9 {
+		t.Errorf("Expected cost 0.0075, got %v", cost)
+	}
+	if cost := usageCost("llama3", Usage{InputTokens: 1000}); cost != nil {
+		t.Errorf("Expected no cost for unknown model, got %v", *cost)
+	}
+}
+
+func TestLoadUserPricing(t *testing.T) {
+	saved := prices
+	prices = map[string]Price{"gpt-4o": {2.50, 10}}
+	defer func() { prices = saved }()
+
+	path := filepath.Join(t.TempDir(), "pricing.yaml")
+	content := "llama3:\n  input: 0.2\n  output: 0.4\ngpt-4o:\n  input: 2\n  output: 8\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadUserPricing(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if p, _ := priceFor("llama3:8b"); p != (Price{0.2, 0.4}) {
+		t.Errorf("Expected user price for llama3, got %v", p)
+	}
+	if p, _ := priceFor("gpt-4o"); p != (Price{2, 8}) {
+		t.Errorf("Expected overridden price for gpt-4o, got %v", p)
+	}
+
+	if err := os.WriteFile(path, []byte("llama3:\n  inptu: 0.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadUserPricing(path); err == nil {
+		t.Error("Expected error for unknown field")
+	}
+	if err := loadUserPricing(filepath.Join(t.TempDir(), "missing.yaml")); err != nil {
+		t.Errorf("Expected missing file to be ignored, got %v", err)
+	}
+}
+
+func TestDescribeCost(t *testing.T) {
+	tests := []struct {
+		model    string
+		expected string
+	}{
+		{"gpt-4o", "$0.0060 for 1200 input and 300 output tokens"},
+		{"llama3", "unknown for 1200 input and 300 output tokens, no price for llama3"},
+	}
+	for _, tt := range tests {
+		if got := describeCost(tt.model, Usage{InputTokens: 1200, OutputTokens: 300}); got != tt.expected {
+			t.Errorf("Expected %q, got %q", tt.expected, got)
+		}
+	}
+}
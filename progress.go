@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressRedraw and progressLog bound how often the progress display is
+// redrawn in place on a terminal, and printed as new lines elsewhere
+const (
+	progressRedraw = 100 * time.Millisecond
+	progressLog    = time.Second
+)
+
+// batchProgress reports how a batch run is going on stderr: as a summary
+// redrawn in place, or with --progress json as one event per line for
+// orchestration systems. A nil batchProgress reports nothing. It is safe
+// for concurrent use.
+type batchProgress struct {
+	mu       sync.Mutex
+	w        io.Writer
+	json     bool
+	redraw   bool   // move the cursor back over the last summary
+	model    string // for the spend
+	total    int    // lines to run, or 0 if unknown
+	started  time.Time
+	drawn    int // lines of the summary on screen
+	lastDraw time.Time
+
+	completed, failed, inFlight int
+	usage                       Usage
+}
+
+// progressEvent is one line of --progress json
+type progressEvent struct {
+	Event        string   `json:"event"` // started, completed, failed or finished
+	Line         int      `json:"line,omitempty"`
+	Error        string   `json:"error,omitempty"`
+	Completed    int      `json:"completed"`
+	Failed       int      `json:"failed"`
+	InFlight     int      `json:"inFlight"`
+	Total        int      `json:"total,omitempty"`
+	InputTokens  int      `json:"inputTokens"`
+	OutputTokens int      `json:"outputTokens"`
+	Cost         *float64 `json:"cost"`
+	ElapsedMs    int64    `json:"elapsedMs"`
+	EtaMs        int64    `json:"etaMs,omitempty"`
+}
+
+// newBatchProgress reports progress in the --progress mode given: auto,
+// which shows a summary only when stderr is a terminal, text, json or
+// none. total is the number of lines to run, or 0 if unknown.
+func newBatchProgress(mode, model string, total int) (*batchProgress, error) {
+	p := &batchProgress{w: os.Stderr, model: model, total: total, started: time.Now()}
+	terminal := isTerminal(os.Stderr) && red != ""
+	switch mode {
+	case "auto":
+		if !terminal {
+			return nil, nil
+		}
+		p.redraw = true
+	case "text":
+		p.redraw = terminal
+	case "json":
+		p.json = true
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("--progress must be auto, text, json or none, got %q", mode)
+	}
+	return p, nil
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// countBatchLines counts the non-blank lines left in f when it is a
+// regular file, so progress can show an ETA, reading them without moving
+// f's offset. It returns 0 when f is a pipe or terminal.
+func countBatchLines(f *os.File) int {
+	stat, err := f.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		return 0
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0
+	}
+	scanner := bufio.NewScanner(io.NewSectionReader(f, offset, stat.Size()-offset))
+	scanner.Buffer(nil, 64<<20)
+	n := 0
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// start records that a line's run has started
+func (p *batchProgress) start(line int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inFlight++
+	p.report(progressEvent{Event: "started", Line: line}, false)
+}
+
+// finish records that a line's run has ended, having used usage
+func (p *batchProgress) finish(line int, usage Usage, err string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inFlight--
+	p.usage.InputTokens += usage.InputTokens
+	p.usage.OutputTokens += usage.OutputTokens
+	event := progressEvent{Event: "completed", Line: line}
+	if err != "" {
+		p.failed++
+		event.Event, event.Error = "failed", err
+	} else {
+		p.completed++
+	}
+	p.report(event, false)
+}
+
+// end reports the batch's final state
+func (p *batchProgress) end() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report(progressEvent{Event: "finished"}, true)
+}
+
+// report writes event in the progress mode, throttling summaries unless
+// final is set
+func (p *batchProgress) report(event progressEvent, final bool) {
+	elapsed := time.Since(p.started)
+	var eta time.Duration
+	if done := p.completed + p.failed; p.total > 0 && done > 0 && done < p.total {
+		eta = elapsed / time.Duration(done) * time.Duration(p.total-done)
+	}
+	cost := usageCost(p.model, p.usage)
+	if p.json {
+		event.Completed, event.Failed, event.InFlight, event.Total = p.completed, p.failed, p.inFlight, p.total
+		event.InputTokens, event.OutputTokens, event.Cost = p.usage.InputTokens, p.usage.OutputTokens, cost
+		event.ElapsedMs, event.EtaMs = elapsed.Milliseconds(), eta.Milliseconds()
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(p.w, "%s\n", data)
+		return
+	}
+
+	interval := progressLog
+	if p.redraw {
+		interval = progressRedraw
+	}
+	if !final && time.Since(p.lastDraw) < interval {
+		return
+	}
+	p.lastDraw = time.Now()
+	status := fmt.Sprintf("Batch: %d", p.completed)
+	if p.total > 0 {
+		status += fmt.Sprintf(" of %d", p.total)
+	}
+	status += fmt.Sprintf(" done, %d failed, %d running", p.failed, p.inFlight)
+	spend := "cost unknown"
+	if cost != nil {
+		spend = fmt.Sprintf("$%.4f", *cost)
+	}
+	tokens := fmt.Sprintf("Tokens: %d in, %d out, %s", p.usage.InputTokens, p.usage.OutputTokens, spend)
+	timing := fmt.Sprintf("Elapsed: %v", elapsed.Round(time.Second))
+	if eta > 0 {
+		timing += fmt.Sprintf(", about %v left", eta.Round(time.Second))
+	}
+	lines := []string{status, tokens, timing}
+	if !p.redraw {
+		fmt.Fprintln(p.w, strings.Join(lines, "; "))
+		return
+	}
+	var b strings.Builder
+	if p.drawn > 0 {
+		fmt.Fprintf(&b, "\033[%dA", p.drawn)
+	}
+	for _, line := range lines {
+		fmt.Fprintf(&b, "\033[2K%s\n", line)
+	}
+	p.drawn = len(lines)
+	io.WriteString(p.w, b.String())
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchProgressJSON(t *testing.T) {
+	var out bytes.Buffer
+	p := &batchProgress{w: &out, json: true, model: "gpt-4o", total: 2, started: time.Now()}
+	p.start(1)
+	p.start(3)
+	p.finish(1, Usage{InputTokens: 100000}, "")
+	p.finish(3, Usage{}, "boom")
+	p.end()
+
+	var events []progressEvent
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e progressEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Expected a JSON event, got %q", line)
+		}
+		events = append(events, e)
+	}
+	if len(events) != 5 {
+		t.Fatalf("Expected 5 events, got %d", len(events))
+	}
+	if e := events[1]; e.Event != "started" || e.Line != 3 || e.InFlight != 2 {
+		t.Errorf("Expected line 3 started with 2 in flight, got %+v", e)
+	}
+	if e := events[2]; e.Event != "completed" || e.Completed != 1 || e.Cost == nil || *e.Cost != 0.25 || e.EtaMs < 0 {
+		t.Errorf("Expected line 1 completed at $0.25, got %+v", e)
+	}
+	if e := events[3]; e.Event != "failed" || e.Error != "boom" || e.Failed != 1 {
+		t.Errorf("Expected line 3 failed, got %+v", e)
+	}
+	if e := events[4]; e.Event != "finished" || e.Completed != 1 || e.Failed != 1 || e.InFlight != 0 || e.Total != 2 {
+		t.Errorf("Expected the final counts, got %+v", e)
+	}
+}
+
+func TestBatchProgressText(t *testing.T) {
+	var out bytes.Buffer
+	p := &batchProgress{w: &out, redraw: true, model: "unpriced-model", total: 4, started: time.Now()}
+	p.start(1)
+	// Too soon after the last redraw to draw again
+	p.finish(1, Usage{InputTokens: 10, OutputTokens: 2}, "")
+	p.end()
+
+	draws := strings.Split(out.String(), "\033[3A")
+	if len(draws) != 2 {
+		t.Fatalf("Expected the summary drawn twice, got %q", out.String())
+	}
+	if !strings.Contains(draws[0], "Batch: 0 of 4 done, 0 failed, 1 running\n") {
+		t.Errorf("Expected the first summary, got %q", draws[0])
+	}
+	for _, s := range []string{"Batch: 1 of 4 done, 0 failed, 0 running\n", "Tokens: 10 in, 2 out, cost unknown\n", "about "} {
+		if !strings.Contains(draws[1], s) {
+			t.Errorf("Expected %q in the final summary, got %q", s, draws[1])
+		}
+	}
+}
+
+func TestNewBatchProgress(t *testing.T) {
+	if p, err := newBatchProgress("none", "x", 0); p != nil || err != nil {
+		t.Errorf("Expected no progress, got %v (%v)", p, err)
+	}
+	if p, err := newBatchProgress("json", "x", 3); err != nil || !p.json || p.total != 3 {
+		t.Errorf("Expected JSON progress of 3 lines, got %+v (%v)", p, err)
+	}
+	if _, err := newBatchProgress("bar", "x", 0); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
+
+func TestCountBatchLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "in.jsonl")
+	if err := os.WriteFile(path, []byte("{\"a\": 1}\n\n{\"a\": 2}\n{\"a\": 3}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if n := countBatchLines(f); n != 3 {
+		t.Errorf("Expected 3 lines, got %d", n)
+	}
+	// Counting leaves the file where it was
+	f.Seek(9, 0)
+	if n := countBatchLines(f); n != 2 {
+		t.Errorf("Expected 2 lines after the first, got %d", n)
+	}
+	if offset, _ := f.Seek(0, 1); offset != 9 {
+		t.Errorf("Expected the offset kept at 9, got %d", offset)
+	}
+}
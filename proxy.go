@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// httpClient makes runprompt's requests to providers and registries. Like
+// http.DefaultClient, it honors HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+// unless serve's --proxy flag replaces it; a prompt's proxy setting
+// applies to its own run through runClient.
+var httpClient = http.DefaultClient
+
+// runClient returns the client for a run's requests: one going through the
+// proxy setting if the prompt has one, or httpClient
+func runClient(meta map[string]interface{}) (*http.Client, error) {
+	if v, ok := meta["proxy"]; ok {
+		return proxyClient(v)
+	}
+	return httpClient, nil
+}
+
+// proxyClient returns a client for the proxy setting: the URL of a proxy
+// every request goes through, such as http://proxy.corp:3128 or
+// socks5://localhost:1080, or none (or false) to connect directly even if
+// the proxy environment variables are set
+func proxyClient(v interface{}) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	s, _ := v.(string)
+	switch {
+	case v == false || s == "none":
+		transport.Proxy = nil
+	case s != "":
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+			return nil, fmt.Errorf("proxy must be an http, https or socks5 URL, or none, got %v", v)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	default:
+		return nil, fmt.Errorf("proxy must be an http, https or socks5 URL, or none, got %v", v)
+	}
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyClient(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A proxy is sent the absolute URL of the request
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte(`{"choices":[{"message":{"content":"ok"}}]}`))
+	}))
+	defer proxy.Close()
+
+	client, err := runClient(map[string]interface{}{"proxy": proxy.URL})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := makeRequest(context.Background(), client, "http://provider.invalid/v1/chat/completions", "", "model", nil, nil, nil, GenerationConfig{}, nil, nil, "custom", nil, Limits{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(proxied) != 1 || proxied[0] != "http://provider.invalid/v1/chat/completions" {
+		t.Errorf("Expected the request sent through the proxy, got %v", proxied)
+	}
+
+	for _, v := range []interface{}{"none", false} {
+		client, err := proxyClient(v)
+		if err != nil || client.Transport.(*http.Transport).Proxy != nil {
+			t.Errorf("%v: expected a direct client, got %v", v, err)
+		}
+	}
+	for _, v := range []interface{}{"", "proxy.corp:3128", "ftp://proxy.corp", 8080, true} {
+		if _, err := proxyClient(v); err == nil || !strings.Contains(err.Error(), "proxy must be") {
+			t.Errorf("%v: expected an error, got %v", v, err)
+		}
+	}
+}
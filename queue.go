@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Job states. A running job whose lease has expired belonged to a worker
+// that stopped without finishing it, and is run again.
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// defaultJobAttempts is how many times a job is tried unless --attempts
+// is given
+const defaultJobAttempts = 5
+
+var (
+	// queueLease is how long a worker holds a job without renewing it
+	queueLease = time.Minute
+	// queuePoll is how often an idle worker looks for new jobs
+	queuePoll = 2 * time.Second
+	// queueBackoff is the wait before a failed job's first retry; it
+	// doubles with each attempt, up to maxQueueBackoff
+	queueBackoff = 10 * time.Second
+)
+
+const maxQueueBackoff = 10 * time.Minute
+
+// queueJob is one prompt run waiting in the queue, stored as
+// <data dir>/queue/<id>.json
+type queueJob struct {
+	ID     string `json:"id"`
+	Prompt string `json:"prompt"`
+	// Dir is the directory the job was added from, where project config
+	// and relative paths are resolved
+	Dir         string    `json:"dir"`
+	Args        []string  `json:"args,omitempty"`
+	Input       string    `json:"input"`
+	Added       time.Time `json:"added"`
+	State       string    `json:"state"`
+	Attempts    int       `json:"attempts"`
+	MaxAttempts int       `json:"maxAttempts"`
+	// NotBefore delays a retry; Lease is when a running job is given up on
+	NotBefore time.Time `json:"notBefore"`
+	Lease     time.Time `json:"lease"`
+	Error     string    `json:"error,omitempty"`
+	Result    string    `json:"result,omitempty"`
+	Finished  time.Time `json:"finished"`
+}
+
+// queueDir returns the directory holding queued jobs
+func queueDir() string {
+	return filepath.Join(dataDir(), "queue")
+}
+
+// jobPath returns the file of the job with the given ID
+func jobPath(id string) (string, error) {
+	if !sessionNameRe.MatchString(id) {
+		return "", fmt.Errorf("invalid job ID %q", id)
+	}
+	return filepath.Join(queueDir(), id+".json"), nil
+}
+
+// lockQueue locks the whole queue, so that claiming a job and updating one
+// are never interleaved between workers
+func lockQueue() (func(), error) {
+	return lockFile(filepath.Join(queueDir(), "queue"))
+}
+
+// newJobID returns an ID that sorts by the time the job was added
+func newJobID(now time.Time) string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return now.UTC().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+func readJob(path string) (*queueJob, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var job queueJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &job, nil
+}
+
+func writeJob(job *queueJob) error {
+	path, err := jobPath(job.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0600)
+}
+
+// loadJob reads the job with the given ID
+func loadJob(id string) (*queueJob, error) {
+	path, err := jobPath(id)
+	if err != nil {
+		return nil, err
+	}
+	job, err := readJob(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no job %s", id)
+	}
+	return job, err
+}
+
+// listJobs returns every job in the queue, oldest first
+func listJobs() ([]*queueJob, error) {
+	paths, err := filepath.Glob(filepath.Join(queueDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*queueJob
+	for _, path := range paths {
+		job, err := readJob(path)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].Added.Equal(jobs[j].Added) {
+			return jobs[i].Added.Before(jobs[j].Added)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs, nil
+}
+
+// addJob persists a new pending job and returns it
+func addJob(prompt string, args []string, input string, maxAttempts int, now time.Time) (*queueJob, error) {
+	file, _ := splitPromptName(prompt)
+	if _, err := os.Stat(file); err != nil {
+		return nil, fmt.Errorf("reading prompt file: %v", err)
+	}
+	abs, err := filepath.Abs(prompt)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(queueDir(), 0700); err != nil {
+		return nil, err
+	}
+	job := &queueJob{
+		ID:          newJobID(now),
+		Prompt:      abs,
+		Dir:         dir,
+		Args:        args,
+		Input:       input,
+		Added:       now.UTC(),
+		State:       jobPending,
+		MaxAttempts: maxAttempts,
+	}
+	return job, writeJob(job)
+}
+
+// claimJob marks the next job that is ready to run as running, leased to
+// the caller until now+queueLease, and returns it. When no job is ready it
+// returns nil and the time the next one will be, which is zero if there
+// are no jobs left to run.
+func claimJob(now time.Time) (*queueJob, time.Time, error) {
+	unlock, err := lockQueue()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer unlock()
+	jobs, err := listJobs()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var next time.Time
+	for _, job := range jobs {
+		ready := job.NotBefore
+		switch job.State {
+		case jobRunning:
+			ready = job.Lease
+		case jobPending:
+		default:
+			continue
+		}
+		if ready.After(now) {
+			if next.IsZero() || ready.Before(next) {
+				next = ready
+			}
+			continue
+		}
+		if job.State == jobRunning {
+			fmt.Fprintf(os.Stderr, "Job %s was left running by a worker that stopped, running it again\n", job.ID)
+		}
+		job.State = jobRunning
+		job.Attempts++
+		job.Lease = now.Add(queueLease)
+		return job, time.Time{}, writeJob(job)
+	}
+	return nil, next, nil
+}
+
+// updateJob applies change to the stored job under the queue lock
+func updateJob(id string, change func(*queueJob)) error {
+	unlock, err := lockQueue()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	job, err := loadJob(id)
+	if err != nil {
+		return err
+	}
+	change(job)
+	return writeJob(job)
+}
+
+// retryDelay is the wait before retrying a job that has failed attempts
+// times
+func retryDelay(attempts int) time.Duration {
+	delay := queueBackoff
+	for i := 1; i < attempts && delay < maxQueueBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxQueueBackoff)
+}
+
+// workQueue runs queued jobs one at a time until ctx is cancelled, or with
+// once until no job is left to run. Jobs are run at least once: a job
+// interrupted by a crash, a sleep that outlasts its lease or a cancelled
+// ctx is run again later. A budget in USD, unless zero, stops the worker
+// once its jobs have cost that much, and caps each job's maxCost at what
+// is left of it.
+func workQueue(ctx context.Context, once bool, budget float64) error {
+	spent := 0.0
+	for ctx.Err() == nil {
+		if budget > 0 && spent >= budget {
+			return budgetError(spent, budget)
+		}
+		job, next, err := claimJob(time.Now())
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			if once && next.IsZero() {
+				return nil
+			}
+			wait := queuePoll
+			if !next.IsZero() {
+				wait = min(wait, time.Until(next))
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(wait):
+			}
+			continue
+		}
+		remaining := 0.0
+		if budget > 0 {
+			remaining = budget - spent
+		}
+		cost, overBudget, err := processJob(ctx, job, remaining)
+		spent += cost
+		if err != nil {
+			return err
+		}
+		if overBudget {
+			return budgetError(spent, budget)
+		}
+	}
+	return nil
+}
+
+// budgetError reports that a worker has used up its budget
+func budgetError(spent, budget float64) error {
+	return &limitError{State: stopBudget, Detail: fmt.Sprintf("spent $%.4f of the $%g budget set by --budget", spent, budget)}
+}
+
+// processJob runs a claimed job, renewing its lease while it runs, and
+// records the outcome. It returns what the job cost, and whether it was
+// put back because it would have gone over the remaining budget.
+func processJob(ctx context.Context, job *queueJob, remaining float64) (float64, bool, error) {
+	fmt.Fprintf(os.Stderr, "Running job %s (attempt %d of %d): %s\n", job.ID, job.Attempts, job.MaxAttempts, job.Prompt)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(queueLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				updateJob(job.ID, func(j *queueJob) { j.Lease = time.Now().Add(queueLease) })
+			}
+		}
+	}()
+	result, cost, capped, runErr := runJob(ctx, job, remaining)
+	close(done)
+	<-stopped
+
+	var limit *limitError
+	overBudget := capped && errors.As(runErr, &limit) && limit.State == stopCostLimit
+	now := time.Now()
+	err := updateJob(job.ID, func(j *queueJob) {
+		j.Lease = time.Time{}
+		switch {
+		case runErr == nil:
+			j.State, j.Result, j.Error, j.Finished = jobDone, result, "", now.UTC()
+			fmt.Fprintf(os.Stderr, "Job %s done\n", j.ID)
+		case overBudget:
+			// Not the job's fault; it runs once there is budget for it
+			j.State = jobPending
+			j.Attempts--
+			fmt.Fprintf(os.Stderr, "Job %s would go over the budget, it will run again\n", j.ID)
+		case ctx.Err() != nil:
+			// The worker is stopping; the attempt doesn't count
+			j.State = jobPending
+			j.Attempts--
+			fmt.Fprintf(os.Stderr, "Job %s interrupted, it will run again\n", j.ID)
+		case j.Attempts >= j.MaxAttempts:
+			j.State, j.Error, j.Finished = jobFailed, runErr.Error(), now.UTC()
+			fmt.Fprintf(os.Stderr, "%sJob %s failed after %d attempts: %v%s\n", red, j.ID, j.Attempts, runErr, reset)
+		default:
+			delay := retryDelay(j.Attempts)
+			j.State, j.Error, j.NotBefore = jobPending, runErr.Error(), now.Add(delay)
+			fmt.Fprintf(os.Stderr, "Job %s failed: %v\nRetrying in %s\n", j.ID, runErr, delay.Round(time.Second))
+		}
+	})
+	return cost, overBudget, err
+}
+
+// runJob renders and sends a job's prompt from the directory it was added
+// in, returning the result and its cost in USD. Like serve, it leaves
+// runtime settings such as the proxy alone, since they would carry over to
+// the jobs that follow. Unless remaining is zero, the job's maxCost is
+// lowered to it, and capped reports whether it was.
+func runJob(ctx context.Context, job *queueJob, remaining float64) (string, float64, bool, error) {
+	_, _, overrides, _, err := parseArgs(job.Args)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if cwd, err := os.Getwd(); err == nil {
+		if err := os.Chdir(job.Dir); err != nil {
+			return "", 0, false, err
+		}
+		defer os.Chdir(cwd)
+	}
+
+	path := localizedPath(job.Prompt, requestedLocale(overrides))
+	meta, template, err := parsePromptFile(path)
+	if err != nil {
+		return "", 0, false, fmt.Errorf("reading prompt file: %v", err)
+	}
+	meta, template, variant, err := resolvePrompt(meta, template, overrides, nil)
+	if err != nil {
+		return "", 0, false, err
+	}
+	// Jobs share the worker's connection pool
+	delete(meta, "proxy")
+	limits, err := runLimits(meta)
+	if err != nil {
+		return "", 0, false, err
+	}
+	capped := remaining > 0 && (limits.MaxCost == 0 || remaining < limits.MaxCost)
+	if capped {
+		setLimit(meta, "maxCost", remaining)
+	}
+	if err := checkRequiredEnv(meta); err != nil {
+		return "", 0, false, err
+	}
+	provider, model, err := resolveModel(meta)
+	if err != nil {
+		return "", 0, false, err
+	}
+	variables, err := inputVariables(job.Input, meta)
+	if err != nil {
+		return "", 0, false, err
+	}
+	messages, err := renderPromptMessages(compileMessages(template), variables, meta)
+	if err != nil {
+		return "", 0, false, err
+	}
+	outputConfig, _ := meta["output"].(map[string]interface{})
+	sinks, err := parseSinks(outputConfig)
+	if err != nil {
+		return "", 0, false, err
+	}
+	pr := promptRun{
+		path:     path,
+		meta:     meta,
+		variant:  variant,
+		provider: provider,
+		model:    model,
+		messages: messages,
+		out:      io.Discard,
+		job:      job.ID,
+	}
+	c, err := complete(ctx, pr)
+	if c.Fallback != "" {
+		_, model = parseModelString(c.Fallback)
+	}
+	cost := 0.0
+	if spent := usageCost(model, c.Usage); spent != nil {
+		cost = *spent
+	}
+	if err == nil {
+		err = deliverSinks(ctx, sinks, pr, c, variables)
+	}
+	return c.Result, cost, capped, err
+}
+
+// writeJobList prints the jobs as a table
+func writeJobList(w io.Writer, jobs []*queueJob) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATE\tATTEMPTS\tADDED\tPROMPT")
+	for _, job := range jobs {
+		fmt.Fprintf(tw, "%s\t%s\t%d/%d\t%s\t%s\n", job.ID, job.State, job.Attempts, job.MaxAttempts,
+			job.Added.Local().Format("2006-01-02 15:04"), job.Prompt)
+	}
+	return tw.Flush()
+}
+
+// queueCommand implements runprompt queue
+func queueCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return commandUsage("queue")
+	}
+	switch sub, rest := args[0], args[1:]; sub {
+	case "add":
+		return queueAdd(rest)
+	case "work":
+		flags, positional, err := parseFlags("queue", rest, map[string]bool{"once": false, "budget": true})
+		if err != nil {
+			return err
+		}
+		if len(positional) > 0 {
+			return commandUsage("queue")
+		}
+		_, once := flags["once"]
+		budget := 0.0
+		if v, ok := flags["budget"]; ok {
+			if budget, err = strconv.ParseFloat(v, 64); err != nil || budget <= 0 {
+				return fmt.Errorf("--budget must be a positive amount in USD, got %s", v)
+			}
+		}
+		return workQueue(ctx, once, budget)
+	case "list":
+		if len(rest) > 0 {
+			return commandUsage("queue")
+		}
+		jobs, err := listJobs()
+		if err != nil {
+			return err
+		}
+		return writeJobList(os.Stdout, jobs)
+	case "result":
+		if len(rest) != 1 {
+			return commandUsage("queue")
+		}
+		job, err := loadJob(rest[0])
+		if err != nil {
+			return err
+		}
+		switch job.State {
+		case jobDone:
+			fmt.Println(job.Result)
+			return nil
+		case jobFailed:
+			return fmt.Errorf("job %s failed after %d attempts: %s", job.ID, job.Attempts, job.Error)
+		}
+		return fmt.Errorf("job %s is %s", job.ID, job.State)
+	}
+	return commandUsage("queue")
+}
+
+// queueAdd implements runprompt queue add. The job's input is --input, or
+// stdin; other options are metadata overrides, applied when the job runs.
+func queueAdd(args []string) error {
+	input, haveInput := "", false
+	attempts := defaultJobAttempts
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		key, value, hasValue := strings.Cut(args[i], "=")
+		if key != "--input" && key != "--attempts" {
+			rest = append(rest, args[i])
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s requires a value", key)
+			}
+			i++
+			value = args[i]
+		}
+		if key == "--input" {
+			input, haveInput = value, true
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("--attempts must be a positive integer, got %s", value)
+		}
+		attempts = n
+	}
+	verboseFlag, savePath, _, remaining, err := parseArgs(rest)
+	if err != nil {
+		return err
+	}
+	verbose = verbose || verboseFlag
+	if len(remaining) != 1 {
+		return commandUsage("queue")
+	}
+	if savePath != "" {
+		return errors.New("--save-response is not supported for queued jobs")
+	}
+	if !haveInput {
+		input = readStdin()
+	}
+	// Keep the overrides as given, to be parsed again when the job runs
+	var overrides []string
+	prompt := -1
+	for i, arg := range rest {
+		if arg == remaining[0] {
+			prompt = i
+		}
+	}
+	for i, arg := range rest {
+		if i != prompt && arg != "-v" {
+			overrides = append(overrides, arg)
+		}
+	}
+	job, err := addJob(remaining[0], overrides, strings.TrimSpace(input), attempts, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Println(job.ID)
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyServer is a provider that fails the first failures requests and
+// then replies "Hello"
+func flakyServer(t *testing.T, failures int32) *httptest.Server {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			http.Error(w, `{"error":{"message":"upstream unavailable"}}`, http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"Hello"}}]}`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func setQueueBackoff(t *testing.T, d time.Duration) {
+	saved := queueBackoff
+	queueBackoff = d
+	t.Cleanup(func() { queueBackoff = saved })
+}
+
+func TestWorkQueueRetries(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("RUNPROMPT_BASE_URL", flakyServer(t, 1).URL)
+	setQueueBackoff(t, time.Millisecond)
+	dir := t.TempDir()
+	writeFiles(t, dir, "hello.prompt", "---\nmodel: custom/x\n---\nSay hello to {{input}}")
+
+	job, err := addJob(filepath.Join(dir, "hello.prompt"), nil, "Ada", 3, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := workQueue(context.Background(), true, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	job, err = loadJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != jobDone || job.Result != "Hello" || job.Attempts != 2 {
+		t.Errorf("Expected done with Hello after 2 attempts, got %s with %q after %d", job.State, job.Result, job.Attempts)
+	}
+
+	records, err := readHistory(historyPath(), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Job != job.ID {
+		t.Errorf("Expected one history record for job %s, got %+v", job.ID, records)
+	}
+}
+
+func TestWorkQueueGivesUp(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("RUNPROMPT_BASE_URL", flakyServer(t, 5).URL)
+	setQueueBackoff(t, time.Millisecond)
+	dir := t.TempDir()
+	writeFiles(t, dir, "hello.prompt", "---\nmodel: custom/x\n---\nHi")
+
+	job, err := addJob(filepath.Join(dir, "hello.prompt"), nil, "", 2, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := workQueue(context.Background(), true, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	job, err = loadJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != jobFailed || job.Attempts != 2 || job.Error == "" {
+		t.Errorf("Expected failed after 2 attempts with an error, got %s after %d: %q", job.State, job.Attempts, job.Error)
+	}
+}
+
+func TestWorkQueueBudget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// $0.25 a call at gpt-4o prices
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"Hello"}}],"usage":{"prompt_tokens":100000,"completion_tokens":0}}`)
+	}))
+	defer server.Close()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("RUNPROMPT_BASE_URL", server.URL)
+	dir := t.TempDir()
+	writeFiles(t, dir, "hello.prompt", "---\nmodel: custom/gpt-4o\n---\nHi")
+
+	now := time.Now()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		job, err := addJob(filepath.Join(dir, "hello.prompt"), nil, "", 3, now.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.ID)
+	}
+	err := workQueue(context.Background(), true, 0.4)
+	var limit *limitError
+	if !errors.As(err, &limit) || limit.State != stopBudget {
+		t.Fatalf("Expected the budget to stop the worker, got %v", err)
+	}
+	for i, expected := range []string{jobDone, jobDone, jobPending} {
+		job, err := loadJob(ids[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State != expected {
+			t.Errorf("Job %d: expected %s, got %s", i, expected, job.State)
+		}
+	}
+}
+
+func TestClaimJobLease(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeFiles(t, dir, "hello.prompt", "---\nmodel: custom/x\n---\nHi")
+	now := time.Now()
+	added, err := addJob(filepath.Join(dir, "hello.prompt"), []string{"--temperature=0"}, "", 3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, _, err := claimJob(now)
+	if err != nil || job == nil || job.ID != added.ID {
+		t.Fatalf("Expected to claim job %s, got %v (%v)", added.ID, job, err)
+	}
+	// The worker holding it stops without finishing
+	job, next, err := claimJob(now.Add(time.Second))
+	if err != nil || job != nil {
+		t.Fatalf("Expected no job while the lease holds, got %v (%v)", job, err)
+	}
+	if !next.Equal(now.Add(queueLease)) {
+		t.Errorf("Expected the next job at %v, got %v", now.Add(queueLease), next)
+	}
+	job, _, err = claimJob(now.Add(queueLease + time.Second))
+	if err != nil || job == nil {
+		t.Fatalf("Expected to reclaim the job once its lease expired, got %v (%v)", job, err)
+	}
+	if job.Attempts != 2 || len(job.Args) != 1 {
+		t.Errorf("Expected attempt 2 with the job's args, got %d with %v", job.Attempts, job.Args)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{4, 80 * time.Second},
+		{20, maxQueueBackoff},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempts); got != tt.expected {
+			t.Errorf("retryDelay(%d): expected %v, got %v", tt.attempts, tt.expected, got)
+		}
+	}
+}
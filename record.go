@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// saveFormat is the current version of the --save-response file format.
+// Version 1 files were the bare response with _provider and _variant keys
+// added; version 2 wraps the response with the request that produced it.
+const saveFormat = 2
+
+// Exchange records one request to a provider and its decoded response
+type Exchange struct {
+	URL      string
+	Header   http.Header
+	Body     map[string]interface{}
+	Started  time.Time
+	Duration time.Duration
+	Status   int
+	Response map[string]interface{}
+}
+
+// secretHeaderWords mark headers whose values are credentials
+var secretHeaderWords = []string{"auth", "key", "token", "secret", "cookie"}
+
+// secretSetting reports whether a setting or environment variable, such as
+// api_key, accessToken or RUNPROMPT_API_KEY, holds a credential. Token
+// counts such as maxOutputTokens don't.
+func secretSetting(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasSuffix(lower, "_key") || strings.HasSuffix(lower, "apikey") ||
+		strings.Contains(lower, "token") && !strings.Contains(lower, "tokens") ||
+		strings.Contains(lower, "secret") || strings.Contains(lower, "password")
+}
+
+// redactHeaders returns headers with credential values replaced
+func redactHeaders(header http.Header) map[string]string {
+	redacted := make(map[string]string, len(header))
+	for name, values := range header {
+		value := strings.Join(values, ", ")
+		lower := strings.ToLower(name)
+		for _, word := range secretHeaderWords {
+			if strings.Contains(lower, word) {
+				value = "[REDACTED]"
+				break
+			}
+		}
+		redacted[name] = value
+	}
+	return redacted
+}
+
+// redactURL replaces credential query parameters, such as ?key=, in a URL
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.RawQuery == "" {
+		return rawURL
+	}
+	query := u.Query()
+	for name := range query {
+		lower := strings.ToLower(name)
+		for _, word := range secretHeaderWords {
+			if strings.Contains(lower, word) {
+				query.Set(name, "REDACTED")
+				break
+			}
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// saveResponse writes an exchange to savePath in the versioned save format:
+// the response together with the request body, redacted headers, timing,
+// the variant that ran and the runprompt version
+func saveResponse(exchange *Exchange, provider, variant, savePath string) error {
+	saved := map[string]interface{}{
+		"_format":   saveFormat,
+		"_provider": provider,
+		"version":   version,
+		"request": map[string]interface{}{
+			"url":     redactURL(exchange.URL),
+			"headers": redactHeaders(exchange.Header),
+			"body":    exchange.Body,
+		},
+		"timing": map[string]interface{}{
+			"started":    exchange.Started.UTC().Format(time.RFC3339Nano),
+			"durationMs": exchange.Duration.Milliseconds(),
+		},
+		"status":   exchange.Status,
+		"response": exchange.Response,
+	}
+	if variant != "" {
+		saved["_variant"] = variant
+	}
+
+	data, _ := json.MarshalIndent(saved, "", "  ")
+	if err := os.WriteFile(savePath, data, 0644); err != nil {
+		return fmt.Errorf("saving response: %v", err)
+	}
+	log(fmt.Sprintf("Saved response to: %s", savePath))
+	return nil
+}
+
+// loadTestResponse loads a .test-response file. Both save formats are
+// accepted; the response is returned with _provider set as in version 1.
+func loadTestResponse(path string) (map[string]interface{}, error) {
+	testFile := path + ".test-response"
+	content, err := os.ReadFile(testFile)
+	if err != nil {
+		return nil, fmt.Errorf("test response file not found: %s", testFile)
+	}
+	log(fmt.Sprintf("Loaded test response from: %s", testFile))
+
+	var saved map[string]interface{}
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return nil, fmt.Errorf("parsing test response: %v", err)
+	}
+	return unwrapSaved(saved)
+}
+
+// unwrapSaved returns the response held by a saved file of any format
+func unwrapSaved(saved map[string]interface{}) (map[string]interface{}, error) {
+	format, ok := saved["_format"]
+	if !ok {
+		return saved, nil
+	}
+	if intValue(format) != saveFormat {
+		return nil, fmt.Errorf("unsupported saved response format %v", format)
+	}
+	response, ok := saved["response"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("saved response has no response object")
+	}
+	unwrapped := map[string]interface{}{"_provider": saved["_provider"]}
+	for k, v := range response {
+		unwrapped[k] = v
+	}
+	return unwrapped, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveResponseRoundTrip(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer sk-secret")
+	header.Set("X-Api-Key", "sk-secret")
+	header.Set("Content-Type", "application/json")
+	exchange := &Exchange{
+		URL:      "https://example.com/v1/chat?key=sk-secret&alt=json",
+		Header:   header,
+		Body:     map[string]interface{}{"model": "gpt-4o"},
+		Started:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Duration: 1500 * time.Millisecond,
+		Status:   200,
+		Response: map[string]interface{}{"id": "c1", "model": "gpt-4o"},
+	}
+
+	base := filepath.Join(t.TempDir(), "run.prompt")
+	if err := saveResponse(exchange, "openai", "B", base+".test-response"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(base + ".test-response")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]interface{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved["_format"] != float64(saveFormat) || saved["_variant"] != "B" || saved["version"] != version {
+		t.Errorf("Unexpected envelope: %v", saved)
+	}
+	request := saved["request"].(map[string]interface{})
+	headers := request["headers"].(map[string]interface{})
+	if headers["Authorization"] != "[REDACTED]" || headers["X-Api-Key"] != "[REDACTED]" {
+		t.Errorf("Expected credentials redacted, got %v", headers)
+	}
+	if headers["Content-Type"] != "application/json" {
+		t.Errorf("Expected Content-Type kept, got %v", headers["Content-Type"])
+	}
+	if url := request["url"]; url != "https://example.com/v1/chat?alt=json&key=REDACTED" {
+		t.Errorf("Expected key redacted from URL, got %v", url)
+	}
+	if timing := saved["timing"].(map[string]interface{}); timing["durationMs"] != float64(1500) {
+		t.Errorf("Expected durationMs 1500, got %v", timing["durationMs"])
+	}
+
+	response, err := loadTestResponse(base)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response["_provider"] != "openai" || response["id"] != "c1" {
+		t.Errorf("Unexpected unwrapped response: %v", response)
+	}
+}
+
+func TestUnwrapSavedFormats(t *testing.T) {
+	legacy := map[string]interface{}{"_provider": "anthropic", "content": []interface{}{}}
+	if got, err := unwrapSaved(legacy); err != nil || got["_provider"] != "anthropic" {
+		t.Errorf("Expected legacy file returned as is, got %v, %v", got, err)
+	}
+	if _, err := unwrapSaved(map[string]interface{}{"_format": float64(99)}); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A registry is a directory of published prompt versions, so production
+// systems can pin a prompt version and roll back without a code deploy:
+//
+//	index.json
+//	summarize/1.2.0.prompt
+//	summarize/1.3.0.prompt
+//
+// index.json lists every version with its SHA-256, checked when a version
+// is fetched. Published versions never change. A registry directory can be
+// served by any static file server and read over HTTP; publishing needs
+// the directory itself.
+const registryIndex = "index.json"
+
+// registryEntry is one published version in a registry index
+type registryEntry struct {
+	SHA256    string    `json:"sha256"`
+	Published time.Time `json:"published"`
+}
+
+// registryIndexData maps prompt names to their versions
+type registryIndexData struct {
+	Prompts map[string]map[string]registryEntry `json:"prompts"`
+}
+
+// registryNameRe matches a valid registry prompt name
+var registryNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// registryCommand implements runprompt registry
+func registryCommand(ctx context.Context, args []string) error {
+	for i, arg := range args {
+		if arg == "-o" {
+			args[i] = "--output"
+		}
+	}
+	flags, positional, err := parseFlags("registry", args, map[string]bool{"registry": true, "output": true})
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return commandUsage("registry")
+	}
+	registry := flags["registry"]
+	if registry == "" {
+		registry = os.Getenv("RUNPROMPT_REGISTRY")
+	}
+	if registry == "" {
+		return fmt.Errorf("no registry: pass --registry <dir or URL> or set RUNPROMPT_REGISTRY")
+	}
+
+	switch sub, rest := positional[0], positional[1:]; {
+	case sub == "publish" && (len(rest) == 1 || len(rest) == 2):
+		ref := ""
+		if len(rest) == 2 {
+			ref = rest[1]
+		}
+		name, version, err := publishPrompt(registry, rest[0], ref, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Published %s@%s to %s\n", name, version, registry)
+		return nil
+	case sub == "get" && len(rest) == 1:
+		name, version, content, err := fetchPrompt(ctx, registry, rest[0])
+		if err != nil {
+			return err
+		}
+		if flags["output"] == "" {
+			_, err = os.Stdout.Write(content)
+			return err
+		}
+		if err := writeFileAtomic(flags["output"], content, 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s@%s to %s\n", name, version, flags["output"])
+		return nil
+	case sub == "list" && len(rest) <= 1:
+		index, err := readRegistryIndex(ctx, registry)
+		if err != nil {
+			return err
+		}
+		return writeRegistryList(os.Stdout, index, rest)
+	}
+	return commandUsage("registry")
+}
+
+// publishPrompt adds a prompt file to a registry directory. ref is
+// name@version, name or ""; missing parts come from the prompt's name: and
+// version: frontmatter, and the name defaults to the file name.
+func publishPrompt(registry, path, ref string, now time.Time) (string, string, error) {
+	if isURL(registry) {
+		return "", "", fmt.Errorf("can't publish to %s: publish to the registry directory", registry)
+	}
+	if errs := lintPrompt(path); len(errs) > 0 {
+		return "", "", fmt.Errorf("fix these problems before publishing:\n%v", errors.Join(errs...))
+	}
+	meta, _, err := parsePromptFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	if partialTagRe.Match(content) || includeTagRe.Match(content) || meta["imports"] != nil || meta["extends"] != nil {
+		return "", "", fmt.Errorf("%s uses partials or other prompts, which the registry doesn't store; publish a prompt without them", path)
+	}
+
+	name, version, _ := strings.Cut(ref, "@")
+	if name == "" {
+		name, _ = meta["name"].(string)
+	}
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(path), ".prompt")
+	}
+	if v, ok := meta["version"]; ok && version == "" {
+		version = fmt.Sprintf("%v", v)
+	}
+	if !registryNameRe.MatchString(name) {
+		return "", "", fmt.Errorf("invalid prompt name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	if version == "" {
+		return "", "", fmt.Errorf("no version for %s: pass %s@1.0.0 or set version: in its frontmatter", path, name)
+	}
+	if _, err := parseSemver(version); err != nil {
+		return "", "", err
+	}
+
+	sum := sha256.Sum256(content)
+	entry := registryEntry{SHA256: hex.EncodeToString(sum[:]), Published: now}
+
+	indexPath := filepath.Join(registry, registryIndex)
+	unlock, err := lockFile(indexPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer unlock()
+	index, err := readRegistryIndex(context.Background(), registry)
+	if err != nil {
+		return "", "", err
+	}
+	if existing, ok := index.Prompts[name][version]; ok {
+		if existing.SHA256 == entry.SHA256 {
+			return name, version, nil
+		}
+		return "", "", fmt.Errorf("%s@%s is already published with different content; publish a new version", name, version)
+	}
+
+	target := filepath.Join(registry, name, version+".prompt")
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", "", err
+	}
+	if err := writeFileAtomic(target, content, 0644); err != nil {
+		return "", "", err
+	}
+	if index.Prompts[name] == nil {
+		index.Prompts[name] = map[string]registryEntry{}
+	}
+	index.Prompts[name][version] = entry
+	data, _ := json.MarshalIndent(index, "", "  ")
+	if err := writeFileAtomic(indexPath, append(data, '\n'), 0644); err != nil {
+		return "", "", err
+	}
+	return name, version, nil
+}
+
+// fetchPrompt reads a published prompt from a registry, checking it against
+// the index. ref is name@version, where version may be exact, a prefix such
+// as 1 or 1.2 matching the newest version under it, or latest; a bare name
+// means latest.
+func fetchPrompt(ctx context.Context, registry, ref string) (string, string, []byte, error) {
+	name, want, _ := strings.Cut(ref, "@")
+	index, err := readRegistryIndex(ctx, registry)
+	if err != nil {
+		return "", "", nil, err
+	}
+	versions, ok := index.Prompts[name]
+	if !ok {
+		return "", "", nil, fmt.Errorf("no prompt %q in %s", name, registry)
+	}
+	version, ok := matchVersion(versions, want)
+	if !ok {
+		return "", "", nil, fmt.Errorf("no version of %s matches %q (have %s)", name, want, strings.Join(sortedVersions(versions), ", "))
+	}
+	content, err := readRegistryFile(ctx, registry, name+"/"+version+".prompt")
+	if err != nil {
+		return "", "", nil, err
+	}
+	sum := sha256.Sum256(content)
+	if hex.EncodeToString(sum[:]) != versions[version].SHA256 {
+		return "", "", nil, fmt.Errorf("integrity check failed for %s@%s", name, version)
+	}
+	return name, version, content, nil
+}
+
+// readRegistryIndex reads a registry's index; a registry directory without
+// one is empty
+func readRegistryIndex(ctx context.Context, registry string) (registryIndexData, error) {
+	index := registryIndexData{Prompts: map[string]map[string]registryEntry{}}
+	data, err := readRegistryFile(ctx, registry, registryIndex)
+	if os.IsNotExist(err) && !isURL(registry) {
+		return index, nil
+	}
+	if err != nil {
+		return index, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("reading %s index: %v", registry, err)
+	}
+	if index.Prompts == nil {
+		index.Prompts = map[string]map[string]registryEntry{}
+	}
+	return index, nil
+}
+
+// readRegistryFile reads a slash-separated path from a registry directory
+// or URL
+func readRegistryFile(ctx context.Context, registry, rel string) ([]byte, error) {
+	if !isURL(registry) {
+		return os.ReadFile(filepath.Join(registry, filepath.FromSlash(rel)))
+	}
+	url := strings.TrimSuffix(registry, "/") + "/" + rel
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: HTTP %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// isURL reports whether a registry location is an HTTP URL rather than a
+// directory
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// writeRegistryList prints the prompts in an index with their versions,
+// newest first, or only those of the named prompt
+func writeRegistryList(w io.Writer, index registryIndexData, names []string) error {
+	if len(names) == 0 {
+		for name := range index.Prompts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		versions, ok := index.Prompts[name]
+		if !ok {
+			return fmt.Errorf("no prompt %q in the registry", name)
+		}
+		sorted := sortedVersions(versions)
+		for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+			sorted[i], sorted[j] = sorted[j], sorted[i]
+		}
+		fmt.Fprintf(w, "%s %s\n", name, strings.Join(sorted, " "))
+	}
+	return nil
+}
+
+// semver is a MAJOR.MINOR.PATCH version with an optional pre-release
+type semver struct {
+	parts [3]int
+	pre   string
+}
+
+func parseSemver(s string) (semver, error) {
+	var v semver
+	core, pre, _ := strings.Cut(s, "-")
+	fields := strings.Split(core, ".")
+	if len(fields) != 3 {
+		return v, fmt.Errorf("invalid version %q: use MAJOR.MINOR.PATCH, like 1.2.0", s)
+	}
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 || f != strconv.Itoa(n) {
+			return v, fmt.Errorf("invalid version %q: use MAJOR.MINOR.PATCH, like 1.2.0", s)
+		}
+		v.parts[i] = n
+	}
+	v.pre = pre
+	return v, nil
+}
+
+// less orders versions; a pre-release comes before its release
+func (v semver) less(o semver) bool {
+	for i := range v.parts {
+		if v.parts[i] != o.parts[i] {
+			return v.parts[i] < o.parts[i]
+		}
+	}
+	if (v.pre == "") != (o.pre == "") {
+		return v.pre != ""
+	}
+	return v.pre < o.pre
+}
+
+// sortedVersions lists versions oldest first
+func sortedVersions(versions map[string]registryEntry) []string {
+	list := make([]string, 0, len(versions))
+	for version := range versions {
+		list = append(list, version)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, _ := parseSemver(list[i])
+		b, _ := parseSemver(list[j])
+		return a.less(b)
+	})
+	return list
+}
+
+// matchVersion picks the version want names: an exact version, the newest
+// release under a prefix such as 1 or 1.2, or the newest release for
+// latest or ""
+func matchVersion(versions map[string]registryEntry, want string) (string, bool) {
+	if _, ok := versions[want]; ok {
+		return want, true
+	}
+	if want == "latest" {
+		want = ""
+	}
+	sorted := sortedVersions(versions)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		v := sorted[i]
+		if strings.Contains(v, "-") {
+			// Pre-releases are only fetched by exact version
+			continue
+		}
+		if want == "" || strings.HasPrefix(v, want+".") {
+			return v, true
+		}
+	}
+	return "", false
+}
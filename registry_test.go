@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistryPublishAndGet(t *testing.T) {
+	src := t.TempDir()
+	registry := t.TempDir()
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	writeFiles(t, src,
+		"summarize.prompt", "---\nmodel: openai/gpt-4o\nversion: 1.2.0\n---\nSummarize: {{STDIN}}",
+		"v2.prompt", "---\nmodel: openai/gpt-4o\n---\nSummarize briefly: {{STDIN}}",
+	)
+
+	name, version, err := publishPrompt(registry, filepath.Join(src, "summarize.prompt"), "", now)
+	if err != nil || name != "summarize" || version != "1.2.0" {
+		t.Fatalf("Expected summarize@1.2.0, got %s@%s, %v", name, version, err)
+	}
+	for _, ref := range []string{"summarize@1.10.0", "summarize@2.0.0-rc.1"} {
+		if _, _, err := publishPrompt(registry, filepath.Join(src, "v2.prompt"), ref, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Published versions can't change, but republishing the same file is fine
+	if _, _, err := publishPrompt(registry, filepath.Join(src, "summarize.prompt"), "", now); err != nil {
+		t.Errorf("Expected republishing identical content to succeed, got %v", err)
+	}
+	_, _, err = publishPrompt(registry, filepath.Join(src, "v2.prompt"), "summarize@1.2.0", now)
+	if err == nil || !strings.Contains(err.Error(), "already published with different content") {
+		t.Errorf("Expected an immutability error, got %v", err)
+	}
+
+	tests := []struct {
+		ref      string
+		expected string
+	}{
+		{"summarize@1.2.0", "1.2.0"},
+		{"summarize@1", "1.10.0"},
+		{"summarize@1.2", "1.2.0"},
+		{"summarize", "1.10.0"},
+		{"summarize@latest", "1.10.0"},
+		{"summarize@2.0.0-rc.1", "2.0.0-rc.1"},
+	}
+	for _, tc := range tests {
+		_, version, content, err := fetchPrompt(context.Background(), registry, tc.ref)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.ref, err)
+			continue
+		}
+		if version != tc.expected {
+			t.Errorf("%s: expected version %s, got %s", tc.ref, tc.expected, version)
+		}
+		if len(content) == 0 {
+			t.Errorf("%s: expected the prompt's content", tc.ref)
+		}
+	}
+
+	var out bytes.Buffer
+	index, _ := readRegistryIndex(context.Background(), registry)
+	writeRegistryList(&out, index, nil)
+	if expected := "summarize 2.0.0-rc.1 1.10.0 1.2.0\n"; out.String() != expected {
+		t.Errorf("Expected list %q, got %q", expected, out.String())
+	}
+
+	if _, _, _, err := fetchPrompt(context.Background(), registry, "summarize@3"); err == nil ||
+		!strings.Contains(err.Error(), `no version of summarize matches "3"`) {
+		t.Errorf("Expected a no matching version error, got %v", err)
+	}
+	os.WriteFile(filepath.Join(registry, "summarize", "1.2.0.prompt"), []byte("tampered"), 0644)
+	if _, _, _, err := fetchPrompt(context.Background(), registry, "summarize@1.2.0"); err == nil ||
+		!strings.Contains(err.Error(), "integrity check failed") {
+		t.Errorf("Expected an integrity error, got %v", err)
+	}
+}
+
+func TestRegistryOverHTTP(t *testing.T) {
+	src := t.TempDir()
+	registry := t.TempDir()
+	writeFiles(t, src, "greet.prompt", "---\nmodel: openai/gpt-4o\n---\nHello {{name}}")
+	if _, _, err := publishPrompt(registry, filepath.Join(src, "greet.prompt"), "greet@0.1.0", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(registry)))
+	defer server.Close()
+
+	_, version, content, err := fetchPrompt(context.Background(), server.URL+"/", "greet@0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "0.1.0" || !strings.Contains(string(content), "Hello {{name}}") {
+		t.Errorf("Expected greet@0.1.0, got %s %q", version, content)
+	}
+	if _, _, err := publishPrompt(server.URL, filepath.Join(src, "greet.prompt"), "greet@0.2.0", time.Now()); err == nil {
+		t.Error("Expected publishing to a URL to fail")
+	}
+}
+
+func TestRegistryPublishErrors(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src,
+		"ok.prompt", "---\nmodel: openai/gpt-4o\n---\nHi",
+		"bad.prompt", "---\nmodel: openai/gpt-4o\ntemprature: 1\n---\nHi",
+		"partial.prompt", "---\nmodel: openai/gpt-4o\n---\n{{> persona}}",
+		"_partials/persona.prompt", "You are kind.",
+		"include.prompt", "---\nmodel: openai/gpt-4o\n---\n{{include \"ok.prompt\"}}",
+	)
+	tests := []struct {
+		file, ref string
+		expected  string
+	}{
+		{"ok.prompt", "", "no version for"},
+		{"ok.prompt", "ok@1.2", `invalid version "1.2"`},
+		{"ok.prompt", "../x@1.0.0", "invalid prompt name"},
+		{"bad.prompt", "bad@1.0.0", `unknown key "temprature"`},
+		{"partial.prompt", "p@1.0.0", "uses partials"},
+		{"include.prompt", "i@1.0.0", "uses partials or other prompts"},
+	}
+	for _, tc := range tests {
+		_, _, err := publishPrompt(t.TempDir(), filepath.Join(src, tc.file), tc.ref, time.Now())
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%s %s: expected error containing %q, got %v", tc.file, tc.ref, tc.expected, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// repairEnabled reports whether output.repair asks for almost-JSON output
+// to be repaired before it is validated; it is off unless set to true
+func repairEnabled(outputConfig map[string]interface{}) bool {
+	v, _ := outputConfig["repair"].(bool)
+	return v
+}
+
+// repairOutput repairs a response that is almost JSON, as smaller models
+// often produce, logging each fix. Text that is already valid JSON, or
+// that the repairs don't make valid, is returned unchanged.
+func repairOutput(text string) string {
+	trimmed := strings.TrimSpace(text)
+	if json.Valid([]byte(trimmed)) {
+		return text
+	}
+	start := strings.IndexAny(trimmed, "{[")
+	if start == -1 {
+		return text
+	}
+	repaired, fixes := repairJSON(trimmed[start:])
+	if len(fixes) == 0 {
+		return text
+	}
+	repaired = extractJSONText(repaired)
+	if !json.Valid([]byte(repaired)) {
+		log(fmt.Sprintf("Could not repair JSON output: %s", strings.Join(fixes, "; ")))
+		return text
+	}
+	log(fmt.Sprintf("Repaired JSON output:\n  %s", strings.Join(fixes, "\n  ")))
+	return repaired
+}
+
+// repairJSON fixes the usual ways model output falls short of JSON:
+// trailing commas, single-quoted strings and raw newlines or other control
+// characters inside strings. It returns the repaired text and a note of
+// each fix, located in the original text.
+func repairJSON(text string) (string, []string) {
+	var b strings.Builder
+	var fixes []string
+	fix := func(pos int, format string, args ...interface{}) {
+		line, col := lineCol(text, pos)
+		fixes = append(fixes, fmt.Sprintf("%d:%d: ", line, col)+fmt.Sprintf(format, args...))
+	}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch c {
+		case '"', '\'':
+			if c == '\'' {
+				fix(i, "replaced single quotes with double quotes")
+			}
+			i = repairString(text, i, &b, fix)
+		case ',':
+			j := i + 1
+			for j < len(text) && strings.IndexByte(" \t\r\n", text[j]) >= 0 {
+				j++
+			}
+			if j < len(text) && (text[j] == '}' || text[j] == ']') {
+				fix(i, "removed trailing comma")
+				continue
+			}
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), fixes
+}
+
+// repairString copies the string starting at the quote text[start] to b
+// as a double-quoted JSON string, returning the position of its closing
+// quote
+func repairString(text string, start int, b *strings.Builder, fix func(int, string, ...interface{})) int {
+	quote := text[start]
+	b.WriteByte('"')
+	i := start + 1
+	for ; i < len(text) && text[i] != quote; i++ {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text):
+			if quote == '\'' && text[i+1] == '\'' {
+				// \' needs no escape in a double-quoted string
+				b.WriteByte('\'')
+			} else {
+				b.WriteString(text[i : i+2])
+			}
+			i++
+		case c == '"':
+			b.WriteString(`\"`)
+		case c == '\n':
+			fix(i, "escaped newline in string")
+			b.WriteString(`\n`)
+		case c == '\r':
+			fix(i, "escaped carriage return in string")
+			b.WriteString(`\r`)
+		case c == '\t':
+			fix(i, "escaped tab in string")
+			b.WriteString(`\t`)
+		case c < 0x20:
+			fix(i, "escaped control character in string")
+			fmt.Fprintf(b, `\u%04x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return i
+}
+
+// lineCol converts a byte offset in text to a 1-based line and column
+func lineCol(text string, pos int) (int, int) {
+	line := 1 + strings.Count(text[:pos], "\n")
+	return line, pos - strings.LastIndex(text[:pos], "\n")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRepairJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected string
+		fixes    []string
+	}{
+		{"trailing commas", "{\"a\": [1, 2,],\n \"b\": 3,\n}", "{\"a\": [1, 2],\n \"b\": 3\n}",
+			[]string{"1:12: removed trailing comma", "2:8: removed trailing comma"}},
+		{"single quotes", `{'name': 'Ann "A" O\'Neil'}`, `{"name": "Ann \"A\" O'Neil"}`,
+			[]string{"1:2: replaced single quotes with double quotes", "1:10: replaced single quotes with double quotes"}},
+		{"raw newline", "{\"text\": \"line one\nline two\"}", `{"text": "line one\nline two"}`,
+			[]string{"1:19: escaped newline in string"}},
+		{"commas in strings kept", `{"a": "x,]"}`, `{"a": "x,]"}`, nil},
+		{"escapes kept", `{"a": "tab\t \"q\""}`, `{"a": "tab\t \"q\""}`, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, fixes := repairJSON(tc.text)
+			if got != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, got)
+			}
+			if !reflect.DeepEqual(fixes, tc.fixes) {
+				t.Errorf("Expected fixes %q, got %q", tc.fixes, fixes)
+			}
+		})
+	}
+}
+
+func TestRepairOutput(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"Here's the JSON: {'a': 1,} Hope that's right!", `{"a": 1}`},
+		{`{"a": 1}`, `{"a": 1}`},
+		{"{'a': }", "{'a': }"},
+		{"no JSON here", "no JSON here"},
+	}
+	for _, tc := range tests {
+		if got := repairOutput(tc.text); got != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.text, tc.expected, got)
+		}
+	}
+}
+
+func TestCompleteRepair(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"content":"{'name': 'Ann',}"}}]}`))
+	}))
+	defer server.Close()
+
+	for _, repair := range []bool{false, true} {
+		c, err := complete(context.Background(), promptRun{
+			path: "repair.prompt",
+			meta: map[string]interface{}{
+				"baseURL": server.URL,
+				"output": map[string]interface{}{
+					"schema":     map[string]interface{}{"name": "string"},
+					"maxRetries": 0,
+					"repair":     repair,
+				},
+			},
+			provider: "custom",
+			model:    "x",
+			messages: []Message{{Role: "user", Content: "Extract the name."}},
+		})
+		if repair && (err != nil || c.Result != `{"name": "Ann"}`) {
+			t.Errorf("Expected the repaired output, got %q, %v", c.Result, err)
+		}
+		if !repair && (err == nil || !strings.Contains(err.Error(), "not valid JSON")) {
+			t.Errorf("Expected invalid JSON without repair, got %q, %v", c.Result, err)
+		}
+	}
+}
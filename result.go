@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Result is a provider-agnostic view of a model response
+type Result struct {
+	// Text is the text content, or the JSON arguments of the first tool
+	// call when the model called a tool (as it does for structured output)
+	Text string
+	// Data is the decoded arguments of the first tool call, if any
+	Data         interface{}
+	ToolCalls    []ToolCall
+	Usage        Usage
+	FinishReason string
+	Model        string
+	Fingerprint  string // OpenAI's system_fingerprint of the serving backend
+	// Refusal is the model's explanation when it declined to answer
+	Refusal string
+	// Unknown names the fields present in the response that the decoder
+	// doesn't read, such as content block types newer than it
+	Unknown []string
+	// Media is the images and audio the response carries as base64
+	Media []Media
+	Raw   map[string]interface{}
+}
+
+// ToolCall is a tool invocation requested by the model
+type ToolCall struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"` // JSON-encoded arguments
+}
+
+// Usage counts the tokens consumed by a request
+type Usage struct {
+	InputTokens  int `json:"inputTokens"`
+	OutputTokens int `json:"outputTokens"`
+}
+
+// finishReasons maps provider stop reasons onto OpenAI's vocabulary
+var finishReasons = map[string]string{
+	"end_turn":      "stop",
+	"stop_sequence": "stop",
+	"max_tokens":    "length",
+	"tool_use":      "tool_calls",
+	"refusal":       "content_filter",
+}
+
+// extractResponse normalizes a provider API response into a Result. Fields
+// the decoder doesn't read are logged in verbose mode, and named in a
+// warning when they may hold the reply it found no text in.
+func extractResponse(response map[string]interface{}, outputConfig map[string]interface{}, provider string) Result {
+	result := adapterFor(provider).ParseResponse(response)
+	result.Raw = response
+	result.Model, _ = response["model"].(string)
+	result.Fingerprint, _ = response["system_fingerprint"].(string)
+	if reason, ok := finishReasons[result.FinishReason]; ok {
+		result.FinishReason = reason
+	}
+	if len(result.ToolCalls) > 0 {
+		var data interface{}
+		if err := json.Unmarshal([]byte(result.ToolCalls[0].Arguments), &data); err == nil {
+			result.Data = data
+		}
+	}
+	for _, field := range result.Unknown {
+		log(fmt.Sprintf("Response field %s is not one runprompt reads", field))
+	}
+	if result.Text == "" && result.Refusal == "" && len(result.Unknown) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: no text found in the response, which has fields runprompt doesn't read: %s\n",
+			strings.Join(result.Unknown, ", "))
+	}
+	return result
+}
+
+// refused returns an error for a response whose model declined to answer
+// rather than replying with text
+func (r Result) refused() error {
+	if r.Refusal == "" || r.Text != "" {
+		return nil
+	}
+	return fmt.Errorf("the model refused: %s", r.Refusal)
+}
+
+// version is the model version the response reports
+func (r Result) version() modelVersion {
+	return modelVersion{Model: r.Model, Fingerprint: r.Fingerprint}
+}
+
+// unknownFields lists the keys of obj, prefixed with path, that aren't in
+// known and hold a value
+func unknownFields(path string, obj map[string]interface{}, known ...string) []string {
+	var unknown []string
+	for k, v := range obj {
+		if containsString(known, k) || isEmptyValue(v) {
+			continue
+		}
+		unknown = append(unknown, path+k)
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// isEmptyValue reports whether a decoded JSON value is null or empty
+func isEmptyValue(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// toolArguments returns tool call arguments as JSON text, whether the
+// provider sent them encoded as a string or as an object
+func toolArguments(v interface{}, indent bool) string {
+	switch args := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return args
+	}
+	var data []byte
+	if indent {
+		data, _ = json.MarshalIndent(v, "", "  ")
+	} else {
+		data, _ = json.Marshal(v)
+	}
+	return string(data)
+}
+
+// anthropicBlockKeys are the content block fields the Messages API sends
+var anthropicBlockKeys = []string{"type", "text", "citations", "id", "name", "input", "source", "cache_control"}
+
+// extractAnthropicResponse reads a Messages API response. Content may be a
+// list of blocks or, from some proxies, a plain string; thinking and server
+// tool blocks are skipped.
+func extractAnthropicResponse(response map[string]interface{}) Result {
+	var result Result
+	result.FinishReason, _ = response["stop_reason"].(string)
+	if usage, ok := response["usage"].(map[string]interface{}); ok {
+		result.Usage.InputTokens = intValue(usage["input_tokens"])
+		result.Usage.OutputTokens = intValue(usage["output_tokens"])
+	}
+
+	text := ""
+	switch content := response["content"].(type) {
+	case string:
+		text = content
+	case []interface{}:
+		for i, block := range content {
+			b, ok := block.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			path := fmt.Sprintf("content[%d].", i)
+			switch b["type"] {
+			case "tool_use":
+				id, _ := b["id"].(string)
+				name, _ := b["name"].(string)
+				args := toolArguments(b["input"], true)
+				if args == "" {
+					args = "{}"
+				}
+				result.ToolCalls = append(result.ToolCalls, ToolCall{ID: id, Name: name, Arguments: args})
+			case "text":
+				t, _ := b["text"].(string)
+				text += t
+			case "image":
+				source, _ := b["source"].(map[string]interface{})
+				if data, ok := source["data"].(string); ok {
+					mime, _ := source["media_type"].(string)
+					result.Media = append(result.Media, Media{MIME: mime, Data: data})
+				}
+			case "thinking", "redacted_thinking", "server_tool_use", "web_search_tool_result":
+				continue
+			default:
+				result.Unknown = append(result.Unknown, fmt.Sprintf("%stype %v", path, b["type"]))
+				continue
+			}
+			result.Unknown = append(result.Unknown, unknownFields(path, b, anthropicBlockKeys...)...)
+		}
+	}
+	result.Text = text
+	result.Media = append(result.Media, inlineMedia(text)...)
+	if result.FinishReason == "refusal" {
+		result.Refusal = "no reason given"
+	}
+	if len(result.ToolCalls) > 0 {
+		result.Text = result.ToolCalls[0].Arguments
+	}
+	return result
+}
+
+// openAIMessageKeys are the message fields chat completion APIs send,
+// including reasoning fields that some compatible servers add
+var openAIMessageKeys = []string{"role", "content", "refusal", "tool_calls", "function_call", "name",
+	"annotations", "audio", "images", "reasoning", "reasoning_content", "reasoning_details"}
+
+// openAIChoiceKeys are the fields of a chat completion choice
+var openAIChoiceKeys = []string{"index", "message", "finish_reason", "native_finish_reason", "stop_reason", "logprobs", "text"}
+
+// extractOpenAIResponse reads an OpenAI-compatible chat completion. It
+// accepts content as a string or a list of parts, the refusal field, the
+// legacy function_call and the text of a completions API choice.
+func extractOpenAIResponse(response map[string]interface{}) Result {
+	var result Result
+	if usage, ok := response["usage"].(map[string]interface{}); ok {
+		result.Usage.InputTokens = intValue(usage["prompt_tokens"])
+		result.Usage.OutputTokens = intValue(usage["completion_tokens"])
+		if result.Usage == (Usage{}) {
+			// Servers that follow the Responses API name them like Anthropic
+			result.Usage.InputTokens = intValue(usage["input_tokens"])
+			result.Usage.OutputTokens = intValue(usage["output_tokens"])
+		}
+	}
+
+	choices, _ := response["choices"].([]interface{})
+	if len(choices) == 0 {
+		return result
+	}
+	choice, _ := choices[0].(map[string]interface{})
+	result.FinishReason, _ = choice["finish_reason"].(string)
+	result.Unknown = unknownFields("choices[0].", choice, openAIChoiceKeys...)
+	message, ok := choice["message"].(map[string]interface{})
+	if !ok {
+		result.Text, _ = choice["text"].(string)
+		return result
+	}
+	result.Unknown = append(result.Unknown, unknownFields("message.", message, openAIMessageKeys...)...)
+	toolCalls, _ := message["tool_calls"].([]interface{})
+	for _, c := range toolCalls {
+		tc, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fn, _ := tc["function"].(map[string]interface{})
+		id, _ := tc["id"].(string)
+		name, _ := fn["name"].(string)
+		result.ToolCalls = append(result.ToolCalls, ToolCall{ID: id, Name: name, Arguments: toolArguments(fn["arguments"], false)})
+	}
+	if fn, ok := message["function_call"].(map[string]interface{}); ok && len(result.ToolCalls) == 0 {
+		name, _ := fn["name"].(string)
+		result.ToolCalls = append(result.ToolCalls, ToolCall{Name: name, Arguments: toolArguments(fn["arguments"], false)})
+	}
+	result.Refusal, _ = message["refusal"].(string)
+	switch content := message["content"].(type) {
+	case string:
+		result.Text = content
+	case []interface{}:
+		for i, part := range content {
+			p, ok := part.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			switch p["type"] {
+			case "text", "output_text":
+				t, _ := p["text"].(string)
+				result.Text += t
+			case "refusal":
+				if result.Refusal == "" {
+					result.Refusal, _ = p["refusal"].(string)
+				}
+			case "image_url":
+				result.Media = append(result.Media, imageURLMedia(p)...)
+			default:
+				result.Unknown = append(result.Unknown, fmt.Sprintf("message.content[%d].type %v", i, p["type"]))
+			}
+		}
+	}
+	result.Media = append(result.Media, inlineMedia(result.Text)...)
+	images, _ := message["images"].([]interface{})
+	for _, image := range images {
+		if p, ok := image.(map[string]interface{}); ok {
+			result.Media = append(result.Media, imageURLMedia(p)...)
+		}
+	}
+	if audio, ok := message["audio"].(map[string]interface{}); ok {
+		if data, ok := audio["data"].(string); ok && data != "" {
+			result.Media = append(result.Media, Media{Data: data})
+		}
+		if transcript, ok := audio["transcript"].(string); ok && result.Text == "" {
+			result.Text = transcript
+		}
+	}
+	if len(result.ToolCalls) > 0 {
+		result.Text = result.ToolCalls[0].Arguments
+	}
+	return result
+}
+
+// imageURLMedia reads an image_url part whose URL is a data: URL
+func imageURLMedia(part map[string]interface{}) []Media {
+	image, _ := part["image_url"].(map[string]interface{})
+	url, _ := image["url"].(string)
+	if m, ok := parseDataURL(url); ok {
+		return []Media{m}
+	}
+	return nil
+}
+
+// intValue converts a decoded JSON number to int
+func intValue(v interface{}) int {
+	switch n := v.(type) {
+	case float64:
+		return int(n)
+	case int:
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractAnthropicResponse(t *testing.T) {
+	response := map[string]interface{}{
+		"model":       "claude-3",
+		"stop_reason": "tool_use",
+		"usage":       map[string]interface{}{"input_tokens": 12.0, "output_tokens": 7.0},
+		"content": []interface{}{
+			map[string]interface{}{"type": "text", "text": "Extracting."},
+			map[string]interface{}{"type": "tool_use", "id": "tu_1", "name": "extract",
+				"input": map[string]interface{}{"name": "John"}},
+		},
+	}
+	result := extractResponse(response, nil, "anthropic")
+	if result.Text != "{\n  \"name\": \"John\"\n}" {
+		t.Errorf("Text: got %q", result.Text)
+	}
+	if data, ok := result.Data.(map[string]interface{}); !ok || data["name"] != "John" {
+		t.Errorf("Data: got %v", result.Data)
+	}
+	if len(result.ToolCalls) != 1 || result.ToolCalls[0].Name != "extract" || result.ToolCalls[0].ID != "tu_1" {
+		t.Errorf("ToolCalls: got %+v", result.ToolCalls)
+	}
+	if result.Usage != (Usage{InputTokens: 12, OutputTokens: 7}) {
+		t.Errorf("Usage: got %+v", result.Usage)
+	}
+	if result.FinishReason != "tool_calls" || result.Model != "claude-3" {
+		t.Errorf("FinishReason/Model: got %q %q", result.FinishReason, result.Model)
+	}
+}
+
+func TestExtractOpenAIResponseFixtures(t *testing.T) {
+	tests := []struct {
+		file         string
+		text         string
+		finishReason string
+		hasData      bool
+	}{
+		{"tests/job.prompt.test-response", `{"occupation":"teacher","age":30,"name":"John"}`, "tool_calls", true},
+		{"tests/job-haiku.prompt.test-response", "", "stop", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.file, func(t *testing.T) {
+			content, err := os.ReadFile(tc.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var response map[string]interface{}
+			if err := json.Unmarshal(content, &response); err != nil {
+				t.Fatal(err)
+			}
+			result := extractResponse(response, nil, "openrouter")
+			if tc.text != "" && result.Text != tc.text {
+				t.Errorf("Text: Expected %q, got %q", tc.text, result.Text)
+			}
+			if result.Text == "" {
+				t.Error("Expected non-empty text")
+			}
+			if result.FinishReason != tc.finishReason {
+				t.Errorf("FinishReason: Expected %q, got %q", tc.finishReason, result.FinishReason)
+			}
+			if (result.Data != nil) != tc.hasData {
+				t.Errorf("Data: got %v", result.Data)
+			}
+			if result.Usage.InputTokens == 0 {
+				t.Errorf("Expected usage to be read, got %+v", result.Usage)
+			}
+		})
+	}
+}
+
+func TestExtractResponseVariants(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		response string
+		text     string
+		refusal  string
+		unknown  []string
+	}{
+		{"openai content parts", "openai",
+			`{"choices":[{"message":{"role":"assistant","content":[{"type":"text","text":"Hel"},{"type":"output_text","text":"lo"}]}}]}`,
+			"Hello", "", nil},
+		{"openai refusal field", "openai",
+			`{"choices":[{"message":{"role":"assistant","content":null,"refusal":"I can't help with that."}}]}`,
+			"", "I can't help with that.", nil},
+		{"openai refusal part", "openai",
+			`{"choices":[{"message":{"role":"assistant","content":[{"type":"refusal","refusal":"No."}]}}]}`,
+			"", "No.", nil},
+		{"openai legacy function_call", "openai",
+			`{"choices":[{"message":{"role":"assistant","function_call":{"name":"extract","arguments":"{\"a\":1}"}}}]}`,
+			`{"a":1}`, "", nil},
+		{"openai object arguments", "openai",
+			`{"choices":[{"message":{"role":"assistant","tool_calls":[{"id":"c1","function":{"name":"extract","arguments":{"a":1}}}]}}]}`,
+			`{"a":1}`, "", nil},
+		{"openai completions text", "openai",
+			`{"choices":[{"text":"Hi","finish_reason":"stop"}]}`,
+			"Hi", "", nil},
+		{"openai unknown fields", "openai",
+			`{"choices":[{"message":{"role":"assistant","content":"","answer":"Hi","extra":null},"score":1}]}`,
+			"", "", []string{"choices[0].score", "message.answer"}},
+		{"openai reasoning is known", "openai",
+			`{"choices":[{"message":{"role":"assistant","content":"Hi","reasoning_content":"thinking"}}]}`,
+			"Hi", "", nil},
+		{"anthropic thinking blocks", "anthropic",
+			`{"content":[{"type":"thinking","thinking":"hmm","signature":"x"},{"type":"redacted_thinking","data":"y"},{"type":"text","text":"Hi"}]}`,
+			"Hi", "", nil},
+		{"anthropic string content", "anthropic",
+			`{"content":"Hi"}`,
+			"Hi", "", nil},
+		{"anthropic unknown block", "anthropic",
+			`{"content":[{"type":"hologram","payload":"Hi"},{"type":"text","text":"","body":"Hi"}]}`,
+			"", "", []string{"content[0].type hologram", "content[1].body"}},
+		{"anthropic refusal", "anthropic",
+			`{"stop_reason":"refusal","content":[]}`,
+			"", "no reason given", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var response map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.response), &response); err != nil {
+				t.Fatal(err)
+			}
+			result := extractResponse(response, nil, tc.provider)
+			if result.Text != tc.text {
+				t.Errorf("Text: Expected %q, got %q", tc.text, result.Text)
+			}
+			if result.Refusal != tc.refusal {
+				t.Errorf("Refusal: Expected %q, got %q", tc.refusal, result.Refusal)
+			}
+			if fmt.Sprint(result.Unknown) != fmt.Sprint(tc.unknown) {
+				t.Errorf("Unknown: Expected %v, got %v", tc.unknown, result.Unknown)
+			}
+			if (result.refused() != nil) != (tc.refusal != "") {
+				t.Errorf("refused: got %v", result.refused())
+			}
+		})
+	}
+}
+
+func TestRunRefusal(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeFiles(t, dir,
+		"ask.prompt", "---\nmodel: test\n---\nHello",
+		"ask.prompt.test-response", `{"choices":[{"message":{"role":"assistant","content":null,"refusal":"I can't help with that."}}]}`)
+	err := run(context.Background(), []string{filepath.Join(dir, "ask.prompt")})
+	if err == nil || !strings.Contains(err.Error(), "refused: I can't help with that.") {
+		t.Errorf("Expected a refusal error, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for retrying a model call the provider turned away with a
+// Retry-After header, set by limits.rateLimitRetries and limits.maxRetryWait
+const (
+	defaultRateLimitRetries = 3
+	defaultMaxRetryWait     = time.Minute
+)
+
+// retryAfterError is a 429 or 503 response, sent when the client is rate
+// limited or the provider is overloaded, that said how long to wait before
+// trying again
+type retryAfterError struct {
+	Status  int
+	Wait    time.Duration
+	Message string
+}
+
+func (e *retryAfterError) Error() string {
+	return e.Message
+}
+
+// retryAfter reads how long a response asks the client to wait: a
+// Retry-After header in seconds or as an HTTP date, or OpenAI's
+// retry-after-ms
+func retryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	if v := strings.TrimSpace(h.Get("Retry-After-Ms")); v != "" {
+		if ms, err := strconv.ParseFloat(v, 64); err == nil && ms >= 0 {
+			return time.Duration(ms * float64(time.Millisecond)), true
+		}
+	}
+	v := strings.TrimSpace(h.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseFloat(v, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	if date, err := http.ParseTime(v); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// retryStatus reports whether a response status may carry a Retry-After
+// worth honoring
+func retryStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// retryRateLimited makes a model call with call, calling again when the
+// provider answers with a Retry-After header after waiting as long as it
+// asked. It gives up after limits.rateLimitRetries retries, when the wait
+// is over limits.maxRetryWait, or when it would outlast ctx.
+func (l Limits) retryRateLimited(ctx context.Context, call func() (*Exchange, error)) (*Exchange, error) {
+	for retries := 0; ; retries++ {
+		exchange, err := call()
+		var rateLimited *retryAfterError
+		if !errors.As(err, &rateLimited) || retries >= l.RateLimitRetries {
+			return exchange, err
+		}
+		wait := rateLimited.Wait
+		if l.MaxRetryWait > 0 && wait > l.MaxRetryWait {
+			return nil, fmt.Errorf("%v (retry after %v is over the %v limit set by limits.maxRetryWait)", err, wait, l.MaxRetryWait)
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "%v\nRetrying in %v (HTTP %d)\n", err, wait, rateLimited.Status)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		header http.Header
+		wait   time.Duration
+		ok     bool
+	}{
+		{http.Header{"Retry-After": {"2"}}, 2 * time.Second, true},
+		{http.Header{"Retry-After": {"0.5"}}, 500 * time.Millisecond, true},
+		{http.Header{"Retry-After": {now.Add(30 * time.Second).Format(http.TimeFormat)}}, 30 * time.Second, true},
+		{http.Header{"Retry-After": {now.Add(-time.Minute).Format(http.TimeFormat)}}, 0, true},
+		{http.Header{"Retry-After-Ms": {"250"}, "Retry-After": {"1"}}, 250 * time.Millisecond, true},
+		{http.Header{"Retry-After": {"soon"}}, 0, false},
+		{http.Header{}, 0, false},
+	}
+	for _, tc := range tests {
+		wait, ok := retryAfter(tc.header, now)
+		if wait != tc.wait || ok != tc.ok {
+			t.Errorf("%v: expected %v %v, got %v %v", tc.header, tc.wait, tc.ok, wait, ok)
+		}
+	}
+}
+
+// rateLimitServer answers the first failures calls with status and the
+// given Retry-After header, then with a normal reply
+func rateLimitServer(t *testing.T, failures int32, status int, retryAfter string) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			w.Write([]byte(`{"error": {"type": "rate_limit_error", "message": "slow down"}}`))
+			return
+		}
+		w.Write([]byte(`{"choices":[{"message":{"content":"ok"}}]}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestCompleteRetryAfter(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		limits     map[string]interface{}
+		calls      int32
+		err        string
+	}{
+		{"retried", http.StatusTooManyRequests, "0", nil, 3, ""},
+		{"overloaded", http.StatusServiceUnavailable, "0.01", nil, 3, ""},
+		{"no header", http.StatusTooManyRequests, "", nil, 1, "rate_limit_error: slow down"},
+		{"other status", http.StatusInternalServerError, "0", nil, 1, "rate_limit_error: slow down"},
+		{"out of retries", http.StatusTooManyRequests, "0", map[string]interface{}{"rateLimitRetries": 1}, 2, "slow down"},
+		{"wait too long", http.StatusTooManyRequests, "120", nil, 1, "over the 1m0s limit set by limits.maxRetryWait"},
+		{"past the deadline", http.StatusTooManyRequests, "5", map[string]interface{}{"totalTimeout": "1s"}, 1, "slow down"},
+	}
+	for _, tt := range tests {
+		server, calls := rateLimitServer(t, 2, tt.status, tt.retryAfter)
+		meta := map[string]interface{}{"baseURL": server.URL}
+		if tt.limits != nil {
+			meta["limits"] = tt.limits
+		}
+		result, err := complete(context.Background(), promptRun{
+			path:     "retry.prompt",
+			meta:     meta,
+			provider: "custom",
+			model:    "x",
+			messages: []Message{{Role: "user", Content: "Hi"}},
+		})
+		if tt.err == "" && (err != nil || result.Reply != "ok") {
+			t.Errorf("%s: expected ok, got %q, %v", tt.name, result.Reply, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: expected error %q, got %v", tt.name, tt.err, err)
+		}
+		if n := atomic.LoadInt32(calls); n != tt.calls {
+			t.Errorf("%s: expected %d calls, got %d", tt.name, tt.calls, n)
+		}
+	}
+}
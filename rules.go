@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// outputRules are checks on structured output beyond its schema's types,
+// declared in frontmatter:
+//
+//	output:
+//	  validate:
+//	    score:
+//	      min: 0
+//	      max: 10
+//	    code:
+//	      pattern: '^[A-Z]{3}$'
+//	    items[].price:
+//	      min: 0
+//	  rules: ["end_date >= start_date"]
+//
+// validate maps field paths to constraints; a path segment ending in []
+// applies the rest of the path to each item of a list. rules compare two
+// fields, or a field and a literal. Violations are handled like schema
+// errors, so the model is asked to correct them.
+type outputRules struct {
+	fields   []fieldRule
+	compares []compareRule
+}
+
+// fieldRule constrains the values at one field path
+type fieldRule struct {
+	path                 string
+	min, max             *float64
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+}
+
+// compareRule is a cross-field rule such as "end_date >= start_date"
+type compareRule struct {
+	text        string
+	left, right ruleOperand
+	op          string
+}
+
+// ruleOperand is one side of a compareRule: a field path or a literal
+type ruleOperand struct {
+	path  string
+	value interface{}
+}
+
+// fieldRuleKeys are the constraints output.validate accepts for a field
+var fieldRuleKeys = []string{"min", "max", "minLength", "maxLength", "pattern"}
+
+// compareOps are the operators of cross-field rules, longest first so
+// ">=" is not read as ">"
+var compareOps = []string{">=", "<=", "==", "!=", ">", "<"}
+
+// parseOutputRules reads output.validate and output.rules, returning nil if
+// neither is set
+func parseOutputRules(outputConfig map[string]interface{}) (*outputRules, error) {
+	validate, hasValidate := outputConfig["validate"]
+	rules, hasRules := outputConfig["rules"]
+	if !hasValidate && !hasRules {
+		return nil, nil
+	}
+	r := &outputRules{}
+
+	if hasValidate {
+		fields, ok := validate.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("output.validate must map fields to constraints, got %v", validate)
+		}
+		paths := make([]string, 0, len(fields))
+		for path := range fields {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			rule, err := parseFieldRule(path, fields[path])
+			if err != nil {
+				return nil, fmt.Errorf("output.validate.%s: %v", path, err)
+			}
+			r.fields = append(r.fields, rule)
+		}
+	}
+
+	if hasRules {
+		list, ok := rules.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("output.rules must be a list of comparisons, got %v", rules)
+		}
+		for _, item := range list {
+			text, _ := item.(string)
+			rule, err := parseCompareRule(text)
+			if err != nil {
+				return nil, fmt.Errorf("output.rules: %v", err)
+			}
+			r.compares = append(r.compares, rule)
+		}
+	}
+	return r, nil
+}
+
+func parseFieldRule(path string, v interface{}) (fieldRule, error) {
+	rule := fieldRule{path: path}
+	constraints, ok := v.(map[string]interface{})
+	if !ok {
+		return rule, fmt.Errorf("expected constraints such as {min: 0}, got %v", v)
+	}
+	for key, value := range constraints {
+		switch key {
+		case "min", "max":
+			f, ok := toFloat(value)
+			if !ok {
+				return rule, fmt.Errorf("%s must be a number, got %v", key, value)
+			}
+			if key == "min" {
+				rule.min = &f
+			} else {
+				rule.max = &f
+			}
+		case "minLength", "maxLength":
+			f, ok := toFloat(value)
+			n := int(f)
+			if !ok || f < 0 || float64(n) != f {
+				return rule, fmt.Errorf("%s must be a non-negative integer, got %v", key, value)
+			}
+			if key == "minLength" {
+				rule.minLength = &n
+			} else {
+				rule.maxLength = &n
+			}
+		case "pattern":
+			s, _ := value.(string)
+			re, err := regexp.Compile(s)
+			if err != nil || s == "" {
+				return rule, fmt.Errorf("invalid pattern %v", value)
+			}
+			rule.pattern = re
+		default:
+			return rule, fmt.Errorf("unknown constraint %q (use %s)", key, strings.Join(fieldRuleKeys, ", "))
+		}
+	}
+	return rule, nil
+}
+
+func parseCompareRule(text string) (compareRule, error) {
+	rule := compareRule{text: text}
+	for _, op := range compareOps {
+		left, right, ok := strings.Cut(text, op)
+		if !ok {
+			continue
+		}
+		left, right = strings.TrimSpace(left), strings.TrimSpace(right)
+		if left == "" || right == "" {
+			break
+		}
+		rule.op = op
+		rule.left, rule.right = parseRuleOperand(left), parseRuleOperand(right)
+		return rule, nil
+	}
+	return rule, fmt.Errorf("invalid rule %q, expected a comparison like \"end_date >= start_date\"", text)
+}
+
+// parseRuleOperand reads a quoted string or number as a literal and
+// anything else as a field path
+func parseRuleOperand(s string) ruleOperand {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return ruleOperand{value: s[1 : len(s)-1]}
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return ruleOperand{value: f}
+	}
+	return ruleOperand{path: s}
+}
+
+// check returns the rules that value, the parsed output, violates. Rules on
+// fields the output doesn't have are skipped; the schema decides whether
+// fields are required.
+func (r *outputRules) check(value interface{}) []string {
+	if r == nil {
+		return nil
+	}
+	var problems []string
+	for _, rule := range r.fields {
+		for _, f := range fieldValues(value, "$", strings.Split(rule.path, ".")) {
+			problems = append(problems, rule.check(f.path, f.value)...)
+		}
+	}
+	for _, rule := range r.compares {
+		if problem := rule.check(value); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+func (rule fieldRule) check(path string, value interface{}) []string {
+	var problems []string
+	if n, ok := value.(float64); ok {
+		if rule.min != nil && n < *rule.min {
+			problems = append(problems, fmt.Sprintf("%s: %v is less than the minimum %v", path, n, *rule.min))
+		}
+		if rule.max != nil && n > *rule.max {
+			problems = append(problems, fmt.Sprintf("%s: %v is more than the maximum %v", path, n, *rule.max))
+		}
+	}
+	length := -1
+	switch v := value.(type) {
+	case string:
+		length = len([]rune(v))
+		if rule.pattern != nil && !rule.pattern.MatchString(v) {
+			problems = append(problems, fmt.Sprintf("%s: %q does not match the pattern %s", path, v, rule.pattern))
+		}
+	case []interface{}:
+		length = len(v)
+	}
+	if length >= 0 {
+		if rule.minLength != nil && length < *rule.minLength {
+			problems = append(problems, fmt.Sprintf("%s: length %d is less than the minimum %d", path, length, *rule.minLength))
+		}
+		if rule.maxLength != nil && length > *rule.maxLength {
+			problems = append(problems, fmt.Sprintf("%s: length %d is more than the maximum %d", path, length, *rule.maxLength))
+		}
+	}
+	return problems
+}
+
+// check returns a description of the violation, or "" if the rule holds or
+// names a missing field
+func (rule compareRule) check(value interface{}) string {
+	left, ok := rule.left.resolve(value)
+	if !ok {
+		return ""
+	}
+	right, ok := rule.right.resolve(value)
+	if !ok {
+		return ""
+	}
+	cmp, ok := compareValues(left, right)
+	if !ok {
+		if rule.op != "==" && rule.op != "!=" {
+			return fmt.Sprintf("rule %q compares %s with %s", rule.text, jsonTypeName(left), jsonTypeName(right))
+		}
+		// Values of different types are never equal
+		cmp = 1
+	}
+	var holds bool
+	switch rule.op {
+	case ">=":
+		holds = cmp >= 0
+	case "<=":
+		holds = cmp <= 0
+	case ">":
+		holds = cmp > 0
+	case "<":
+		holds = cmp < 0
+	case "==":
+		holds = cmp == 0
+	case "!=":
+		holds = cmp != 0
+	}
+	if holds {
+		return ""
+	}
+	return fmt.Sprintf("rule %q failed: %s", rule.text, strings.Join(rule.describe(left, right), ", "))
+}
+
+// describe lists the field values a rule compared, for its error message
+func (rule compareRule) describe(left, right interface{}) []string {
+	var parts []string
+	for i, o := range []ruleOperand{rule.left, rule.right} {
+		if o.path == "" {
+			continue
+		}
+		v := left
+		if i == 1 {
+			v = right
+		}
+		parts = append(parts, fmt.Sprintf("%s is %s", o.path, formatRuleValue(v)))
+	}
+	return parts
+}
+
+func formatRuleValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// resolve returns the operand's value in the output
+func (o ruleOperand) resolve(value interface{}) (interface{}, bool) {
+	if o.path == "" {
+		return o.value, true
+	}
+	values := fieldValues(value, "$", strings.Split(o.path, "."))
+	if len(values) != 1 {
+		return nil, false
+	}
+	return values[0].value, true
+}
+
+// compareValues orders two numbers or two strings; strings compare
+// lexically, which orders ISO 8601 dates correctly
+func compareValues(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	case bool:
+		y, ok := b.(bool)
+		if !ok || x != y {
+			return 1, ok
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// fieldValue is a value found at a path in the output
+type fieldValue struct {
+	path  string
+	value interface{}
+}
+
+// fieldValues finds the values at a field path, expanding segments that end
+// in [] over each item of a list
+func fieldValues(value interface{}, path string, segments []string) []fieldValue {
+	if len(segments) == 0 {
+		return []fieldValue{{path, value}}
+	}
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	name, each := strings.CutSuffix(segments[0], "[]")
+	v, ok := obj[name]
+	if !ok || v == nil {
+		return nil
+	}
+	path += "." + name
+	if !each {
+		return fieldValues(v, path, segments[1:])
+	}
+	items, _ := v.([]interface{})
+	var values []fieldValue
+	for i, item := range items {
+		values = append(values, fieldValues(item, fmt.Sprintf("%s[%d]", path, i), segments[1:])...)
+	}
+	return values
+}
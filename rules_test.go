@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOutputRules(t *testing.T) {
+	meta := parseYAML(`output:
+  validate:
+    score:
+      min: 0
+      max: 10
+    code:
+      pattern: '^[A-Z]{3}$'
+      maxLength: 3
+    tags:
+      minLength: 1
+    items[].price:
+      min: 0
+  rules: ["end_date >= start_date", "score != 5", "status == 'open'"]`)
+	rules, err := parseOutputRules(meta["output"].(map[string]interface{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		output   string
+		expected []string
+	}{
+		{"valid", `{"score": 7, "code": "ABC", "tags": ["a"], "start_date": "2024-01-01", "end_date": "2024-02-01", "status": "open",
+			"items": [{"price": 1}, {"price": 0}]}`, nil},
+		{"missing fields skipped", `{}`, nil},
+		{"range", `{"score": 11}`, []string{"$.score: 11 is more than the maximum 10"}},
+		{"pattern and length", `{"code": "abcd"}`, []string{
+			`$.code: "abcd" does not match the pattern ^[A-Z]{3}$`,
+			"$.code: length 4 is more than the maximum 3"}},
+		{"list length", `{"tags": []}`, []string{"$.tags: length 0 is less than the minimum 1"}},
+		{"each item", `{"items": [{"price": 1}, {"price": -2}]}`, []string{"$.items[1].price: -2 is less than the minimum 0"}},
+		{"cross field", `{"start_date": "2024-03-01", "end_date": "2024-02-01"}`, []string{
+			`rule "end_date >= start_date" failed: end_date is "2024-02-01", start_date is "2024-03-01"`}},
+		{"literal", `{"score": 5, "status": "closed"}`, []string{
+			`rule "score != 5" failed: score is 5`,
+			`rule "status == 'open'" failed: status is "closed"`}},
+		{"mixed types", `{"start_date": 1, "end_date": "x"}`, []string{
+			`rule "end_date >= start_date" compares string with number`}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var value interface{}
+			if err := json.Unmarshal([]byte(tc.output), &value); err != nil {
+				t.Fatal(err)
+			}
+			if got := rules.check(value); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseOutputRulesErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   map[string]interface{}
+		expected string
+	}{
+		{"not a map", map[string]interface{}{"validate": "x"}, "output.validate must map fields"},
+		{"unknown constraint", map[string]interface{}{"validate": map[string]interface{}{"a": map[string]interface{}{"mn": 1}}},
+			`output.validate.a: unknown constraint "mn"`},
+		{"bad number", map[string]interface{}{"validate": map[string]interface{}{"a": map[string]interface{}{"max": "lots"}}},
+			"max must be a number"},
+		{"bad length", map[string]interface{}{"validate": map[string]interface{}{"a": map[string]interface{}{"maxLength": 1.5}}},
+			"maxLength must be a non-negative integer"},
+		{"bad pattern", map[string]interface{}{"validate": map[string]interface{}{"a": map[string]interface{}{"pattern": "("}}},
+			"invalid pattern ("},
+		{"rules not a list", map[string]interface{}{"rules": "a > b"}, "output.rules must be a list"},
+		{"bad rule", map[string]interface{}{"rules": []interface{}{"a is b"}}, `invalid rule "a is b"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseOutputRules(tc.config)
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("Expected error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+	if rules, err := parseOutputRules(map[string]interface{}{}); rules != nil || err != nil {
+		t.Errorf("Expected no rules, got %v, %v", rules, err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// unsafeSettings are the prompt file settings --safe ignores, so a prompt
+// from someone else can't run commands, write files or send data anywhere
+// but to the model. Prompts, includes and partials are only ever read from
+// disk, so there is no remote loading to turn off.
+var unsafeSettings = []struct {
+	key    string // a top-level key, or output.<key>
+	reason string
+}{
+	{"onModelChange", "runs a shell command"},
+	{"tools", "runs commands the model chooses to call"},
+	{"mcpServers", "starts commands or connects to servers for tools"},
+	{"output.files", "writes files"},
+	{"output.sink", "delivers output to files, webhooks or S3"},
+	{"output.media", "chooses where images and audio are written"},
+	{"baseURL", "sends requests, with their API key, to another server"},
+	{"proxy", "routes requests through another server"},
+}
+
+// restrictPrompt removes the unsafeSettings from a prompt's own settings,
+// warning about each one found. It is applied to the prompt file and the
+// project config, which come with it, but not to the global config, env
+// vars and flags, which are the user's own and keep working.
+func restrictPrompt(meta map[string]interface{}) {
+	for _, setting := range unsafeSettings {
+		key, block := setting.key, meta
+		if name, ok := strings.CutPrefix(key, "output."); ok {
+			output, _ := meta["output"].(map[string]interface{})
+			key = name
+			if _, ok := output[key]; !ok {
+				continue
+			}
+			// Copied, leaving the block meta came with unchanged
+			block = make(map[string]interface{}, len(output))
+			for k, v := range output {
+				block[k] = v
+			}
+			meta["output"] = block
+		}
+		if _, ok := block[key]; !ok {
+			continue
+		}
+		delete(block, key)
+		fmt.Fprintf(os.Stderr, "Warning: --safe ignores %s, which %s\n", setting.key, setting.reason)
+	}
+}
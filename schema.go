@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// picoschemaKeyRe splits a picoschema key such as "tags?(array, labels)"
+// into name, optional marker, type and description
+var picoschemaKeyRe = regexp.MustCompile(`^([^?(]+?)\s*(\?)?\s*(?:\(\s*(\w+)\s*(?:,\s*(.*?))?\s*\))?\s*(\?)?$`)
+
+// picoschemaObject converts a picoschema map into a JSON schema object.
+// Fields are written "name: type, description" with an optional "?" suffix
+// on the name. Beyond scalar types it supports:
+//
+//	tags(array, labels): string     # array of a scalar type
+//	items(array):                   # array of objects
+//	  name: string
+//	address(object, where they live):
+//	  city: string
+//	status(enum, current state): [open, closed]
+func picoschemaObject(schema map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+
+	keys := make([]string, 0, len(schema))
+	for key := range schema {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name, prop, optional := picoschemaField(key, schema[key])
+		properties[name] = prop
+		if !optional {
+			required = append(required, name)
+		}
+	}
+
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+// picoschemaField converts one picoschema field into its JSON schema
+func picoschemaField(key string, value interface{}) (string, map[string]interface{}, bool) {
+	name, optional, kind, description := strings.TrimSpace(key), false, "", ""
+	if m := picoschemaKeyRe.FindStringSubmatch(key); m != nil {
+		name, kind, description = m[1], m[3], m[4]
+		optional = m[2] != "" || m[5] != ""
+	}
+
+	var prop map[string]interface{}
+	switch kind {
+	case "array":
+		items, itemDescription := picoschemaType(value)
+		if description == "" {
+			description = itemDescription
+		}
+		prop = map[string]interface{}{"type": "array", "items": items}
+	case "enum":
+		values, _ := value.([]interface{})
+		if values == nil {
+			values = []interface{}{}
+			for _, v := range stringList(value) {
+				values = append(values, v)
+			}
+		}
+		prop = map[string]interface{}{"enum": values}
+	default:
+		// (object) and plain fields: the type comes from the value
+		var typeDescription string
+		prop, typeDescription = picoschemaType(value)
+		if description == "" {
+			description = typeDescription
+		}
+	}
+	if description != "" {
+		prop["description"] = description
+	}
+	return name, prop, optional
+}
+
+// picoschemaType converts a field value, either "type, description" or a
+// nested map for an object, into a JSON schema and description
+func picoschemaType(value interface{}) (map[string]interface{}, string) {
+	switch v := value.(type) {
+	case nil:
+		return map[string]interface{}{"type": "null"}, ""
+	case map[string]interface{}:
+		return picoschemaObject(v), ""
+	case string:
+		parts := strings.SplitN(v, ",", 2)
+		description := ""
+		if len(parts) > 1 {
+			description = strings.TrimSpace(parts[1])
+		}
+		switch typeName := strings.TrimSpace(parts[0]); typeName {
+		case "number", "integer", "boolean", "null":
+			return map[string]interface{}{"type": typeName}, description
+		case "any":
+			return map[string]interface{}{}, description
+		default:
+			return map[string]interface{}{"type": "string"}, description
+		}
+	}
+	return map[string]interface{}{"type": "string"}, ""
+}
+
+// picoschemaTypes are the scalar types a picoschema field may have
+var picoschemaTypes = []string{"string", "number", "integer", "boolean", "null", "any"}
+
+// schemaProblem is a mistake in one picoschema field. picoschemaObject
+// tolerates these, treating unknown types as strings, so they are only
+// reported by validate.
+type schemaProblem struct {
+	field string // dotted path of the field's key
+	msg   string
+}
+
+// checkPicoschema reports mistakes in a picoschema's fields
+func checkPicoschema(schema map[string]interface{}, prefix string) []schemaProblem {
+	var problems []schemaProblem
+	for key, value := range schema {
+		field := prefix + key
+		m := picoschemaKeyRe.FindStringSubmatch(key)
+		if m == nil {
+			problems = append(problems, schemaProblem{field, fmt.Sprintf("invalid field %q", key)})
+			continue
+		}
+		switch kind := m[3]; kind {
+		case "", "array":
+			problems = append(problems, checkPicoschemaType(value, field)...)
+		case "object":
+			fields, ok := value.(map[string]interface{})
+			if !ok {
+				problems = append(problems, schemaProblem{field, "(object) field needs nested fields"})
+				continue
+			}
+			problems = append(problems, checkPicoschema(fields, field+".")...)
+		case "enum":
+			if _, ok := value.([]interface{}); !ok {
+				problems = append(problems, schemaProblem{field, "(enum) field needs a list of values, like [a, b]"})
+			}
+		default:
+			problems = append(problems, schemaProblem{field, fmt.Sprintf("unknown field kind %q (use array, object or enum)", kind)})
+		}
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].field < problems[j].field })
+	return problems
+}
+
+// checkPicoschemaType reports a field value that is neither a known type nor
+// nested fields
+func checkPicoschemaType(value interface{}, field string) []schemaProblem {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		return checkPicoschema(v, field+".")
+	case string:
+		typeName := strings.TrimSpace(strings.SplitN(v, ",", 2)[0])
+		if !containsString(picoschemaTypes, typeName) {
+			return []schemaProblem{{field, fmt.Sprintf("unknown type %q (use %s)", typeName, strings.Join(picoschemaTypes, ", "))}}
+		}
+		return nil
+	}
+	return []schemaProblem{{field, fmt.Sprintf("expected a type like \"string, description\", got %v", value)}}
+}
+
+// outputJSONSchema converts an output schema from frontmatter into the
+// JSON schema used for the extract tool's parameters
+func outputJSONSchema(schema map[string]interface{}) map[string]interface{} {
+	tool := buildSchemaTool(schema)
+	return tool["function"].(map[string]interface{})["parameters"].(map[string]interface{})
+}
+
+// usesTools reports whether structured output should be requested through
+// tool calling. Providers without tool support fall back to instructions in
+// the prompt; output.useTools in frontmatter forces either behavior.
+func usesTools(provider string, outputConfig map[string]interface{}) bool {
+	if v, ok := outputConfig["useTools"].(bool); ok {
+		return v
+	}
+	return adapterFor(provider).Capabilities().Tools
+}
+
+// schemaInstructions returns text appended to the prompt asking for JSON
+// output when the schema can't be enforced through tool calling
+func schemaInstructions(schema map[string]interface{}) string {
+	data, _ := json.MarshalIndent(outputJSONSchema(schema), "", "  ")
+	return "\n\nRespond only with a JSON object that matches this JSON schema. " +
+		"Do not include any other text.\n\n" + string(data)
+}
+
+// describeSchema renders a JSON schema built by picoschemaObject as
+// instructions for {{schema input}} and {{schema output}}: a sentence, then
+// one line per field with nested fields indented below their parent
+func describeSchema(name string, schema map[string]interface{}) string {
+	var b strings.Builder
+	if name == "output" {
+		b.WriteString("Respond with a JSON object with these fields:\n")
+	} else {
+		fmt.Fprintf(&b, "The %s is a JSON object with these fields:\n", name)
+	}
+	writeSchemaFields(&b, schema, "")
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// writeSchemaFields writes a line for each property of an object schema,
+// such as "- tags (list of string, optional): labels"
+func writeSchemaFields(b *strings.Builder, schema map[string]interface{}, indent string) {
+	properties, _ := schema["properties"].(map[string]interface{})
+	required := stringList(schema["required"])
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prop, _ := properties[name].(map[string]interface{})
+		kind, nested := describeSchemaType(prop)
+		if !containsString(required, name) {
+			kind += ", optional"
+		}
+		fmt.Fprintf(b, "%s- %s (%s)", indent, name, kind)
+		if description, _ := prop["description"].(string); description != "" {
+			b.WriteString(": " + description)
+		}
+		b.WriteString("\n")
+		if nested != nil {
+			writeSchemaFields(b, nested, indent+"  ")
+		}
+	}
+}
+
+// describeSchemaType names the type of a field, returning the object schema
+// whose fields should be listed below it, if any
+func describeSchemaType(prop map[string]interface{}) (string, map[string]interface{}) {
+	if values, ok := prop["enum"].([]interface{}); ok {
+		quoted := make([]string, len(values))
+		for i, v := range values {
+			data, _ := json.Marshal(v)
+			quoted[i] = string(data)
+		}
+		return "one of " + strings.Join(quoted, ", "), nil
+	}
+	switch typeName, _ := prop["type"].(string); typeName {
+	case "":
+		return "any type", nil
+	case "object":
+		return "object", prop
+	case "array":
+		items, _ := prop["items"].(map[string]interface{})
+		itemType, nested := describeSchemaType(items)
+		if nested != nil {
+			return "list of objects", nested
+		}
+		return "list of " + itemType, nil
+	default:
+		return typeName, nil
+	}
+}
+
+// extractJSONText strips what models commonly wrap JSON in when asked for it
+// through instructions: markdown code fences, a preamble such as "Here is
+// the JSON:" and any commentary after the value. Text without a JSON value
+// is returned unchanged so validation reports it.
+func extractJSONText(text string) string {
+	if m := codeFenceRe.FindStringSubmatch(text); m != nil {
+		text = m[1]
+	}
+	text = strings.TrimSpace(text)
+	start := strings.IndexAny(text, "{[")
+	if start == -1 {
+		return text
+	}
+	dec := json.NewDecoder(strings.NewReader(text[start:]))
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return text
+	}
+	if start > 0 {
+		log(fmt.Sprintf("Stripped preamble: %s", strings.TrimSpace(text[:start])))
+	}
+	return text[start : start+int(dec.InputOffset())]
+}
+
+// cleanupEnabled reports whether output.cleanup allows extractJSONText; it
+// is on unless set to false
+func cleanupEnabled(outputConfig map[string]interface{}) bool {
+	v, ok := outputConfig["cleanup"].(bool)
+	return !ok || v
+}
+
+// defaultMaxRetries is how many times invalid structured output is sent
+// back to the model for repair unless output.maxRetries says otherwise
+const defaultMaxRetries = 1
+
+// retrySetting reads output.maxRetries
+func retrySetting(outputConfig map[string]interface{}) (int, error) {
+	v, ok := outputConfig["maxRetries"]
+	if !ok {
+		return defaultMaxRetries, nil
+	}
+	n, ok := v.(int)
+	if !ok || n < 0 {
+		return 0, fmt.Errorf("output.maxRetries must be a non-negative integer, got %v", v)
+	}
+	return n, nil
+}
+
+// repairPrompt asks the model to correct output that failed validation
+func repairPrompt(problems []string) string {
+	return "Your response did not match the required output schema:\n\n- " +
+		strings.Join(problems, "\n- ") +
+		"\n\nRespond again with only the corrected JSON."
+}
+
+// applyInputSchema fills in input.default values for missing variables and
+// checks the variables against input.schema, listing every missing required
+// input at once
+func applyInputSchema(variables map[string]interface{}, inputConfig map[string]interface{}) error {
+	if defaults, ok := inputConfig["default"].(map[string]interface{}); ok {
+		for key, value := range defaults {
+			if _, set := variables[key]; !set {
+				variables[key] = value
+			}
+		}
+	}
+	schema, _ := inputConfig["schema"].(map[string]interface{})
+	if len(schema) == 0 {
+		return nil
+	}
+	jsonSchema := picoschemaObject(schema)
+	properties, _ := jsonSchema["properties"].(map[string]interface{})
+
+	var missing []string
+	for _, key := range stringList(jsonSchema["required"]) {
+		if _, ok := variables[key]; ok {
+			continue
+		}
+		if description, _ := properties[key].(map[string]interface{})["description"].(string); description != "" {
+			key += " (" + description + ")"
+		}
+		missing = append(missing, key)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required input:\n  %s", strings.Join(missing, "\n  "))
+	}
+	if problems := validateSchema(variables, jsonSchema, "input"); len(problems) > 0 {
+		return fmt.Errorf("input does not match the input schema:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// validateStructuredOutput parses a model's text response as JSON and checks
+// it against the output schema, returning the errors found
+func validateStructuredOutput(text string, schema map[string]interface{}) (interface{}, []string) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(text)), &value); err != nil {
+		return nil, []string{fmt.Sprintf("response is not valid JSON: %v", err)}
+	}
+	return value, validateSchema(value, outputJSONSchema(schema), "$")
+}
+
+// validateSchema checks value against the subset of JSON schema that
+// runprompt generates: type, properties, required, items and enum
+func validateSchema(value interface{}, schema map[string]interface{}, path string) []string {
+	var errs []string
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if fmt.Sprintf("%v", allowed) == fmt.Sprintf("%v", value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: %v is not one of %v", path, value, enum))
+		}
+	}
+
+	typeName, _ := schema["type"].(string)
+	switch typeName {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected object, got %s", path, jsonTypeName(value)))
+		}
+		for _, key := range stringList(schema["required"]) {
+			if _, ok := obj[key]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required field %q", path, key))
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if prop, ok := properties[key].(map[string]interface{}); ok {
+				errs = append(errs, validateSchema(obj[key], prop, path+"."+key)...)
+			}
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected array, got %s", path, jsonTypeName(value)))
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range arr {
+				errs = append(errs, validateSchema(item, items, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case "string", "number", "integer", "boolean", "null":
+		if !matchesJSONType(value, typeName) {
+			errs = append(errs, fmt.Sprintf("%s: expected %s, got %s", path, typeName, jsonTypeName(value)))
+		}
+	}
+	return errs
+}
+
+// matchesJSONType reports whether a decoded JSON value has the given type
+func matchesJSONType(value interface{}, typeName string) bool {
+	switch typeName {
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == float64(int64(f))
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	}
+	return jsonTypeName(value) == typeName
+}
+
+// jsonTypeName names the JSON type of a decoded value
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64, int:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// stringList converts a []string or []interface{} of strings to []string
+func stringList(v interface{}) []string {
+	switch l := v.(type) {
+	case []string:
+		return l
+	case []interface{}:
+		out := make([]string, 0, len(l))
+		for _, item := range l {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateStructuredOutput(t *testing.T) {
+	schema := map[string]interface{}{
+		"name":  "string, the name",
+		"age?":  "number, the age",
+		"admin": "boolean",
+	}
+	tests := []struct {
+		name   string
+		text   string
+		errors []string
+	}{
+		{"valid", `{"name": "Ann", "age": 30, "admin": false}`, nil},
+		{"optional missing", ` {"name": "Ann", "admin": true} `, nil},
+		{"missing required", `{"name": "Ann"}`, []string{`$: missing required field "admin"`}},
+		{"wrong type", `{"name": 5, "admin": true}`, []string{"$.name: expected string, got number"}},
+		{"not json", `Sure! {"name": "Ann"}`, []string{"response is not valid JSON"}},
+		{"not object", `[1, 2]`, []string{"$: expected object, got array"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, errs := validateStructuredOutput(tc.text, schema)
+			if len(errs) != len(tc.errors) {
+				t.Fatalf("Expected %d errors, got %v", len(tc.errors), errs)
+			}
+			for i, e := range errs {
+				if !strings.HasPrefix(e, tc.errors[i]) {
+					t.Errorf("Expected error starting %q, got %q", tc.errors[i], e)
+				}
+			}
+		})
+	}
+}
+
+func TestUsesTools(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		output   map[string]interface{}
+		expected bool
+	}{
+		{"openai", "openai", nil, true},
+		{"custom", "custom", nil, false},
+		{"forced on", "custom", map[string]interface{}{"useTools": true}, true},
+		{"forced off", "anthropic", map[string]interface{}{"useTools": false}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := usesTools(tc.provider, tc.output); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSchemaInstructions(t *testing.T) {
+	text := schemaInstructions(map[string]interface{}{"name": "string"})
+	if !strings.Contains(text, "Respond only with a JSON object") || !strings.Contains(text, `"required": [`) {
+		t.Errorf("Unexpected instructions: %q", text)
+	}
+}
+
+func TestDescribeSchema(t *testing.T) {
+	schema := picoschemaObject(map[string]interface{}{
+		"name":                "string, full name",
+		"age?":                "integer",
+		"tags(array, labels)": "string",
+		"status(enum)":        []interface{}{"open", "closed"},
+		"extra":               "any",
+		"address(object)":     map[string]interface{}{"city": "string", "zip?": "string"},
+		"items(array)":        map[string]interface{}{"sku": "string"},
+	})
+	expected := `Respond with a JSON object with these fields:
+- address (object)
+  - city (string)
+  - zip (string, optional)
+- age (integer, optional)
+- extra (any type)
+- items (list of objects)
+  - sku (string)
+- name (string): full name
+- status (one of "open", "closed")
+- tags (list of string): labels`
+	if got := describeSchema("output", schema); got != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, got)
+	}
+	input := describeSchema("input", picoschemaObject(map[string]interface{}{"text": "string"}))
+	if input != "The input is a JSON object with these fields:\n- text (string)" {
+		t.Errorf("Unexpected input description: %q", input)
+	}
+}
+
+func TestPicoschema(t *testing.T) {
+	schema := parseYAML(`name: string, the name
+tags?(array, labels): string
+scores(array): integer, a score
+items(array):
+  sku: string
+  qty?: integer
+address(object, where they live):
+  city: string
+status(enum, current state): [open, closed]
+meta?: any`)
+
+	got := picoschemaObject(schema)
+	data, _ := json.Marshal(got)
+	expected := `{"properties":{` +
+		`"address":{"description":"where they live","properties":{"city":{"type":"string"}},"required":["city"],"type":"object"},` +
+		`"items":{"items":{"properties":{"qty":{"type":"integer"},"sku":{"type":"string"}},"required":["sku"],"type":"object"},"type":"array"},` +
+		`"meta":{},` +
+		`"name":{"description":"the name","type":"string"},` +
+		`"scores":{"description":"a score","items":{"type":"integer"},"type":"array"},` +
+		`"status":{"description":"current state","enum":["open","closed"]},` +
+		`"tags":{"description":"labels","items":{"type":"string"},"type":"array"}},` +
+		`"required":["address","items","name","scores","status"],"type":"object"}`
+	if string(data) != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, data)
+	}
+}
+
+func TestPicoschemaValidation(t *testing.T) {
+	schema := parseYAML(`items(array):
+  sku: string
+status(enum): [open, closed]`)
+	_, errs := validateStructuredOutput(`{"items": [{"sku": 1}], "status": "pending"}`, schema)
+	expected := []string{"$.items[0].sku: expected string, got number", "$.status: pending is not one of [open closed]"}
+	if strings.Join(errs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected %v, got %v", expected, errs)
+	}
+}
+
+func TestExtractJSONText(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"plain", `{"a": 1}`, `{"a": 1}`},
+		{"fenced", "```json\n{\"a\": 1}\n```", `{"a": 1}`},
+		{"preamble", `Here is the JSON: {"a": "b}"} Hope this helps!`, `{"a": "b}"}`},
+		{"fenced with preamble", "Sure!\n\n```\n[1, 2]\n```\n", `[1, 2]`},
+		{"no json", "I can't help with that.", "I can't help with that."},
+		{"broken json", `Result: {"a": `, `Result: {"a":`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := extractJSONText(tc.input); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestCheckPicoschema(t *testing.T) {
+	schema := map[string]interface{}{
+		"name":               "string, full name",
+		"age?":               "integer",
+		"tags(array)":        "strng",
+		"status(enum)":       "open",
+		"address(object)":    map[string]interface{}{"city": "text"},
+		"items(array)":       map[string]interface{}{"id": "number"},
+		"meta(map)":          "string",
+		"count":              5,
+		"extra?(object)":     "string",
+		"choice(enum, pick)": []interface{}{"a", "b"},
+	}
+	var got []string
+	for _, p := range checkPicoschema(schema, "") {
+		got = append(got, p.field)
+	}
+	expected := []string{"address(object).city", "count", "extra?(object)", "meta(map)", "status(enum)", "tags(array)"}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected problems in %v, got %v", expected, got)
+	}
+}
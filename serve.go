@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultServeAddr is where runprompt serve listens unless --addr is given
+const defaultServeAddr = "localhost:8080"
+
+// maxServeBody bounds the input accepted by a serve request
+const maxServeBody = 10 << 20
+
+// serveOverrideKeys are the settings a request may override with query
+// parameters. Anything else could have the server run commands, write
+// files or send its API keys to another host, so it is refused.
+var serveOverrideKeys = append([]string{"variant", "locale", "model", "config"}, generationKeys...)
+
+// serveCommand implements runprompt serve
+func serveCommand(ctx context.Context, args []string) error {
+	flags, positional, err := parseFlags("serve", args, map[string]bool{"addr": true, "proxy": true})
+	if err != nil {
+		return err
+	}
+	if len(positional) > 1 {
+		return commandUsage("serve")
+	}
+	dir := "."
+	if len(positional) == 1 {
+		dir = positional[0]
+	}
+	dir, err = resolveBundle(dir)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	addr := flags["addr"]
+	if addr == "" {
+		addr = defaultServeAddr
+	}
+	if proxy, ok := flags["proxy"]; ok {
+		// Requests share the client, so the proxy is set for the server
+		// rather than by each prompt
+		if httpClient, err = proxyClient(parseYAMLValue(proxy)); err != nil {
+			return err
+		}
+	}
+
+	server := &http.Server{Addr: addr, Handler: newPromptServer(dir)}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+	fmt.Fprintf(os.Stderr, "Serving prompts from %s on http://%s\n", dir, addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// promptServer runs the prompts in a directory over HTTP:
+//
+//	GET  /prompts          lists prompt names
+//	POST /prompts/<name>   runs <dir>/<name>.prompt
+//
+// A POST body is the prompt's input, as stdin is for run. Query parameters
+// override metadata like --key=value does, and ?name= selects a prompt from
+// a multi-prompt file. A request that accepts text/event-stream gets the
+// reply as server-sent events as it arrives. Prompts are parsed once and
+// cached until they change.
+type promptServer struct {
+	dir   string
+	cache *promptCache
+}
+
+func newPromptServer(dir string) *promptServer {
+	return &promptServer{dir: dir, cache: newPromptCache()}
+}
+
+func (s *promptServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/prompts" {
+		if r.Method != http.MethodGet {
+			writeServeError(w, http.StatusMethodNotAllowed, "use GET to list prompts")
+			return
+		}
+		names, err := s.list()
+		if err != nil {
+			writeServeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeServeJSON(w, http.StatusOK, names)
+		return
+	}
+	name, ok := strings.CutPrefix(r.URL.Path, "/prompts/")
+	if !ok || name == "" {
+		writeServeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeServeError(w, http.StatusMethodNotAllowed, "use POST to run a prompt")
+		return
+	}
+	s.runPrompt(w, r, name)
+}
+
+// list returns the names of the prompts under the directory
+func (s *promptServer) list() ([]string, error) {
+	names := []string{}
+	err := filepath.WalkDir(s.dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.IsDir() && d.Name() == partialsDir {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".prompt") {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(strings.TrimSuffix(rel, ".prompt")))
+		return nil
+	})
+	return names, err
+}
+
+// promptPath maps a request name to a prompt file inside the directory
+func (s *promptServer) promptPath(name string) (string, bool) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	for _, part := range strings.Split(clean, string(filepath.Separator)) {
+		if part == partialsDir {
+			// Partials are only run as part of a prompt
+			return "", false
+		}
+	}
+	return filepath.Join(s.dir, clean+".prompt"), true
+}
+
+func (s *promptServer) runPrompt(w http.ResponseWriter, r *http.Request, name string) {
+	path, ok := s.promptPath(name)
+	if !ok {
+		writeServeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	query := r.URL.Query()
+	overrides := map[string]interface{}{}
+	for k := range query {
+		if k == "name" {
+			continue
+		}
+		if !containsString(serveOverrideKeys, k) {
+			writeServeError(w, http.StatusBadRequest, fmt.Sprintf("%s can't be set by a request", k))
+			return
+		}
+		overrides[k] = parseYAMLValue(query.Get(k))
+	}
+	key := localizedPath(path, requestedLocale(overrides))
+	if section := query.Get("name"); section != "" {
+		key += "#" + section
+	}
+	prompt, err := s.cache.Get(key)
+	if os.IsNotExist(err) {
+		writeServeError(w, http.StatusNotFound, fmt.Sprintf("no prompt %s", name))
+		return
+	}
+	if err != nil {
+		writeServeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	meta, template, variant, err := resolvePrompt(copyMeta(prompt.Meta), prompt.Template, overrides, nil)
+	if err != nil {
+		writeServeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Requests share the server's connection pool, set with --proxy
+	delete(meta, "proxy")
+	if err := checkRequiredEnv(meta); err != nil {
+		// The server, not the request, is missing something
+		writeServeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	provider, model, err := resolveModel(meta)
+	if err != nil {
+		writeServeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxServeBody))
+	if err != nil {
+		writeServeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+
+	parts := prompt.Messages
+	if template != prompt.Template {
+		// The variant replaced the template
+		parts = compileMessages(template)
+	}
+	variables, err := inputVariables(strings.TrimSpace(string(body)), meta)
+	if err != nil {
+		writeServeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	messages, err := renderPromptMessages(parts, variables, meta)
+	if err != nil {
+		writeServeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	run := promptRun{
+		path:     key,
+		meta:     meta,
+		variant:  variant,
+		provider: provider,
+		model:    model,
+		messages: messages,
+	}
+	var events *sseWriter
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		events = &sseWriter{w: w}
+		run.stream, run.out = true, events
+	}
+	c, err := complete(r.Context(), run)
+	if err != nil && events != nil && events.started {
+		events.event("error", map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		writeServeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	response := summarize(run, c)
+	if events != nil {
+		events.event("done", response)
+		return
+	}
+	writeServeJSON(w, http.StatusOK, response)
+}
+
+func writeServeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeServeError(w http.ResponseWriter, status int, message string) {
+	writeServeJSON(w, status, map[string]string{"error": message})
+}
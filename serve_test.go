@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPromptServer(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	prompt := "---\nmodel: test\noutput:\n  schema:\n    name: string\n---\nExtract {{input}}"
+	os.WriteFile(filepath.Join(dir, "sub", "extract.prompt"), []byte(prompt), 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "extract.prompt.test-response"),
+		[]byte(`{"choices":[{"message":{"content":"{\"name\": \"Ann\"}"}}]}`), 0644)
+
+	server := httptest.NewServer(newPromptServer(dir))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/prompts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	json.NewDecoder(resp.Body).Decode(&names)
+	resp.Body.Close()
+	if len(names) != 1 || names[0] != "sub/extract" {
+		t.Errorf("Expected [sub/extract], got %v", names)
+	}
+
+	resp, err = http.Post(server.URL+"/prompts/sub/extract", "text/plain", strings.NewReader("Ann is here"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result runSummary
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	output, _ := result.Output.(map[string]interface{})
+	if output["name"] != "Ann" || result.Model != "test" {
+		t.Errorf("Unexpected response: %+v", result)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"POST", "/prompts/missing", http.StatusNotFound},
+		{"POST", "/prompts/..%2f..%2fetc/passwd", http.StatusNotFound},
+		{"GET", "/prompts/sub/extract", http.StatusMethodNotAllowed},
+		{"POST", "/prompts/sub/extract?variant=b", http.StatusBadRequest},
+		{"POST", "/prompts/sub/extract?temperature=0", http.StatusOK},
+		{"GET", "/other", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, server.URL+tt.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.status, resp.StatusCode)
+		}
+	}
+
+	// Settings that run commands, write files or send requests elsewhere
+	// can't come from a request
+	marker := filepath.Join(t.TempDir(), "ran")
+	for _, query := range []string{
+		"mcpServers={x: {command: 'touch " + marker + "'}}",
+		"tools=[{name: pwn, command: 'touch " + marker + "'}]",
+		"onModelChange=touch " + marker,
+		"output={files: {out: '" + marker + "'}}",
+		"output.files=" + marker,
+		"baseURL=http://example.com",
+		"proxy=http://example.com:3128",
+		"headers={X-Test: 1}",
+	} {
+		key, value, _ := strings.Cut(query, "=")
+		resp, err := http.Post(server.URL+"/prompts/sub/extract?"+key+"="+url.QueryEscape(value), "text/plain", strings.NewReader("Ann"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("?%s: expected 400, got %d", key, resp.StatusCode)
+		}
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("Expected no command to run or file to be written")
+	}
+}
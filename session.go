@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// sessionMessage is a message as a session file stores it, with the time
+// it was added. The time is kept out of Message so it is never sent.
+type sessionMessage struct {
+	Message
+	Time *time.Time `json:"time,omitempty"`
+}
+
+// sessionNameRe restricts session names to safe file names
+var sessionNameRe = regexp.MustCompile(`^[\w.-]+$`)
+
+// sessionPath returns the file holding a named session's messages
+func sessionPath(name string) (string, error) {
+	if !sessionNameRe.MatchString(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid session name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	return filepath.Join(dataDir(), "sessions", name+".json"), nil
+}
+
+// loadSession returns a session's stored messages; a new session has none
+func loadSession(name string) ([]Message, error) {
+	path, err := sessionPath(name)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := readSessionFile(path)
+	if err != nil {
+		return nil, err
+	}
+	log(fmt.Sprintf("Loaded %d messages from session %s", len(messages), name))
+	return messages, nil
+}
+
+func readSessionFile(path string) ([]Message, error) {
+	entries, err := readSessionEntries(path)
+	messages := make([]Message, len(entries))
+	for i, e := range entries {
+		messages[i] = e.Message
+	}
+	return messages, err
+}
+
+// readSessionEntries reads a session file with the times of its messages
+func readSessionEntries(path string) ([]sessionMessage, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []sessionMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return entries, nil
+}
+
+// appendSession adds a turn's messages to a session. The file is locked and
+// re-read first, so turns from runs sharing the session are all kept; if
+// another run started the session meanwhile, this turn's system messages
+// are dropped as they already open the stored history.
+func appendSession(name string, turn []Message) error {
+	path, err := sessionPath(name)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	stored, err := readSessionEntries(path)
+	if err != nil {
+		return err
+	}
+	history := make([]Message, len(stored))
+	for i, e := range stored {
+		history[i] = e.Message
+	}
+	now := time.Now().UTC()
+	for _, m := range withSession(history, turn)[len(stored):] {
+		stored = append(stored, sessionMessage{Message: m, Time: &now})
+	}
+	data, _ := json.MarshalIndent(stored, "", "  ")
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return err
+	}
+	log(fmt.Sprintf("Saved session %s to %s", name, path))
+	return nil
+}
+
+// writeSession stores messages as a new session, replacing an existing one
+// only if force is set
+func writeSession(name string, messages []Message, force bool) error {
+	path, err := sessionPath(name)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := os.Stat(path); err == nil && !force {
+		return fmt.Errorf("session %s already exists (use --force to replace it)", name)
+	}
+	data, _ := json.MarshalIndent(messages, "", "  ")
+	return writeFileAtomic(path, data, 0600)
+}
+
+// resetSession deletes a session's stored messages
+func resetSession(name string) error {
+	path, err := sessionPath(name)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// withSession prepends a session's earlier messages to the rendered ones.
+// The template's system messages are only sent on the first turn, since the
+// stored history already begins with them.
+func withSession(history, rendered []Message) []Message {
+	if len(history) == 0 {
+		return rendered
+	}
+	messages := append([]Message(nil), history...)
+	for _, m := range rendered {
+		if m.Role != "system" {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
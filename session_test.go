@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSessionRoundTrip(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+
+	messages, err := loadSession("work")
+	if err != nil || len(messages) != 0 {
+		t.Fatalf("Expected empty new session, got %v, %v", messages, err)
+	}
+	stored := []Message{
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello"},
+	}
+	if err := appendSession("work", stored); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	messages, err = loadSession("work")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(messages) != 2 || !reflect.DeepEqual(messages[1], stored[1]) {
+		t.Errorf("Expected %v, got %v", stored, messages)
+	}
+
+	if err := resetSession("work"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if messages, _ := loadSession("work"); len(messages) != 0 {
+		t.Errorf("Expected reset session to be empty, got %v", messages)
+	}
+}
+
+func TestAppendSessionConcurrent(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			turn := []Message{
+				{Role: "system", Content: "Be brief."},
+				{Role: "user", Content: fmt.Sprintf("Question %d", i)},
+			}
+			if err := appendSession("shared", turn); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	messages, err := loadSession("shared")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(messages) != 11 || messages[0].Role != "system" {
+		t.Errorf("Expected one system message and 10 questions, got %v", messages)
+	}
+}
+
+func TestSessionPathInvalid(t *testing.T) {
+	for _, name := range []string{"", "..", "a/b", "../etc"} {
+		if _, err := sessionPath(name); err == nil {
+			t.Errorf("Expected error for %q", name)
+		}
+	}
+}
+
+func TestWithSession(t *testing.T) {
+	history := []Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello"},
+	}
+	rendered := []Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "And again"},
+	}
+	messages := withSession(history, rendered)
+	if len(messages) != 4 || messages[3].Content != "And again" {
+		t.Errorf("Unexpected messages: %v", messages)
+	}
+	if messages := withSession(nil, rendered); len(messages) != 2 {
+		t.Errorf("Expected rendered messages on first turn, got %v", messages)
+	}
+}
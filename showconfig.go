@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// configTrace records where each setting of a prompt's effective
+// configuration came from, for --show-config. Each stage of resolving the
+// configuration is compared with the one before, and the settings it
+// changed are credited to it. A nil trace records nothing.
+type configTrace struct {
+	sources map[string]string // dotted key path to the source that last set it
+	values  map[string]string // dotted key path to its value, as JSON
+}
+
+func newConfigTrace() *configTrace {
+	return &configTrace{sources: map[string]string{}, values: map[string]string{}}
+}
+
+// stage credits the settings changed since the last stage to source
+func (t *configTrace) stage(meta map[string]interface{}, source string) {
+	t.stageFunc(meta, func(string) string { return source })
+}
+
+// stageFunc is stage with a source named after each setting's top-level
+// key, such as the environment variable that set it
+func (t *configTrace) stageFunc(meta map[string]interface{}, source func(key string) string) {
+	if t == nil {
+		return
+	}
+	values := map[string]string{}
+	flattenSettings(meta, "", values)
+	for path, v := range values {
+		if old, ok := t.values[path]; !ok || old != v {
+			key, _, _ := strings.Cut(path, ".")
+			t.sources[path] = source(key)
+		}
+	}
+	for path := range t.sources {
+		if _, ok := values[path]; !ok {
+			delete(t.sources, path)
+		}
+	}
+	t.values = values
+}
+
+// flattenSettings writes each leaf of a settings map, encoded as JSON,
+// under its dotted key path
+func flattenSettings(m map[string]interface{}, prefix string, out map[string]string) {
+	for k, v := range m {
+		if nested, ok := v.(map[string]interface{}); ok && len(nested) > 0 {
+			flattenSettings(nested, prefix+k+".", out)
+			continue
+		}
+		data, _ := json.Marshal(v)
+		out[prefix+k] = string(data)
+	}
+}
+
+// write prints the settings, one per line with the source that set it
+func (t *configTrace) write(w io.Writer) {
+	paths := make([]string, 0, len(t.values))
+	shown := make(map[string]string, len(t.values))
+	width := 0
+	for path, v := range t.values {
+		paths = append(paths, path)
+		shown[path] = shownValue(path, v)
+		width = max(width, min(len(path)+2+len(shown[path]), 60))
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintf(w, "%-*s  # %s\n", width, path+": "+shown[path], t.sources[path])
+	}
+}
+
+// shownValue is a setting's value as --show-config prints it, with
+// credentials hidden: keys such as api_key, anything under headers, and the
+// same within lists such as output.sink
+func shownValue(path, value string) string {
+	var v interface{}
+	if err := json.Unmarshal([]byte(value), &v); err != nil {
+		return value
+	}
+	data, _ := json.Marshal(redactSettings(strings.Split(path, "."), v))
+	return string(data)
+}
+
+func redactSettings(keys []string, v interface{}) interface{} {
+	for _, key := range keys {
+		if key == "headers" || secretSetting(key) {
+			return "[REDACTED]"
+		}
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = redactSettings([]string{k}, item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactSettings(nil, item)
+		}
+	}
+	return v
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigTrace(t *testing.T) {
+	trace := newConfigTrace()
+	meta := map[string]interface{}{
+		"model":  "openai/gpt-4o",
+		"config": map[string]interface{}{"temperature": 0.2, "maxTokens": 100},
+		"stop":   []interface{}{"END"},
+	}
+	trace.stage(meta, "a.prompt")
+	meta["config"].(map[string]interface{})["temperature"] = 0.0
+	trace.stage(meta, "variant cold")
+	meta["model"] = "anthropic/claude"
+	delete(meta, "stop")
+	trace.stageFunc(meta, func(key string) string { return "--" + key })
+
+	var buf bytes.Buffer
+	trace.write(&buf)
+	expected := `config.maxTokens: 100      # a.prompt
+config.temperature: 0      # variant cold
+model: "anthropic/claude"  # --model
+`
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+
+	var none *configTrace
+	none.stage(meta, "ignored")
+}
+
+func TestShowConfig(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "xdg"))
+	t.Setenv("RUNPROMPT_MODEL", "anthropic/claude")
+	t.Setenv("RUNPROMPT_ENV", "prod")
+	writeFiles(t, dir,
+		"a.prompt", "---\nmodel: openai/gpt-4o\nconfig:\n  temperature: 0.2\nwhen:\n  prod:\n    timeout: 30\n---\nHi\n",
+		projectConfigName, "config:\n  maxTokens: 500\n",
+	)
+
+	trace := newConfigTrace()
+	if _, _, _, err := tracePrompt(filepath.Join(dir, "a.prompt"), map[string]interface{}{"stream": true}, trace); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]string{
+		"config.temperature": "a.prompt",
+		"timeout":            "when: prod",
+		"config.maxTokens":   projectConfigName,
+		"model":              "$RUNPROMPT_MODEL",
+		"env":                "$RUNPROMPT_ENV",
+		"stream":             "--stream",
+	}
+	for path, source := range expected {
+		if got := filepath.Base(trace.sources[path]); got != filepath.Base(source) {
+			t.Errorf("Expected %s from %q, got %q", path, source, trace.sources[path])
+		}
+	}
+	if len(trace.values) != len(expected) {
+		t.Errorf("Expected %d settings, got %v", len(expected), trace.values)
+	}
+}
+
+func TestShowConfigHidesSecrets(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "xdg"))
+	t.Setenv("RUNPROMPT_API_KEY", "sk-secret-env")
+	t.Setenv("RUNPROMPT_ACCESS_TOKEN", "secret-token")
+	writeFiles(t, dir,
+		"a.prompt", "---\nmodel: custom/x\nconfig:\n  maxOutputTokens: 100\n---\nHi\n",
+		projectConfigName, `api_key: sk-secret-file
+mcpServers:
+  search:
+    url: http://localhost/sse
+    headers:
+      Authorization: Bearer secret-header
+output:
+  sink:
+    - type: http
+      url: http://localhost/hook
+      headers: {X-Auth: secret-sink}
+`,
+	)
+
+	trace := newConfigTrace()
+	if _, _, _, err := tracePrompt(filepath.Join(dir, "a.prompt"), map[string]interface{}{}, trace); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var buf bytes.Buffer
+	trace.write(&buf)
+	if strings.Contains(buf.String(), "secret") {
+		t.Errorf("Expected credentials to be hidden, got:\n%s", buf.String())
+	}
+	for _, want := range []string{`api_key: "[REDACTED]"`, `mcpServers.search.headers.Authorization: "[REDACTED]"`, `config.maxOutputTokens: 100`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected %q in:\n%s", want, buf.String())
+		}
+	}
+	if _, ok := trace.values["api_key"]; !ok {
+		t.Errorf("Expected the config file's api_key to be listed, got %v", trace.values)
+	}
+	if _, ok := trace.values["access_token"]; ok {
+		t.Error("Expected $RUNPROMPT_ACCESS_TOKEN not to become a setting")
+	}
+}
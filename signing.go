@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signing HMAC-signs request bodies for gateways that require signed
+// requests. It is set per provider in providers.yaml, or in a prompt's
+// signing: block, which takes precedence:
+//
+//	signing:
+//	  secretEnv: GATEWAY_SECRET     # or secretFile: path/to/secret
+//	  header: X-Signature           # default X-Signature
+//	  algorithm: sha256             # sha256 (default) or sha512
+//	  encoding: hex                 # hex (default) or base64
+//	  prefix: "sha256="             # prepended to the signature
+//	  timestampHeader: X-Timestamp  # also sign "<unix time>.<body>"
+//
+// signing: false turns off a provider's signing for one prompt.
+type Signing struct {
+	SecretEnv       string
+	SecretFile      string
+	Header          string
+	Algorithm       string
+	Encoding        string
+	Prefix          string
+	TimestampHeader string
+}
+
+// parseSigning reads a signing: block. The secret is only read when a
+// request is signed, so prompts can be checked without it.
+func parseSigning(v interface{}) (*Signing, error) {
+	if enabled, ok := v.(bool); ok && !enabled {
+		return nil, nil
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("signing must be a mapping or false")
+	}
+	s := &Signing{Header: "X-Signature", Algorithm: "sha256", Encoding: "hex"}
+	for key, value := range fields {
+		str := fmt.Sprintf("%v", value)
+		switch key {
+		case "secretEnv":
+			s.SecretEnv = str
+		case "secretFile":
+			s.SecretFile = str
+		case "header":
+			s.Header = str
+		case "algorithm":
+			s.Algorithm = str
+		case "encoding":
+			s.Encoding = str
+		case "prefix":
+			s.Prefix = str
+		case "timestampHeader":
+			s.TimestampHeader = str
+		default:
+			return nil, fmt.Errorf("unknown field signing.%s", key)
+		}
+	}
+	if (s.SecretEnv == "") == (s.SecretFile == "") {
+		return nil, fmt.Errorf("signing needs one of secretEnv or secretFile")
+	}
+	if s.hash() == nil {
+		return nil, fmt.Errorf("signing.algorithm must be sha256 or sha512, got %q", s.Algorithm)
+	}
+	if s.Encoding != "hex" && s.Encoding != "base64" {
+		return nil, fmt.Errorf("signing.encoding must be hex or base64, got %q", s.Encoding)
+	}
+	return s, nil
+}
+
+func (s *Signing) hash() func() hash.Hash {
+	switch s.Algorithm {
+	case "sha256":
+		return sha256.New
+	case "sha512":
+		return sha512.New
+	}
+	return nil
+}
+
+// secret reads the signing key from its environment variable or file
+func (s *Signing) secret() ([]byte, error) {
+	if s.SecretEnv != "" {
+		secret := os.Getenv(s.SecretEnv)
+		if secret == "" {
+			return nil, fmt.Errorf("signing: %s environment variable not set", s.SecretEnv)
+		}
+		return []byte(secret), nil
+	}
+	data, err := os.ReadFile(s.SecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("signing: %v", err)
+	}
+	return []byte(strings.TrimSpace(string(data))), nil
+}
+
+// Sign sets the signature header, and the timestamp header if configured,
+// for a request body
+func (s *Signing) Sign(header http.Header, body []byte, now time.Time) error {
+	secret, err := s.secret()
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(s.hash(), secret)
+	if s.TimestampHeader != "" {
+		ts := strconv.FormatInt(now.Unix(), 10)
+		header.Set(s.TimestampHeader, ts)
+		mac.Write([]byte(ts + "."))
+	}
+	mac.Write(body)
+	sum := mac.Sum(nil)
+	signature := hex.EncodeToString(sum)
+	if s.Encoding == "base64" {
+		signature = base64.StdEncoding.EncodeToString(sum)
+	}
+	header.Set(s.Header, s.Prefix+signature)
+	return nil
+}
+
+// signingFor returns the signing settings for a request: the prompt's
+// signing: block if it has one, otherwise the provider's
+func signingFor(meta map[string]interface{}, provider string) (*Signing, error) {
+	if v, ok := meta["signing"]; ok {
+		return parseSigning(v)
+	}
+	return providers[provider].Signing, nil
+}
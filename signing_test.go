@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	t.Setenv("GATEWAY_SECRET", "k3y")
+	body := []byte(`{"a":1}`)
+
+	s, err := parseSigning(map[string]interface{}{"secretEnv": "GATEWAY_SECRET"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	header := http.Header{}
+	if err := s.Sign(header, body, time.Now()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "32db719f172c48e89dbfa56ed20d9e19cdbfdbe9f652ccdf5fa03494d2444853"
+	if got := header.Get("X-Signature"); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secretFile, []byte("k3y\n"), 0600)
+	s, err = parseSigning(map[string]interface{}{
+		"secretFile":      secretFile,
+		"header":          "X-Gateway-Signature",
+		"algorithm":       "sha512",
+		"encoding":        "base64",
+		"prefix":          "v1=",
+		"timestampHeader": "X-Gateway-Timestamp",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	header = http.Header{}
+	if err := s.Sign(header, body, time.Unix(1700000000, 0)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected = "v1=ZyvMHgKiO9Stqng5QQvyDjH7KPvurxav8YU6JLMU8BdcbT9NIuQ/bQvPSoz9MRnxZ+RWAOVr8J6DxbZsDUkgMQ=="
+	if got := header.Get("X-Gateway-Signature"); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	if got := header.Get("X-Gateway-Timestamp"); got != "1700000000" {
+		t.Errorf("Expected timestamp header, got %q", got)
+	}
+
+	t.Setenv("GATEWAY_SECRET", "")
+	s, _ = parseSigning(map[string]interface{}{"secretEnv": "GATEWAY_SECRET"})
+	if err := s.Sign(http.Header{}, body, time.Now()); err == nil {
+		t.Error("Expected error when the secret is not set")
+	}
+}
+
+func TestParseSigningErrors(t *testing.T) {
+	for _, v := range []interface{}{
+		"yes",
+		map[string]interface{}{},
+		map[string]interface{}{"secretEnv": "A", "secretFile": "b"},
+		map[string]interface{}{"secretEnv": "A", "algorithm": "md5"},
+		map[string]interface{}{"secretEnv": "A", "encoding": "base32"},
+		map[string]interface{}{"secretEnv": "A", "heder": "X"},
+	} {
+		if _, err := parseSigning(v); err == nil {
+			t.Errorf("Expected error for %v", v)
+		}
+	}
+	if s, err := parseSigning(false); s != nil || err != nil {
+		t.Errorf("Expected signing: false to disable signing, got %v, %v", s, err)
+	}
+}
+
+func TestSigningFor(t *testing.T) {
+	saved := providers["custom"]
+	defer func() { providers["custom"] = saved }()
+	p := providers["custom"]
+	p.Signing = &Signing{SecretEnv: "PROVIDER_SECRET", Header: "X-Provider"}
+	providers["custom"] = p
+
+	if s, _ := signingFor(map[string]interface{}{}, "custom"); s == nil || s.Header != "X-Provider" {
+		t.Errorf("Expected the provider's signing, got %+v", s)
+	}
+	meta := map[string]interface{}{"signing": map[string]interface{}{"secretEnv": "PROMPT_SECRET", "header": "X-Prompt"}}
+	if s, _ := signingFor(meta, "custom"); s == nil || s.Header != "X-Prompt" {
+		t.Errorf("Expected the prompt's signing, got %+v", s)
+	}
+	if s, _ := signingFor(map[string]interface{}{"signing": false}, "custom"); s != nil {
+		t.Errorf("Expected signing: false to override the provider, got %+v", s)
+	}
+}
+
+func TestMakeRequestSigned(t *testing.T) {
+	t.Setenv("GATEWAY_SECRET", "k3y")
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("X-Signature")
+		w.Write([]byte(`{"choices":[{"message":{"content":"ok"}}]}`))
+	}))
+	defer server.Close()
+
+	signing := &Signing{SecretEnv: "GATEWAY_SECRET", Header: "X-Signature", Algorithm: "sha256", Encoding: "hex"}
+	_, err := makeRequest(context.Background(), httpClient, server.URL, "", "model", nil, nil, nil, GenerationConfig{}, signing, nil, "custom", nil, Limits{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(signature) != 64 {
+		t.Errorf("Expected a hex SHA-256 signature, got %q", signature)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sink delivers a run's output somewhere besides stdout, so a prompt
+// describes where its results go and can be scheduled with a short command
+// line. Sinks are set by output.sink, a mapping or a list of them:
+//
+//	output:
+//	  sink:
+//	    - type: http                  # POST to a webhook
+//	      url: https://hooks.example.com/summaries
+//	      headers: {X-Source: runprompt}
+//	      headersEnv: {Authorization: HOOK_AUTH}  # values from the environment
+//	    - type: file
+//	      path: out/{{name}}.txt      # a template, like output.files paths
+//	      append: true
+//	    - type: s3
+//	      bucket: reports
+//	      key: summaries/{{name}}.json
+//	      format: json
+//
+// format is text, the run's result, or json, its runSummary as
+// --output json prints it. http sinks default to json and the others to
+// text.
+type sink struct {
+	Type       string
+	Format     string
+	URL        string // http
+	Method     string
+	Headers    map[string]string
+	HeadersEnv map[string]string
+	Path       string // file
+	Append     bool
+	Bucket     string // s3
+	Key        string
+	Region     string
+	Endpoint   string // an S3-compatible service instead of AWS
+}
+
+// sinkFields are the fields each type of sink takes, besides type and
+// format
+var sinkFields = map[string][]string{
+	"http": {"url", "method", "headers", "headersEnv"},
+	"file": {"path", "append"},
+	"s3":   {"bucket", "key", "region", "endpoint"},
+}
+
+// parseSinks reads output.sink
+func parseSinks(outputConfig map[string]interface{}) ([]*sink, error) {
+	v, ok := outputConfig["sink"]
+	if !ok {
+		return nil, nil
+	}
+	items, ok := v.([]interface{})
+	if !ok {
+		items = []interface{}{v}
+	}
+	var sinks []*sink
+	for i, item := range items {
+		key := "output.sink"
+		if len(items) > 1 {
+			key = fmt.Sprintf("output.sink[%d]", i)
+		}
+		s, err := parseSink(item, key)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+func parseSink(v interface{}, key string) (*sink, error) {
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a mapping with a type", key)
+	}
+	s := &sink{}
+	s.Type, _ = fields["type"].(string)
+	known, ok := sinkFields[s.Type]
+	if !ok {
+		return nil, fmt.Errorf("%s.type must be http, file or s3, got %v", key, fields["type"])
+	}
+	s.Format = "text"
+	if s.Type == "http" {
+		s.Format = "json"
+	}
+	for name, value := range fields {
+		str := fmt.Sprintf("%v", value)
+		switch {
+		case name == "type":
+		case name == "format":
+			if str != "text" && str != "json" {
+				return nil, fmt.Errorf("%s.format must be text or json, got %q", key, str)
+			}
+			s.Format = str
+		case !containsString(known, name):
+			return nil, fmt.Errorf("unknown field %s.%s for a %s sink", key, name, s.Type)
+		case name == "headers":
+			s.Headers = map[string]string{}
+			if err := addHeaders(s.Headers, value, key+".headers"); err != nil {
+				return nil, err
+			}
+		case name == "headersEnv":
+			s.HeadersEnv = map[string]string{}
+			if err := addHeaders(s.HeadersEnv, value, key+".headersEnv"); err != nil {
+				return nil, err
+			}
+		case name == "append":
+			b, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("%s.append must be true or false", key)
+			}
+			s.Append = b
+		case name == "url":
+			s.URL = str
+		case name == "method":
+			s.Method = strings.ToUpper(str)
+		case name == "path":
+			s.Path = str
+		case name == "bucket":
+			s.Bucket = str
+		case name == "key":
+			s.Key = str
+		case name == "region":
+			s.Region = str
+		case name == "endpoint":
+			s.Endpoint = strings.TrimSuffix(str, "/")
+		}
+	}
+	switch s.Type {
+	case "http":
+		if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s.url must be an http or https URL, got %q", key, s.URL)
+		}
+		if s.Method == "" {
+			s.Method = http.MethodPost
+		}
+	case "file":
+		if s.Path == "" {
+			return nil, fmt.Errorf("%s.path is required for a file sink", key)
+		}
+	case "s3":
+		if s.Bucket == "" || s.Key == "" {
+			return nil, fmt.Errorf("%s needs a bucket and a key for an s3 sink", key)
+		}
+	}
+	return s, nil
+}
+
+// deliverSinks sends the output of a completed run to each sink, reporting
+// every failure. variables fill in templated paths and keys, along with
+// the fields of a JSON object response.
+func deliverSinks(ctx context.Context, sinks []*sink, pr promptRun, c completion, variables map[string]interface{}) error {
+	if len(sinks) == 0 {
+		return nil
+	}
+	data := make(map[string]interface{}, len(variables))
+	for k, v := range variables {
+		data[k] = v
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(c.Result), &fields); err == nil {
+		for k, v := range fields {
+			data[k] = v
+		}
+	}
+	client, err := runClient(pr.meta)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, s := range sinks {
+		body := []byte(c.Result + "\n")
+		if s.Format == "json" {
+			encoded, _ := json.Marshal(summarize(pr, c))
+			body = append(encoded, '\n')
+		}
+		where, err := s.deliver(ctx, client, body, data)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s sink: %v", s.Type, err))
+			continue
+		}
+		log(fmt.Sprintf("Delivered output to %s", where))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("delivering output: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// deliver sends body to the sink with client, returning where it went
+func (s *sink) deliver(ctx context.Context, client *http.Client, body []byte, data map[string]interface{}) (string, error) {
+	switch s.Type {
+	case "file":
+		path, err := renderPath(s.Path, data)
+		if err != nil {
+			return "", fmt.Errorf("path %v", err)
+		}
+		if dir := filepath.Dir(path); dir != "." {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return "", err
+			}
+		}
+		if !s.Append {
+			return path, writeFileAtomic(path, body, 0644)
+		}
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return "", err
+		}
+		if _, err := f.Write(body); err != nil {
+			f.Close()
+			return "", err
+		}
+		return path, f.Close()
+	case "http":
+		req, err := http.NewRequestWithContext(ctx, s.Method, s.URL, bytes.NewReader(body))
+		if err != nil {
+			return "", err
+		}
+		for name, value := range s.Headers {
+			req.Header.Set(name, value)
+		}
+		for name, env := range s.HeadersEnv {
+			value := os.Getenv(env)
+			if value == "" {
+				return "", fmt.Errorf("header %s needs %s to be set", name, env)
+			}
+			req.Header.Set(name, value)
+		}
+		return s.URL, s.send(client, req, body)
+	default:
+		key := strings.TrimPrefix(renderTemplate(s.Key, data), "/")
+		if key == "" {
+			return "", fmt.Errorf("key rendered empty")
+		}
+		return fmt.Sprintf("s3://%s/%s", s.Bucket, key), s.putObject(ctx, client, key, body)
+	}
+}
+
+// send makes a sink's request, failing unless it is answered with success
+func (s *sink) send(client *http.Client, req *http.Request, body []byte) error {
+	if req.Header.Get("Content-Type") == "" {
+		if s.Format == "json" {
+			req.Header.Set("Content-Type", "application/json")
+		} else {
+			req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		}
+	}
+	req.Header.Set("User-Agent", userAgent())
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// putObject uploads body to the sink's bucket, signed with the AWS
+// credentials in the environment
+func (s *sink) putObject(ctx context.Context, client *http.Client, key string, body []byte) error {
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	region := s.Region
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region == "" {
+			region = os.Getenv(env)
+		}
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	objectURL := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.Bucket, region, awsEscapePath(key))
+	if s.Endpoint != "" {
+		// S3-compatible services are addressed by path
+		objectURL = fmt.Sprintf("%s/%s/%s", s.Endpoint, s.Bucket, awsEscapePath(key))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signV4(req, body, accessKey, secretKey, region, "s3", time.Now())
+	return s.send(client, req, body)
+}
+
+// signV4 signs req with AWS Signature Version 4, covering its host and
+// every header it has so far
+func signV4(req *http.Request, body []byte, accessKey, secretKey, region, service string, now time.Time) {
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+
+	date := amzDate[:8]
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscapePath percent-encodes an object key as AWS signs it: everything
+// but unreserved characters, keeping the slashes between segments
+func awsEscapePath(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
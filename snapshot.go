@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// varSnapshot is the context a run rendered its prompt with, written by
+// --snapshot-vars and replayed by --from-snapshot so a rendering problem
+// can be reproduced without the stdin, defaults and flags that produced it
+type varSnapshot struct {
+	Prompt    string                 `json:"prompt"`
+	Variant   string                 `json:"variant,omitempty"`
+	Overrides map[string]interface{} `json:"overrides,omitempty"` // the --key=value settings given
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// snapshotFlags takes --snapshot-vars and --from-snapshot out of the
+// overrides. A snapshot being replayed is loaded, and its variant and
+// overrides applied beneath any given on the command line.
+func snapshotFlags(argOverrides map[string]interface{}) (string, *varSnapshot, error) {
+	write := ""
+	if v, ok := argOverrides["snapshot-vars"]; ok {
+		write = fmt.Sprintf("%v", v)
+		delete(argOverrides, "snapshot-vars")
+	}
+	v, ok := argOverrides["from-snapshot"]
+	if !ok {
+		return write, nil, nil
+	}
+	delete(argOverrides, "from-snapshot")
+	snap, err := readVarSnapshot(fmt.Sprintf("%v", v))
+	if err != nil {
+		return "", nil, err
+	}
+	for key, value := range snap.Overrides {
+		if _, set := argOverrides[key]; !set {
+			argOverrides[key] = value
+		}
+	}
+	if _, set := argOverrides["variant"]; !set && snap.Variant != "" {
+		argOverrides["variant"] = snap.Variant
+	}
+	return write, snap, nil
+}
+
+// readVarSnapshot loads a snapshot written by --snapshot-vars
+func readVarSnapshot(path string) (*varSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot: %v", err)
+	}
+	var snap varSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("reading snapshot %s: %v", path, err)
+	}
+	if snap.Variables == nil {
+		return nil, fmt.Errorf("reading snapshot %s: it has no variables", path)
+	}
+	return &snap, nil
+}
+
+// snapshotVariables returns the variables to render path with: those of
+// the snapshot being replayed, or those read from stdin
+func snapshotVariables(snap *varSnapshot, path string, meta map[string]interface{}) (map[string]interface{}, error) {
+	if snap == nil {
+		return inputVariables(readStdin(), meta)
+	}
+	if snap.Prompt != "" && snap.Prompt != path {
+		fmt.Fprintf(os.Stderr, "Warning: the snapshot was taken of %s, not %s\n", snap.Prompt, path)
+	}
+	log("Using the variables of the snapshot, not stdin")
+	return snap.Variables, nil
+}
+
+// writeVarSnapshot writes the context a run rendered path with
+func writeVarSnapshot(file, path, variant string, overrides, variables map[string]interface{}) error {
+	snap := varSnapshot{Prompt: path, Variant: variant, Overrides: overrides, Variables: variables}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return fmt.Errorf("writing snapshot: %v", err)
+	}
+	if err := os.WriteFile(file, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("writing snapshot: %v", err)
+	}
+	log(fmt.Sprintf("Wrote variable snapshot %s", file))
+	return nil
+}
+
+// copyOverrides copies the overrides a snapshot records, leaving out the
+// variant, which it records on its own
+func copyOverrides(argOverrides map[string]interface{}) map[string]interface{} {
+	if len(argOverrides) == 0 {
+		return nil
+	}
+	overrides := make(map[string]interface{}, len(argOverrides))
+	for k, v := range argOverrides {
+		if k != "variant" {
+			overrides[k] = v
+		}
+	}
+	return overrides
+}
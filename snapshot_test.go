@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotFlags(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vars.json")
+	variables := map[string]interface{}{"name": "Ada", "tags": []interface{}{"a", "b"}}
+	if err := writeVarSnapshot(path, "greet.prompt", "b", map[string]interface{}{"strict": true, "temperature": 0.2}, variables); err != nil {
+		t.Fatal(err)
+	}
+
+	overrides := map[string]interface{}{"from-snapshot": path, "temperature": 0.9}
+	write, snap, err := snapshotFlags(overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if write != "" || snap == nil || snap.Prompt != "greet.prompt" {
+		t.Fatalf("Unexpected snapshot %q %+v", write, snap)
+	}
+	// The command line wins over the snapshot's overrides
+	if overrides["temperature"] != 0.9 || overrides["strict"] != true || overrides["variant"] != "b" {
+		t.Errorf("Expected the snapshot's overrides beneath the command line's, got %v", overrides)
+	}
+	if _, ok := overrides["from-snapshot"]; ok {
+		t.Error("Expected --from-snapshot to be taken out of the overrides")
+	}
+	got, err := snapshotVariables(snap, "greet.prompt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := json.Marshal(got); string(data) != `{"name":"Ada","tags":["a","b"]}` {
+		t.Errorf("Expected the snapshot's variables, got %s", data)
+	}
+
+	os.WriteFile(path, []byte(`{"prompt":"greet.prompt"}`), 0o644)
+	if _, _, err := snapshotFlags(map[string]interface{}{"from-snapshot": path}); err == nil {
+		t.Error("Expected an error for a snapshot without variables")
+	}
+}
+
+func TestRunSnapshot(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeFiles(t, dir,
+		"greet.prompt", "---\nmodel: test\nstrictVariables: true\ninput:\n  default:\n    tone: warm\n---\nHello {{name}}, {{tone}}ly",
+		"greet.prompt.test-response", `{"choices":[{"message":{"content":"Hi"}}]}`)
+	path := filepath.Join(dir, "greet.prompt")
+	snapshot := filepath.Join(dir, "vars.json")
+
+	// Without a name the strict prompt fails to render, but the snapshot
+	// is written first so the failure can be reproduced
+	if err := run(context.Background(), []string{"--snapshot-vars", snapshot, path}); err == nil {
+		t.Fatal("Expected the render to fail without a name")
+	}
+	snap, err := readVarSnapshot(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Variables["tone"] != "warm" || snap.Prompt != path {
+		t.Errorf("Expected the defaults in the snapshot, got %+v", snap)
+	}
+
+	snap.Variables["name"] = "Ada"
+	data, _ := json.Marshal(snap)
+	os.WriteFile(snapshot, data, 0o644)
+	if err := run(context.Background(), []string{"--from-snapshot", snapshot, path}); err != nil {
+		t.Errorf("Expected the run to render from the snapshot, got %v", err)
+	}
+	if err := run(context.Background(), []string{"--batch", "--from-snapshot", snapshot, path}); err == nil {
+		t.Error("Expected --batch and --from-snapshot to conflict")
+	}
+}
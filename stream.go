@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errStreamCut reports a stream that ended without the provider's end of
+// response marker, as when a proxy or the server drops the connection
+var errStreamCut = errors.New("the connection closed before the response finished")
+
+// streamInterruptedError reports a stream that failed partway. The text
+// received before the failure has already been written out.
+type streamInterruptedError struct {
+	Received string
+	Cause    error
+}
+
+func (e *streamInterruptedError) Error() string {
+	if e.Received == "" {
+		return fmt.Sprintf("response stream failed: %v", e.Cause)
+	}
+	return fmt.Sprintf("response stream interrupted after %d characters, the reply above is incomplete: %v",
+		len([]rune(e.Received)), e.Cause)
+}
+
+func (e *streamInterruptedError) Unwrap() error { return e.Cause }
+
+// streamStats measure a streamed reply: how long the first text took to
+// arrive, how many chunks it came in, and how fast the rest followed
+type streamStats struct {
+	FirstTokenMs    int64   `json:"firstTokenMs"`
+	Chunks          int     `json:"chunks"`
+	TokensPerSecond float64 `json:"tokensPerSecond,omitempty"`
+}
+
+// streamMeter passes a streamed reply through to w, timing its chunks from
+// when the request was made
+type streamMeter struct {
+	w      io.Writer
+	start  time.Time
+	first  time.Time
+	chunks int
+}
+
+func newStreamMeter(w io.Writer) *streamMeter {
+	return &streamMeter{w: w, start: time.Now()}
+}
+
+func (m *streamMeter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		if m.chunks == 0 {
+			m.first = time.Now()
+		}
+		m.chunks++
+	}
+	return m.w.Write(p)
+}
+
+// stats measures the stream once it has ended, given the output tokens the
+// provider reported for it. It is nil if no text arrived.
+func (m *streamMeter) stats(outputTokens int) *streamStats {
+	if m == nil || m.chunks == 0 {
+		return nil
+	}
+	s := &streamStats{FirstTokenMs: m.first.Sub(m.start).Milliseconds(), Chunks: m.chunks}
+	if generating := time.Since(m.first).Seconds(); outputTokens > 0 && generating > 0 {
+		s.TokensPerSecond = math.Round(float64(outputTokens)/generating*10) / 10
+	}
+	return s
+}
+
+// sseEvents calls fn with the payload of every "data:" line in an SSE stream.
+// It reports whether the stream ended with a [DONE] event.
+func sseEvents(body io.Reader, fn func(data string) error) (bool, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(line[len("data:"):])
+		if data == "" {
+			continue
+		}
+		if data == "[DONE]" {
+			return true, nil
+		}
+		if err := fn(data); err != nil {
+			return false, err
+		}
+	}
+	return false, scanner.Err()
+}
+
+// streamError returns the error carried by a stream event, if any
+func streamError(event map[string]interface{}) error {
+	if _, ok := event["error"]; !ok {
+		return nil
+	}
+	data, _ := json.Marshal(event)
+	return fmt.Errorf("%s", extractErrorMessage(string(data)))
+}
+
+// readOpenAIStream assembles OpenAI-compatible chat.completion.chunk events
+func readOpenAIStream(body io.Reader, w io.Writer) (map[string]interface{}, error) {
+	var content, refusal strings.Builder
+	type toolCall struct {
+		id, name string
+		args     strings.Builder
+	}
+	toolCalls := make(map[int]*toolCall)
+	response := map[string]interface{}{}
+	finishReason := ""
+
+	done, err := sseEvents(body, func(data string) error {
+		var chunk map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("parsing stream event: %v", err)
+		}
+		if err := streamError(chunk); err != nil {
+			return err
+		}
+		for _, key := range []string{"id", "model", "provider", "system_fingerprint", "usage"} {
+			if v, ok := chunk[key]; ok && v != nil {
+				response[key] = v
+			}
+		}
+		choices, _ := chunk["choices"].([]interface{})
+		if len(choices) == 0 {
+			return nil
+		}
+		choice, _ := choices[0].(map[string]interface{})
+		if reason, ok := choice["finish_reason"].(string); ok && reason != "" {
+			finishReason = reason
+		}
+		delta, _ := choice["delta"].(map[string]interface{})
+		if text, ok := delta["content"].(string); ok && text != "" {
+			content.WriteString(text)
+			fmt.Fprint(w, text)
+		}
+		if text, ok := delta["refusal"].(string); ok {
+			refusal.WriteString(text)
+		}
+		calls, _ := delta["tool_calls"].([]interface{})
+		for _, c := range calls {
+			call, _ := c.(map[string]interface{})
+			index := 0
+			if i, ok := call["index"].(float64); ok {
+				index = int(i)
+			}
+			tc, ok := toolCalls[index]
+			if !ok {
+				tc = &toolCall{}
+				toolCalls[index] = tc
+			}
+			if id, ok := call["id"].(string); ok && id != "" {
+				tc.id = id
+			}
+			fn, _ := call["function"].(map[string]interface{})
+			if name, ok := fn["name"].(string); ok && name != "" {
+				tc.name = name
+			}
+			if args, ok := fn["arguments"].(string); ok {
+				tc.args.WriteString(args)
+				fmt.Fprint(w, args)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !done && finishReason == "" {
+		return nil, errStreamCut
+	}
+
+	message := map[string]interface{}{
+		"role":    "assistant",
+		"content": content.String(),
+	}
+	if refusal.Len() > 0 {
+		message["refusal"] = refusal.String()
+	}
+	if len(toolCalls) > 0 {
+		indexes := make([]int, 0, len(toolCalls))
+		for i := range toolCalls {
+			indexes = append(indexes, i)
+		}
+		sort.Ints(indexes)
+		calls := []interface{}{}
+		for _, i := range indexes {
+			tc := toolCalls[i]
+			calls = append(calls, map[string]interface{}{
+				"id":   tc.id,
+				"type": "function",
+				"function": map[string]interface{}{
+					"name":      tc.name,
+					"arguments": tc.args.String(),
+				},
+			})
+		}
+		message["tool_calls"] = calls
+	}
+	response["object"] = "chat.completion"
+	response["choices"] = []interface{}{map[string]interface{}{
+		"index":         0,
+		"message":       message,
+		"finish_reason": finishReason,
+	}}
+	return response, nil
+}
+
+// readAnthropicStream assembles Anthropic Messages API stream events
+func readAnthropicStream(body io.Reader, w io.Writer) (map[string]interface{}, error) {
+	response := map[string]interface{}{}
+	type block struct {
+		data map[string]interface{}
+		text strings.Builder
+		json strings.Builder
+	}
+	blocks := make(map[int]*block)
+	stopped := false
+
+	_, err := sseEvents(body, func(data string) error {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return fmt.Errorf("parsing stream event: %v", err)
+		}
+		if err := streamError(event); err != nil {
+			return err
+		}
+		index := 0
+		if i, ok := event["index"].(float64); ok {
+			index = int(i)
+		}
+
+		switch event["type"] {
+		case "message_start":
+			if message, ok := event["message"].(map[string]interface{}); ok {
+				for k, v := range message {
+					response[k] = v
+				}
+			}
+		case "content_block_start":
+			data, _ := event["content_block"].(map[string]interface{})
+			blocks[index] = &block{data: data}
+		case "content_block_delta":
+			b, ok := blocks[index]
+			if !ok {
+				b = &block{data: map[string]interface{}{"type": "text"}}
+				blocks[index] = b
+			}
+			delta, _ := event["delta"].(map[string]interface{})
+			switch delta["type"] {
+			case "text_delta":
+				text, _ := delta["text"].(string)
+				b.text.WriteString(text)
+				fmt.Fprint(w, text)
+			case "input_json_delta":
+				partial, _ := delta["partial_json"].(string)
+				b.json.WriteString(partial)
+				fmt.Fprint(w, partial)
+			}
+		case "message_delta":
+			if delta, ok := event["delta"].(map[string]interface{}); ok {
+				for k, v := range delta {
+					response[k] = v
+				}
+			}
+			if usage, ok := event["usage"].(map[string]interface{}); ok {
+				merged, _ := response["usage"].(map[string]interface{})
+				if merged == nil {
+					merged = map[string]interface{}{}
+				}
+				for k, v := range usage {
+					merged[k] = v
+				}
+				response["usage"] = merged
+			}
+		case "message_stop":
+			stopped = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !stopped {
+		return nil, errStreamCut
+	}
+
+	indexes := make([]int, 0, len(blocks))
+	for i := range blocks {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	content := []interface{}{}
+	for _, i := range indexes {
+		b := blocks[i]
+		assembled := map[string]interface{}{}
+		for k, v := range b.data {
+			assembled[k] = v
+		}
+		switch assembled["type"] {
+		case "tool_use":
+			var input map[string]interface{}
+			if b.json.Len() > 0 {
+				if err := json.Unmarshal([]byte(b.json.String()), &input); err != nil {
+					return nil, fmt.Errorf("parsing streamed tool input: %v", err)
+				}
+			}
+			assembled["input"] = input
+		default:
+			assembled["text"] = b.text.String()
+		}
+		content = append(content, assembled)
+	}
+	response["content"] = content
+	return response, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadOpenAIStream(t *testing.T) {
+	body := strings.Join([]string{
+		`data: {"id":"c1","model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}`,
+		``,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"content":"lo"}}]}`,
+		``,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+		``,
+		`data: [DONE]`,
+	}, "\n")
+
+	var out strings.Builder
+	response, err := adapterFor("openai").ParseStream(strings.NewReader(body), &out)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if out.String() != "Hello" {
+		t.Errorf("Expected streamed %q, got %q", "Hello", out.String())
+	}
+	if result := extractResponse(response, nil, "openai").Text; result != "Hello" {
+		t.Errorf("Expected assembled %q, got %q", "Hello", result)
+	}
+}
+
+func TestReadOpenAIStreamToolCall(t *testing.T) {
+	body := strings.Join([]string{
+		`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"extract","arguments":""}}]}}]}`,
+		`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"name\":"}}]}}]}`,
+		`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"John\"}"}}]}}]}`,
+		`data: [DONE]`,
+	}, "\n")
+
+	var out strings.Builder
+	response, err := adapterFor("openrouter").ParseStream(strings.NewReader(body), &out)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := `{"name":"John"}`
+	if result := extractResponse(response, nil, "openrouter").Text; result != expected {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+}
+
+func TestReadAnthropicStream(t *testing.T) {
+	body := strings.Join([]string{
+		`event: message_start`,
+		`data: {"type":"message_start","message":{"id":"msg_1","model":"claude-3","content":[],"usage":{"input_tokens":10}}}`,
+		``,
+		`event: content_block_start`,
+		`data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		``,
+		`event: content_block_delta`,
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi "}}`,
+		``,
+		`event: content_block_delta`,
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"there"}}`,
+		``,
+		`event: message_delta`,
+		`data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":2}}`,
+		``,
+		`event: message_stop`,
+		`data: {"type":"message_stop"}`,
+	}, "\n")
+
+	var out strings.Builder
+	response, err := adapterFor("anthropic").ParseStream(strings.NewReader(body), &out)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if out.String() != "Hi there" {
+		t.Errorf("Expected streamed %q, got %q", "Hi there", out.String())
+	}
+	if result := extractResponse(response, nil, "anthropic").Text; result != "Hi there" {
+		t.Errorf("Expected assembled %q, got %q", "Hi there", result)
+	}
+	if response["stop_reason"] != "end_turn" {
+		t.Errorf("Expected stop_reason end_turn, got %v", response["stop_reason"])
+	}
+}
+
+func TestReadStreamError(t *testing.T) {
+	body := `data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`
+	var out strings.Builder
+	_, err := adapterFor("anthropic").ParseStream(strings.NewReader(body), &out)
+	if err == nil || err.Error() != "overloaded_error: Overloaded" {
+		t.Errorf("Expected overloaded error, got %v", err)
+	}
+}
+
+func TestReadStreamCut(t *testing.T) {
+	tests := []struct {
+		provider string
+		body     string
+	}{
+		{"openai", `data: {"choices":[{"index":0,"delta":{"content":"Hel"}}]}`},
+		{"anthropic", strings.Join([]string{
+			`data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}`,
+		}, "\n")},
+	}
+	for _, tc := range tests {
+		var out strings.Builder
+		_, err := adapterFor(tc.provider).ParseStream(strings.NewReader(tc.body), &out)
+		if err != errStreamCut {
+			t.Errorf("%s: expected errStreamCut, got %v", tc.provider, err)
+		}
+		if out.String() != "Hel" {
+			t.Errorf("%s: expected the received text written, got %q", tc.provider, out.String())
+		}
+	}
+
+	// A finish reason marks the end even without [DONE]
+	body := `data: {"choices":[{"index":0,"delta":{"content":"Hi"},"finish_reason":"stop"}]}`
+	if _, err := adapterFor("openai").ParseStream(strings.NewReader(body), io.Discard); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestMakeRequestCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hel\"}}]}\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := makeRequest(ctx, httpClient, server.URL, "", "model", nil, nil, nil, GenerationConfig{}, nil, nil, "openai", io.Discard, Limits{})
+	var interrupted *streamInterruptedError
+	if !errors.As(err, &interrupted) || interrupted.Received != "Hel" {
+		t.Fatalf("Expected an interrupted stream with the partial reply, got %v", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancellation as the cause, got %v", err)
+	}
+
+	var buf strings.Builder
+	if status := report(&buf, err, true); status != exitInterrupted {
+		t.Errorf("Expected exit status %d, got %d", exitInterrupted, status)
+	}
+	if !strings.Contains(buf.String(), "interrupted after 3 characters") {
+		t.Errorf("Expected the partial reply noted, got %q", buf.String())
+	}
+}
+
+func TestStreamMeter(t *testing.T) {
+	var out strings.Builder
+	m := newStreamMeter(&out)
+	m.start = m.start.Add(-1300 * time.Millisecond)
+	for _, chunk := range []string{"Hel", "", "lo"} {
+		io.WriteString(m, chunk)
+	}
+	m.first = m.first.Add(-time.Second)
+	s := m.stats(50)
+	if out.String() != "Hello" || s.Chunks != 2 || s.FirstTokenMs < 300 {
+		t.Errorf("Expected Hello in 2 chunks after 300ms or more, got %q in %+v", out.String(), s)
+	}
+	// 50 tokens in a little over a second
+	if s.TokensPerSecond <= 40 || s.TokensPerSecond > 50 {
+		t.Errorf("Expected about 50 tokens per second, got %g", s.TokensPerSecond)
+	}
+	if s := newStreamMeter(&out).stats(50); s != nil {
+		t.Errorf("Expected no stats without text, got %+v", s)
+	}
+	var nilMeter *streamMeter
+	if s := nilMeter.stats(50); s != nil {
+		t.Errorf("Expected no stats when not streaming, got %+v", s)
+	}
+}
+
+func TestCompleteStreamStats(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	var out strings.Builder
+	c, err := complete(context.Background(), promptRun{
+		path:     "hello.prompt",
+		meta:     map[string]interface{}{"baseURL": streamServer(t).URL},
+		provider: "custom",
+		model:    "x",
+		messages: []Message{{Role: "user", Content: "Hi"}},
+		stream:   true,
+		out:      &out,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.Stream == nil || c.Stream.Chunks != 2 {
+		t.Fatalf("Expected stats for 2 chunks, got %+v", c.Stream)
+	}
+	records, err := readHistory(historyPath(), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Stream == nil || records[0].Stream.Chunks != 2 {
+		t.Errorf("Expected the stream stats in history, got %+v", records)
+	}
+}
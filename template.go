@@ -0,0 +1,694 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Template is a parsed Handlebars-style template. Compiling once and
+// rendering many times avoids rescanning the source on every render, which
+// matters when one prompt renders many inputs.
+type Template struct {
+	src   string
+	nodes []templateNode
+}
+
+type nodeKind int
+
+const (
+	textNode     nodeKind = iota // literal text
+	variableNode                 // {{name}}
+	sectionNode                  // {{#name}}...{{/name}}
+	invertedNode                 // {{^name}}...{{/name}}
+	eachNode                     // {{#each name}}...{{else}}...{{/each}}
+	ifNode                       // {{#if name}}...{{else}}...{{/if}}
+	unlessNode                   // {{#unless name}}...{{else}}...{{/unless}}
+	withNode                     // {{#with name}}...{{else}}...{{/with}}
+	schemaNode                   // {{schema name}}
+	helperNode                   // {{helper arg...}}
+)
+
+// blockHelpers are the Handlebars block helpers, {{#helper name}}, keyed by
+// helper name
+var blockHelpers = map[string]nodeKind{
+	"each":   eachNode,
+	"if":     ifNode,
+	"unless": unlessNode,
+	"with":   withNode,
+}
+
+// parseEnd is how a parse of a template's nodes ended
+type parseEnd int
+
+const (
+	parseFailed parseEnd = iota // the close tag was never found
+	parseClosed                 // the close tag, or the end of the template at the top level
+	parseElse                   // an {{else}} of the enclosing block
+)
+
+// templateNode is one node of a parsed template. text holds the literal
+// text of a text node and the looked-up name of every other kind; pos is
+// the offset of the node's tag in the source. elseChildren are the nodes
+// after a block's {{else}}. A helper node's text is the helper's name and
+// args its unparsed arguments. raw marks a {{{name}}} value, which is never
+// escaped.
+type templateNode struct {
+	kind         nodeKind
+	text         string
+	pos          int
+	children     []templateNode
+	elseChildren []templateNode
+	args         []string
+	raw          bool
+}
+
+// compileTemplate parses a template. Malformed tags are kept as literal text
+// rather than rejected; checkTemplate reports them with positions.
+func compileTemplate(src string) *Template {
+	return compileTemplateRange(src, 0, len(src))
+}
+
+// compileTemplateRange parses src[start:end] as a template, keeping
+// positions relative to all of src so errors point into the whole source
+func compileTemplateRange(src string, start, end int) *Template {
+	p := templateParser{src: src[:end]}
+	nodes, _, _ := p.parse(start, "", nil)
+	return &Template{src: src, nodes: nodes}
+}
+
+// renderTemplate renders a Handlebars-style template
+func renderTemplate(template string, variables map[string]interface{}) string {
+	return compileTemplate(template).Render(variables)
+}
+
+// renderOptions control how a template renders
+type renderOptions struct {
+	// strict makes variables that resolve to nothing an error
+	strict bool
+	// schemas holds the text {{schema name}} renders, keyed by name
+	schemas map[string]string
+	// escape, if set, escapes the values {{name}} and helpers render;
+	// {{{name}}} is never escaped
+	escape func(string) string
+}
+
+// Render renders the template against a context of variables. Variables
+// that resolve to nothing render as empty strings.
+func (t *Template) Render(ctx map[string]interface{}) string {
+	out, _ := t.render(ctx, renderOptions{})
+	return out
+}
+
+// RenderStrict renders the template like Render, but fails if any variable
+// is missing or null, naming each one with its line and column
+func (t *Template) RenderStrict(ctx map[string]interface{}) (string, error) {
+	return t.render(ctx, renderOptions{strict: true})
+}
+
+func (t *Template) render(ctx map[string]interface{}, opts renderOptions) (string, error) {
+	r := renderer{opts: opts}
+	r.nodes(t.nodes, ctx)
+	if len(r.undefined) == 0 && len(r.failed) == 0 {
+		return r.b.String(), nil
+	}
+	var errs []error
+	seen := map[int]bool{}
+	report := func(pos int, msg string) {
+		if seen[pos] {
+			// Reported once, however many times a loop renders it
+			return
+		}
+		seen[pos] = true
+		err := newSourceError(t.src, pos, "%s", msg)
+		err.File = "template"
+		errs = append(errs, err)
+	}
+	for _, n := range r.undefined {
+		msg := fmt.Sprintf("undefined variable %q", n.text)
+		if n.kind == schemaNode {
+			msg = fmt.Sprintf("no %s schema declared for {{schema %s}}", n.text, n.text)
+		}
+		report(n.pos, msg)
+	}
+	for _, f := range r.failed {
+		report(f.node.pos, fmt.Sprintf("helper %q: %v", f.node.text, f.err))
+	}
+	return r.b.String(), errors.Join(errs...)
+}
+
+// renderer accumulates rendered output, the helper calls that failed and,
+// in strict mode, the variable nodes that resolved to nothing
+type renderer struct {
+	b         strings.Builder
+	opts      renderOptions
+	undefined []templateNode
+	failed    []helperFailure
+}
+
+// helperFailure is a helper call that returned an error
+type helperFailure struct {
+	node templateNode
+	err  error
+}
+
+type templateParser struct {
+	src string
+}
+
+// parse reads nodes from pos until the close tag named closing, or to the
+// end of the source when closing is "". It returns the nodes, the position
+// after the close tag and how the parse ended. A close tag for one of the
+// enclosing sections ends the parse unsuccessfully, so the unclosed
+// section's open tag can be kept as text. An {{else}} of an if, unless,
+// each or with block ends the parse with the position of the {{else}} tag.
+func (p *templateParser) parse(pos int, closing string, enclosing []string) ([]templateNode, int, parseEnd) {
+	var nodes []templateNode
+	text := func(s string) {
+		if s == "" {
+			return
+		}
+		if n := len(nodes); n > 0 && nodes[n-1].kind == textNode {
+			nodes[n-1].text += s
+			return
+		}
+		nodes = append(nodes, templateNode{kind: textNode, text: s})
+	}
+
+	for {
+		start := strings.Index(p.src[pos:], "{{")
+		if start == -1 {
+			text(p.src[pos:])
+			return nodes, len(p.src), topLevel(closing)
+		}
+		start += pos
+		text(p.src[pos:start])
+
+		if node, next, ok := p.tripleStash(start); ok {
+			nodes = append(nodes, node)
+			pos = next
+			continue
+		}
+		end := strings.Index(p.src[start+2:], "}}")
+		if end == -1 {
+			text(p.src[start:])
+			return nodes, len(p.src), topLevel(closing)
+		}
+		end += start + 2
+		inner, trimBefore, trimAfter := whitespaceControl(p.src[start+2 : end])
+		tag := p.src[start : end+2]
+		pos = end + 2
+		// control applies the tag's ~ markers, and removes the line a tag
+		// that can stand alone does, returning how much of the text before
+		// the tag to drop and where the text after it resumes
+		control := func(canStandAlone bool) (int, int) {
+			return p.control(nodes, start, end, trimBefore, trimAfter, canStandAlone)
+		}
+
+		switch {
+		case strings.HasPrefix(inner, "!"):
+			// Comment
+			var drop int
+			drop, pos = control(true)
+			nodes = dropText(nodes, drop)
+		case strings.Contains(inner, "{{"):
+			text("{{")
+			pos = start + 2
+		case strings.HasPrefix(inner, "#"), strings.HasPrefix(inner, "^"):
+			name := strings.TrimSpace(inner[1:])
+			kind := sectionNode
+			if inner[0] == '^' {
+				kind = invertedNode
+			}
+			closeName := name
+			if kind == sectionNode {
+				if helper, arg := splitHelper(name); arg != "" {
+					if helperKind, ok := blockHelpers[helper]; ok {
+						kind = helperKind
+						name = arg
+						closeName = helper
+					}
+				}
+			}
+			if name == "" {
+				text(tag)
+				continue
+			}
+			drop, bodyStart := control(true)
+			node, next, ok := p.block(start, bodyStart, kind, name, closeName, append(enclosing, closing))
+			if !ok {
+				text(tag)
+				continue
+			}
+			nodes = append(dropText(nodes, drop), node)
+			pos = next
+		case strings.HasPrefix(inner, "/"):
+			name := strings.TrimSpace(inner[1:])
+			if closing != "" && name == closing {
+				drop, next := control(true)
+				return dropText(nodes, drop), next, parseClosed
+			}
+			for _, outer := range enclosing {
+				if outer != "" && name == outer {
+					return nodes, start, parseFailed
+				}
+			}
+			text(tag)
+		case isElseTag(inner, closing):
+			drop, _ := control(true)
+			return dropText(nodes, drop), start, parseElse
+		case strings.TrimSpace(inner) == "" || strings.ContainsAny(inner, "#^/}"):
+			text(tag)
+		default:
+			var drop int
+			drop, pos = control(false)
+			nodes = append(dropText(nodes, drop), valueTag(inner, start))
+		}
+	}
+}
+
+// valueTag makes the node of a tag that renders a value: a variable, a
+// helper call or {{schema name}}
+func valueTag(inner string, pos int) templateNode {
+	name := strings.TrimSpace(inner)
+	kind := variableNode
+	var args []string
+	if helper, arg := splitHelper(name); helper == "schema" && arg != "" {
+		kind, name = schemaNode, arg
+	} else if _, ok := lookupHelper(helper); ok && (arg != "" || bareHelpers[helper]) {
+		if parsed, err := helperArgs(arg); err == nil {
+			kind, name, args = helperNode, helper, parsed
+		}
+	}
+	return templateNode{kind: kind, text: name, pos: pos, args: args}
+}
+
+// tripleStash parses a {{{name}}} tag at start, which renders a value
+// without escaping, returning the node and the position after the tag
+func (p *templateParser) tripleStash(start int) (templateNode, int, bool) {
+	if !strings.HasPrefix(p.src[start:], "{{{") {
+		return templateNode{}, 0, false
+	}
+	end := strings.Index(p.src[start+3:], "}}}")
+	if end == -1 {
+		return templateNode{}, 0, false
+	}
+	end += start + 3
+	inner := p.src[start+3 : end]
+	if strings.TrimSpace(inner) == "" || strings.ContainsAny(inner, "{}#^/!") {
+		return templateNode{}, 0, false
+	}
+	node := valueTag(inner, start)
+	node.raw = true
+	return node, end + 3, true
+}
+
+// block parses the body of a block whose open tag is at start, up to its
+// close tag, splitting it at {{else}}. An {{else if name}} opens a nested if
+// block that shares the close tag.
+func (p *templateParser) block(start, pos int, kind nodeKind, name, closeName string, enclosing []string) (templateNode, int, bool) {
+	node := templateNode{kind: kind, text: name, pos: start}
+	children, next, end := p.parse(pos, closeName, enclosing)
+	node.children = children
+	if end != parseElse {
+		return node, next, end == parseClosed
+	}
+
+	elsePos := next
+	tagEnd := strings.Index(p.src[elsePos:], "}}") + elsePos
+	inner, _, trimAfter := whitespaceControl(p.src[elsePos+2 : tagEnd])
+	_, bodyStart := p.control(nil, elsePos, tagEnd, false, trimAfter, true)
+	_, cond := splitHelper(strings.TrimSpace(inner))
+	if cond == "" {
+		elseChildren, next, end := p.parse(bodyStart, closeName, enclosing)
+		node.elseChildren = elseChildren
+		return node, next, end == parseClosed
+	}
+	helper, arg := splitHelper(cond)
+	elseNode, next, ok := p.block(elsePos, bodyStart, blockHelpers[helper], arg, closeName, enclosing)
+	node.elseChildren = []templateNode{elseNode}
+	return node, next, ok
+}
+
+// whitespaceControl strips the ~ markers from the inside of a tag: {{~
+// trims the whitespace before the tag and ~}} the whitespace after it
+func whitespaceControl(inner string) (string, bool, bool) {
+	inner, trimBefore := strings.CutPrefix(inner, "~")
+	inner, trimAfter := strings.CutSuffix(inner, "~")
+	return inner, trimBefore, trimAfter
+}
+
+// control works out the whitespace to remove around the tag whose {{ is at
+// start and }} at end. It returns how many bytes of text to drop from the
+// end of nodes, the text before the tag, and where the text after the tag
+// resumes. Section, else and comment tags can stand alone: alone on their
+// line but for spaces and tabs, the whole line is removed, so block tags
+// on lines of their own leave no blank lines behind. ~ markers trim all
+// whitespace, newlines included, on their side of the tag.
+func (p *templateParser) control(nodes []templateNode, start, end int, trimBefore, trimAfter, canStandAlone bool) (int, int) {
+	drop, next := 0, end+2
+	before := ""
+	if n := len(nodes); n > 0 && nodes[n-1].kind == textNode {
+		before = nodes[n-1].text
+	}
+	if canStandAlone {
+		lineStart := strings.LastIndexByte(p.src[:start], '\n') + 1
+		lineEnd := strings.IndexByte(p.src[next:], '\n')
+		rest := p.src[next:]
+		if lineEnd != -1 {
+			rest = rest[:lineEnd]
+		}
+		if indent := p.src[lineStart:start]; isBlank(indent) && isBlank(strings.TrimSuffix(rest, "\r")) {
+			if strings.HasSuffix(before, indent) {
+				drop = len(indent)
+			}
+			next += len(rest)
+			if lineEnd != -1 {
+				next++
+			}
+		}
+	}
+	if trimBefore {
+		drop = len(before) - len(strings.TrimRight(before, " \t\r\n"))
+	}
+	if trimAfter {
+		next = len(p.src) - len(strings.TrimLeft(p.src[next:], " \t\r\n"))
+	}
+	return drop, next
+}
+
+// isBlank reports whether s holds only spaces and tabs
+func isBlank(s string) bool {
+	return strings.Trim(s, " \t") == ""
+}
+
+// dropText removes n bytes from the end of the last of nodes, a text node
+func dropText(nodes []templateNode, n int) []templateNode {
+	if n == 0 {
+		return nodes
+	}
+	last := len(nodes) - 1
+	nodes[last].text = nodes[last].text[:len(nodes[last].text)-n]
+	if nodes[last].text == "" {
+		nodes = nodes[:last]
+	}
+	return nodes
+}
+
+// splitHelper splits the inside of a tag such as "if name" into the helper
+// and its trimmed argument
+func splitHelper(inner string) (string, string) {
+	i := strings.IndexAny(inner, " \t")
+	if i == -1 {
+		return inner, ""
+	}
+	return inner[:i], strings.TrimSpace(inner[i:])
+}
+
+// topLevel is how a parse ends when it reaches the end of the source:
+// successfully only if it isn't looking for a close tag
+func topLevel(closing string) parseEnd {
+	if closing == "" {
+		return parseClosed
+	}
+	return parseFailed
+}
+
+// isElseTag reports whether the inside of a tag is an {{else}} of a block
+// closed by closing. Only if and unless blocks take {{else if name}} and
+// {{else unless name}}.
+func isElseTag(inner, closing string) bool {
+	inner = strings.TrimSpace(inner)
+	switch closing {
+	case "each", "with":
+		return inner == "else"
+	case "if", "unless":
+		keyword, cond := splitHelper(inner)
+		if keyword != "else" {
+			return false
+		}
+		helper, arg := splitHelper(cond)
+		return cond == "" || (helper == "if" || helper == "unless") && arg != ""
+	}
+	return false
+}
+
+// nodes writes nodes rendered against ctx
+func (r *renderer) nodes(nodes []templateNode, ctx map[string]interface{}) {
+	for _, n := range nodes {
+		switch n.kind {
+		case textNode:
+			r.b.WriteString(n.text)
+		case variableNode:
+			val, ok := resolve(n.text, ctx)
+			// Handle special "." lookup for non-dict items in lists
+			if n.text == "." {
+				if dotVal, found := ctx["."]; found {
+					val, ok = dotVal, true
+				}
+			}
+			if !ok || val == nil {
+				if r.opts.strict {
+					r.undefined = append(r.undefined, n)
+				}
+				val = ""
+			}
+			r.value(n, fmt.Sprintf("%v", val))
+		case sectionNode:
+			r.section(n, ctx)
+		case invertedNode:
+			if isFalsy(lookup(n.text, ctx)) {
+				r.nodes(n.children, ctx)
+			}
+		case eachNode:
+			r.each(n, ctx)
+		case schemaNode:
+			text, ok := r.opts.schemas[n.text]
+			if !ok && r.opts.strict {
+				r.undefined = append(r.undefined, n)
+			}
+			r.b.WriteString(text)
+		case helperNode:
+			r.helper(n, ctx)
+		case withNode:
+			r.with(n, ctx)
+		case ifNode, unlessNode:
+			if isTruthy(lookup(n.text, ctx)) == (n.kind == ifNode) {
+				r.nodes(n.children, ctx)
+			} else {
+				r.nodes(n.elseChildren, ctx)
+			}
+		}
+	}
+}
+
+// section renders {{#key}}...{{/key}}: once per item of a list, in the
+// context of a map, or once if the value is truthy
+func (r *renderer) section(n templateNode, ctx map[string]interface{}) {
+	switch v := lookup(n.text, ctx).(type) {
+	case []interface{}:
+		for i, item := range v {
+			itemCtx := make(map[string]interface{})
+			if m, ok := item.(map[string]interface{}); ok {
+				for k, val := range m {
+					itemCtx[k] = val
+				}
+			} else {
+				itemCtx["_value"] = item
+			}
+			itemCtx["@index"] = i
+			itemCtx["@first"] = i == 0
+			itemCtx["@last"] = i == len(v)-1
+			itemCtx["."] = item
+			r.nodes(n.children, itemCtx)
+		}
+	case bool:
+		if v {
+			r.nodes(n.children, ctx)
+		}
+	case string:
+		if v != "" {
+			r.nodes(n.children, ctx)
+		}
+	case map[string]interface{}:
+		r.nodes(n.children, v)
+	case nil:
+		// Don't render
+	default:
+		r.nodes(n.children, ctx)
+	}
+}
+
+// isFalsy reports whether an inverted section {{^key}} renders for a value
+func isFalsy(val interface{}) bool {
+	switch v := val.(type) {
+	case []interface{}:
+		return len(v) == 0
+	case bool:
+		return !v
+	case string:
+		return v == ""
+	case nil:
+		return true
+	}
+	return false
+}
+
+// with renders {{#with key}}...{{/with}} with the key's value as the
+// context, or its {{else}} if the value is falsy. A value that isn't an
+// object is available as {{.}}.
+func (r *renderer) with(n templateNode, ctx map[string]interface{}) {
+	val := lookup(n.text, ctx)
+	if !isTruthy(val) {
+		r.nodes(n.elseChildren, ctx)
+		return
+	}
+	scope, ok := val.(map[string]interface{})
+	if !ok {
+		scope = map[string]interface{}{".": val}
+	}
+	r.nodes(n.children, scope)
+}
+
+// isTruthy reports whether {{#if key}} renders its body for a value. As in
+// Handlebars, zero is false as well as the values isFalsy treats as false.
+func isTruthy(val interface{}) bool {
+	switch v := val.(type) {
+	case int:
+		return v != 0
+	case float64:
+		return v != 0
+	}
+	return !isFalsy(val)
+}
+
+// each renders {{#each key}}...{{/each}} once per list item or map entry,
+// with map entries in key order, or its {{else}} for an empty or missing
+// value
+func (r *renderer) each(n templateNode, ctx map[string]interface{}) {
+	switch v := lookup(n.text, ctx).(type) {
+	case []interface{}:
+		if len(v) == 0 {
+			r.nodes(n.elseChildren, ctx)
+		}
+		for i, item := range v {
+			itemCtx := make(map[string]interface{})
+			if m, ok := item.(map[string]interface{}); ok {
+				for k, val := range m {
+					itemCtx[k] = val
+				}
+			}
+			itemCtx["@index"] = i
+			itemCtx["@first"] = i == 0
+			itemCtx["@last"] = i == len(v)-1
+			itemCtx["."] = item
+			r.nodes(n.children, itemCtx)
+		}
+	case map[string]interface{}:
+		if len(v) == 0 {
+			r.nodes(n.elseChildren, ctx)
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for i, k := range keys {
+			item := v[k]
+			itemCtx := make(map[string]interface{})
+			if m, ok := item.(map[string]interface{}); ok {
+				for key, val := range m {
+					itemCtx[key] = val
+				}
+			}
+			itemCtx["@key"] = k
+			itemCtx["@index"] = i
+			itemCtx["@first"] = i == 0
+			itemCtx["@last"] = i == len(keys)-1
+			itemCtx["."] = item
+			r.nodes(n.children, itemCtx)
+		}
+	default:
+		r.nodes(n.elseChildren, ctx)
+	}
+}
+
+// helper writes the output of a helper node, calling it with its literal
+// arguments and its variable arguments resolved against ctx
+func (r *renderer) helper(n templateNode, ctx map[string]interface{}) {
+	if len(n.args) == 0 {
+		// A bare helper such as {{uuid}} gives way to a variable of its name
+		if v, ok := resolve(n.text, ctx); ok && v != nil {
+			r.value(n, fmt.Sprintf("%v", v))
+			return
+		}
+	}
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		if v, ok := helperLiteral(arg); ok {
+			args[i] = v
+			continue
+		}
+		v, ok := resolve(arg, ctx)
+		if (!ok || v == nil) && r.opts.strict {
+			r.undefined = append(r.undefined, templateNode{kind: variableNode, text: arg, pos: n.pos})
+		}
+		args[i] = v
+	}
+	fn, _ := lookupHelper(n.text)
+	out, err := fn(args)
+	if err != nil {
+		r.failed = append(r.failed, helperFailure{n, err})
+		return
+	}
+	r.value(n, out)
+}
+
+// value writes the text a variable or helper node renders, escaped unless
+// the node is raw
+func (r *renderer) value(n templateNode, s string) {
+	if r.opts.escape != nil && !n.raw {
+		s = r.opts.escape(s)
+	}
+	r.b.WriteString(s)
+}
+
+// lookup resolves a dotted name, "." or an @-variable against ctx, giving
+// "" for names that resolve to nothing
+func lookup(name string, ctx map[string]interface{}) interface{} {
+	v, ok := resolve(name, ctx)
+	if !ok || v == nil {
+		return ""
+	}
+	return v
+}
+
+// resolve looks up a dotted name, "." or an @-variable against ctx and
+// reports whether it was found
+func resolve(name string, ctx map[string]interface{}) (interface{}, bool) {
+	name = strings.TrimSpace(name)
+	if name == "." {
+		if v, ok := ctx["."]; ok {
+			return v, true
+		}
+		return ctx, true
+	}
+	// Handle @index, @first, @last, @key
+	if strings.HasPrefix(name, "@") {
+		v, ok := ctx[name]
+		return v, ok
+	}
+	parts := strings.Split(name, ".")
+	var current interface{} = ctx
+	for _, part := range parts {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
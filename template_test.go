@@ -0,0 +1,276 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileTemplateMalformed(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"unclosed section", "{{#a}}x {{name}}", "{{#a}}x Ann"},
+		{"stray close", "x{{/a}}y", "x{{/a}}y"},
+		{"unterminated tag", "hi {{name", "hi {{name"},
+		{"empty tag", "a{{}}b", "a{{}}b"},
+		{"nested unclosed", "{{#ok}}{{#a}}{{name}}{{/ok}}", "{{#a}}Ann"},
+		{"mismatched each", "{{#each items}}x", "{{#each items}}x"},
+		{"multiline comment", "a{{! one\ntwo }}b", "ab"},
+		{"brace in tag", "{{ {{name}}", "{{ Ann"},
+	}
+	vars := map[string]interface{}{"name": "Ann", "ok": true}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := renderTemplate(tc.template, vars); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestTemplateValuesNotReexpanded(t *testing.T) {
+	vars := map[string]interface{}{
+		"STDIN":  "{{secret}} {{#each list}}x{{/each}}",
+		"secret": "leaked",
+	}
+	expected := "{{secret}} {{#each list}}x{{/each}}"
+	if got := renderTemplate("{{STDIN}}", vars); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestTemplateScoping(t *testing.T) {
+	vars := map[string]interface{}{
+		"person": map[string]interface{}{
+			"tags": []interface{}{
+				map[string]interface{}{"tag": "a"},
+				map[string]interface{}{"tag": "b"},
+			},
+		},
+	}
+	tmpl := "{{#person}}{{#each tags}}{{tag}}{{/each}}{{/person}}"
+	if got := renderTemplate(tmpl, vars); got != "ab" {
+		t.Errorf("Expected %q, got %q", "ab", got)
+	}
+}
+
+func TestTemplateRenderMany(t *testing.T) {
+	tmpl := compileTemplate("Hello {{name}}{{^last}}, {{/last}}")
+	names := []string{"Ann", "Bob"}
+	for i, name := range names {
+		got := tmpl.Render(map[string]interface{}{"name": name, "last": i == len(names)-1})
+		expected := "Hello " + name
+		if i < len(names)-1 {
+			expected += ", "
+		}
+		if got != expected {
+			t.Errorf("Expected %q, got %q", expected, got)
+		}
+	}
+}
+
+func TestTemplateIfUnless(t *testing.T) {
+	vars := map[string]interface{}{
+		"yes":   true,
+		"no":    false,
+		"zero":  0,
+		"name":  "Ann",
+		"items": []interface{}{"a", "b"},
+		"none":  []interface{}{},
+		"user":  map[string]interface{}{"admin": true},
+	}
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"if true", "{{#if yes}}y{{/if}}", "y"},
+		{"if false", "{{#if no}}y{{/if}}", ""},
+		{"if else", "{{#if no}}y{{else}}n{{/if}}", "n"},
+		{"if missing", "{{#if missing}}y{{else}}n{{/if}}", "n"},
+		{"if zero", "{{#if zero}}y{{else}}n{{/if}}", "n"},
+		{"if string", "{{#if name}}Hi {{name}}{{/if}}", "Hi Ann"},
+		{"if empty list", "{{#if none}}y{{else}}n{{/if}}", "n"},
+		{"if dotted", "{{#if user.admin}}admin{{/if}}", "admin"},
+		{"if keeps context", "{{#if items}}{{name}}{{/if}}", "Ann"},
+		{"else if", "{{#if no}}a{{else if yes}}b{{else}}c{{/if}}", "b"},
+		{"else if falls through", "{{#if no}}a{{else if missing}}b{{else}}c{{/if}}", "c"},
+		{"else unless", "{{#if no}}a{{else unless no}}b{{/if}}", "b"},
+		{"unless", "{{#unless no}}u{{/unless}}", "u"},
+		{"unless else", "{{#unless yes}}u{{else}}e{{/unless}}", "e"},
+		{"nested", "{{#if yes}}{{#if no}}a{{else}}b{{/if}}{{else}}c{{/if}}", "b"},
+		{"inside each", "{{#each items}}{{#if @first}}{{.}}{{else}},{{.}}{{/if}}{{/each}}", "a,b"},
+		{"each else", "{{#each none}}x{{else}}empty{{/each}}", "empty"},
+		{"each else missing", "{{#each missing}}x{{else}}empty{{/each}}", "empty"},
+		{"each else items", "{{#each items}}{{.}}{{else}}empty{{/each}}", "ab"},
+		{"tab after helper", "{{#if\tyes}}y{{/if}}", "y"},
+		{"unclosed if", "{{#if yes}}y", "{{#if yes}}y"},
+		{"second else", "{{#if no}}a{{else}}b{{else}}c{{/if}}", "{{#if no}}abc{{/if}}"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := renderTemplate(tc.template, vars); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestTemplateWith(t *testing.T) {
+	vars := map[string]interface{}{
+		"order": map[string]interface{}{
+			"id": 7,
+			"customer": map[string]interface{}{
+				"name":    "Ann",
+				"address": map[string]interface{}{"city": "Oslo"},
+			},
+		},
+		"title": "Dr",
+		"empty": "",
+	}
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"object", "{{#with order.customer}}{{name}} in {{address.city}}{{/with}}", "Ann in Oslo"},
+		{"nested", "{{#with order}}#{{id}} {{#with customer.address}}{{city}}{{/with}}{{/with}}", "#7 Oslo"},
+		{"scalar", "{{#with title}}{{.}}.{{/with}}", "Dr."},
+		{"missing", "{{#with nobody}}{{name}}{{/with}}", ""},
+		{"else", "{{#with nobody}}{{name}}{{else}}anonymous{{/with}}", "anonymous"},
+		{"falsy", "{{#with empty}}x{{else}}none{{/with}}", "none"},
+		{"rescoped", "{{#with order.customer}}{{title}}{{/with}}", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := renderTemplate(tc.template, vars); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestTemplateRenderStrict(t *testing.T) {
+	vars := map[string]interface{}{
+		"name":  "Ann",
+		"empty": "",
+		"none":  nil,
+		"user":  map[string]interface{}{"email": "ann@example.com"},
+		"items": []interface{}{"a", "b"},
+	}
+	tests := []struct {
+		name     string
+		template string
+		expected string
+		err      string
+	}{
+		{"defined", "Hi {{name}} <{{user.email}}>", "Hi Ann <ann@example.com>", ""},
+		{"empty string is defined", "[{{empty}}]", "[]", ""},
+		{"missing", "Hi {{nmae}}", "", `template:1:4: undefined variable "nmae"`},
+		{"null", "x\n  {{none}}", "", `template:2:3: undefined variable "none"`},
+		{"missing nested", "{{user.phone}}", "", `undefined variable "user.phone"`},
+		{"dot in list", "{{#each items}}{{.}}{{/each}}", "ab", ""},
+		{"missing in loop", "{{#each items}}{{label}}{{/each}}", "", `undefined variable "label"`},
+		{"false section skipped", "{{#empty}}{{nmae}}{{/empty}}ok", "ok", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := compileTemplate(tc.template).RenderStrict(vars)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if got != tc.expected {
+					t.Errorf("Expected %q, got %q", tc.expected, got)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("Expected error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestTemplateRenderStrictReportsOnce(t *testing.T) {
+	vars := map[string]interface{}{"items": []interface{}{"a", "b", "c"}}
+	_, err := compileTemplate("{{#each items}}{{label}}{{/each}} {{other}}").RenderStrict(vars)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if n := strings.Count(err.Error(), "undefined variable"); n != 2 {
+		t.Errorf("Expected 2 undefined variables, got %d: %v", n, err)
+	}
+}
+
+func BenchmarkTemplateRender(b *testing.B) {
+	src := "{{#each items}}{{@index}}: {{name}}{{^@last}}, {{/@last}}{{/each}} {{#meta}}{{author}}{{/meta}}"
+	vars := map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"name": "a"},
+			map[string]interface{}{"name": "b"},
+			map[string]interface{}{"name": "c"},
+		},
+		"meta": map[string]interface{}{"author": "Ann"},
+	}
+	tmpl := compileTemplate(src)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tmpl.Render(vars)
+	}
+}
+
+func TestTemplateWhitespaceControl(t *testing.T) {
+	vars := map[string]interface{}{
+		"items": []interface{}{"a", "b"},
+		"name":  "Ann",
+		"yes":   true,
+	}
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"standalone each", "List:\n{{#each items}}\n- {{.}}\n{{/each}}\nDone", "List:\n- a\n- b\nDone"},
+		{"indented standalone", "  {{#if yes}}\n  x\n  {{/if}}\n", "  x\n"},
+		{"standalone else", "{{#if no}}\nyes\n{{else}}\nno\n{{/if}}\n", "no\n"},
+		{"standalone comment", "a\n{{! note }}\nb", "a\nb"},
+		{"crlf", "{{#if yes}}\r\nx\r\n{{/if}}\r\n", "x\r\n"},
+		{"standalone at end", "x\n{{#if yes}}y{{/if}}", "x\ny"},
+		{"not standalone", "- {{#if yes}}x{{/if}}\n", "- x\n"},
+		{"variables never stand alone", "a\n{{missing}}\nb", "a\n\nb"},
+		{"trim before", "Hello,   \n  {{~name}}!", "Hello,Ann!"},
+		{"trim after", "{{name~}}  \n\n !", "Ann!"},
+		{"trim loop", "[{{#each items~}}\n  {{.}}\n{{~/each}}]", "[ab]"},
+		{"trim else", "{{#if no}}x{{else~}}   y  {{~/if}}", "y"},
+		{"trim comment", "a  {{~! c ~}}  b", "ab"},
+		{"unclosed keeps tag", "{{#open}}\nx", "{{#open}}\nx"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := renderTemplate(tc.template, vars); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestTemplateTripleStash(t *testing.T) {
+	vars := map[string]interface{}{"a": "<b>", "user": map[string]interface{}{"name": "Ann"}}
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{{a}}}", "<b>"},
+		{"{{{ user.name }}}!", "Ann!"},
+		{"{{{upper a}}}", "<B>"},
+		{"{{{missing}}}", ""},
+	}
+	for _, tc := range tests {
+		if got := renderTemplate(tc.template, vars); got != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.template, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// tiktokenURL is where OpenAI publishes the BPE vocabularies its models use.
+// They are downloaded once into the cache directory.
+var tiktokenURL = "https://openaipublic.blob.core.windows.net/encodings/"
+
+// charsPerToken is the rule of thumb for models whose tokenizer isn't known
+const charsPerToken = 4
+
+// tokenizerWS is the Unicode White_Space class that \s means in tiktoken's
+// patterns; \s in Go matches ASCII whitespace only
+const tokenizerWS = `\s\p{Z}\x{0B}\x{85}`
+
+// tokenizerSpec describes a BPE vocabulary: where its ranks are read from
+// and the pattern that splits text into the pieces it encodes separately.
+// Patterns are tiktoken's without the \s+(?!\S) alternative, which Go can't
+// express; pieces handles that case.
+type tokenizerSpec struct {
+	file    string // a .tiktoken file, or "" to download it from tiktokenURL
+	pattern string
+}
+
+// tokenizers are the vocabularies tokens can be counted with, by name. Add
+// more, such as those of local models, in tokenizers.yaml in the config
+// directory.
+var tokenizers = map[string]tokenizerSpec{
+	"cl100k_base": {pattern: `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^` + tokenizerWS + `\p{L}\p{N}]+[\r\n]*|[` + tokenizerWS + `]*[\r\n]+|[` + tokenizerWS + `]+`},
+	"o200k_base": {pattern: `[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|\p{N}{1,3}| ?[^` + tokenizerWS + `\p{L}\p{N}]+[\r\n/]*|[` + tokenizerWS + `]*[\r\n]+|[` + tokenizerWS + `]+`},
+}
+
+// tokenizerModels maps model name prefixes from tokenizers.yaml to the
+// tokenizer that counts them. A prefix with a slash matches provider/model.
+var tokenizerModels = map[string]string{}
+
+// loadUserTokenizers merges a tokenizers.yaml file into the tokenizers:
+//
+//	llama3:
+//	  file: llama3.tiktoken   # BPE ranks in tiktoken's format
+//	  pattern: cl100k_base    # a tokenizer's pattern, or a regular expression
+//	  models: [ollama/llama3, llama-3]
+//
+// Relative files are found in the directory of tokenizers.yaml. Declaring a
+// built-in tokenizer's name, such as cl100k_base, adds models to it. A
+// missing file is not an error.
+func loadUserTokenizers(path string) error {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for name, value := range parseYAML(string(content)) {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: tokenizer %q must be a mapping", path, name)
+		}
+		spec, builtin := tokenizers[name]
+		var models []interface{}
+		for key, v := range fields {
+			switch key {
+			case "file":
+				spec.file = fmt.Sprintf("%v", v)
+				if !filepath.IsAbs(spec.file) {
+					spec.file = filepath.Join(filepath.Dir(path), spec.file)
+				}
+			case "pattern":
+				spec.pattern = fmt.Sprintf("%v", v)
+				if named, ok := tokenizers[spec.pattern]; ok {
+					spec.pattern = named.pattern
+				} else if _, err := regexp.Compile(spec.pattern); err != nil {
+					return fmt.Errorf("%s: %s.pattern: %v", path, name, err)
+				}
+			case "models":
+				if models, ok = v.([]interface{}); !ok {
+					return fmt.Errorf("%s: %s.models must be a list of model names", path, name)
+				}
+			default:
+				return fmt.Errorf("%s: unknown field %s.%s", path, name, key)
+			}
+		}
+		if spec.file == "" && !builtin {
+			return fmt.Errorf("%s: tokenizer %q has no file", path, name)
+		}
+		if spec.pattern == "" {
+			spec.pattern = tokenizers["cl100k_base"].pattern
+		}
+		tokenizers[name] = spec
+		for _, m := range models {
+			tokenizerModels[fmt.Sprintf("%v", m)] = name
+		}
+		log(fmt.Sprintf("Loaded tokenizer %s from %s", name, path))
+	}
+	return nil
+}
+
+// userTokenizer returns the tokenizer tokenizers.yaml assigns a model, by
+// longest matching prefix, or ""
+func userTokenizer(provider, model string) string {
+	full := provider + "/" + model
+	bare := model
+	if i := strings.LastIndex(model, "/"); i != -1 {
+		bare = model[i+1:]
+	}
+	best := ""
+	for prefix := range tokenizerModels {
+		target := bare
+		if strings.Contains(prefix, "/") {
+			target = full
+		}
+		if strings.HasPrefix(target, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	return tokenizerModels[best]
+}
+
+// encodingFor returns the vocabulary a model's tokens are counted with:
+// the one tokenizers.yaml assigns it, the tiktoken vocabulary of an OpenAI
+// model, or "" for other models
+func encodingFor(provider, model string) string {
+	if name := userTokenizer(provider, model); name != "" {
+		return name
+	}
+	if i := strings.LastIndex(model, "/"); i != -1 {
+		if provider != "openrouter" || !strings.HasPrefix(model, "openai/") {
+			return ""
+		}
+		model = model[i+1:]
+	} else if provider != "openai" && provider != "azureopenai" {
+		return ""
+	}
+	for _, prefix := range []string{"gpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "chatgpt-", "o1", "o3", "o4"} {
+		if strings.HasPrefix(model, prefix) {
+			return "o200k_base"
+		}
+	}
+	for _, prefix := range []string{"gpt-4", "gpt-3.5", "text-embedding-"} {
+		if strings.HasPrefix(model, prefix) {
+			return "cl100k_base"
+		}
+	}
+	return ""
+}
+
+// bpe is a tiktoken-compatible byte pair encoder
+type bpe struct {
+	ranks   map[string]int
+	pattern *regexp.Regexp
+}
+
+var (
+	bpeMu    sync.Mutex
+	bpeCache = map[string]*bpe{}
+)
+
+// loadBPE returns the named vocabulary, read from its file or downloaded
+// into the cache directory the first time
+func loadBPE(ctx context.Context, name string) (*bpe, error) {
+	bpeMu.Lock()
+	defer bpeMu.Unlock()
+	if e, ok := bpeCache[name]; ok {
+		return e, nil
+	}
+	spec, ok := tokenizers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown tokenizer %q", name)
+	}
+	path := spec.file
+	if path == "" {
+		path = filepath.Join(cacheDir(), "tiktoken", name+".tiktoken")
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && spec.file == "" {
+		data, err = downloadVocabulary(ctx, name, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ranks, err := parseVocabulary(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	e := &bpe{ranks: ranks, pattern: regexp.MustCompile(spec.pattern)}
+	bpeCache[name] = e
+	return e, nil
+}
+
+func downloadVocabulary(ctx context.Context, name, path string) ([]byte, error) {
+	fmt.Fprintf(os.Stderr, "Downloading the %s vocabulary to %s\n", name, filepath.Dir(path))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tiktokenURL+name+".tiktoken", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %s: %s", req.URL, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseVocabulary(data); err != nil {
+		return nil, fmt.Errorf("downloading %s: %v", req.URL, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return data, writeFileAtomic(path, data, 0644)
+}
+
+// parseVocabulary reads a .tiktoken file: one base64 token and its rank
+// per line
+func parseVocabulary(data []byte) (map[string]int, error) {
+	ranks := map[string]int{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		token, rank, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected a token and a rank", n)
+		}
+		b, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		r, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		ranks[string(b)] = r
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("empty vocabulary")
+	}
+	return ranks, scanner.Err()
+}
+
+// pieces splits text as the vocabulary's pattern does
+func (e *bpe) pieces(text string) []string {
+	var pieces []string
+	for text != "" {
+		end := e.pattern.FindStringIndex(text)[1]
+		piece := text[:end]
+		if end < len(text) && strings.TrimSpace(piece) == "" && !strings.ContainsAny(piece[len(piece)-1:], "\r\n") {
+			// \s+(?!\S): a run of spaces before a word leaves its last
+			// space to the word
+			if _, size := utf8.DecodeLastRuneInString(piece); size < len(piece) {
+				end -= size
+			}
+		}
+		pieces = append(pieces, text[:end])
+		text = text[end:]
+	}
+	return pieces
+}
+
+// count returns the number of tokens text encodes to
+func (e *bpe) count(text string) int {
+	n := 0
+	for _, piece := range e.pieces(text) {
+		n += e.pieceTokens(piece)
+	}
+	return n
+}
+
+// pieceTokens byte-pair merges a piece, always merging the adjacent pair
+// with the lowest rank, and returns the number of tokens left
+func (e *bpe) pieceTokens(piece string) int {
+	if _, ok := e.ranks[piece]; ok {
+		return 1
+	}
+	// bounds holds the start of each token, then the end of the piece
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+	for len(bounds) > 2 {
+		best, at := -1, -1
+		for i := 0; i+2 < len(bounds); i++ {
+			if rank, ok := e.ranks[piece[bounds[i]:bounds[i+2]]]; ok && (at == -1 || rank < best) {
+				best, at = rank, i
+			}
+		}
+		if at == -1 {
+			break
+		}
+		bounds = append(bounds[:at+1], bounds[at+2:]...)
+	}
+	return len(bounds) - 1
+}
+
+// heuristicTokens estimates the tokens in text for a model whose tokenizer
+// isn't known
+func heuristicTokens(text string) int {
+	return (utf8.RuneCountInString(text) + charsPerToken - 1) / charsPerToken
+}
+
+// messageTokens counts the tokens of a conversation as OpenAI's chat format
+// lays it out: each message's role and content plus a few tokens of
+// framing, and the tokens that prime the reply
+func messageTokens(messages []Message, count func(string) int) int {
+	n := 3
+	for _, m := range messages {
+		n += 3 + count(m.Role) + count(m.Content)
+	}
+	return n
+}
+
+// countTokens counts the input tokens of a conversation, and reports how
+// they were counted and whether exactly. OpenAI models and those given a
+// tokenizer in tokenizers.yaml are counted with their vocabulary; others,
+// or when the vocabulary can't be loaded, at about charsPerToken
+// characters a token.
+func countTokens(ctx context.Context, provider, model string, messages []Message) (int, string, bool) {
+	if name := encodingFor(provider, model); name != "" {
+		e, err := loadBPE(ctx, name)
+		if err == nil {
+			return messageTokens(messages, e.count), name, true
+		}
+		fmt.Fprintf(os.Stderr, "Could not load the %s vocabulary, estimating instead: %v\n", name, err)
+	}
+	return messageTokens(messages, heuristicTokens), fmt.Sprintf("about %d characters per token", charsPerToken), false
+}
+
+// tokenCounter returns a function counting the tokens of text for the
+// model, with its vocabulary when there is one and estimating otherwise
+func tokenCounter(ctx context.Context, provider, model string) func(string) int {
+	if name := encodingFor(provider, model); name != "" {
+		e, err := loadBPE(ctx, name)
+		if err == nil {
+			return e.count
+		}
+		fmt.Fprintf(os.Stderr, "Could not load the %s vocabulary, estimating instead: %v\n", name, err)
+	}
+	return heuristicTokens
+}
+
+// writeEstimate prints the number of tokens a prompt will send and what
+// they will cost, without sending it
+func writeEstimate(ctx context.Context, w io.Writer, provider, model string, messages []Message, gen GenerationConfig) {
+	tokens, method, exact := countTokens(ctx, provider, model, messages)
+	approx := "~"
+	if exact {
+		approx = ""
+	}
+	fmt.Fprintf(w, "Prompt tokens: %s%d (%s)\n", approx, tokens, method)
+
+	price, ok := priceFor(model)
+	if !ok {
+		fmt.Fprintf(w, "Input cost:    unknown, no price for %s; add one to %s\n", model, filepath.Join(configDir(), "pricing.yaml"))
+		return
+	}
+	fmt.Fprintf(w, "Input cost:    $%.4f at $%.2f per million tokens\n", *usageCost(model, Usage{InputTokens: tokens}), price.Input)
+	if gen.MaxOutputTokens != nil {
+		maxCost := usageCost(model, Usage{InputTokens: tokens, OutputTokens: *gen.MaxOutputTokens})
+		fmt.Fprintf(w, "Maximum cost:  $%.4f with up to %d output tokens\n", *maxCost, *gen.MaxOutputTokens)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestEncodingFor(t *testing.T) {
+	tests := []struct {
+		provider, model, expected string
+	}{
+		{"openai", "gpt-4o-mini", "o200k_base"},
+		{"openai", "o3-mini", "o200k_base"},
+		{"openai", "gpt-4-turbo", "cl100k_base"},
+		{"azureopenai", "gpt-35-turbo", ""},
+		{"openrouter", "openai/gpt-4.1", "o200k_base"},
+		{"openrouter", "anthropic/claude-sonnet-4", ""},
+		{"anthropic", "claude-sonnet-4-20250514", ""},
+		{"custom", "gpt-4o", ""},
+	}
+	for _, tt := range tests {
+		if got := encodingFor(tt.provider, tt.model); got != tt.expected {
+			t.Errorf("encodingFor(%q, %q): expected %q, got %q", tt.provider, tt.model, tt.expected, got)
+		}
+	}
+}
+
+func TestBPEPieces(t *testing.T) {
+	e := &bpe{pattern: regexp.MustCompile(tokenizers["cl100k_base"].pattern)}
+	got := e.pieces("Hello world  foo 123456\n\n  bar's!!")
+	expected := []string{"Hello", " world", " ", " foo", " ", "123", "456", "\n\n", " ", " bar", "'s", "!!"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	e = &bpe{pattern: regexp.MustCompile(tokenizers["o200k_base"].pattern)}
+	got = e.pieces("HTTPServer isn't\tdone")
+	expected = []string{"HTTPServer", " isn't", "\tdone"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestLoadBPE(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	var vocabulary strings.Builder
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&vocabulary, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), i)
+	}
+	for i, token := range []string{"he", "ll", "hell", "hello"} {
+		fmt.Fprintf(&vocabulary, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), 256+i)
+	}
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cl100k_base.tiktoken" {
+			http.NotFound(w, r)
+			return
+		}
+		downloads++
+		fmt.Fprint(w, vocabulary.String())
+	}))
+	defer server.Close()
+	saved := tiktokenURL
+	tiktokenURL = server.URL + "/"
+	defer func() {
+		tiktokenURL = saved
+		delete(bpeCache, "cl100k_base")
+	}()
+
+	e, err := loadBPE(context.Background(), "cl100k_base")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tests := []struct {
+		text     string
+		expected int
+	}{
+		{"hello", 1},
+		{"hellx", 2},    // hell x
+		{"shell", 2},    // s hell
+		{"hello!", 2},   // hello !
+		{" hello", 2},   // " hello" is one piece: space hello
+		{"hi there", 7}, // h i, then space t he r e
+	}
+	for _, tt := range tests {
+		if got := e.count(tt.text); got != tt.expected {
+			t.Errorf("count(%q): expected %d, got %d", tt.text, tt.expected, got)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(cacheDir(), "tiktoken", "cl100k_base.tiktoken")); err != nil {
+		t.Errorf("Expected the vocabulary to be cached: %v", err)
+	}
+	delete(bpeCache, "cl100k_base")
+	if _, err := loadBPE(context.Background(), "cl100k_base"); err != nil || downloads != 1 {
+		t.Errorf("Expected the cached vocabulary to be used, got %d downloads (%v)", downloads, err)
+	}
+}
+
+func TestWriteEstimate(t *testing.T) {
+	messages := []Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: strings.Repeat("word ", 200)},
+	}
+	maxTokens := 1000
+	var out bytes.Buffer
+	writeEstimate(context.Background(), &out, "anthropic", "claude-sonnet-4-20250514", messages, GenerationConfig{MaxOutputTokens: &maxTokens})
+	// 3 + (3 + 2 + 3) + (3 + 1 + 250)
+	expected := "Prompt tokens: ~265 (about 4 characters per token)\n" +
+		"Input cost:    $0.0008 at $3.00 per million tokens\n" +
+		"Maximum cost:  $0.0158 with up to 1000 output tokens\n"
+	if out.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestLoadUserTokenizers(t *testing.T) {
+	savedTokenizers, savedModels := tokenizers, tokenizerModels
+	tokenizers = map[string]tokenizerSpec{"cl100k_base": savedTokenizers["cl100k_base"]}
+	tokenizerModels = map[string]string{}
+	defer func() {
+		tokenizers, tokenizerModels = savedTokenizers, savedModels
+		delete(bpeCache, "llama3")
+	}()
+
+	dir := t.TempDir()
+	var vocabulary bytes.Buffer
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&vocabulary, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), i)
+	}
+	for i, token := range []string{"he", "ll", "hell", "hello"} {
+		fmt.Fprintf(&vocabulary, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), 256+i)
+	}
+	path := filepath.Join(dir, "tokenizers.yaml")
+	writeFiles(t, dir,
+		"llama3.tiktoken", vocabulary.String(),
+		"tokenizers.yaml", "llama3:\n  file: llama3.tiktoken\n  models: [ollama/llama3, llama-3]\ncl100k_base:\n  models: [my-finetune]\n")
+	if err := loadUserTokenizers(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tests := []struct {
+		provider, model, expected string
+	}{
+		{"ollama", "llama3:8b", "llama3"},
+		{"openrouter", "meta/llama-3-70b", "llama3"},
+		{"openai", "my-finetune-v2", "cl100k_base"},
+		{"ollama", "mistral", ""},
+		{"openai", "gpt-4o", "o200k_base"},
+	}
+	for _, tt := range tests {
+		if got := encodingFor(tt.provider, tt.model); got != tt.expected {
+			t.Errorf("encodingFor(%q, %q): expected %q, got %q", tt.provider, tt.model, tt.expected, got)
+		}
+	}
+	// Counted from the file on disk, without downloading anything
+	tokens, method, exact := countTokens(context.Background(), "ollama", "llama3", []Message{{Role: "user", Content: "hello"}})
+	if tokens != 11 || method != "llama3" || !exact {
+		t.Errorf("Expected 11 tokens exactly with llama3, got %d with %s (exact %v)", tokens, method, exact)
+	}
+
+	for _, content := range []string{
+		"mine:\n  models: [x]\n",
+		"mine:\n  file: x.tiktoken\n  pattern: \"(\"\n",
+		"mine:\n  file: x.tiktoken\n  vocab: y\n",
+	} {
+		writeFiles(t, dir, "tokenizers.yaml", content)
+		if err := loadUserTokenizers(path); err == nil {
+			t.Errorf("Expected an error for %q", content)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Tool is a command the model may call, declared in a tools: list:
+//
+//	tools:
+//	  - name: get_weather
+//	    description: Look up the current weather in a city
+//	    schema:
+//	      city: string, the city name
+//	    command: ./weather.sh
+//
+// The command is run through the shell with the call's arguments as a
+// JSON object on stdin, and what it prints is the result sent back. Tools
+// from MCP servers are called on their server instead.
+type Tool struct {
+	Name        string
+	Description string
+	Schema      map[string]interface{} // the arguments, in picoschema
+	Command     string
+
+	InputSchema map[string]interface{} // the arguments as JSON schema, for MCP tools
+	mcp         *mcpClient
+	mcpName     string // the tool's name on its MCP server
+}
+
+// defaultMaxToolRounds caps the rounds of tool calls in a run when
+// limits.maxToolRounds doesn't
+const defaultMaxToolRounds = 10
+
+// parseTools reads the tools a prompt declares
+func parseTools(meta map[string]interface{}) ([]Tool, error) {
+	v, ok := meta["tools"]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tools must be a list of tools")
+	}
+	tools := make([]Tool, 0, len(list))
+	for i, item := range list {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("tool %d must be a mapping", i+1)
+		}
+		var tool Tool
+		for key, value := range fields {
+			switch key {
+			case "name":
+				tool.Name, _ = value.(string)
+			case "description":
+				tool.Description = fmt.Sprintf("%v", value)
+			case "schema":
+				if tool.Schema, ok = value.(map[string]interface{}); !ok {
+					return nil, fmt.Errorf("tool %d: schema must map argument names to types", i+1)
+				}
+			case "command":
+				tool.Command, _ = value.(string)
+			default:
+				return nil, fmt.Errorf("tool %d: unknown field %s", i+1, key)
+			}
+		}
+		if !pipelineStepNameRe.MatchString(tool.Name) {
+			return nil, fmt.Errorf("tool %d needs a name of letters, digits, - and _", i+1)
+		}
+		if tool.Name == "extract" {
+			return nil, fmt.Errorf("tool name extract is used for structured output")
+		}
+		if tool.Command == "" {
+			return nil, fmt.Errorf("tool %s needs a command", tool.Name)
+		}
+		for _, t := range tools {
+			if t.Name == tool.Name {
+				return nil, fmt.Errorf("two tools are named %s", tool.Name)
+			}
+		}
+		tools = append(tools, tool)
+	}
+	return tools, nil
+}
+
+// parameters is the JSON schema of the tool's arguments
+func (t Tool) parameters() map[string]interface{} {
+	if t.InputSchema != nil {
+		return t.InputSchema
+	}
+	return picoschemaObject(t.Schema)
+}
+
+// runToolCalls runs the tools the model called, in order, and returns a
+// tool message with the result of each. A failing command's error is sent
+// back as its result, so the model can recover. A call that runs longer
+// than timeout, unless it is zero, stops the run with tool_timeout.
+func runToolCalls(ctx context.Context, tools []Tool, calls []ToolCall, timeout time.Duration) ([]Message, error) {
+	results := make([]Message, 0, len(calls))
+	for _, call := range calls {
+		var output string
+		var err error
+		tool, ok := findTool(tools, call.Name)
+		if ok {
+			log(fmt.Sprintf("Calling tool %s with %s", call.Name, call.Arguments))
+			callCtx, cancel := ctx, context.CancelFunc(func() {})
+			if timeout > 0 {
+				callCtx, cancel = context.WithTimeout(ctx, timeout)
+			}
+			output, err = tool.run(callCtx, call.Arguments)
+			cancel()
+			if ctx.Err() == nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+				return results, &limitError{State: stopToolTimeout, Detail: fmt.Sprintf("tool %s ran longer than %v", call.Name, timeout)}
+			}
+		} else {
+			err = fmt.Errorf("no tool named %s", call.Name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: tool %s failed: %v\n", call.Name, err)
+			output = "error: " + err.Error()
+		}
+		log(fmt.Sprintf("Tool %s returned: %s", call.Name, output))
+		results = append(results, Message{Role: "tool", Content: output, ToolCallID: call.ID})
+	}
+	return results, nil
+}
+
+func findTool(tools []Tool, name string) (Tool, bool) {
+	for _, t := range tools {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Tool{}, false
+}
+
+// run runs the tool's command with args on stdin, returning its output
+func (t Tool) run(ctx context.Context, args string) (string, error) {
+	if t.mcp != nil {
+		return t.mcp.callTool(ctx, t.mcpName, args)
+	}
+	if strings.TrimSpace(args) == "" {
+		args = "{}"
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", t.Command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", t.Command)
+	}
+	cmd.Env = append(os.Environ(), "TOOL_NAME="+t.Name)
+	cmd.Stdin = strings.NewReader(args)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	// Don't wait on a process the command started that keeps its output open
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%v: %s", err, msg)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// toolArgumentsObject decodes a call's JSON arguments for providers that
+// take them as an object
+func toolArgumentsObject(args string) interface{} {
+	var input interface{}
+	if err := json.Unmarshal([]byte(args), &input); err != nil || input == nil {
+		return map[string]interface{}{}
+	}
+	return input
+}
+
+// hasToolMessages reports whether a conversation includes tool calls or
+// their results, which each API encodes in its own way
+func hasToolMessages(messages []Message) bool {
+	for _, m := range messages {
+		if len(m.ToolCalls) > 0 || m.Role == "tool" {
+			return true
+		}
+	}
+	return false
+}
+
+// openAIToolMessages encodes a conversation with tool calls for the chat
+// completions API
+func openAIToolMessages(messages []Message) []interface{} {
+	encoded := make([]interface{}, 0, len(messages))
+	for _, m := range messages {
+		switch {
+		case m.Role == "tool":
+			encoded = append(encoded, map[string]interface{}{"role": "tool", "tool_call_id": m.ToolCallID, "content": m.Content})
+		case len(m.ToolCalls) > 0:
+			calls := make([]interface{}, len(m.ToolCalls))
+			for i, c := range m.ToolCalls {
+				calls[i] = map[string]interface{}{
+					"id":       c.ID,
+					"type":     "function",
+					"function": map[string]interface{}{"name": c.Name, "arguments": c.Arguments},
+				}
+			}
+			msg := map[string]interface{}{"role": m.Role, "content": nil, "tool_calls": calls}
+			if m.Content != "" {
+				msg["content"] = m.Content
+			}
+			encoded = append(encoded, msg)
+		default:
+			encoded = append(encoded, m)
+		}
+	}
+	return encoded
+}
+
+// anthropicToolMessages encodes a conversation with tool calls for the
+// Messages API, where calls are tool_use blocks and their results
+// tool_result blocks in the user turn that follows
+func anthropicToolMessages(messages []Message) []interface{} {
+	encoded := make([]interface{}, 0, len(messages))
+	var results []interface{}
+	for _, m := range messages {
+		if m.Role == "tool" {
+			results = append(results, map[string]interface{}{"type": "tool_result", "tool_use_id": m.ToolCallID, "content": m.Content})
+			continue
+		}
+		if results != nil {
+			encoded = append(encoded, map[string]interface{}{"role": "user", "content": results})
+			results = nil
+		}
+		if len(m.ToolCalls) == 0 {
+			encoded = append(encoded, m)
+			continue
+		}
+		var blocks []interface{}
+		if m.Content != "" {
+			blocks = append(blocks, map[string]interface{}{"type": "text", "text": m.Content})
+		}
+		for _, c := range m.ToolCalls {
+			blocks = append(blocks, map[string]interface{}{"type": "tool_use", "id": c.ID, "name": c.Name, "input": toolArgumentsObject(c.Arguments)})
+		}
+		encoded = append(encoded, map[string]interface{}{"role": m.Role, "content": blocks})
+	}
+	if results != nil {
+		encoded = append(encoded, map[string]interface{}{"role": "user", "content": results})
+	}
+	return encoded
+}
@@ -0,0 +1,554 @@
+//go:build ignore
+
+// build.go cross-compiles release binaries of runprompt into dist/.
+//
+// Usage:
+//
+//	go run tools/build.go [version]
+//	go run tools/build.go --changelog <version>
+//	go run tools/build.go --verify <version>
+//
+// Targets are built concurrently and skipped when neither the sources nor the
+// build settings have changed since the last build into dist/.
+//
+// Builds are reproducible: they use -trimpath, an empty build ID, no VCS
+// stamping and a pinned toolchain, so rebuilding a tagged release must yield
+// byte-identical binaries. The expected hashes are recorded in
+// dist/runprompt_<version>_checksums.txt.
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Target is a GOOS/GOARCH pair to build
+type Target struct {
+	OS   string
+	Arch string
+}
+
+var targets = []Target{
+	{"linux", "amd64"},
+	{"linux", "arm64"},
+	{"linux", "riscv64"},
+	{"darwin", "amd64"},
+	{"darwin", "arm64"},
+	{"windows", "amd64"},
+	{"windows", "arm64"},
+	{"freebsd", "amd64"},
+	{"openbsd", "amd64"},
+}
+
+const (
+	distDir = "dist"
+	// maxBinarySize is the size budget for a single release binary
+	maxBinarySize = 16 << 20
+	// pinnedToolchain is the Go toolchain release binaries are built with
+	pinnedToolchain = "go1.23.4"
+	// releaseURL is where published release assets are downloaded from
+	releaseURL = "https://github.com/x86ed/runprompt/releases/download/%s/%s"
+	// cacheFile records the inputs each binary in dist/ was built from
+	cacheFile = ".buildcache.json"
+)
+
+var toolchain = pinnedToolchain
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+// binaryName returns the output file name for a target
+func binaryName(version string, t Target) string {
+	name := fmt.Sprintf("runprompt_%s_%s_%s", version, t.OS, t.Arch)
+	if t.OS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// checksumsName returns the checksum file name for a release
+func checksumsName(version string) string {
+	return fmt.Sprintf("runprompt_%s_checksums.txt", version)
+}
+
+// build compiles a single target from srcDir into outDir and returns the output path
+func build(version string, t Target, srcDir, outDir string) (string, error) {
+	out, err := filepath.Abs(filepath.Join(outDir, binaryName(version, t)))
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command("go", "build",
+		"-trimpath",
+		"-buildvcs=false",
+		"-ldflags", fmt.Sprintf("-s -w -buildid= -X main.version=%s", version),
+		"-o", out, ".")
+	cmd.Dir = srcDir
+	cmd.Env = append(os.Environ(),
+		"GOOS="+t.OS, "GOARCH="+t.Arch, "CGO_ENABLED=0", "GOTOOLCHAIN="+toolchain)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// hashFile returns the hex SHA-256 of a file
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeChecksums writes hashes in sha256sum format
+func writeChecksums(path string, hashes map[string]string) error {
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s  %s\n", hashes[name], name)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// parseChecksums parses sha256sum-format content into a name->hash map
+func parseChecksums(r io.Reader) (map[string]string, error) {
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		hashes[strings.TrimPrefix(fields[1], "*")] = fields[0]
+	}
+	return hashes, scanner.Err()
+}
+
+// loadChecksums reads published checksums from a local path or URL
+func loadChecksums(source string) (map[string]string, error) {
+	if strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://") {
+		resp, err := http.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GET %s: %s", source, resp.Status)
+		}
+		return parseChecksums(resp.Body)
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseChecksums(f)
+}
+
+var jobs = runtime.NumCPU()
+
+// cacheEntry records what a binary in dist/ was built from
+type cacheEntry struct {
+	Inputs string `json:"inputs"`
+	SHA256 string `json:"sha256"`
+}
+
+// sourceHash hashes every file that can affect the build output, so a
+// target only needs rebuilding when this changes
+func sourceHash(srcDir string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(srcDir, path)
+		if d.IsDir() {
+			if rel == ".git" || rel == distDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(rel, "_test.go") {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", filepath.ToSlash(rel), len(content))
+		h.Write(content)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loadCache reads the build cache, returning an empty cache if missing
+func loadCache(path string) map[string]cacheEntry {
+	cache := make(map[string]cacheEntry)
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &cache)
+	}
+	return cache
+}
+
+// upToDate reports whether out was built from inputs and is unmodified
+func upToDate(out string, entry cacheEntry, inputs string) bool {
+	if entry.Inputs != inputs {
+		return false
+	}
+	hash, err := hashFile(out)
+	return err == nil && hash == entry.SHA256
+}
+
+// buildAll builds every target with a pool of workers and returns the
+// binary hashes by file name. When cache is non-nil, targets whose inputs are
+// unchanged are skipped and the cache is updated in place.
+func buildAll(version, srcDir, outDir string, workers int, cache map[string]cacheEntry) (map[string]string, error) {
+	srcHash, err := sourceHash(srcDir)
+	if err != nil {
+		return nil, fmt.Errorf("hashing sources: %v", err)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var mu sync.Mutex
+	hashes := make(map[string]string)
+	var errs []string
+
+	work := make(chan Target)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range work {
+				name := binaryName(version, t)
+				out := filepath.Join(outDir, name)
+				inputs := strings.Join([]string{srcHash, version, toolchain, t.OS, t.Arch}, "/")
+
+				mu.Lock()
+				entry, cached := cache[name]
+				mu.Unlock()
+				if cached && upToDate(out, entry, inputs) {
+					fmt.Printf("Skipping %s/%s (up to date)\n", t.OS, t.Arch)
+					mu.Lock()
+					hashes[name] = entry.SHA256
+					mu.Unlock()
+					continue
+				}
+
+				fmt.Printf("Building %s/%s\n", t.OS, t.Arch)
+				hash, err := buildTarget(version, t, srcDir, outDir)
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("%s/%s: %v", t.OS, t.Arch, err))
+				} else {
+					hashes[name] = hash
+					if cache != nil {
+						cache[name] = cacheEntry{Inputs: inputs, SHA256: hash}
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, t := range targets {
+		work <- t
+	}
+	close(work)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return hashes, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return hashes, nil
+}
+
+// buildTarget builds and checks one target, returning the binary hash
+func buildTarget(version string, t Target, srcDir, outDir string) (string, error) {
+	out, err := build(version, t, srcDir, outDir)
+	if err != nil {
+		return "", fmt.Errorf("build failed: %v", err)
+	}
+	if err := checkStatic(out, t); err != nil {
+		return "", fmt.Errorf("static check failed: %v", err)
+	}
+	if err := checkSize(out); err != nil {
+		return "", fmt.Errorf("size check failed: %v", err)
+	}
+	return hashFile(out)
+}
+
+// verify rebuilds a tagged release in a clean worktree and compares the
+// binaries against the published checksums
+func verify(version, checksumsSource string) error {
+	if checksumsSource == "" {
+		checksumsSource = fmt.Sprintf(releaseURL, version, checksumsName(version))
+	}
+	expected, err := loadChecksums(checksumsSource)
+	if err != nil {
+		return fmt.Errorf("loading checksums: %v", err)
+	}
+
+	tmp, err := os.MkdirTemp("", "runprompt-verify-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	srcDir := filepath.Join(tmp, "src")
+	if _, err := git("worktree", "add", "--detach", srcDir, version); err != nil {
+		return fmt.Errorf("checking out %s: %v", version, err)
+	}
+	defer git("worktree", "remove", "--force", srcDir)
+
+	built, err := buildAll(version, srcDir, tmp, jobs, nil)
+	if err != nil {
+		return err
+	}
+
+	mismatches := 0
+	for _, t := range targets {
+		name := binaryName(version, t)
+		want, ok := expected[name]
+		if !ok {
+			fmt.Printf("SKIP  %s (not published)\n", name)
+			continue
+		}
+		if got := built[name]; got != want {
+			fmt.Printf("FAIL  %s\n  expected %s\n  got      %s\n", name, want, got)
+			mismatches++
+		} else {
+			fmt.Printf("OK    %s\n", name)
+		}
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("%d binaries do not match the published checksums", mismatches)
+	}
+	return nil
+}
+
+// checkStatic verifies an ELF binary has no dynamic interpreter or shared
+// library dependencies. Darwin, Windows and OpenBSD binaries always make
+// system calls through the system libraries, so they are exempt.
+func checkStatic(path string, t Target) error {
+	if t.OS == "darwin" || t.OS == "windows" || t.OS == "openbsd" {
+		return nil
+	}
+	f, err := elf.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return fmt.Errorf("%s has a dynamic interpreter", path)
+		}
+	}
+	libs, err := f.ImportedLibraries()
+	if err != nil {
+		return err
+	}
+	if len(libs) > 0 {
+		return fmt.Errorf("%s links against %s", path, strings.Join(libs, ", "))
+	}
+	return nil
+}
+
+// checkSize verifies a binary fits in the size budget
+func checkSize(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > maxBinarySize {
+		return fmt.Errorf("%s is %d bytes, over the %d byte budget", path, info.Size(), maxBinarySize)
+	}
+	return nil
+}
+
+// changelogSections lists conventional-commit types in output order
+var changelogSections = []struct {
+	Type  string
+	Title string
+}{
+	{"feat", "Features"},
+	{"fix", "Bug Fixes"},
+	{"perf", "Performance"},
+	{"refactor", "Refactoring"},
+	{"docs", "Documentation"},
+	{"test", "Tests"},
+	{"build", "Build"},
+	{"ci", "CI"},
+	{"chore", "Chores"},
+	{"", "Other Changes"},
+}
+
+var conventionalRe = regexp.MustCompile(`^(\w+)(\([^)]*\))?!?:\s*(.+)$`)
+
+// git runs a git command and returns its trimmed output
+func git(args ...string) (string, error) {
+	out, err := exec.Command("git", args...).Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// previousTag returns the most recent tag before version, or "" if none
+func previousTag(version string) string {
+	ref := "HEAD"
+	if _, err := git("rev-parse", "--verify", "--quiet", "refs/tags/"+version); err == nil {
+		ref = version + "^"
+	}
+	tag, err := git("describe", "--tags", "--abbrev=0", ref)
+	if err != nil {
+		return ""
+	}
+	return tag
+}
+
+// groupCommits buckets commit subjects by conventional-commit type
+func groupCommits(subjects []string) map[string][]string {
+	known := make(map[string]bool)
+	for _, section := range changelogSections {
+		known[section.Type] = true
+	}
+	groups := make(map[string][]string)
+	for _, subject := range subjects {
+		subject = strings.TrimSpace(subject)
+		if subject == "" {
+			continue
+		}
+		commitType := ""
+		entry := subject
+		if m := conventionalRe.FindStringSubmatch(subject); m != nil && known[strings.ToLower(m[1])] {
+			commitType = strings.ToLower(m[1])
+			entry = m[3]
+			if m[2] != "" {
+				entry = fmt.Sprintf("**%s:** %s", strings.Trim(m[2], "()"), entry)
+			}
+		}
+		groups[commitType] = append(groups[commitType], entry)
+	}
+	return groups
+}
+
+// writeChangelog writes dist/CHANGELOG_<version>.md from commits since the previous tag
+func writeChangelog(version string) (string, error) {
+	logRange := "HEAD"
+	prev := previousTag(version)
+	if prev != "" {
+		logRange = prev + "..HEAD"
+	}
+	out, err := git("log", "--no-merges", "--pretty=format:%s", logRange)
+	if err != nil {
+		return "", fmt.Errorf("git log %s: %v", logRange, err)
+	}
+	groups := groupCommits(strings.Split(out, "\n"))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n", version)
+	if prev != "" {
+		fmt.Fprintf(&b, "\nChanges since %s.\n", prev)
+	}
+	for _, section := range changelogSections {
+		entries := groups[section.Type]
+		if len(entries) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n## %s\n\n", section.Title)
+		for _, entry := range entries {
+			fmt.Fprintf(&b, "- %s\n", entry)
+		}
+	}
+
+	if err := os.MkdirAll(distDir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(distDir, fmt.Sprintf("CHANGELOG_%s.md", version))
+	return path, os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+func main() {
+	changelog := flag.Bool("changelog", false, "write dist/CHANGELOG_<version>.md instead of building")
+	verifyFlag := flag.Bool("verify", false, "rebuild <version> and compare against published checksums")
+	checksums := flag.String("checksums", "", "checksum file path or URL to verify against (default: GitHub release)")
+	flag.StringVar(&toolchain, "toolchain", pinnedToolchain, "GOTOOLCHAIN to build with")
+	flag.IntVar(&jobs, "j", jobs, "number of targets to build concurrently")
+	flag.Parse()
+
+	version := "dev"
+	if flag.NArg() > 0 {
+		version = flag.Arg(0)
+	}
+
+	if *changelog {
+		path, err := writeChangelog(version)
+		if err != nil {
+			fail("Error writing changelog: %v", err)
+		}
+		fmt.Printf("Wrote %s\n", path)
+		return
+	}
+
+	if *verifyFlag {
+		if flag.NArg() == 0 {
+			fail("--verify requires a version")
+		}
+		if err := verify(version, *checksums); err != nil {
+			fail("Verification failed: %v", err)
+		}
+		fmt.Printf("All binaries for %s match the published checksums\n", version)
+		return
+	}
+
+	if err := os.MkdirAll(distDir, 0755); err != nil {
+		fail("Error creating %s: %v", distDir, err)
+	}
+
+	cachePath := filepath.Join(distDir, cacheFile)
+	cache := loadCache(cachePath)
+	hashes, err := buildAll(version, ".", distDir, jobs, cache)
+	if data, merr := json.MarshalIndent(cache, "", "  "); merr == nil {
+		os.WriteFile(cachePath, data, 0644)
+	}
+	if err != nil {
+		fail("Release build failed:\n%v", err)
+	}
+	if err := writeChecksums(filepath.Join(distDir, checksumsName(version)), hashes); err != nil {
+		fail("Error writing checksums: %v", err)
+	}
+	fmt.Printf("Built %d targets into %s/\n", len(targets), distDir)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseTools(t *testing.T) {
+	meta := parseYAML(`tools:
+  - name: get_weather
+    description: Look up the weather
+    schema:
+      city: string, the city name
+    command: ./weather.sh`)
+	tools, err := parseTools(meta)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(tools) != 1 || tools[0].Name != "get_weather" || tools[0].Command != "./weather.sh" {
+		t.Fatalf("Expected the get_weather tool, got %+v", tools)
+	}
+	params := tools[0].parameters()
+	if props, _ := params["properties"].(map[string]interface{}); props["city"] == nil {
+		t.Errorf("Expected a city parameter, got %v", params)
+	}
+
+	for _, content := range []string{
+		"tools: weather.sh",
+		"tools:\n  - name: get weather\n    command: x",
+		"tools:\n  - name: extract\n    command: x",
+		"tools:\n  - name: lookup",
+		"tools:\n  - name: lookup\n    command: x\n    timeout: 5",
+		"tools:\n  - name: lookup\n    command: x\n  - name: lookup\n    command: y",
+	} {
+		if _, err := parseTools(parseYAML(content)); err == nil {
+			t.Errorf("Expected error for %q", content)
+		}
+	}
+}
+
+func TestRunToolCalls(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("tool commands in this test use sh")
+	}
+	tools := []Tool{
+		{Name: "echo", Command: `printf "%s:" "$TOOL_NAME"; cat`},
+		{Name: "fail", Command: "echo broken >&2; exit 1"},
+	}
+	messages, err := runToolCalls(context.Background(), tools, []ToolCall{
+		{ID: "1", Name: "echo", Arguments: `{"a":1}`},
+		{ID: "2", Name: "fail"},
+		{ID: "3", Name: "missing"},
+	}, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []Message{
+		{Role: "tool", Content: `echo:{"a":1}`, ToolCallID: "1"},
+		{Role: "tool", Content: "error: exit status 1: broken", ToolCallID: "2"},
+		{Role: "tool", Content: "error: no tool named missing", ToolCallID: "3"},
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, messages)
+	}
+
+	// A command that hangs is stopped by limits.toolTimeout
+	tools = append(tools, Tool{Name: "hang", Command: "sleep 10"})
+	start := time.Now()
+	_, err = runToolCalls(context.Background(), tools, []ToolCall{{ID: "4", Name: "hang"}}, 50*time.Millisecond)
+	var limitErr *limitError
+	if !errors.As(err, &limitErr) || limitErr.State != stopToolTimeout {
+		t.Errorf("Expected %s, got %v", stopToolTimeout, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the tool to be stopped, took %v", elapsed)
+	}
+}
+
+func TestToolMessages(t *testing.T) {
+	messages := []Message{
+		{Role: "user", Content: "Weather in Paris?"},
+		{Role: "assistant", ToolCalls: []ToolCall{{ID: "c1", Name: "get_weather", Arguments: `{"city":"Paris"}`}}},
+		{Role: "tool", Content: "sunny", ToolCallID: "c1"},
+	}
+	encode := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+
+	openAI := encode(openAIToolMessages(messages))
+	for _, want := range []string{`"tool_calls":[{"function":{"arguments":"{\"city\":\"Paris\"}","name":"get_weather"},"id":"c1","type":"function"}]`, `{"content":"sunny","role":"tool","tool_call_id":"c1"}`} {
+		if !strings.Contains(openAI, want) {
+			t.Errorf("Expected OpenAI messages to contain %s, got %s", want, openAI)
+		}
+	}
+
+	anthropic := encode(anthropicToolMessages(messages))
+	for _, want := range []string{`{"id":"c1","input":{"city":"Paris"},"name":"get_weather","type":"tool_use"}`, `{"content":[{"content":"sunny","tool_use_id":"c1","type":"tool_result"}],"role":"user"}`} {
+		if !strings.Contains(anthropic, want) {
+			t.Errorf("Expected Anthropic messages to contain %s, got %s", want, anthropic)
+		}
+	}
+}
+
+// toolServer asks for the echo tool until it has been called rounds times,
+// then answers with the last tool result it was sent
+func toolServer(t *testing.T, rounds int32) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		var body struct {
+			Tools    []interface{}            `json:"tools"`
+			Messages []map[string]interface{} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if len(body.Tools) != 1 {
+			t.Errorf("Expected the echo tool to be offered, got %v", body.Tools)
+		}
+		message := map[string]interface{}{"role": "assistant", "content": nil, "tool_calls": []interface{}{map[string]interface{}{
+			"id":       "call",
+			"type":     "function",
+			"function": map[string]interface{}{"name": "echo", "arguments": `{"text":"from the tool"}`},
+		}}}
+		if n > rounds {
+			last := body.Messages[len(body.Messages)-1]
+			message = map[string]interface{}{"role": "assistant", "content": last["role"].(string) + ": " + last["content"].(string)}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{"message": message}},
+			"usage":   map[string]interface{}{"prompt_tokens": 10, "completion_tokens": 5},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestCompleteTools(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("tool commands in this test use sh")
+	}
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	meta := func(url string, limits map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"baseURL": url,
+			"limits":  limits,
+			"tools":   []interface{}{map[string]interface{}{"name": "echo", "command": "cat"}},
+		}
+	}
+	pr := promptRun{
+		path:     "tools.prompt",
+		provider: "custom",
+		model:    "x",
+		messages: []Message{{Role: "user", Content: "Call the tool."}},
+	}
+
+	server, calls := toolServer(t, 2)
+	pr.meta = meta(server.URL, nil)
+	c, err := complete(context.Background(), pr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := `tool: {"text":"from the tool"}`; c.Reply != expected {
+		t.Errorf("Expected %q, got %q", expected, c.Reply)
+	}
+	if n := atomic.LoadInt32(calls); n != 3 || c.Requests != 3 {
+		t.Errorf("Expected 3 requests, got %d (%d counted)", n, c.Requests)
+	}
+
+	server, _ = toolServer(t, 5)
+	pr.meta = meta(server.URL, map[string]interface{}{"maxToolRounds": 2})
+	_, err = complete(context.Background(), pr)
+	var limitErr *limitError
+	if !errors.As(err, &limitErr) || limitErr.State != stopToolRounds {
+		t.Errorf("Expected %s, got %v", stopToolRounds, err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// outputTransform is one step of an output.transform pipeline
+type outputTransform struct {
+	name string
+	arg  string
+	re   *regexp.Regexp
+}
+
+// transformNames lists the supported transforms and whether each takes an
+// argument
+var transformNames = map[string]bool{
+	"trim":             false,
+	"strip-code-fence": false,
+	"json-parse":       false,
+	"regex-extract":    true,
+}
+
+// parseTransforms reads output.transform: a transform name, or a list of
+// names and "name: argument" strings or single-key maps:
+//
+//	transform: [strip-code-fence, "regex-extract: \\{.*\\}", json-parse]
+func parseTransforms(v interface{}) ([]outputTransform, error) {
+	var items []interface{}
+	switch t := v.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		items = t
+	default:
+		items = []interface{}{t}
+	}
+
+	var transforms []outputTransform
+	for _, item := range items {
+		var name, arg string
+		switch t := item.(type) {
+		case string:
+			name, arg, _ = strings.Cut(t, ":")
+		case map[string]interface{}:
+			if len(t) != 1 {
+				return nil, fmt.Errorf("output.transform: %v must have exactly one key", t)
+			}
+			for k, v := range t {
+				name, arg = k, fmt.Sprintf("%v", v)
+			}
+		default:
+			return nil, fmt.Errorf("output.transform: invalid step %v", item)
+		}
+		name, arg = strings.TrimSpace(name), strings.TrimSpace(arg)
+
+		takesArg, ok := transformNames[name]
+		if !ok {
+			return nil, fmt.Errorf("output.transform: unknown transform %q", name)
+		}
+		if takesArg && arg == "" {
+			return nil, fmt.Errorf("output.transform: %s requires an argument", name)
+		}
+		if !takesArg && arg != "" {
+			return nil, fmt.Errorf("output.transform: %s takes no argument", name)
+		}
+		tr := outputTransform{name: name, arg: arg}
+		if name == "regex-extract" {
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("output.transform: regex-extract: %v", err)
+			}
+			tr.re = re
+		}
+		transforms = append(transforms, tr)
+	}
+	return transforms, nil
+}
+
+// codeFenceRe matches a markdown fenced code block
+var codeFenceRe = regexp.MustCompile("(?s)```[\\w+-]*[ \\t]*\\r?\\n(.*?)\\r?\\n?```")
+
+// applyTransforms runs the model output through each transform in order
+func applyTransforms(text string, transforms []outputTransform) (string, error) {
+	for _, t := range transforms {
+		switch t.name {
+		case "trim":
+			text = strings.TrimSpace(text)
+		case "strip-code-fence":
+			if m := codeFenceRe.FindStringSubmatch(text); m != nil {
+				text = m[1]
+			}
+		case "json-parse":
+			var value interface{}
+			if err := json.Unmarshal([]byte(strings.TrimSpace(text)), &value); err != nil {
+				return "", fmt.Errorf("json-parse: %v", err)
+			}
+			data, _ := json.MarshalIndent(value, "", "  ")
+			text = string(data)
+		case "regex-extract":
+			m := t.re.FindStringSubmatch(text)
+			if m == nil {
+				return "", fmt.Errorf("regex-extract: no match for %s", t.arg)
+			}
+			text = m[0]
+			if len(m) > 1 {
+				text = m[1]
+			}
+		}
+		log(fmt.Sprintf("After %s: %s", t.name, text))
+	}
+	return text, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestApplyTransforms(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform string
+		input     string
+		expected  string
+	}{
+		{"trim", `trim`, "  hi \n", "hi"},
+		{"strip fence", `strip-code-fence`, "Here you go:\n```json\n{\"a\": 1}\n```\nEnjoy", `{"a": 1}`},
+		{"no fence", `strip-code-fence`, "plain", "plain"},
+		{"json parse", `[strip-code-fence, json-parse]`, "```\n{\"a\":1}\n```", "{\n  \"a\": 1\n}"},
+		{"regex whole match", `["regex-extract: \\d+"]`, "total: 42 items", "42"},
+		{"regex group", `["regex-extract: name=(\\w+), age"]`, "name=Ann, age=3", "Ann"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			transforms, err := parseTransforms(parseYAMLValue(tc.transform))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			got, err := applyTransforms(tc.input, transforms)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+	parseErrors := []string{`shout`, `[trim: x]`, `regex-extract`, `["regex-extract: ("]`}
+	for _, spec := range parseErrors {
+		if _, err := parseTransforms(parseYAMLValue(spec)); err == nil {
+			t.Errorf("Expected parse error for %s", spec)
+		}
+	}
+
+	transforms, _ := parseTransforms(parseYAMLValue(`[json-parse]`))
+	if _, err := applyTransforms("not json", transforms); err == nil {
+		t.Error("Expected json-parse error")
+	}
+	transforms, _ = parseTransforms(map[string]interface{}{"regex-extract": "x+"})
+	if _, err := applyTransforms("abc", transforms); err == nil {
+		t.Error("Expected regex-extract error")
+	}
+}
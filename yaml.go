@@ -0,0 +1,729 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Frontmatter, config and pricing files are read with a YAML subset: block
+// mappings and sequences, flow collections ([a, b] and {a: 1}), plain,
+// quoted and block scalars (| and >), comments, and anchors (&name) with
+// aliases (*name) and << merge keys. Tags, directives, multiple documents
+// and complex keys are not supported.
+//
+// Scalars resolve as in YAML 1.2's core schema, except that true and false
+// may be written in any case, as they always could in frontmatter.
+
+// yamlParser reads a YAML document line by line. Each block node consumes
+// the lines indented beneath its parent.
+type yamlParser struct {
+	lines    []string
+	i        int // next line to read
+	anchors  map[string]interface{}
+	keyLines map[string]int // dotted key path to its line index
+	errs     []*sourceError
+}
+
+func newYAMLParser(s string) *yamlParser {
+	return &yamlParser{
+		lines:    strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n"),
+		anchors:  map[string]interface{}{},
+		keyLines: map[string]int{},
+	}
+}
+
+// parseYAMLDocument parses frontmatter, which must be a mapping. It returns
+// the mapping, the index of the line each dotted key path is on, and the
+// syntax errors found, which don't stop the rest of the document parsing.
+func parseYAMLDocument(s string) (map[string]interface{}, map[string]int, []*sourceError) {
+	p := newYAMLParser(s)
+	result := map[string]interface{}{}
+	for {
+		i, indent := p.peek()
+		if i == -1 {
+			break
+		}
+		for k, v := range p.mapping(indent, "") {
+			result[k] = v
+		}
+		if p.i <= i {
+			p.errorAt(i, indent, `expected "key: value"`)
+			p.i = i + 1
+		}
+	}
+	return result, p.keyLines, p.errs
+}
+
+// parseYAML parses frontmatter, skipping any lines with syntax errors
+func parseYAML(s string) map[string]interface{} {
+	result, _, _ := parseYAMLDocument(s)
+	return result
+}
+
+// checkFrontmatter reports frontmatter syntax errors
+func checkFrontmatter(s string) []*sourceError {
+	_, _, errs := parseYAMLDocument(s)
+	return errs
+}
+
+// parseYAMLValue parses a value given on the command line, in an
+// environment variable or in a query string. A single line is a scalar or
+// flow collection, never a mapping, so "--title=Note: hi" stays a string.
+func parseYAMLValue(s string) interface{} {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	p := newYAMLParser(s)
+	var v interface{}
+	switch {
+	case strings.Contains(s, "\n"):
+		v = p.block(-1, "")
+	case strings.ContainsAny(s[:1], `[{"'`):
+		v = p.value(s, 0, -1, "", false)
+	default:
+		return resolveYAMLScalar(s)
+	}
+	if len(p.errs) > 0 {
+		return s
+	}
+	return v
+}
+
+func (p *yamlParser) errorAt(i, col int, format string, args ...interface{}) {
+	p.errs = append(p.errs, &sourceError{
+		Line: i + 1,
+		Col:  col + 1,
+		Msg:  fmt.Sprintf(format, args...),
+		Text: p.lines[i],
+	})
+}
+
+// peek finds the next line with content, skipping blank and comment
+// lines, and returns its index and indentation, or -1 at the end
+func (p *yamlParser) peek() (int, int) {
+	for i := p.i; i < len(p.lines); i++ {
+		trimmed := strings.TrimLeft(p.lines[i], " \t")
+		if trimmed != "" && trimmed[0] != '#' {
+			return i, len(p.lines[i]) - len(trimmed)
+		}
+	}
+	return -1, 0
+}
+
+// block parses the node on the following lines, which must be indented
+// more than parent; there is none if they aren't
+func (p *yamlParser) block(parent int, path string) interface{} {
+	i, indent := p.peek()
+	if i == -1 || indent <= parent {
+		return nil
+	}
+	content := p.lines[i][indent:]
+	switch {
+	case isSequenceEntry(content):
+		return p.sequence(indent, path)
+	case isMappingEntry(content):
+		return p.mapping(indent, path)
+	}
+	p.i = i + 1
+	return p.value(content, i, parent, path, false)
+}
+
+// mapping parses the "key: value" lines at indent
+func (p *yamlParser) mapping(indent int, path string) map[string]interface{} {
+	m := map[string]interface{}{}
+	var merges []map[string]interface{}
+	for {
+		i, ind := p.peek()
+		if i == -1 || ind < indent {
+			break
+		}
+		if ind > indent {
+			p.errorAt(i, ind, "unexpected indentation")
+			p.i = i + 1
+			continue
+		}
+		content := p.lines[i][ind:]
+		if isSequenceEntry(content) {
+			// The list under the previous key, or a mistake the caller reports
+			break
+		}
+		key, rest, ok := splitYAMLKey(content)
+		if !ok {
+			if len(m) == 0 {
+				break
+			}
+			p.errorAt(i, ind, `expected "key: value"`)
+			p.i = i + 1
+			continue
+		}
+		p.i = i + 1
+		p.keyLines[path+key] = i
+		v := p.value(rest, i, indent, path+key+".", true)
+		if key != "<<" {
+			m[key] = v
+			continue
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			merges = append(merges, v)
+		case []interface{}:
+			for _, item := range v {
+				if item, ok := item.(map[string]interface{}); ok {
+					merges = append(merges, item)
+				}
+			}
+		default:
+			p.errorAt(i, ind, "<< must merge a mapping or a list of mappings")
+		}
+	}
+	for _, merge := range merges {
+		for k, v := range merge {
+			if _, ok := m[k]; !ok {
+				m[k] = v
+			}
+		}
+	}
+	return m
+}
+
+// sequence parses the "- item" lines at indent
+func (p *yamlParser) sequence(indent int, path string) []interface{} {
+	list := []interface{}{}
+	for {
+		i, ind := p.peek()
+		if i == -1 || ind != indent || !isSequenceEntry(p.lines[i][ind:]) {
+			break
+		}
+		itemPath := path + strconv.Itoa(len(list)) + "."
+		rest := strings.TrimLeft(p.lines[i][ind+1:], " \t")
+		if isSequenceEntry(rest) || isMappingEntry(rest) {
+			// A compact nested node such as "- name: x": read the line again
+			// as if the dash were indentation
+			p.lines[i] = strings.Repeat(" ", len(p.lines[i])-len(rest)) + rest
+			list = append(list, p.block(indent, itemPath))
+			continue
+		}
+		p.i = i + 1
+		list = append(list, p.value(rest, i, indent, itemPath, false))
+	}
+	return list
+}
+
+// value parses the node following a key or dash on line i: text is the
+// rest of that line, and any continuation lines must be indented more
+// than indent. A sequence may sit at the same indentation as its key.
+func (p *yamlParser) value(text string, i, indent int, path string, sequenceAtIndent bool) interface{} {
+	text = strings.TrimSpace(text)
+	anchor := ""
+	if strings.HasPrefix(text, "&") {
+		end := strings.IndexAny(text, " \t")
+		if end == -1 {
+			end = len(text)
+		}
+		anchor, text = text[1:end], strings.TrimSpace(text[end:])
+	}
+	v := p.node(text, i, indent, path, sequenceAtIndent)
+	if anchor != "" {
+		p.anchors[anchor] = v
+	}
+	return v
+}
+
+// node parses a value after any anchor
+func (p *yamlParser) node(text string, i, indent int, path string, sequenceAtIndent bool) interface{} {
+	col := strings.LastIndex(p.lines[i], text)
+	switch {
+	case text == "" || text[0] == '#':
+		if next, ind := p.peek(); next != -1 && ind == indent && sequenceAtIndent && isSequenceEntry(p.lines[next][ind:]) {
+			return p.sequence(indent, path)
+		}
+		return p.block(indent, path)
+	case text[0] == '*':
+		name := stripYAMLComment(text[1:])
+		v, ok := p.anchors[name]
+		if !ok {
+			p.errorAt(i, col, "unknown alias *%s", name)
+		}
+		return v
+	case text[0] == '|' || text[0] == '>':
+		return p.blockScalar(text, i, col, indent)
+	case text[0] == '[' || text[0] == '{' || text[0] == '"' || text[0] == '\'':
+		return p.flow(text, i, col, indent)
+	}
+	return p.plain(stripYAMLComment(text), indent)
+}
+
+// plain reads a plain scalar, folding any continuation lines into it
+func (p *yamlParser) plain(text string, indent int) interface{} {
+	folded, blanks := text, 0
+	for j := p.i; j < len(p.lines); j++ {
+		trimmed := strings.TrimSpace(p.lines[j])
+		if trimmed == "" {
+			blanks++
+			continue
+		}
+		ind := len(p.lines[j]) - len(strings.TrimLeft(p.lines[j], " \t"))
+		if ind <= indent || trimmed[0] == '#' || isMappingEntry(trimmed) {
+			break
+		}
+		if blanks > 0 {
+			folded += strings.Repeat("\n", blanks)
+		} else {
+			folded += " "
+		}
+		folded += stripYAMLComment(trimmed)
+		blanks = 0
+		p.i = j + 1
+	}
+	if folded != text {
+		return folded
+	}
+	return resolveYAMLScalar(text)
+}
+
+// blockScalar reads a literal (|) or folded (>) block scalar. The header
+// may give a chomping indicator, - to strip the final line break or + to
+// keep trailing blank lines, and the content's indentation.
+func (p *yamlParser) blockScalar(header string, i, col, indent int) string {
+	folded, chomp, contentIndent := header[0] == '>', byte(0), 0
+	for _, c := range stripYAMLComment(header[1:]) {
+		switch {
+		case (c == '-' || c == '+') && chomp == 0:
+			chomp = byte(c)
+		case c >= '1' && c <= '9' && contentIndent == 0:
+			contentIndent = max(indent, 0) + int(c-'0')
+		default:
+			p.errorAt(i, col, "invalid block scalar header %q, use | or > with an optional - or +", header)
+			return ""
+		}
+	}
+
+	var lines []string
+	j := p.i
+	for ; j < len(p.lines); j++ {
+		line := p.lines[j]
+		if strings.TrimSpace(line) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		ind := len(line) - len(strings.TrimLeft(line, " \t"))
+		if contentIndent == 0 {
+			if ind <= indent {
+				break
+			}
+			contentIndent = ind
+		}
+		if ind < contentIndent {
+			break
+		}
+		lines = append(lines, line[contentIndent:])
+	}
+	p.i = j
+
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for k, line := range lines {
+		switch {
+		case k == 0:
+		case !folded, moreIndented(line), moreIndented(lines[k-1]):
+			b.WriteByte('\n')
+		case line == "":
+			b.WriteByte('\n')
+			continue
+		case lines[k-1] != "":
+			b.WriteByte(' ')
+		}
+		b.WriteString(line)
+	}
+	switch chomp {
+	case '-':
+	case '+':
+		b.WriteString(strings.Repeat("\n", trailing+1))
+	default:
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// moreIndented reports whether a folded scalar's line is indented beyond
+// the content, which keeps its line breaks
+func moreIndented(line string) bool {
+	return line != "" && (line[0] == ' ' || line[0] == '\t')
+}
+
+// flow reads a quoted scalar or flow collection, which may continue on
+// the lines after line i
+func (p *yamlParser) flow(text string, i, col, indent int) interface{} {
+	for {
+		f := &flowParser{s: text, anchors: p.anchors}
+		v, err := f.value()
+		if err == nil {
+			if rest := strings.TrimSpace(text[f.pos:]); rest != "" && rest[0] != '#' {
+				err = fmt.Errorf("unexpected %q after %s", rest, strings.TrimSpace(text[:f.pos]))
+			}
+		}
+		if err != errFlowEnd {
+			if err != nil {
+				p.errorAt(i, col, "%v", err)
+			}
+			return v
+		}
+		// Continuation lines are indented, except for a closing bracket
+		next := p.i
+		if next >= len(p.lines) || !continuesFlow(p.lines[next], indent) {
+			p.errorAt(i, col, "unterminated %s", flowName(text[0]))
+			return nil
+		}
+		text += "\n" + p.lines[next]
+		p.i++
+	}
+}
+
+func continuesFlow(line string, indent int) bool {
+	trimmed := strings.TrimLeft(line, " \t")
+	return trimmed == "" || len(line)-len(trimmed) > indent || trimmed[0] == ']' || trimmed[0] == '}'
+}
+
+func flowName(c byte) string {
+	switch c {
+	case '[':
+		return "list, missing ]"
+	case '{':
+		return "mapping, missing }"
+	}
+	return "string, missing " + string(c)
+}
+
+// errFlowEnd reports a flow node that continues past the text read so far
+var errFlowEnd = errors.New("unexpected end of value")
+
+// flowParser reads a quoted scalar or flow collection from text that may
+// span lines
+type flowParser struct {
+	s       string
+	pos     int
+	anchors map[string]interface{}
+}
+
+func (f *flowParser) skipSpace() {
+	for f.pos < len(f.s) && strings.IndexByte(" \t\n", f.s[f.pos]) >= 0 {
+		f.pos++
+	}
+}
+
+func (f *flowParser) value() (interface{}, error) {
+	f.skipSpace()
+	if f.pos >= len(f.s) {
+		return nil, errFlowEnd
+	}
+	switch c := f.s[f.pos]; c {
+	case '[':
+		return f.sequence()
+	case '{':
+		return f.mapping()
+	case '"', '\'':
+		return f.quoted()
+	case '&':
+		name := f.name()
+		v, err := f.value()
+		f.anchors[name] = v
+		return v, err
+	case '*':
+		name := f.name()
+		v, ok := f.anchors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown alias *%s", name)
+		}
+		return v, nil
+	}
+	return resolveYAMLScalar(f.plain()), nil
+}
+
+// name reads an anchor or alias name after its & or *
+func (f *flowParser) name() string {
+	start := f.pos + 1
+	f.pos = start
+	for f.pos < len(f.s) && strings.IndexByte(" \t\n,[]{}", f.s[f.pos]) == -1 {
+		f.pos++
+	}
+	return f.s[start:f.pos]
+}
+
+// plain reads a plain scalar, which ends at a flow indicator or ": "
+func (f *flowParser) plain() string {
+	start := f.pos
+	for ; f.pos < len(f.s); f.pos++ {
+		c := f.s[f.pos]
+		if strings.IndexByte(",[]{}", c) >= 0 || c == ':' && f.isValueIndicator(f.pos) ||
+			c == '#' && f.pos > start && strings.IndexByte(" \t", f.s[f.pos-1]) >= 0 {
+			break
+		}
+	}
+	return strings.Join(strings.Fields(f.s[start:f.pos]), " ")
+}
+
+// isValueIndicator reports whether the : at i separates a key from its value
+func (f *flowParser) isValueIndicator(i int) bool {
+	return i+1 >= len(f.s) || strings.IndexByte(" \t\n,[]{}", f.s[i+1]) >= 0
+}
+
+func (f *flowParser) sequence() (interface{}, error) {
+	f.pos++
+	list := []interface{}{}
+	for {
+		f.skipSpace()
+		if f.pos >= len(f.s) {
+			return nil, errFlowEnd
+		}
+		if f.s[f.pos] == ']' {
+			f.pos++
+			return list, nil
+		}
+		item, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		f.skipSpace()
+		if f.pos < len(f.s) && f.s[f.pos] == ':' {
+			// A single pair mapping, as in [name: value]
+			f.pos++
+			v, err := f.entryValue()
+			if err != nil {
+				return nil, err
+			}
+			item = map[string]interface{}{fmt.Sprint(item): v}
+		}
+		list = append(list, item)
+		if err := f.separator(']'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (f *flowParser) mapping() (interface{}, error) {
+	f.pos++
+	m := map[string]interface{}{}
+	for {
+		f.skipSpace()
+		if f.pos >= len(f.s) {
+			return nil, errFlowEnd
+		}
+		if f.s[f.pos] == '}' {
+			f.pos++
+			return m, nil
+		}
+		key, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		f.skipSpace()
+		var v interface{}
+		if f.pos < len(f.s) && f.s[f.pos] == ':' {
+			f.pos++
+			if v, err = f.entryValue(); err != nil {
+				return nil, err
+			}
+		}
+		m[fmt.Sprint(key)] = v
+		if err := f.separator('}'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// entryValue reads the value after a key's colon, which may be empty
+func (f *flowParser) entryValue() (interface{}, error) {
+	f.skipSpace()
+	if f.pos < len(f.s) && strings.IndexByte(",]}", f.s[f.pos]) >= 0 {
+		return nil, nil
+	}
+	return f.value()
+}
+
+// separator reads the comma between flow entries, or the closing bracket
+func (f *flowParser) separator(end byte) error {
+	f.skipSpace()
+	switch {
+	case f.pos >= len(f.s):
+		return errFlowEnd
+	case f.s[f.pos] == ',':
+		f.pos++
+		return nil
+	case f.s[f.pos] == end:
+		return nil
+	}
+	return fmt.Errorf("expected , or %c, got %q", end, f.s[f.pos:min(f.pos+10, len(f.s))])
+}
+
+// quoted reads a single or double quoted scalar. Line breaks inside fold to
+// spaces, and blank lines to newlines.
+func (f *flowParser) quoted() (interface{}, error) {
+	q := f.s[f.pos]
+	var b strings.Builder
+	for i := f.pos + 1; i < len(f.s); i++ {
+		c := f.s[i]
+		switch {
+		case c == q && q == '\'' && i+1 < len(f.s) && f.s[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case c == q:
+			f.pos = i + 1
+			return b.String(), nil
+		case c == '\\' && q == '"':
+			n, err := yamlEscape(&b, f.s[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			i += n
+		case c == '\n':
+			// Fold the break, dropping the spaces around it
+			s := strings.TrimRight(b.String(), " \t")
+			b.Reset()
+			b.WriteString(s)
+			breaks := 0
+			for i+1 < len(f.s) && strings.IndexByte(" \t\n", f.s[i+1]) >= 0 {
+				if f.s[i+1] == '\n' {
+					breaks++
+				}
+				i++
+			}
+			if breaks == 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(strings.Repeat("\n", breaks))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return nil, errFlowEnd
+}
+
+// yamlEscapes are the single character escapes in double quoted scalars
+var yamlEscapes = map[byte]string{
+	'0': "\x00", 'a': "\a", 'b': "\b", 't': "\t", '\t': "\t", 'n': "\n",
+	'v': "\v", 'f': "\f", 'r': "\r", 'e': "\x1b", ' ': " ", '"': "\"",
+	'/': "/", '\\': "\\", 'N': "\u0085", '_': "\u00a0", 'L': "\u2028", 'P': "\u2029",
+}
+
+// yamlEscape writes the escape sequence at the start of s, which follows a
+// backslash, and returns how many bytes of s it used
+func yamlEscape(b *strings.Builder, s string) (int, error) {
+	if s == "" {
+		return 0, errFlowEnd
+	}
+	if e, ok := yamlEscapes[s[0]]; ok {
+		b.WriteString(e)
+		return 1, nil
+	}
+	digits := map[byte]int{'x': 2, 'u': 4, 'U': 8}[s[0]]
+	if digits == 0 {
+		if s[0] == '\n' {
+			// An escaped line break joins the lines without a space
+			return len(s) - len(strings.TrimLeft(s, " \t\n")), nil
+		}
+		return 0, fmt.Errorf("unknown escape \\%c", s[0])
+	}
+	if len(s) < digits+1 {
+		return 0, fmt.Errorf("short escape \\%s", s)
+	}
+	n, err := strconv.ParseUint(s[1:digits+1], 16, 32)
+	if err != nil || !utf8.ValidRune(rune(n)) {
+		return 0, fmt.Errorf("invalid escape \\%s", s[:digits+1])
+	}
+	b.WriteRune(rune(n))
+	return digits + 1, nil
+}
+
+var (
+	yamlIntRe   = regexp.MustCompile(`^[-+]?\d+$`)
+	yamlFloatRe = regexp.MustCompile(`^[-+]?(\d+\.\d*|\.\d+|\d+)([eE][-+]?\d+)?$`)
+)
+
+// resolveYAMLScalar gives a plain scalar its type: a boolean, null, an
+// integer, a float, or otherwise a string
+func resolveYAMLScalar(s string) interface{} {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	}
+	switch strings.ToLower(s) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if yamlIntRe.MatchString(s) {
+		if i, err := strconv.Atoi(s); err == nil {
+			return i
+		}
+	}
+	if yamlFloatRe.MatchString(s) {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return s
+}
+
+// isSequenceEntry reports whether a line's content starts a "- item"
+func isSequenceEntry(content string) bool {
+	return content == "-" || strings.HasPrefix(content, "- ") || strings.HasPrefix(content, "-\t")
+}
+
+// isMappingEntry reports whether a line's content is a "key: value"
+func isMappingEntry(content string) bool {
+	_, _, ok := splitYAMLKey(content)
+	return ok
+}
+
+// splitYAMLKey splits "key: value" at the first colon followed by a space
+// or the end of the line, outside a quoted key
+func splitYAMLKey(content string) (string, string, bool) {
+	if content == "" || strings.IndexByte("[{#&*|>!%@`", content[0]) >= 0 || isSequenceEntry(content) {
+		return "", "", false
+	}
+	if q := content[0]; q == '"' || q == '\'' {
+		f := &flowParser{s: content}
+		key, err := f.quoted()
+		if err != nil {
+			return "", "", false
+		}
+		rest := strings.TrimLeft(content[f.pos:], " \t")
+		if rest == ":" || strings.HasPrefix(rest, ": ") || strings.HasPrefix(rest, ":\t") {
+			return key.(string), rest[1:], true
+		}
+		return "", "", false
+	}
+	for i := 0; i < len(content); i++ {
+		switch {
+		case content[i] == '#' && i > 0 && (content[i-1] == ' ' || content[i-1] == '\t'):
+			return "", "", false
+		case content[i] == ':' && (i+1 == len(content) || content[i+1] == ' ' || content[i+1] == '\t'):
+			return strings.TrimSpace(content[:i]), content[i+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// stripYAMLComment removes a trailing "# comment" from a value. A # only
+// starts a comment after whitespace and outside quotes.
+func stripYAMLComment(value string) string {
+	for i := 0; i < len(value); i++ {
+		if value[i] == '#' && (i == 0 || value[i-1] == ' ' || value[i-1] == '\t') {
+			return strings.TrimSpace(value[:i])
+		}
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseYAMLDocument(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		expected map[string]interface{}
+	}{
+		{"nested mapping", "config:\n  temperature: 0.2\n  maxTokens: 10",
+			map[string]interface{}{"config": map[string]interface{}{"temperature": 0.2, "maxTokens": 10}}},
+		{"sequence", "stop:\n  - END\n  - \"STOP\"",
+			map[string]interface{}{"stop": []interface{}{"END", "STOP"}}},
+		{"sequence at key indent", "stop:\n- END\n- STOP\nmodel: test",
+			map[string]interface{}{"stop": []interface{}{"END", "STOP"}, "model": "test"}},
+		{"sequence of mappings", "rules:\n  - name: short\n    max: 3\n  - name: polite",
+			map[string]interface{}{"rules": []interface{}{
+				map[string]interface{}{"name": "short", "max": 3},
+				map[string]interface{}{"name": "polite"},
+			}}},
+		{"nested sequences", "grid:\n  - - 1\n    - 2\n  - [3, 4]",
+			map[string]interface{}{"grid": []interface{}{[]interface{}{1, 2}, []interface{}{3, 4}}}},
+		{"literal block", "system: |\n  Line one\n    indented\n\n  Line three\nmodel: test",
+			map[string]interface{}{"system": "Line one\n  indented\n\nLine three\n", "model": "test"}},
+		{"literal strip", "system: |-\n  one\n  two\n\n",
+			map[string]interface{}{"system": "one\ntwo"}},
+		{"literal keep", "system: |+\n  one\n\n\nmodel: test",
+			map[string]interface{}{"system": "one\n\n\n", "model": "test"}},
+		{"literal indent indicator", "system: |2\n    code\n  text",
+			map[string]interface{}{"system": "  code\ntext\n"}},
+		{"literal keeps comments", "system: |\n  # not a comment\n  key: not a key",
+			map[string]interface{}{"system": "# not a comment\nkey: not a key\n"}},
+		{"folded block", "description: >\n  A long\n  description\n\n  New paragraph",
+			map[string]interface{}{"description": "A long description\nNew paragraph\n"}},
+		{"folded more indented", "description: >-\n  Text\n    code\n  more",
+			map[string]interface{}{"description": "Text\n  code\nmore"}},
+		{"plain multi-line", "description: a long\n  description",
+			map[string]interface{}{"description": "a long description"}},
+		{"double quoted multi-line", "title: \"a\n  b\n\n  c\"",
+			map[string]interface{}{"title": "a b\nc"}},
+		{"escapes", `title: "tab\there é \x41"`,
+			map[string]interface{}{"title": "tab\there é A"}},
+		{"flow mapping", "config: {temperature: 0.5, stop: [a, b], \"quoted key\": x}",
+			map[string]interface{}{"config": map[string]interface{}{
+				"temperature": 0.5, "stop": []interface{}{"a", "b"}, "quoted key": "x"}}},
+		{"flow over lines", "stop: [\n  a,\n  b\n]\nmodel: test",
+			map[string]interface{}{"stop": []interface{}{"a", "b"}, "model": "test"}},
+		{"json", `schema: {"name": "string", "tags": ["a"], "n": null}`,
+			map[string]interface{}{"schema": map[string]interface{}{
+				"name": "string", "tags": []interface{}{"a"}, "n": nil}}},
+		{"anchor and alias", "base: &base\n  temperature: 0.2\nvariants:\n  a: *base",
+			map[string]interface{}{
+				"base":     map[string]interface{}{"temperature": 0.2},
+				"variants": map[string]interface{}{"a": map[string]interface{}{"temperature": 0.2}},
+			}},
+		{"merge key", "base: &base\n  temperature: 0.2\n  maxTokens: 5\ncold:\n  <<: *base\n  temperature: 0",
+			map[string]interface{}{
+				"base": map[string]interface{}{"temperature": 0.2, "maxTokens": 5},
+				"cold": map[string]interface{}{"temperature": 0, "maxTokens": 5},
+			}},
+		{"scalar anchor", "a: &v 3\nb: *v", map[string]interface{}{"a": 3, "b": 3}},
+		{"nulls", "a: null\nb: ~\nc:", map[string]interface{}{"a": nil, "b": nil, "c": nil}},
+		{"numbers", "a: -3\nb: 1e3\nc: +2.5\nd: 1.2.0\ne: 007",
+			map[string]interface{}{"a": -3, "b": 1000.0, "c": 2.5, "d": "1.2.0", "e": 7}},
+		{"colon in value", "url: http://example.com/a:b", map[string]interface{}{"url": "http://example.com/a:b"}},
+		{"quoted key", `"a: b": c`, map[string]interface{}{"a: b": "c"}},
+		{"comments", "# heading\na: 1 # one\n  # indented comment\nb: '#2'",
+			map[string]interface{}{"a": 1, "b": "#2"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, _, errs := parseYAMLDocument(tc.yaml)
+			for _, err := range errs {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if g, e := fmt.Sprintf("%#v", got), fmt.Sprintf("%#v", tc.expected); g != e {
+				t.Errorf("Expected %s, got %s", e, g)
+			}
+		})
+	}
+}
+
+func TestParseYAMLDocumentErrors(t *testing.T) {
+	tests := []struct {
+		yaml string
+		line int
+		msg  string
+	}{
+		{"model: test\njust text", 2, `expected "key: value"`},
+		{"model: test\n  extra: x", 2, "unexpected indentation"},
+		{"- a\n- b", 1, `expected "key: value"`},
+		{"stop: [a, b", 1, "unterminated list"},
+		{"title: \"open\nmodel: test", 1, "unterminated string"},
+		{"a: *missing", 1, "unknown alias *missing"},
+		{"a: |x\n  text", 1, "invalid block scalar header"},
+		{"a: [1, 2] extra", 1, "unexpected"},
+		{"a: 1\n<<: 2", 2, "<< must merge a mapping"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.yaml, func(t *testing.T) {
+			_, _, errs := parseYAMLDocument(tc.yaml)
+			if len(errs) == 0 {
+				t.Fatal("Expected an error")
+			}
+			if errs[0].Line != tc.line || !strings.Contains(errs[0].Msg, tc.msg) {
+				t.Errorf("Expected %q on line %d, got %q on line %d", tc.msg, tc.line, errs[0].Msg, errs[0].Line)
+			}
+		})
+	}
+}
+
+func TestYAMLKeyLines(t *testing.T) {
+	_, keyLines, _ := parseYAMLDocument("system: |\n  note: inside\noutput:\n  rules:\n    - name: x\n      max: 3")
+	expected := map[string]int{"system": 0, "output": 2, "output.rules": 3, "output.rules.0.name": 4, "output.rules.0.max": 5}
+	if g, e := fmt.Sprint(keyLines), fmt.Sprint(expected); g != e {
+		t.Errorf("Expected %s, got %s", e, g)
+	}
+}
+
+func TestParseYAMLValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected interface{}
+	}{
+		{"Note: hi", "Note: hi"},
+		{"a #b", "a #b"},
+		{"42", 42},
+		{"TRUE", true},
+		{`{"a": 1}`, map[string]interface{}{"a": 1}},
+		{"[a, {b: c}]", []interface{}{"a", map[string]interface{}{"b": "c"}}},
+		{"[unclosed", "[unclosed"},
+		{"a: 1\nb: [x]", map[string]interface{}{"a": 1, "b": []interface{}{"x"}}},
+		{"- a\n- b", []interface{}{"a", "b"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.value, func(t *testing.T) {
+			if g, e := fmt.Sprintf("%#v", parseYAMLValue(tc.value)), fmt.Sprintf("%#v", tc.expected); g != e {
+				t.Errorf("Expected %s, got %s", e, g)
+			}
+		})
+	}
+}